@@ -0,0 +1,197 @@
+// Package apperror サービスのドメインエラーと、HTTPレスポンスへの変換を定義する
+//
+// エラーレスポンスは次の形式のJSONで返す。codeはクライアントが分岐に利用できる固定の文字列で、messageは表示・調査用の説明。
+//
+//	{"error": {"code": "card_error", "message": "Your card has insufficient funds.", "decline_code": "insufficient_funds"}}
+package apperror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Code エラーの種類を表す固定の文字列
+type Code string
+
+const (
+	CodeInvalidRequest      Code = "invalid_request"
+	CodeValidationFailed    Code = "validation_failed"
+	CodeRequestTooLarge     Code = "request_too_large"
+	CodeUnauthenticated     Code = "unauthenticated"
+	CodeForbidden           Code = "forbidden"
+	CodeBenefitNotGranted   Code = "benefit_not_granted"
+	CodeQuotaExceeded       Code = "quota_exceeded"
+	CodeNotFound            Code = "not_found"
+	CodeInvalidPlan         Code = "invalid_plan"
+	CodeInvalidPromotion    Code = "invalid_promotion_code"
+	CodeMethodNotAllowed    Code = "method_not_allowed"
+	CodeConflict            Code = "conflict"
+	CodeIdempotencyKeyReuse Code = "idempotency_key_reused"
+	CodePaymentRequired     Code = "payment_required"
+	CodeCardError           Code = "card_error"
+	CodeUpstreamUnavailable Code = "upstream_unavailable"
+	CodeInternal            Code = "internal"
+)
+
+var statusByCode = map[Code]int{
+	CodeInvalidRequest:      http.StatusBadRequest,
+	CodeValidationFailed:    http.StatusBadRequest,
+	CodeRequestTooLarge:     http.StatusRequestEntityTooLarge,
+	CodeUnauthenticated:     http.StatusUnauthorized,
+	CodeForbidden:           http.StatusForbidden,
+	CodeBenefitNotGranted:   http.StatusForbidden,
+	CodeQuotaExceeded:       http.StatusTooManyRequests,
+	CodeNotFound:            http.StatusNotFound,
+	CodeInvalidPlan:         http.StatusBadRequest,
+	CodeInvalidPromotion:    http.StatusBadRequest,
+	CodeMethodNotAllowed:    http.StatusMethodNotAllowed,
+	CodeConflict:            http.StatusConflict,
+	CodeIdempotencyKeyReuse: http.StatusUnprocessableEntity,
+	CodePaymentRequired:     http.StatusPaymentRequired,
+	CodeCardError:           http.StatusPaymentRequired,
+	CodeUpstreamUnavailable: http.StatusServiceUnavailable,
+	CodeInternal:            http.StatusInternalServerError,
+}
+
+// Error ドメインエラー
+type Error struct {
+	Code    Code
+	Message string
+	// DeclineCode カードが拒否された理由 https://stripe.com/docs/declines/codes
+	DeclineCode string
+	// Fields 入力値の検証に失敗した項目
+	Fields []FieldError
+	// Err 原因となったエラー。レスポンスには含めない
+	Err error
+}
+
+// FieldError 入力値の検証に失敗した項目と理由
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// HTTPStatus エラーに対応するHTTPステータスコード
+func (e *Error) HTTPStatus() int {
+	if status, ok := statusByCode[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+func InvalidRequest(message string, err error) *Error {
+	return &Error{Code: CodeInvalidRequest, Message: message, Err: err}
+}
+
+func ValidationFailed(fields []FieldError) *Error {
+	return &Error{Code: CodeValidationFailed, Message: "request has invalid fields", Fields: fields}
+}
+
+func RequestTooLarge(err error) *Error {
+	return &Error{Code: CodeRequestTooLarge, Message: "request body is too large", Err: err}
+}
+
+func Unauthenticated(err error) *Error {
+	return &Error{Code: CodeUnauthenticated, Message: "authentication is required", Err: err}
+}
+
+func Forbidden(message string) *Error {
+	return &Error{Code: CodeForbidden, Message: message}
+}
+
+func BenefitNotGranted(reason string) *Error {
+	return &Error{Code: CodeBenefitNotGranted, Message: fmt.Sprintf("benefit is not available: %s", reason)}
+}
+
+func QuotaExceeded() *Error {
+	return &Error{Code: CodeQuotaExceeded, Message: "benefit has already been used up for the current period"}
+}
+
+func NotFound(message string) *Error {
+	return &Error{Code: CodeNotFound, Message: message}
+}
+
+func InvalidPlan(planID string) *Error {
+	message := fmt.Sprintf("plan %q is not available for this subscription", planID)
+	return &Error{Code: CodeInvalidPlan, Message: message, Fields: []FieldError{{Field: "plan_id", Message: message}}}
+}
+
+// InvalidPromotionCode プロモーションコードが存在しない、または契約に利用できない
+func InvalidPromotionCode(reason string) *Error {
+	message := fmt.Sprintf("promotion code cannot be applied: %s", reason)
+	return &Error{Code: CodeInvalidPromotion, Message: message, Fields: []FieldError{{Field: "promotion_code", Message: reason}}}
+}
+
+func MethodNotAllowed(method string) *Error {
+	return &Error{Code: CodeMethodNotAllowed, Message: fmt.Sprintf("method %s is not allowed", method)}
+}
+
+func Conflict(message string) *Error {
+	return &Error{Code: CodeConflict, Message: message}
+}
+
+func IdempotencyKeyReused() *Error {
+	return &Error{Code: CodeIdempotencyKeyReuse, Message: "Idempotency-Key is already used with a different request"}
+}
+
+func PaymentRequired(message string, err error) *Error {
+	return &Error{Code: CodePaymentRequired, Message: message, Err: err}
+}
+
+func CardError(message, declineCode string, err error) *Error {
+	return &Error{Code: CodeCardError, Message: message, DeclineCode: declineCode, Err: err}
+}
+
+func UpstreamUnavailable(err error) *Error {
+	return &Error{Code: CodeUpstreamUnavailable, Message: "payment provider is temporarily unavailable", Err: err}
+}
+
+func Internal(err error) *Error {
+	return &Error{Code: CodeInternal, Message: "internal server error", Err: err}
+}
+
+// From errからドメインエラーを取り出す。ドメインエラーでない場合はInternalとして扱う
+func From(err error) *Error {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	return Internal(err)
+}
+
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code        Code         `json:"code"`
+	Message     string       `json:"message"`
+	DeclineCode string       `json:"decline_code,omitempty"`
+	Fields      []FieldError `json:"fields,omitempty"`
+}
+
+// Write errをJSONのエラーレスポンスとして書き込む
+func Write(w http.ResponseWriter, err error) {
+	appErr := From(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(appErr.HTTPStatus())
+	_ = json.NewEncoder(w).Encode(errorBody{Error: errorDetail{
+		Code:        appErr.Code,
+		Message:     appErr.Message,
+		DeclineCode: appErr.DeclineCode,
+		Fields:      appErr.Fields,
+	}})
+}
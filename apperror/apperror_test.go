@@ -0,0 +1,104 @@
+package apperror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestError_HTTPStatus(t *testing.T) {
+	tests := []struct {
+		err  *Error
+		want int
+	}{
+		{InvalidRequest("bad", nil), http.StatusBadRequest},
+		{ValidationFailed(nil), http.StatusBadRequest},
+		{RequestTooLarge(nil), http.StatusRequestEntityTooLarge},
+		{Unauthenticated(nil), http.StatusUnauthorized},
+		{Forbidden("no"), http.StatusForbidden},
+		{BenefitNotGranted("expired"), http.StatusForbidden},
+		{QuotaExceeded(), http.StatusTooManyRequests},
+		{NotFound("missing"), http.StatusNotFound},
+		{InvalidPlan("plan-x"), http.StatusBadRequest},
+		{InvalidPromotionCode("expired"), http.StatusBadRequest},
+		{MethodNotAllowed(http.MethodPut), http.StatusMethodNotAllowed},
+		{Conflict("busy"), http.StatusConflict},
+		{IdempotencyKeyReused(), http.StatusUnprocessableEntity},
+		{PaymentRequired("unpaid", nil), http.StatusPaymentRequired},
+		{CardError("declined", "insufficient_funds", nil), http.StatusPaymentRequired},
+		{UpstreamUnavailable(nil), http.StatusServiceUnavailable},
+		{Internal(nil), http.StatusInternalServerError},
+		{&Error{Code: "unknown"}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.err.Code), func(t *testing.T) {
+			if got := tt.err.HTTPStatus(); got != tt.want {
+				t.Errorf("HTTPStatus() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	cause := errors.New("stripe: card declined")
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		body   string
+	}{
+		{
+			name:   "card error",
+			err:    CardError("Your card has insufficient funds.", "insufficient_funds", cause),
+			status: http.StatusPaymentRequired,
+			body:   `{"error":{"code":"card_error","message":"Your card has insufficient funds.","decline_code":"insufficient_funds"}}`,
+		},
+		{
+			name:   "validation",
+			err:    ValidationFailed([]FieldError{{Field: "plan_id", Message: "is required"}}),
+			status: http.StatusBadRequest,
+			body:   `{"error":{"code":"validation_failed","message":"request has invalid fields","fields":[{"field":"plan_id","message":"is required"}]}}`,
+		},
+		{
+			name:   "wrapped",
+			err:    fmt.Errorf("cancel: %w", Conflict("busy")),
+			status: http.StatusConflict,
+			body:   `{"error":{"code":"conflict","message":"busy"}}`,
+		},
+		{
+			// ドメインエラー以外の内容はレスポンスに含めない
+			name:   "not a domain error",
+			err:    cause,
+			status: http.StatusInternalServerError,
+			body:   `{"error":{"code":"internal","message":"internal server error"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Write(w, tt.err)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %s, want application/json", got)
+			}
+			if got := w.Body.String(); got != tt.body+"\n" {
+				t.Errorf("body = %s, want %s", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestFrom(t *testing.T) {
+	cause := errors.New("boom")
+	if got := From(fmt.Errorf("get: %w", NotFound("missing"))); got.Code != CodeNotFound {
+		t.Errorf("From(wrapped) = %v, want not_found", got)
+	}
+	got := From(cause)
+	if got.Code != CodeInternal || !errors.Is(got, cause) {
+		t.Errorf("From(cause) = %v, want internal wrapping the cause", got)
+	}
+}
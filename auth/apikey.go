@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+// CustomerHeader APIキーで認証したサーバーが操作対象のStripe Customerを指定するヘッダー
+const CustomerHeader = "X-Customer-ID"
+
+// APIKeyAuthenticator サーバー間の呼び出しをAPIキー(Authorization: Bearer <key>)で認証する
+// APIキーを持つサーバーは信頼された呼び出し元として、X-Customer-IDで指定したCustomerを操作できる
+type APIKeyAuthenticator struct {
+	// Keys 名前毎のAPIキー
+	Keys map[string]string
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Caller, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	name, ok := a.lookup(token)
+	if !ok {
+		return nil, errors.New("auth: invalid API key")
+	}
+	customerID := r.Header.Get(CustomerHeader)
+	if customerID == "" {
+		return nil, errors.New("auth: " + CustomerHeader + " header is required")
+	}
+	return &Caller{Subject: name, CustomerID: customerID}, nil
+}
+
+// lookup キーの長さや内容によって比較時間が変わらないよう、ハッシュ値を固定時間で比較する
+func (a *APIKeyAuthenticator) lookup(token string) (string, bool) {
+	got := sha256.Sum256([]byte(token))
+	var found string
+	for name, key := range a.Keys {
+		want := sha256.Sum256([]byte(key))
+		if subtle.ConstantTimeCompare(got[:], want[:]) == 1 {
+			found = name
+		}
+	}
+	return found, found != ""
+}
@@ -0,0 +1,65 @@
+// Package auth リクエストの呼び出し元を認証し、操作対象のStripe Customerを解決する
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrNoCredentials リクエストに認証情報が含まれていない
+var ErrNoCredentials = errors.New("auth: no credentials")
+
+// Caller 認証済みの呼び出し元
+type Caller struct {
+	// Subject 呼び出し元の識別子。JWTの場合はsubクレーム、APIキーの場合はキーの名前
+	Subject string
+	// CustomerID 呼び出し元が操作できるStripe CustomerのID
+	CustomerID string
+}
+
+// Authenticator リクエストから呼び出し元を解決する
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Caller, error)
+}
+
+type callerKey struct{}
+
+// WithCaller ctxに認証済みの呼び出し元を保持する
+func WithCaller(ctx context.Context, c *Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// CallerFromContext WithCallerで保持した呼び出し元を取得する
+func CallerFromContext(ctx context.Context) (*Caller, bool) {
+	c, ok := ctx.Value(callerKey{}).(*Caller)
+	return c, ok
+}
+
+// bearerToken Authorization: Bearer <token> のトークン部分
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(h[len(prefix):]), true
+}
+
+// Chain 先頭から順に認証を試み、最初に成功した呼び出し元を返す
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Caller, error) {
+	err := ErrNoCredentials
+	for _, a := range c {
+		caller, aerr := a.Authenticate(r)
+		if aerr == nil {
+			return caller, nil
+		}
+		if aerr != ErrNoCredentials {
+			err = aerr
+		}
+	}
+	return nil, err
+}
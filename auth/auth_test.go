@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newRequest(header ...string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/create-subscription", nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	return r
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	a := &APIKeyAuthenticator{Keys: map[string]string{"shop": "key-shop", "admin": "key-admin"}}
+	tests := []struct {
+		name    string
+		header  []string
+		want    *Caller
+		wantErr error
+	}{
+		{name: "valid", header: []string{"Authorization", "Bearer key-shop", CustomerHeader, "cus_1"}, want: &Caller{Subject: "shop", CustomerID: "cus_1"}},
+		{name: "case insensitive scheme", header: []string{"Authorization", "bearer key-admin", CustomerHeader, "cus_1"}, want: &Caller{Subject: "admin", CustomerID: "cus_1"}},
+		{name: "no credentials", header: []string{CustomerHeader, "cus_1"}, wantErr: ErrNoCredentials},
+		{name: "not a bearer token", header: []string{"Authorization", "Basic a2V5LXNob3A6", CustomerHeader, "cus_1"}, wantErr: ErrNoCredentials},
+		{name: "unknown key", header: []string{"Authorization", "Bearer key-other", CustomerHeader, "cus_1"}},
+		{name: "key prefix", header: []string{"Authorization", "Bearer key-sho", CustomerHeader, "cus_1"}},
+		{name: "no customer", header: []string{"Authorization", "Bearer key-shop"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.Authenticate(newRequest(tt.header...))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("Authenticate() = %+v, want an error", got)
+				}
+				if tt.wantErr != nil && err != tt.wantErr {
+					t.Errorf("Authenticate() = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *tt.want {
+				t.Errorf("Authenticate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// authenticatorFunc 関数をAuthenticatorとして扱う
+type authenticatorFunc func(r *http.Request) (*Caller, error)
+
+func (f authenticatorFunc) Authenticate(r *http.Request) (*Caller, error) {
+	return f(r)
+}
+
+func TestChain(t *testing.T) {
+	noCredentials := authenticatorFunc(func(*http.Request) (*Caller, error) { return nil, ErrNoCredentials })
+	invalid := authenticatorFunc(func(*http.Request) (*Caller, error) { return nil, errors.New("invalid token") })
+	ok := authenticatorFunc(func(*http.Request) (*Caller, error) { return &Caller{Subject: "ok"}, nil })
+
+	tests := []struct {
+		name    string
+		chain   Chain
+		subject string
+		wantErr string
+	}{
+		{name: "first success", chain: Chain{noCredentials, invalid, ok}, subject: "ok"},
+		// 全て失敗した場合は、認証情報がないことよりも認証情報が不正であることを返す
+		{name: "invalid credentials", chain: Chain{invalid, noCredentials}, wantErr: "invalid token"},
+		{name: "no credentials", chain: Chain{noCredentials, noCredentials}, wantErr: ErrNoCredentials.Error()},
+		{name: "empty", chain: Chain{}, wantErr: ErrNoCredentials.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.chain.Authenticate(newRequest())
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Authenticate() = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got.Subject != tt.subject {
+				t.Errorf("Authenticate() = %+v, %v, want %s", got, err, tt.subject)
+			}
+		})
+	}
+}
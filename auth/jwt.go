@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultCustomerClaim Stripe CustomerのIDを保持するJWTのクレーム名
+const DefaultCustomerClaim = "stripe_customer_id"
+
+// JWTAuthenticator Bearerトークンとして送られたJWT(RS256、ES256)を検証する
+type JWTAuthenticator struct {
+	Keys KeySource
+	// Issuer 空でない場合はissクレームと一致することを検証する
+	Issuer string
+	// Audience 空でない場合はaudクレームに含まれることを検証する
+	Audience string
+	// CustomerClaim Stripe CustomerのIDを保持するクレーム名。空の場合はDefaultCustomerClaim
+	CustomerClaim string
+	// Leeway exp、nbfの検証で許容する時刻のずれ
+	Leeway time.Duration
+	// Now 現在時刻。nilの場合はtime.Now
+	Now func() time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Caller, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, _ := claims["sub"].(string)
+	claim := a.CustomerClaim
+	if claim == "" {
+		claim = DefaultCustomerClaim
+	}
+	customerID, _ := claims[claim].(string)
+	if customerID == "" {
+		return nil, fmt.Errorf("auth: token has no %s claim", claim)
+	}
+	return &Caller{Subject: sub, CustomerID: customerID}, nil
+}
+
+func (a *JWTAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("auth: malformed token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("auth: invalid token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("auth: invalid token signature: %w", err)
+	}
+	key, err := a.Keys.Key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("auth: invalid token claims: %w", err)
+	}
+	if err := a.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (a *JWTAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	if a.Now != nil {
+		now = a.Now()
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("auth: token has no exp claim")
+	}
+	if now.Add(-a.Leeway).After(time.Unix(int64(exp), 0)) {
+		return errors.New("auth: token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("auth: token is not valid yet")
+	}
+	if a.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.Issuer {
+			return fmt.Errorf("auth: unexpected issuer %q", iss)
+		}
+	}
+	if a.Audience != "" && !hasAudience(claims["aud"], a.Audience) {
+		return errors.New("auth: token is not issued for this audience")
+	}
+	return nil
+}
+
+// hasAudience audクレームは文字列または文字列の配列
+func hasAudience(aud interface{}, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, sig []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("auth: RS256 token is not signed with an RSA key")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return errors.New("auth: invalid token signature")
+		}
+		return nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return errors.New("auth: ES256 token is not signed with a P-256 key")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return errors.New("auth: invalid token signature")
+		}
+		return nil
+	}
+	// noneやHS256等、公開鍵で検証できないアルゴリズムは受け付けない
+	return fmt.Errorf("auth: unsupported token algorithm %q", alg)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signToken claimsをkeyで署名したJWTを作成する
+func signToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signingInput := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func generateRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func generateECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey := generateRSAKey(t)
+	ecKey := generateECKey(t)
+	otherKey := generateRSAKey(t)
+	now := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":                "user-1",
+			"iss":                "https://auth.example.com",
+			"aud":                []string{"other", "subscriptions"},
+			"exp":                now.Add(time.Hour).Unix(),
+			DefaultCustomerClaim: "cus_1",
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		key   crypto.PublicKey
+		token string
+		ok    bool
+	}{
+		{name: "RS256", key: &rsaKey.PublicKey, token: signToken(t, "RS256", "", rsaKey, claims(nil)), ok: true},
+		{name: "ES256", key: &ecKey.PublicKey, token: signToken(t, "ES256", "", ecKey, claims(nil)), ok: true},
+		{name: "single audience", key: &rsaKey.PublicKey, token: signToken(t, "RS256", "", rsaKey, claims(map[string]interface{}{"aud": "subscriptions"})), ok: true},
+		{name: "expired within leeway", key: &rsaKey.PublicKey, token: signToken(t, "RS256", "", rsaKey, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})), ok: true},
+		{name: "expired", key: &rsaKey.PublicKey, token: signToken(t, "RS256", "", rsaKey, claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}))},
+		{name: "no exp", key: &rsaKey.PublicKey, token: signToken(t, "RS256", "", rsaKey, claims(map[string]interface{}{"exp": nil}))},
+		{name: "not valid yet", key: &rsaKey.PublicKey, token: signToken(t, "RS256", "", rsaKey, claims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()}))},
+		{name: "other issuer", key: &rsaKey.PublicKey, token: signToken(t, "RS256", "", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"}))},
+		{name: "other audience", key: &rsaKey.PublicKey, token: signToken(t, "RS256", "", rsaKey, claims(map[string]interface{}{"aud": "other"}))},
+		{name: "no customer", key: &rsaKey.PublicKey, token: signToken(t, "RS256", "", rsaKey, claims(map[string]interface{}{DefaultCustomerClaim: nil}))},
+		{name: "signed with another key", key: &rsaKey.PublicKey, token: signToken(t, "RS256", "", otherKey, claims(nil))},
+		{name: "algorithm mismatch", key: &rsaKey.PublicKey, token: signToken(t, "ES256", "", ecKey, claims(nil))},
+		{name: "alg none", key: &rsaKey.PublicKey, token: noneToken(signToken(t, "RS256", "", rsaKey, claims(nil)))},
+		{name: "tampered claims", key: &rsaKey.PublicKey, token: tamperClaims(t, signToken(t, "RS256", "", rsaKey, claims(nil)), "cus_2")},
+		{name: "malformed", key: &rsaKey.PublicKey, token: "not-a-jwt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &JWTAuthenticator{
+				Keys:     StaticKey{PublicKey: tt.key},
+				Issuer:   "https://auth.example.com",
+				Audience: "subscriptions",
+				Leeway:   time.Minute,
+				Now:      func() time.Time { return now },
+			}
+			got, err := a.Authenticate(newRequest("Authorization", "Bearer "+tt.token))
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("Authenticate() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Subject != "user-1" || got.CustomerID != "cus_1" {
+				t.Errorf("Authenticate() = %+v, want user-1 cus_1", got)
+			}
+		})
+	}
+}
+
+func TestJWTAuthenticator_CustomerClaim(t *testing.T) {
+	key := generateRSAKey(t)
+	token := signToken(t, "RS256", "", key, map[string]interface{}{
+		"sub":                   "user-1",
+		"exp":                   time.Now().Add(time.Hour).Unix(),
+		"https://example.com/c": "cus_1",
+	})
+	a := &JWTAuthenticator{Keys: StaticKey{PublicKey: &key.PublicKey}, CustomerClaim: "https://example.com/c"}
+	got, err := a.Authenticate(newRequest("Authorization", "Bearer "+token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CustomerID != "cus_1" {
+		t.Errorf("CustomerID = %s, want cus_1", got.CustomerID)
+	}
+
+	if _, err := a.Authenticate(newRequest()); err != ErrNoCredentials {
+		t.Errorf("Authenticate() without a token = %v, want ErrNoCredentials", err)
+	}
+}
+
+// noneToken 署名を外し、algをnoneにしたトークン
+func noneToken(token string) string {
+	parts := strings.Split(token, ".")
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	return header + "." + parts[1] + "."
+}
+
+// tamperClaims 署名はそのままでCustomer IDを書き換えたトークン
+func tamperClaims(t *testing.T, token, customerID string) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		t.Fatal(err)
+	}
+	claims[DefaultCustomerClaim] = customerID
+	b, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString(b) + "." + parts[2]
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// KeySource JWTの署名を検証する公開鍵を取得する
+type KeySource interface {
+	Key(kid string) (crypto.PublicKey, error)
+}
+
+// StaticKey kidによらず固定の公開鍵で検証する
+type StaticKey struct {
+	PublicKey crypto.PublicKey
+}
+
+func (k StaticKey) Key(string) (crypto.PublicKey, error) {
+	return k.PublicKey, nil
+}
+
+// ParsePublicKeyPEM PEM形式(PKIX)のRSA、ECDSA公開鍵を読み込む
+func ParsePublicKeyPEM(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("auth: no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("auth: unsupported public key type %T", key)
+}
+
+// JWKS JSON Web Key Setを取得して公開鍵を解決する
+// 取得した鍵はCacheTTLの間キャッシュし、未知のkidが指定された場合は鍵のローテーションに備えて再取得する
+type JWKS struct {
+	URL    string
+	Client *http.Client
+	// CacheTTL 取得した鍵を保持する期間。0の場合は1時間
+	CacheTTL time.Duration
+	// MinRefreshInterval 未知のkidによる再取得の最小間隔。0の場合は1分
+	MinRefreshInterval time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func NewJWKS(url string) *JWKS {
+	return &JWKS{URL: url}
+}
+
+func (j *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ttl := j.CacheTTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	minInterval := j.MinRefreshInterval
+	if minInterval == 0 {
+		minInterval = time.Minute
+	}
+
+	now := time.Now()
+	key, ok := j.keys[kid]
+	if (!ok && now.Sub(j.fetchedAt) > minInterval) || now.Sub(j.fetchedAt) > ttl {
+		if err := j.refresh(now); err != nil {
+			// 取得に失敗した場合、キャッシュ済みの鍵があればそのまま利用する
+			if !ok {
+				return nil, err
+			}
+		} else {
+			key, ok = j.keys[kid]
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("auth: unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (j *JWKS) refresh(now time.Time) error {
+	cli := j.Client
+	if cli == nil {
+		cli = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := cli.Get(j.URL)
+	if err != nil {
+		return fmt.Errorf("auth: fetch JWKS: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("auth: fetch JWKS: unexpected status %d", res.StatusCode)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return fmt.Errorf("auth: decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// 対応していない鍵は無視する
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	j.keys = keys
+	j.fetchedAt = now
+	return nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("auth: unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("auth: unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jwksServer JWKSを返すテスト用のサーバー
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetches int
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	t.Helper()
+	s := &jwksServer{keys: map[string]*rsa.PublicKey{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		var set struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		for kid, key := range s.keys {
+			set.Keys = append(set.Keys, jsonWebKey{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) setKey(kid string, key *rsa.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[kid] = key
+}
+
+func (s *jwksServer) fetchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func TestJWKS(t *testing.T) {
+	s := newJWKSServer(t)
+	key1 := generateRSAKey(t)
+	s.setKey("key-1", &key1.PublicKey)
+	j := NewJWKS(s.URL)
+	j.MinRefreshInterval = time.Nanosecond
+
+	got, err := j.Key("key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, ok := got.(*rsa.PublicKey); !ok || !pub.Equal(&key1.PublicKey) {
+		t.Errorf("Key() = %v, want key-1", got)
+	}
+	if _, err := j.Key("key-1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.fetchCount(); n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+
+	// 鍵のローテーションで追加された鍵は、未知のkidとして再取得する
+	key2 := generateRSAKey(t)
+	s.setKey("key-2", &key2.PublicKey)
+	time.Sleep(time.Millisecond)
+	got, err = j.Key("key-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, ok := got.(*rsa.PublicKey); !ok || !pub.Equal(&key2.PublicKey) {
+		t.Errorf("Key() = %v, want key-2", got)
+	}
+	if n := s.fetchCount(); n != 2 {
+		t.Errorf("fetched %d times, want 2", n)
+	}
+}
+
+func TestJWKS_MinRefreshInterval(t *testing.T) {
+	s := newJWKSServer(t)
+	key := generateRSAKey(t)
+	s.setKey("key-1", &key.PublicKey)
+	j := NewJWKS(s.URL)
+
+	if _, err := j.Key("key-1"); err != nil {
+		t.Fatal(err)
+	}
+	// 未知のkidを指定したリクエストが続いても、MinRefreshIntervalの間は再取得しない
+	for i := 0; i < 3; i++ {
+		if _, err := j.Key("unknown"); err == nil {
+			t.Fatal("Key() with an unknown kid succeeded")
+		}
+	}
+	if n := s.fetchCount(); n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+}
+
+func TestJWTAuthenticator_JWKS(t *testing.T) {
+	s := newJWKSServer(t)
+	key := generateRSAKey(t)
+	s.setKey("key-1", &key.PublicKey)
+	a := &JWTAuthenticator{Keys: NewJWKS(s.URL)}
+
+	token := signToken(t, "RS256", "key-1", key, map[string]interface{}{
+		"sub":                "user-1",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		DefaultCustomerClaim: "cus_1",
+	})
+	if _, err := a.Authenticate(newRequest("Authorization", "Bearer "+token)); err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := signToken(t, "RS256", "key-2", key, map[string]interface{}{
+		"sub":                "user-1",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		DefaultCustomerClaim: "cus_1",
+	})
+	if _, err := a.Authenticate(newRequest("Authorization", "Bearer "+unknown)); err == nil {
+		t.Error("Authenticate() with an unknown kid succeeded")
+	}
+}
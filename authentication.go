@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+	"github.com/ogiogi93/stripe-subscription-samples/auth"
+)
+
+// withAuth 呼び出し元を認証し、認証済みの呼び出し元をリクエストのContextに保持する
+func withAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := authenticator.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, "withAuth", apperror.Unauthenticated(err))
+			return
+		}
+		h(w, r.WithContext(auth.WithCaller(r.Context(), caller)))
+	}
+}
+
+// callerCustomerID 認証済みの呼び出し元が操作できるCustomerのID
+// リクエストボディでcustomer_idを指定した場合は、呼び出し元のCustomerと一致することを検証する
+func callerCustomerID(r *http.Request, requested string) (string, error) {
+	caller, ok := auth.CallerFromContext(r.Context())
+	if !ok {
+		return "", apperror.Unauthenticated(nil)
+	}
+	if requested != "" && requested != caller.CustomerID {
+		return "", apperror.Forbidden("customer_id does not match the authenticated caller")
+	}
+	return caller.CustomerID, nil
+}
+
+// newAuthenticatorFromEnv 環境変数の設定から認証方式を組み立てる
+//   - API_KEYS: サーバー間の呼び出しに利用するAPIキー(name:key をカンマ区切り)
+//   - JWT_JWKS_URL / JWT_PUBLIC_KEY_FILE: JWTの署名を検証するJWKSのURL、またはPEM形式の公開鍵
+//   - JWT_ISSUER / JWT_AUDIENCE / JWT_CUSTOMER_CLAIM: JWTのiss、aud、Customer IDを保持するクレーム名
+func newAuthenticatorFromEnv() (auth.Authenticator, error) {
+	var chain auth.Chain
+
+	if v := os.Getenv("API_KEYS"); v != "" {
+		keys := map[string]string{}
+		for _, entry := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, fmt.Errorf("API_KEYS must be a comma separated list of name:key")
+			}
+			keys[kv[0]] = kv[1]
+		}
+		chain = append(chain, &auth.APIKeyAuthenticator{Keys: keys})
+	}
+
+	var keys auth.KeySource
+	if v := os.Getenv("JWT_JWKS_URL"); v != "" {
+		keys = auth.NewJWKS(v)
+	} else if v := os.Getenv("JWT_PUBLIC_KEY_FILE"); v != "" {
+		b, err := ioutil.ReadFile(v)
+		if err != nil {
+			return nil, err
+		}
+		key, err := auth.ParsePublicKeyPEM(b)
+		if err != nil {
+			return nil, err
+		}
+		keys = auth.StaticKey{PublicKey: key}
+	}
+	if keys != nil {
+		chain = append(chain, &auth.JWTAuthenticator{
+			Keys:          keys,
+			Issuer:        os.Getenv("JWT_ISSUER"),
+			Audience:      os.Getenv("JWT_AUDIENCE"),
+			CustomerClaim: os.Getenv("JWT_CUSTOMER_CLAIM"),
+		})
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no authentication is configured: set API_KEYS, JWT_JWKS_URL or JWT_PUBLIC_KEY_FILE")
+	}
+	return chain, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ogiogi93/stripe-subscription-samples/auth"
+)
+
+func TestWithAuth(t *testing.T) {
+	e := newTestEnv(t)
+	tests := []struct {
+		name   string
+		body   string
+		header []string
+		want   int
+		code   string
+	}{
+		{name: "no credentials", body: createPlanA, header: []string{"Authorization", ""}, want: http.StatusUnauthorized, code: "unauthenticated"},
+		{name: "invalid API key", body: createPlanA, header: []string{"Authorization", "Bearer wrong-key"}, want: http.StatusUnauthorized, code: "unauthenticated"},
+		{name: "no customer", body: createPlanA, header: []string{auth.CustomerHeader, ""}, want: http.StatusUnauthorized, code: "unauthenticated"},
+		// リクエストボディのcustomer_idで他のCustomerを操作することはできない
+		{name: "other customer", body: `{"customer_id":"cus_2","subscription_id":"sub-ramen","plan_id":"plan-a"}`, want: http.StatusForbidden, code: "forbidden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := e.serve(http.MethodPost, "/create-subscription", tt.body, tt.header...)
+			if w.Code != tt.want || errorCode(t, w.Body.String()) != tt.code {
+				t.Errorf("create = %d %s, want %d %s", w.Code, w.Body, tt.want, tt.code)
+			}
+			if tt.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+	if n := len(e.fake.Requests()); n != 0 {
+		t.Errorf("unauthorized requests called Stripe %d times", n)
+	}
+
+	// 認証した呼び出し元と一致するcustomer_idは指定できる
+	e.mustPost("/create-subscription", `{"customer_id":"cus_1","subscription_id":"sub-ramen","plan_id":"plan-a"}`, nil)
+}
+
+func TestWithAuth_CallerCustomer(t *testing.T) {
+	e := newTestEnv(t)
+	e.subscribe("plan-a")
+	e.fake.CreateCustomer("cus_2")
+
+	// 操作対象のCustomerは認証した呼び出し元から決まり、他のCustomerの契約は操作できない
+	w := e.serve(http.MethodPost, "/cancel-subscription", `{"subscription_id":"sub-ramen","decline_retention_offer":true}`, auth.CustomerHeader, "cus_2")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("cancel as cus_2 = %d %s, want 404", w.Code, w.Body)
+	}
+	if ub := e.userSubscription(); ub.CancelAtPeriodEnd {
+		t.Error("cus_2 canceled the subscription of cus_1")
+	}
+}
+
+func TestNewAuthenticatorFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		apiKeys string
+		wantErr bool
+	}{
+		{name: "api keys", apiKeys: "shop:key-shop, admin:key-admin"},
+		{name: "missing key", apiKeys: "shop:", wantErr: true},
+		{name: "missing name", apiKeys: "key-shop", wantErr: true},
+		{name: "not configured", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("API_KEYS", tt.apiKeys)
+			t.Setenv("JWT_JWKS_URL", "")
+			t.Setenv("JWT_PUBLIC_KEY_FILE", "")
+			a, err := newAuthenticatorFromEnv()
+			if tt.wantErr {
+				if err == nil {
+					t.Error("newAuthenticatorFromEnv() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/user-subscription", nil)
+			r.Header.Set("Authorization", "Bearer key-admin")
+			r.Header.Set(auth.CustomerHeader, testCustomerID)
+			caller, err := a.Authenticate(r)
+			if err != nil || caller.Subject != "admin" {
+				t.Errorf("Authenticate() = %+v, %v, want admin", caller, err)
+			}
+		})
+	}
+}
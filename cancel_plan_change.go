@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+type CancelPlanChangeRequest struct {
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+}
+
+// CancelPlanChangeHandler 請求期間の終了時に予約したプラン変更を取り消し、現在のプランのまま更新されるようにする
+// 予約がない場合は何もせずに成功を返すため、繰り返し呼び出しても安全
+func CancelPlanChangeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	var req CancelPlanChangeRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
+
+	var pending bool
+	op := NewOutboxOperation(outboxOperationID(r), OutboxOperationCancelPlanChange, time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
+		}
+		if ub.Status == stripe.SubscriptionStatusCanceled {
+			return apperror.Conflict("subscription is already canceled")
+		}
+		if ub.NextPlanID == "" && ub.StripeScheduleID == "" {
+			return nil
+		}
+		// 提供を終了したプランを契約中の場合も、そのプランのまま更新されるようにする
+		plan := sub.Plan(ub.PlanID)
+		if plan == nil {
+			return apperror.NotFound("current plan not found")
+		}
+
+		pending = true
+		op.UserSubscriptionID = ub.ID
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.PlanID = plan.ID
+		op.StripePriceID = plan.StripePriceID
+		op.StripeSubscriptionID = ub.StripeSubscriptionID
+		op.StripeSubscriptionItemID = ub.StripeSubscriptionItemID
+		op.StripeScheduleID = ub.StripeScheduleID
+		return saveOutboxOperation(tx, op)
+	})
+	if err != nil {
+		writeError(w, "cancelPlanChangeHandler", err)
+		return
+	}
+	if pending {
+		if _, err := dispatchOutboxOperation(ctx, op.ID); err != nil {
+			writeError(w, "cancelPlanChangeHandler", err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestCancelPlanChange(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-a")
+	e.mustPost("/change-plan", `{"subscription_id":"sub-ramen","plan_id":"plan-b"}`, nil)
+	e.deliverEvents()
+	scheduleID := e.userSubscription().StripeScheduleID
+	if scheduleID == "" {
+		t.Fatal("StripeScheduleID is empty, want the scheduled plan change")
+	}
+
+	// 繰り返し呼び出しても成功し、2回目はStripeを呼び出さない
+	e.mustPost("/cancel-plan-change", `{"subscription_id":"sub-ramen"}`, nil)
+	e.deliverEvents()
+	requests := len(e.fake.Requests())
+	e.mustPost("/cancel-plan-change", `{"subscription_id":"sub-ramen"}`, nil)
+	if n := len(e.fake.Requests()); n != requests {
+		t.Errorf("second cancel called Stripe %d times, want 0", n-requests)
+	}
+
+	schedule, err := billing.GetSubscriptionSchedule(scheduleID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schedule.Status != stripe.SubscriptionScheduleStatusReleased {
+		t.Errorf("schedule status = %s, want released", schedule.Status)
+	}
+	got := e.userSubscription()
+	if got.PlanID != "plan-a" || got.NextPlanID != "" || got.StripeScheduleID != "" {
+		t.Errorf("UserSubscription = plan %s next %q schedule %q, want plan-a without a plan change", got.PlanID, got.NextPlanID, got.StripeScheduleID)
+	}
+
+	// 請求期間の終了後も変更前のプランのまま更新される
+	inv, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.AmountDue != 3000 {
+		t.Errorf("renewal AmountDue = %d, want 3000", inv.AmountDue)
+	}
+	e.deliverEvents()
+	if got := e.userSubscription(); got.PlanID != "plan-a" || got.Status != stripe.SubscriptionStatusActive {
+		t.Errorf("UserSubscription after the renewal = %s %s, want active plan-a", got.PlanID, got.Status)
+	}
+	if res := e.checkEntitlement("b-ramen"); !res.Granted || res.PlanID != "plan-a" {
+		t.Errorf("b-ramen after the renewal = %+v, want granted by plan-a", res)
+	}
+}
+
+func TestCancelPlanChange_Canceled(t *testing.T) {
+	e := newTestEnv(t)
+	e.subscribe("plan-a")
+	e.mustPost("/cancel-subscription-immediately", `{"subscription_id":"sub-ramen"}`, nil)
+	e.deliverEvents()
+
+	if code, body := e.post("/cancel-plan-change", `{"subscription_id":"sub-ramen"}`); code != http.StatusConflict {
+		t.Errorf("cancel plan change after canceling = %d %s, want 409", code, body)
+	}
+}
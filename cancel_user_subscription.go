@@ -2,44 +2,83 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"log"
 	"net/http"
-
-	"cloud.google.com/go/firestore"
-	"github.com/stripe/stripe-go"
+	"time"
 )
 
 type CancelUserSubscriptionRequest struct {
-	CustomerID     string `json:"customer_id"`
-	SubscriptionID string `json:"subscription_id"`
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+	// Reason、Comment 解約理由。UserSubscriptionとStripeのcancellation_detailsに記録する
+	Reason  CancellationReason `json:"reason,omitempty" validate:"cancellation_reason"`
+	Comment string             `json:"comment,omitempty" validate:"cancellation_comment"`
+	// DeclineRetentionOffer 提示された引き止めの特典を断って解約する
+	DeclineRetentionOffer bool `json:"decline_retention_offer,omitempty"`
+}
+
+type CancelUserSubscriptionResponse struct {
+	// Canceled 解約を予約した場合はtrue。引き止めの特典を提示した場合はfalseとなり、解約は行わない
+	Canceled       bool                    `json:"canceled"`
+	RetentionOffer *RetentionOfferResponse `json:"retention_offer,omitempty"`
 }
 
+// CancelUserSubscriptionHandler 請求期間の終了時の解約を予約する
+// 解約理由に該当する引き止めの特典がある場合は、解約せずに特典を返す。decline_retention_offerを指定すると特典を提示せずに解約する
 func CancelUserSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 
-	var req *CancelUserSubscriptionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("json.NewDecoder.Decode: %v", err)
+	var req CancelUserSubscriptionRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
 		return
 	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
 
-	err := fsClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		sub, _ := GetSubscriptionTx(tx, req.SubscriptionID)
-		ub, _ := GetUserSubscriptionTx(tx, sub.UserSubscriptionID(req.CustomerID))
-
-		// 自動更新を無効にする https://stripe.com/docs/billing/subscriptions/cancel
-		params := &stripe.SubscriptionParams{
-			CancelAtPeriodEnd: stripe.Bool(true),
+	var res CancelUserSubscriptionResponse
+	op := NewOutboxOperation(outboxOperationID(r), OutboxOperationCancelAtPeriodEnd, time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
 		}
-		_, _ = client.Subscriptions.Update(ub.StripeSubscriptionID, params)
-		return nil
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
+		}
+		if !req.DeclineRetentionOffer {
+			if offer, plan := sub.RetentionOffer(ub, req.Reason); offer != nil {
+				res.RetentionOffer = newRetentionOfferResponse(offer, plan)
+				return nil
+			}
+		}
+
+		// 自動更新の無効化はOutboxに記録してトランザクションの外で実行する
+		op.UserSubscriptionID = ub.ID
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.StripeSubscriptionID = ub.StripeSubscriptionID
+		op.StripeScheduleID = ub.StripeScheduleID
+		op.CancellationReason = req.Reason
+		op.CancellationComment = req.Comment
+		return saveOutboxOperation(tx, op)
 	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("cancelSubscriptionHandler: %v", err)
+		writeError(w, "cancelSubscriptionHandler", err)
+		return
+	}
+	if res.RetentionOffer != nil {
+		writeJSON(w, "cancelSubscriptionHandler", res)
+		return
+	}
+	if _, err := dispatchOutboxOperation(ctx, op.ID); err != nil {
+		writeError(w, "cancelSubscriptionHandler", err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	res.Canceled = true
+	writeJSON(w, "cancelSubscriptionHandler", res)
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+type CancelUserSubscriptionImmediatelyRequest struct {
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+	// Refund 最新の請求に対する返金方法。省略した場合は返金しない
+	Refund RefundMode `json:"refund,omitempty" validate:"refund_mode"`
+	// Reason、Comment 解約理由。UserSubscriptionとStripeのcancellation_detailsに記録する
+	Reason  CancellationReason `json:"reason,omitempty" validate:"cancellation_reason"`
+	Comment string             `json:"comment,omitempty" validate:"cancellation_comment"`
+}
+
+type CancelUserSubscriptionImmediatelyResponse struct {
+	Status       stripe.SubscriptionStatus `json:"status"`
+	CanceledAt   time.Time                 `json:"canceled_at"`
+	Refund       RefundMode                `json:"refund"`
+	RefundAmount int64                     `json:"refund_amount"`
+	Currency     stripe.Currency           `json:"currency,omitempty"`
+}
+
+// CancelUserSubscriptionImmediatelyHandler 請求期間の終了を待たずに即時に解約し、指定した方法で最新の請求を返金する
+func CancelUserSubscriptionImmediatelyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	var req CancelUserSubscriptionImmediatelyRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
+	if req.Refund == "" {
+		req.Refund = RefundNone
+	}
+
+	op := NewOutboxOperation(outboxOperationID(r), OutboxOperationCancelImmediately, time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
+		}
+		if ub.Status == stripe.SubscriptionStatusCanceled {
+			return apperror.Conflict("subscription is already canceled")
+		}
+
+		// キャンセルと返金はOutboxに記録してトランザクションの外で実行する
+		op.UserSubscriptionID = ub.ID
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.StripeSubscriptionID = ub.StripeSubscriptionID
+		op.RefundMode = req.Refund
+		op.CancellationReason = req.Reason
+		op.CancellationComment = req.Comment
+		return saveOutboxOperation(tx, op)
+	})
+	if err != nil {
+		writeError(w, "cancelUserSubscriptionImmediatelyHandler", err)
+		return
+	}
+	s, err := dispatchOutboxOperation(ctx, op.ID)
+	if err != nil {
+		writeError(w, "cancelUserSubscriptionImmediatelyHandler", err)
+		return
+	}
+
+	res := CancelUserSubscriptionImmediatelyResponse{
+		Status:       s.Status,
+		CanceledAt:   unixTime(s.CanceledAt),
+		Refund:       req.Refund,
+		RefundAmount: cancellationRefundAmount(req.Refund, s),
+	}
+	if s.LatestInvoice != nil {
+		res.Currency = s.LatestInvoice.Currency
+	}
+	writeJSON(w, "cancelUserSubscriptionImmediatelyHandler", res)
+}
+
+// cancellationRefundAmount 即時解約したSubscriptionの最新の請求に対する返金額
+// 日割りの場合はキャンセルした日時から請求期間の終了までの割合で計算し、端数は切り捨てる
+func cancellationRefundAmount(mode RefundMode, s *stripe.Subscription) int64 {
+	inv := s.LatestInvoice
+	if inv == nil || !inv.Paid || inv.PaymentIntent == nil || inv.AmountPaid <= 0 {
+		return 0
+	}
+	switch mode {
+	case RefundFull:
+		return inv.AmountPaid
+	case RefundProrated:
+		start, end := s.CurrentPeriodStart, s.CurrentPeriodEnd
+		canceledAt := s.CanceledAt
+		if canceledAt < start {
+			canceledAt = start
+		}
+		if end <= start || canceledAt >= end {
+			return 0
+		}
+		remaining := float64(end-canceledAt) / float64(end-start)
+		return int64(math.Floor(float64(inv.AmountPaid) * remaining))
+	}
+	return 0
+}
+
+// refundLatestInvoice 即時解約したSubscriptionの最新の請求を返金する https://stripe.com/docs/api/refunds/create
+func refundLatestInvoice(op *OutboxOperation, s *stripe.Subscription) error {
+	amount := cancellationRefundAmount(op.RefundMode, s)
+	if amount <= 0 {
+		return nil
+	}
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(s.LatestInvoice.PaymentIntent.ID),
+		Amount:        stripe.Int64(amount),
+		Reason:        stripe.String(string(stripe.RefundReasonRequestedByCustomer)),
+	}
+	params.AddMetadata("subscription_id", op.SubscriptionID)
+	params.AddMetadata("refund_mode", string(op.RefundMode))
+	params.SetIdempotencyKey(op.StepIdempotencyKey("refund"))
+	_, err := billing.NewRefund(params)
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestCancelSubscriptionImmediately_Refund(t *testing.T) {
+	tests := []struct {
+		refund RefundMode
+		// want 請求期間の残りの割合remainingに対する返金額
+		want func(remaining float64) int64
+	}{
+		{refund: "", want: func(float64) int64 { return 0 }},
+		{refund: RefundNone, want: func(float64) int64 { return 0 }},
+		{refund: RefundFull, want: func(float64) int64 { return 3000 }},
+		{refund: RefundProrated, want: func(remaining float64) int64 { return int64(math.Floor(3000 * remaining)) }},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.refund), func(t *testing.T) {
+			e := newTestEnv(t)
+			ub := e.subscribeMidPeriod("plan-a")
+			paymentIntentID := e.stripeSubscription().LatestInvoice.PaymentIntent.ID
+
+			var res CancelUserSubscriptionImmediatelyResponse
+			e.mustPost("/cancel-subscription-immediately", `{"subscription_id":"sub-ramen","refund":"`+string(tt.refund)+`","reason":"too_expensive"}`, &res)
+			start, end := ub.CurrentPeriodStart.Unix(), ub.CurrentPeriodEnd.Unix()
+			want := tt.want(float64(end-res.CanceledAt.Unix()) / float64(end-start))
+			if res.Status != stripe.SubscriptionStatusCanceled || res.RefundAmount != want || res.Currency != stripe.CurrencyJPY {
+				t.Errorf("response = %+v, want canceled with a refund of %d", res, want)
+			}
+
+			var refunded int64
+			for _, r := range e.fake.Refunds(paymentIntentID) {
+				refunded += r.Amount
+				if r.Reason != stripe.RefundReasonRequestedByCustomer {
+					t.Errorf("refund reason = %s, want requested_by_customer", r.Reason)
+				}
+			}
+			if refunded != want {
+				t.Errorf("refunded = %d, want %d", refunded, want)
+			}
+
+			e.deliverEvents()
+			got := e.userSubscription()
+			if got.Status != stripe.SubscriptionStatusCanceled || got.RefundAmount != want || got.CancellationReason != CancellationReasonTooExpensive {
+				t.Errorf("UserSubscription = %s refund %d reason %s, want canceled refund %d too_expensive", got.Status, got.RefundAmount, got.CancellationReason, want)
+			}
+		})
+	}
+}
+
+func TestCancelSubscriptionImmediately_AlreadyCanceled(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-a")
+	e.mustPost("/cancel-subscription-immediately", `{"subscription_id":"sub-ramen","refund":"full"}`, nil)
+	e.deliverEvents()
+
+	code, body := e.post("/cancel-subscription-immediately", `{"subscription_id":"sub-ramen","refund":"full"}`)
+	if code != http.StatusConflict {
+		t.Errorf("second cancel = %d %s, want 409", code, body)
+	}
+	// 同じ請求を重複して返金しない
+	if n := len(e.fake.Refunds(e.stripeSubscription().LatestInvoice.PaymentIntent.ID)); n != 1 {
+		t.Errorf("len(refunds) = %d, want 1", n)
+	}
+	if got := e.userSubscription().StripeSubscriptionID; got != ub.StripeSubscriptionID {
+		t.Errorf("StripeSubscriptionID = %s, want %s", got, ub.StripeSubscriptionID)
+	}
+}
+
+func TestCancellationRefundAmount(t *testing.T) {
+	paid := &stripe.Invoice{Paid: true, AmountPaid: 3000, PaymentIntent: &stripe.PaymentIntent{ID: "pi_1"}}
+	tests := []struct {
+		name string
+		mode RefundMode
+		sub  *stripe.Subscription
+		want int64
+	}{
+		{name: "prorated", mode: RefundProrated, sub: &stripe.Subscription{CurrentPeriodStart: 0, CurrentPeriodEnd: 30, CanceledAt: 10, LatestInvoice: paid}, want: 2000},
+		// 端数は切り捨てる
+		{name: "prorated rounds down", mode: RefundProrated, sub: &stripe.Subscription{CurrentPeriodStart: 0, CurrentPeriodEnd: 7, CanceledAt: 1, LatestInvoice: paid}, want: 2571},
+		{name: "canceled after the period", mode: RefundProrated, sub: &stripe.Subscription{CurrentPeriodStart: 0, CurrentPeriodEnd: 30, CanceledAt: 30, LatestInvoice: paid}, want: 0},
+		{name: "full", mode: RefundFull, sub: &stripe.Subscription{CurrentPeriodStart: 0, CurrentPeriodEnd: 30, CanceledAt: 29, LatestInvoice: paid}, want: 3000},
+		{name: "none", mode: RefundNone, sub: &stripe.Subscription{CurrentPeriodStart: 0, CurrentPeriodEnd: 30, CanceledAt: 10, LatestInvoice: paid}, want: 0},
+		{name: "unpaid", mode: RefundFull, sub: &stripe.Subscription{CurrentPeriodStart: 0, CurrentPeriodEnd: 30, LatestInvoice: &stripe.Invoice{AmountDue: 3000}}, want: 0},
+		{name: "no invoice", mode: RefundFull, sub: &stripe.Subscription{}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cancellationRefundAmount(tt.mode, tt.sub); got != tt.want {
+				t.Errorf("cancellationRefundAmount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+const (
+	// catalogCacheTTL 変更の通知を受け取れなかった場合に備え、キャッシュしたカタログを再読み込みするまでの時間
+	catalogCacheTTL = 10 * time.Minute
+	// catalogWatchRetryInterval 変更の監視が中断された場合に再開するまでの時間
+	catalogWatchRetryInterval = 10 * time.Second
+)
+
+// catalog 販売中のSubscriptionとプランのキャッシュ
+var catalog = newCatalogCache(catalogCacheTTL)
+
+// catalogCache Subscriptionのドキュメントをプロセス内にキャッシュする。ドキュメントの変更が通知されると破棄する
+type catalogCache struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	subs     []*Subscription
+	loadedAt time.Time
+	// generation 読み込み中に破棄された場合に古い内容を保存しないよう、破棄する度に加算する
+	generation int64
+}
+
+func newCatalogCache(ttl time.Duration) *catalogCache {
+	return &catalogCache{ttl: ttl}
+}
+
+// Subscriptions キャッシュしたSubscriptionを返す。キャッシュがない場合はリポジトリから読み込む
+// 返した値は複数のリクエストで共有するため、呼び出し元で変更してはならない
+func (c *catalogCache) Subscriptions(ctx context.Context) ([]*Subscription, error) {
+	c.mu.Lock()
+	if c.subs != nil && time.Since(c.loadedAt) < c.ttl {
+		subs := c.subs
+		c.mu.Unlock()
+		return subs, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	var subs []*Subscription
+	err := repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		var err error
+		subs, err = tx.ListSubscriptions()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.generation == generation {
+		c.subs = subs
+		c.loadedAt = time.Now()
+	}
+	c.mu.Unlock()
+	return subs, nil
+}
+
+// Invalidate キャッシュを破棄する
+func (c *catalogCache) Invalidate() {
+	c.mu.Lock()
+	c.subs = nil
+	c.generation++
+	c.mu.Unlock()
+}
+
+// watchCatalog Subscriptionのドキュメントの変更を監視し、変更がある度にカタログのキャッシュを破棄する
+func watchCatalog(ctx context.Context) {
+	for {
+		err := repo.WatchSubscriptions(ctx, catalog.Invalidate)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("WatchSubscriptions: %v", err)
+		// 監視が中断されている間の変更を取りこぼさないよう破棄しておく
+		catalog.Invalidate()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(catalogWatchRetryInterval):
+		}
+	}
+}
+
+type CatalogPlanResponse struct {
+	ID            string                        `json:"id"`
+	Title         string                        `json:"title"`
+	Price         int32                         `json:"price"`
+	Currency      stripe.Currency               `json:"currency,omitempty"`
+	Interval      stripe.PriceRecurringInterval `json:"interval,omitempty"`
+	IntervalCount int64                         `json:"interval_count,omitempty"`
+	Benefits      []*BenefitResponse            `json:"benefits"`
+}
+
+type CatalogSubscriptionResponse struct {
+	ID    string                 `json:"id"`
+	Title string                 `json:"title"`
+	Plans []*CatalogPlanResponse `json:"plans"`
+}
+
+type CatalogResponse struct {
+	Subscriptions []*CatalogSubscriptionResponse `json:"subscriptions"`
+}
+
+// CatalogHandler 販売中のSubscriptionとプランの一覧を返す。認証は不要
+// タイトルは locale パラメータ、または Accept-Language ヘッダーで指定した言語に翻訳する
+func CatalogHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, "catalogHandler", apperror.MethodNotAllowed(r.Method))
+		return
+	}
+
+	subs, err := catalog.Subscriptions(ctx)
+	if err != nil {
+		writeError(w, "catalogHandler", err)
+		return
+	}
+
+	subscriptionID := r.URL.Query().Get("subscription_id")
+	locales := requestLocales(r)
+	res := CatalogResponse{Subscriptions: []*CatalogSubscriptionResponse{}}
+	for _, sub := range subs {
+		if sub.Archived || (subscriptionID != "" && sub.ID != subscriptionID) {
+			continue
+		}
+		res.Subscriptions = append(res.Subscriptions, newCatalogSubscriptionResponse(sub, locales))
+	}
+	if subscriptionID != "" && len(res.Subscriptions) == 0 {
+		writeError(w, "catalogHandler", apperror.NotFound("subscription is not found"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Header().Set("Vary", "Accept-Language")
+	writeJSON(w, "catalogHandler", res)
+}
+
+func newCatalogSubscriptionResponse(sub *Subscription, locales []string) *CatalogSubscriptionResponse {
+	res := &CatalogSubscriptionResponse{
+		ID:    sub.ID,
+		Title: sub.Titles.Localize(locales, sub.Title),
+		Plans: []*CatalogPlanResponse{},
+	}
+	for _, plan := range sub.Plans {
+		if plan.Archived {
+			continue
+		}
+		p := &CatalogPlanResponse{
+			ID:            plan.ID,
+			Title:         plan.Titles.Localize(locales, plan.Title),
+			Price:         plan.Price,
+			Currency:      plan.Currency,
+			Interval:      plan.Interval,
+			IntervalCount: plan.IntervalCount,
+			Benefits:      make([]*BenefitResponse, 0, len(plan.Benefits)),
+		}
+		for _, b := range plan.Benefits {
+			p.Benefits = append(p.Benefits, &BenefitResponse{ID: b.ID, Title: b.Titles.Localize(locales, b.Title)})
+		}
+		res.Plans = append(res.Plans, p)
+	}
+	return res
+}
+
+// requestLocales locale パラメータ、Accept-Language ヘッダーの順に、優先度の高い言語から並べて返す
+func requestLocales(r *http.Request) []string {
+	var locales []string
+	if v := r.URL.Query().Get("locale"); v != "" {
+		locales = append(locales, v)
+	}
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[len("q="):], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag: tag, q: q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	for _, t := range tags {
+		locales = append(locales, t.tag)
+	}
+	return locales
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// catalog GET /catalog のレスポンスを返す。headerには名前と値を交互に指定する
+func (e *testEnv) catalog(query string, header ...string) CatalogResponse {
+	e.t.Helper()
+	w := e.serve(http.MethodGet, "/catalog"+query, "", header...)
+	if w.Code != http.StatusOK {
+		e.t.Fatalf("GET /catalog%s = %d %s", query, w.Code, w.Body)
+	}
+	var res CatalogResponse
+	decodeJSON(e.t, w.Body.String(), &res)
+	return res
+}
+
+func TestCatalogCache_TTL(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	c := newCatalogCache(time.Hour)
+	if _, err := c.Subscriptions(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// TTLの間は変更を反映せず、キャッシュを返す
+	e.sub.Title = "ramen v2"
+	e.saveSubscription()
+	subs, err := c.Subscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subs[0].Title != "ramen" {
+		t.Errorf("cached Title = %s, want ramen", subs[0].Title)
+	}
+
+	c.mu.Lock()
+	c.loadedAt = time.Now().Add(-time.Hour)
+	c.mu.Unlock()
+	subs, err = c.Subscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subs[0].Title != "ramen v2" {
+		t.Errorf("Title after the TTL = %s, want ramen v2", subs[0].Title)
+	}
+}
+
+func TestCatalog_InvalidatedOnUpdate(t *testing.T) {
+	e := newTestEnv(t)
+	if got := e.catalog("").Subscriptions[0].Title; got != "ramen" {
+		t.Fatalf("Title = %s, want ramen", got)
+	}
+	e.sub.Title = "ramen v2"
+	e.saveSubscription()
+	if got := e.catalog("").Subscriptions[0].Title; got != "ramen" {
+		t.Errorf("Title before the invalidation = %s, want the cached ramen", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchCatalog(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitForWatcher(t, repo.(*MemoryRepository))
+
+	// Subscriptionのドキュメントの変更が通知されるとキャッシュを破棄する
+	e.sub.Title = "ramen v3"
+	e.saveSubscription()
+	deadline := time.Now().Add(time.Second)
+	for e.catalog("").Subscriptions[0].Title != "ramen v3" {
+		if time.Now().After(deadline) {
+			t.Fatal("catalog was not invalidated after UpdateSubscription")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForWatcher rに変更の監視が登録されるまで待つ
+func waitForWatcher(t *testing.T, r *MemoryRepository) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.mu.Lock()
+		n := len(r.watchers)
+		r.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("WatchSubscriptions did not register a watcher")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCatalog_Locale(t *testing.T) {
+	e := newTestEnv(t)
+	e.sub.Titles = LocalizedTitles{"en": "Ramen"}
+	e.sub.Plan("plan-a").Titles = LocalizedTitles{"en": "Plan A", "ja": "Aプラン"}
+	e.sub.Plan("plan-a").Benefits[0].Titles = LocalizedTitles{"ja": "ラーメン"}
+	e.sub.Plans = append(e.sub.Plans, &Plan{ID: "plan-old", Title: "old", Archived: true})
+	e.saveSubscription()
+
+	tests := []struct {
+		name    string
+		query   string
+		header  []string
+		sub     string
+		plan    string
+		benefit string
+	}{
+		{name: "default", sub: "ramen", plan: "A", benefit: "ramen"},
+		{name: "locale", query: "?locale=ja", sub: "ramen", plan: "Aプラン", benefit: "ラーメン"},
+		// en-USの翻訳がない場合はenの翻訳を利用する
+		{name: "language fallback", header: []string{"Accept-Language", "en-US"}, sub: "Ramen", plan: "Plan A", benefit: "ramen"},
+		{name: "quality", header: []string{"Accept-Language", "fr;q=0.9, ja;q=0.5, en;q=0.8"}, sub: "Ramen", plan: "Plan A", benefit: "ラーメン"},
+		{name: "locale before Accept-Language", query: "?locale=ja", header: []string{"Accept-Language", "en"}, sub: "Ramen", plan: "Aプラン", benefit: "ラーメン"},
+		{name: "not translated", query: "?locale=fr", sub: "ramen", plan: "A", benefit: "ramen"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := e.catalog(tt.query, tt.header...)
+			if len(res.Subscriptions) != 1 || len(res.Subscriptions[0].Plans) != 2 {
+				t.Fatalf("catalog = %+v, want sub-ramen with plan-a and plan-b", res)
+			}
+			sub := res.Subscriptions[0]
+			plan := sub.Plans[0]
+			if sub.Title != tt.sub || plan.Title != tt.plan || plan.Benefits[0].Title != tt.benefit {
+				t.Errorf("titles = %s / %s / %s, want %s / %s / %s", sub.Title, plan.Title, plan.Benefits[0].Title, tt.sub, tt.plan, tt.benefit)
+			}
+		})
+	}
+
+	if code, body := e.get("/catalog?subscription_id=sub-unknown"); code != http.StatusNotFound {
+		t.Errorf("unknown subscription = %d %s, want 404", code, body)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+// PlanComparison プランの上位・下位の比較方法
+type PlanComparison string
+
+const (
+	// PlanComparisonPrice 1日あたりの価格で比較する(デフォルト)
+	PlanComparisonPrice PlanComparison = "price"
+	// PlanComparisonRank Plan.Rankで比較する
+	PlanComparisonRank PlanComparison = "rank"
+)
+
+// PlanChangeDirection 変更前のプランから見た変更後のプランの位置付け
+type PlanChangeDirection string
+
+const (
+	PlanChangeUpgrade   PlanChangeDirection = "upgrade"
+	PlanChangeDowngrade PlanChangeDirection = "downgrade"
+	// PlanChangeLateral 価格や順位が同じプランへの変更
+	PlanChangeLateral PlanChangeDirection = "lateral"
+)
+
+// PlanChangeTiming プラン変更を反映するタイミング
+type PlanChangeTiming string
+
+const (
+	// PlanChangeImmediately 請求期間をリセットして即時に変更し、変更前のプランの未使用期間分を日割りで返金する
+	PlanChangeImmediately PlanChangeTiming = "immediately"
+	// PlanChangeAtPeriodEnd 現在の請求期間の終了まで変更前のプランを継続し、次回の更新時に変更する
+	PlanChangeAtPeriodEnd PlanChangeTiming = "period_end"
+)
+
+// PlanChangePolicy Subscription毎のプラン変更のルール。未設定の項目はデフォルトの値を利用する
+// デフォルトでは価格で比較し、上位のプランへは即時に、下位・同等のプランへは請求期間の終了時に変更する
+type PlanChangePolicy struct {
+	CompareBy PlanComparison   `firestore:"compare_by"`
+	Upgrade   PlanChangeTiming `firestore:"upgrade"`
+	Downgrade PlanChangeTiming `firestore:"downgrade"`
+	Lateral   PlanChangeTiming `firestore:"lateral"`
+}
+
+// PlanChangeDecision プラン変更の判定結果
+type PlanChangeDecision struct {
+	Direction PlanChangeDirection
+	Timing    PlanChangeTiming
+}
+
+// Decide currentからnextへの変更の方向と、変更を反映するタイミングを判定する
+func (p PlanChangePolicy) Decide(current, next *Plan) PlanChangeDecision {
+	d := PlanChangeDecision{Direction: p.compare(current, next)}
+	switch d.Direction {
+	case PlanChangeUpgrade:
+		d.Timing = timingOrDefault(p.Upgrade, PlanChangeImmediately)
+	case PlanChangeDowngrade:
+		d.Timing = timingOrDefault(p.Downgrade, PlanChangeAtPeriodEnd)
+	default:
+		d.Timing = timingOrDefault(p.Lateral, PlanChangeAtPeriodEnd)
+	}
+	return d
+}
+
+func (p PlanChangePolicy) compare(current, next *Plan) PlanChangeDirection {
+	var a, b float64
+	switch p.CompareBy {
+	case PlanComparisonRank:
+		a, b = float64(current.Rank), float64(next.Rank)
+	default:
+		a, b = current.dailyPrice(), next.dailyPrice()
+	}
+	switch {
+	case b > a:
+		return PlanChangeUpgrade
+	case b < a:
+		return PlanChangeDowngrade
+	}
+	return PlanChangeLateral
+}
+
+// dailyPrice 請求間隔の異なるプランを比較するための1日あたりの価格。請求間隔が未設定の場合は価格をそのまま返す
+func (p *Plan) dailyPrice() float64 {
+	days := map[stripe.PriceRecurringInterval]float64{
+		stripe.PriceRecurringIntervalDay:   1,
+		stripe.PriceRecurringIntervalWeek:  7,
+		stripe.PriceRecurringIntervalMonth: 30,
+		stripe.PriceRecurringIntervalYear:  365,
+	}[p.Interval]
+	if days == 0 {
+		return float64(p.Price)
+	}
+	count := p.IntervalCount
+	if count <= 0 {
+		count = 1
+	}
+	return float64(p.Price) / (days * float64(count))
+}
+
+func timingOrDefault(t, def PlanChangeTiming) PlanChangeTiming {
+	if t == "" {
+		return def
+	}
+	return t
+}
+
+type ChangePlanRequest struct {
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+	PlanID         string `json:"plan_id" validate:"required,document_id"`
+	// ProrationDate 即時に変更する場合の日割り計算の基準日時。/preview-plan-change で返した値を指定する
+	ProrationDate int64 `json:"proration_date,omitempty"`
+}
+
+type ChangePlanResponse struct {
+	PlanID    string              `json:"plan_id"`
+	Direction PlanChangeDirection `json:"direction"`
+	Timing    PlanChangeTiming    `json:"timing"`
+	// EffectiveAt 変更後のプランが適用される日時
+	EffectiveAt time.Time `json:"effective_at"`
+	// Status、ClientSecret、NextStep 即時に変更した場合の請求の支払い状態
+	Status       stripe.PaymentIntentStatus `json:"status,omitempty"`
+	ClientSecret string                     `json:"client_secret,omitempty"`
+	NextStep     PaymentNextStep            `json:"next_step,omitempty"`
+}
+
+// ChangePlanHandler Subscriptionのプラン変更のルールに従い、上位のプランへは即時に、下位のプランへは請求期間の終了時にプランを変更する
+func ChangePlanHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	var req ChangePlanRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
+
+	var decision PlanChangeDecision
+	var effectiveAt time.Time
+	op := NewOutboxOperation(outboxOperationID(r), "", time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		plan, err := getPlan(sub, req.PlanID)
+		if err != nil {
+			return err
+		}
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case plan.ID == ub.PlanID:
+			return apperror.Conflict("plan is already active")
+		case plan.ID == ub.NextPlanID:
+			return apperror.Conflict("plan change is already scheduled")
+		}
+		if current := sub.Plan(ub.PlanID); current != nil {
+			decision = sub.PlanChangePolicy.Decide(current, plan)
+		} else {
+			// 削除済みのプランからの変更は比較できないため、即時に行う
+			decision = PlanChangeDecision{Direction: PlanChangeLateral, Timing: PlanChangeImmediately}
+		}
+
+		op.Kind = OutboxOperationChangePlanAtPeriodEnd
+		effectiveAt = ub.CurrentPeriodEnd
+		if decision.Timing == PlanChangeImmediately {
+			op.Kind = OutboxOperationChangePlanImmediately
+			op.ProrationDate, err = resolveProrationDate(req.ProrationDate, plan.ID, ub, time.Now())
+			if err != nil {
+				return err
+			}
+			effectiveAt = time.Unix(op.ProrationDate, 0)
+		}
+
+		op.UserSubscriptionID = ub.ID
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.PlanID = plan.ID
+		op.StripePriceID = plan.StripePriceID
+		op.StripeSubscriptionID = ub.StripeSubscriptionID
+		op.StripeSubscriptionItemID = ub.StripeSubscriptionItemID
+		op.StripeScheduleID = ub.StripeScheduleID
+		return saveOutboxOperation(tx, op)
+	})
+	if err != nil {
+		writeError(w, "changePlanHandler", err)
+		return
+	}
+	s, err := dispatchOutboxOperation(ctx, op.ID)
+	if err != nil {
+		writeError(w, "changePlanHandler", err)
+		return
+	}
+
+	res := ChangePlanResponse{
+		PlanID:      req.PlanID,
+		Direction:   decision.Direction,
+		Timing:      decision.Timing,
+		EffectiveAt: effectiveAt,
+	}
+	if decision.Timing == PlanChangeImmediately && s.LatestInvoice != nil && s.LatestInvoice.PaymentIntent != nil {
+		res.Status = s.LatestInvoice.PaymentIntent.Status
+		res.ClientSecret = s.LatestInvoice.PaymentIntent.ClientSecret
+		res.NextStep = paymentNextStep(s.LatestInvoice.PaymentIntent)
+	}
+	writeJSON(w, "changePlanHandler", res)
+}
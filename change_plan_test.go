@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestPlanChangePolicy_Decide(t *testing.T) {
+	monthly := &Plan{ID: "monthly", Price: 3000, Interval: stripe.PriceRecurringIntervalMonth, IntervalCount: 1, Rank: 1}
+	yearly := &Plan{ID: "yearly", Price: 30000, Interval: stripe.PriceRecurringIntervalYear, IntervalCount: 1, Rank: 2}
+	weekly := &Plan{ID: "weekly", Price: 800, Interval: stripe.PriceRecurringIntervalWeek, IntervalCount: 1, Rank: 3}
+	biweekly := &Plan{ID: "biweekly", Price: 1600, Interval: stripe.PriceRecurringIntervalWeek, IntervalCount: 2, Rank: 3}
+
+	tests := []struct {
+		name          string
+		policy        PlanChangePolicy
+		current, next *Plan
+		want          PlanChangeDecision
+	}{
+		// 請求間隔の異なるプランは1日あたりの価格で比較する
+		{name: "upgrade", current: yearly, next: monthly, want: PlanChangeDecision{Direction: PlanChangeUpgrade, Timing: PlanChangeImmediately}},
+		{name: "downgrade", current: monthly, next: yearly, want: PlanChangeDecision{Direction: PlanChangeDowngrade, Timing: PlanChangeAtPeriodEnd}},
+		{name: "lateral", current: weekly, next: biweekly, want: PlanChangeDecision{Direction: PlanChangeLateral, Timing: PlanChangeAtPeriodEnd}},
+		{name: "by rank", policy: PlanChangePolicy{CompareBy: PlanComparisonRank}, current: monthly, next: yearly, want: PlanChangeDecision{Direction: PlanChangeUpgrade, Timing: PlanChangeImmediately}},
+		{
+			name:    "custom timings",
+			policy:  PlanChangePolicy{Upgrade: PlanChangeAtPeriodEnd, Downgrade: PlanChangeImmediately, Lateral: PlanChangeImmediately},
+			current: monthly, next: yearly,
+			want: PlanChangeDecision{Direction: PlanChangeDowngrade, Timing: PlanChangeImmediately},
+		},
+		{
+			name:    "custom lateral",
+			policy:  PlanChangePolicy{CompareBy: PlanComparisonRank, Lateral: PlanChangeImmediately},
+			current: weekly, next: biweekly,
+			want: PlanChangeDecision{Direction: PlanChangeLateral, Timing: PlanChangeImmediately},
+		},
+		// 請求間隔が未設定のプランは価格をそのまま比較する
+		{name: "no interval", current: &Plan{Price: 350}, next: &Plan{Price: 3000}, want: PlanChangeDecision{Direction: PlanChangeUpgrade, Timing: PlanChangeImmediately}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Decide(tt.current, tt.next); got != tt.want {
+				t.Errorf("Decide() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChangePlan_Upgrade(t *testing.T) {
+	e := newTestEnv(t)
+	e.subscribeMidPeriod("plan-b")
+
+	var res ChangePlanResponse
+	e.mustPost("/change-plan", `{"subscription_id":"sub-ramen","plan_id":"plan-a"}`, &res)
+	if res.Direction != PlanChangeUpgrade || res.Timing != PlanChangeImmediately || res.Status != stripe.PaymentIntentStatusSucceeded {
+		t.Errorf("response = %+v, want an immediate upgrade", res)
+	}
+	e.deliverEvents()
+	if ub := e.userSubscription(); ub.PlanID != "plan-a" || ub.NextPlanID != "" {
+		t.Errorf("PlanID = %s NextPlanID = %s, want plan-a now", ub.PlanID, ub.NextPlanID)
+	}
+
+	code, body := e.post("/change-plan", `{"subscription_id":"sub-ramen","plan_id":"plan-a"}`)
+	if code != http.StatusConflict {
+		t.Errorf("change to the current plan = %d %s, want 409", code, body)
+	}
+}
+
+func TestChangePlan_DowngradeAtPeriodEnd(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-a")
+
+	var res ChangePlanResponse
+	e.mustPost("/change-plan", `{"subscription_id":"sub-ramen","plan_id":"plan-b"}`, &res)
+	if res.Direction != PlanChangeDowngrade || res.Timing != PlanChangeAtPeriodEnd || !res.EffectiveAt.Equal(ub.CurrentPeriodEnd) {
+		t.Errorf("response = %+v, want a downgrade at %v", res, ub.CurrentPeriodEnd)
+	}
+	e.deliverEvents()
+
+	// 請求期間の終了まではplan-aを継続し、Subscription Scheduleで次の請求期間からplan-bに切り替える
+	scheduled := e.userSubscription()
+	if scheduled.PlanID != "plan-a" || scheduled.NextPlanID != "plan-b" || scheduled.StripeScheduleID == "" {
+		t.Fatalf("UserSubscription = plan %s next %s schedule %q, want plan-a next plan-b with a schedule", scheduled.PlanID, scheduled.NextPlanID, scheduled.StripeScheduleID)
+	}
+	s := e.stripeSubscription()
+	if s.Items.Data[0].Price.ID != e.sub.Plan("plan-a").StripePriceID || s.Schedule == nil || s.Schedule.ID != scheduled.StripeScheduleID {
+		t.Errorf("stripe subscription = price %s schedule %v, want plan-a on %s", s.Items.Data[0].Price.ID, s.Schedule, scheduled.StripeScheduleID)
+	}
+	if res := e.checkEntitlement("b-ramen"); !res.Granted {
+		t.Errorf("b-ramen before the renewal = %+v, want granted", res)
+	}
+	// 予約中のプランへの変更は重複して受け付けない
+	if code, body := e.post("/change-plan", `{"subscription_id":"sub-ramen","plan_id":"plan-b"}`); code != http.StatusConflict {
+		t.Errorf("change to the scheduled plan = %d %s, want 409", code, body)
+	}
+
+	inv, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.AmountDue != 350 {
+		t.Errorf("renewal AmountDue = %d, want 350", inv.AmountDue)
+	}
+	e.deliverEvents()
+	renewed := e.userSubscription()
+	if renewed.PlanID != "plan-b" || renewed.NextPlanID != "" {
+		t.Errorf("UserSubscription = plan %s next %s, want plan-b", renewed.PlanID, renewed.NextPlanID)
+	}
+	if res := e.checkEntitlement("b-topping"); !res.Granted || res.PlanID != "plan-b" {
+		t.Errorf("b-topping after the renewal = %+v, want granted by plan-b", res)
+	}
+
+	// 切り替え後のフェーズが終了するとScheduleを解放し、通常のSubscriptionとしてplan-bで更新する
+	inv, err = e.fake.AdvancePeriod(ub.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.AmountDue != 350 {
+		t.Errorf("next renewal AmountDue = %d, want 350", inv.AmountDue)
+	}
+	e.deliverEvents()
+	if got := e.userSubscription(); got.PlanID != "plan-b" || got.StripeScheduleID != "" {
+		t.Errorf("UserSubscription = plan %s schedule %q, want plan-b without a schedule", got.PlanID, got.StripeScheduleID)
+	}
+}
+
+func TestChangePlan_ReplaceScheduledChange(t *testing.T) {
+	e := newTestEnv(t)
+	ramen := e.sub.Plan("plan-a")
+	e.sub.Plans = append(e.sub.Plans, &Plan{ID: "plan-c", Title: "C", StripePriceID: e.fake.CreatePrice("gyoza", 500, stripe.PriceRecurringIntervalDay, 30).ID, Price: 500, Currency: stripe.CurrencyJPY})
+	e.saveSubscription()
+	ub := e.subscribe(ramen.ID)
+
+	e.mustPost("/change-plan", `{"subscription_id":"sub-ramen","plan_id":"plan-b"}`, nil)
+	e.deliverEvents()
+	scheduleID := e.userSubscription().StripeScheduleID
+	// 予約済みのプラン変更は、同じScheduleの次のフェーズを置き換える
+	e.mustPost("/change-plan", `{"subscription_id":"sub-ramen","plan_id":"plan-c"}`, nil)
+	e.deliverEvents()
+	if got := e.userSubscription(); got.NextPlanID != "plan-c" || got.StripeScheduleID != scheduleID {
+		t.Errorf("NextPlanID = %s schedule %s, want plan-c on %s", got.NextPlanID, got.StripeScheduleID, scheduleID)
+	}
+	if n := e.countRequests(http.MethodPost, "/v1/subscription_schedules"); n != 3 {
+		t.Errorf("schedule requests = %d, want create + 2 updates", n)
+	}
+
+	if _, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	e.deliverEvents()
+	if got := e.userSubscription().PlanID; got != "plan-c" {
+		t.Errorf("PlanID after the renewal = %s, want plan-c", got)
+	}
+}
+
+func TestUpdateSubscription_SchedulesChange(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-b")
+
+	// 上位のプランへの変更でも、/update-subscription は請求期間の終了時に変更する
+	e.mustPost("/update-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-a"}`, nil)
+	e.deliverEvents()
+	if got := e.userSubscription(); got.PlanID != "plan-b" || got.NextPlanID != "plan-a" || got.StripeScheduleID == "" {
+		t.Fatalf("UserSubscription = plan %s next %s schedule %q, want plan-b next plan-a with a schedule", got.PlanID, got.NextPlanID, got.StripeScheduleID)
+	}
+	if _, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	e.deliverEvents()
+	if got := e.userSubscription().PlanID; got != "plan-a" {
+		t.Errorf("PlanID after the renewal = %s, want plan-a", got)
+	}
+}
+
+func TestUpdateSubscription_RejectsUnchangedPlan(t *testing.T) {
+	e := newTestEnv(t)
+	e.subscribe("plan-b")
+	e.mustPost("/update-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-a"}`, nil)
+	e.deliverEvents()
+	before := e.userSubscription()
+	posts := e.countRequests(http.MethodPost, "/v1/")
+
+	for _, planID := range []string{"plan-b", "plan-a"} {
+		code, body := e.post("/update-subscription", `{"subscription_id":"sub-ramen","plan_id":"`+planID+`"}`)
+		if code != http.StatusBadRequest || errorCode(t, body) != "validation_failed" {
+			t.Errorf("update to %s = %d %s, want 400 validation_failed", planID, code, body)
+		}
+	}
+	if n := e.countRequests(http.MethodPost, "/v1/"); n != posts {
+		t.Errorf("rejected updates called Stripe %d times", n-posts)
+	}
+	if got := e.userSubscription(); got.PlanID != "plan-b" || got.NextPlanID != "plan-a" || got.StripeScheduleID != before.StripeScheduleID {
+		t.Errorf("UserSubscription = plan %s next %s schedule %s, want it unchanged", got.PlanID, got.NextPlanID, got.StripeScheduleID)
+	}
+}
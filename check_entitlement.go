@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+	"github.com/ogiogi93/stripe-subscription-samples/entitlement"
+)
+
+type CheckEntitlementRequest struct {
+	BenefitID string `json:"benefit_id" validate:"required,document_id"`
+}
+
+type CheckEntitlementResponse struct {
+	BenefitID      string             `json:"benefit_id"`
+	Granted        bool               `json:"granted"`
+	Reason         entitlement.Reason `json:"reason"`
+	SubscriptionID string             `json:"subscription_id,omitempty"`
+	PlanID         string             `json:"plan_id,omitempty"`
+	ExpiresAt      *time.Time         `json:"expires_at,omitempty"`
+}
+
+// CheckEntitlementHandler 呼び出し元が指定した特典を現在利用できるかどうかを返す
+func CheckEntitlementHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, "checkEntitlementHandler", apperror.MethodNotAllowed(r.Method))
+		return
+	}
+	req := CheckEntitlementRequest{BenefitID: r.URL.Query().Get("benefit_id")}
+	if err := validateRequest(&req); err != nil {
+		writeError(w, "validateRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, "")
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+
+	var subs []entitlement.Subscription
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		subs = nil
+		ubs, err := tx.ListUserSubscriptionsByCustomer(customerID)
+		if err != nil {
+			return err
+		}
+		for _, ub := range ubs {
+			sub, err := tx.GetSubscription(ub.SubscriptionID)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			subs = append(subs, ub.Entitlement(sub))
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, "checkEntitlementHandler", err)
+		return
+	}
+
+	d := entitlementPolicy.Check(subs, req.BenefitID, time.Now())
+	res := CheckEntitlementResponse{
+		BenefitID:      req.BenefitID,
+		Granted:        d.Granted,
+		Reason:         d.Reason,
+		SubscriptionID: d.SubscriptionID,
+		PlanID:         d.PlanID,
+	}
+	if d.Granted {
+		res.ExpiresAt = &d.ExpiresAt
+	}
+	writeJSON(w, "checkEntitlementHandler", res)
+}
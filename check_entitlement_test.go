@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ogiogi93/stripe-subscription-samples/entitlement"
+)
+
+// checkEntitlement testCustomerIDがbenefitIDの特典を利用できるかどうかを取得する
+func (e *testEnv) checkEntitlement(benefitID string) CheckEntitlementResponse {
+	e.t.Helper()
+	code, body := e.get("/entitlement?benefit_id=" + benefitID)
+	if code != http.StatusOK {
+		e.t.Fatalf("GET /entitlement = %d %s", code, body)
+	}
+	var res CheckEntitlementResponse
+	decodeJSON(e.t, body, &res)
+	return res
+}
+
+func TestCheckEntitlement(t *testing.T) {
+	e := newTestEnv(t)
+	if res := e.checkEntitlement("b-ramen"); res.Granted || res.Reason != entitlement.ReasonNoSubscription {
+		t.Errorf("before subscribing = %+v, want no_subscription", res)
+	}
+
+	ub := e.subscribe("plan-a")
+	res := e.checkEntitlement("b-ramen")
+	if !res.Granted || res.Reason != entitlement.ReasonActive || res.PlanID != "plan-a" {
+		t.Errorf("b-ramen = %+v, want granted by plan-a", res)
+	}
+	if res.ExpiresAt == nil || !res.ExpiresAt.Equal(ub.CurrentPeriodEnd) {
+		t.Errorf("ExpiresAt = %v, want %v", res.ExpiresAt, ub.CurrentPeriodEnd)
+	}
+	// 契約中のプランに含まれない特典は利用できない
+	if res := e.checkEntitlement("b-topping"); res.Granted || res.Reason != entitlement.ReasonNotIncluded {
+		t.Errorf("b-topping = %+v, want benefit_not_included", res)
+	}
+
+	// 解約が確定した契約の特典は利用できない
+	e.mustPost("/cancel-subscription-immediately", `{"subscription_id":"sub-ramen"}`, nil)
+	e.deliverEvents()
+	if res := e.checkEntitlement("b-ramen"); res.Granted || res.Reason != entitlement.ReasonInactive {
+		t.Errorf("after canceling = %+v, want inactive", res)
+	}
+}
+
+func TestCheckEntitlement_InvalidRequest(t *testing.T) {
+	e := newTestEnv(t)
+	if code, body := e.get("/entitlement"); code != http.StatusBadRequest || errorCode(t, body) != "validation_failed" {
+		t.Errorf("without benefit_id = %d %s, want 400 validation_failed", code, body)
+	}
+	if code, _ := e.post("/entitlement", `{"benefit_id":"b-ramen"}`); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, want 405", code)
+	}
+}
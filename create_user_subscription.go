@@ -2,83 +2,153 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"log"
 	"net/http"
+	"time"
 
-	"cloud.google.com/go/firestore"
-	"github.com/google/uuid"
-	"github.com/stripe/stripe-go"
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+	"github.com/stripe/stripe-go/v72"
 )
 
 type CreateUserSubscriptionRequest struct {
-	CustomerID     string `json:"customer_id"`
-	SubscriptionID string `json:"subscription_id"`
-	PlanID         string `json:"plan_id"`
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+	PlanID         string `json:"plan_id" validate:"required,document_id"`
+	PromotionCode  string `json:"promotion_code,omitempty" validate:"promotion_code"`
 }
 
 type CreateUserSubscriptionResponse struct {
 	Status       stripe.PaymentIntentStatus `json:"status"`
 	ClientSecret string                     `json:"client_secret"`
+	// NextStep 支払いを完了するためにクライアントが次に行うこと
+	NextStep PaymentNextStep `json:"next_step"`
+	// SubscriptionStatus トライアル中は支払いが発生しないため、statusとclient_secretは空になり trialing を返す
+	SubscriptionStatus stripe.SubscriptionStatus `json:"subscription_status"`
+	TrialEnd           *time.Time                `json:"trial_end,omitempty"`
+	// Subtotal、DiscountAmount、AmountDue 最初の請求の割引前の金額、割引額、請求額
+	Subtotal       int64 `json:"subtotal"`
+	DiscountAmount int64 `json:"discount_amount"`
+	AmountDue      int64 `json:"amount_due"`
 }
 
 func CreateUserSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 
-	var req *CreateUserSubscriptionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("json.NewDecoder.Decode: %v", err)
+	var req CreateUserSubscriptionRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
 		return
 	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
 
-	idempotencyKey := uuid.New().String()
-	var intent *stripe.PaymentIntent
-	err := fsClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+	op := NewOutboxOperation(outboxOperationID(r), OutboxOperationCreateSubscription, time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
 		// DBからSubscriptionを取得する
-		sub, _ := GetSubscriptionTx(tx, req.SubscriptionID)
-		plan := sub.Plan(req.PlanID)
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		plan, err := getPlan(sub, req.PlanID)
+		if err != nil {
+			return err
+		}
 
-		// Stripe上にてSubscriptionを作成する https://stripe.com/docs/api/subscriptions/create
-		params := &stripe.SubscriptionParams{
-			Customer: stripe.String(req.CustomerID),
-			Items: []*stripe.SubscriptionItemsParams{
-				{
-					Price:    stripe.String(plan.StripePriceID), // ユーザーが選択したサブスクリプションプランのPriceIDをセットする
-					Quantity: stripe.Int64(1),                   // 数量、今回は1プランを契約する
-				},
-			},
-			CancelAtPeriodEnd: stripe.Bool(false),                                              // 自動更新有無、falseにすることで期限が切れたらStripe側で自動更新される
-			ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorNone)), // 日割り計算に関するパラメータ。今回は日割りなしを想定しているのでNoneを選択する https://stripe.com/docs/billing/subscriptions/prorations
-			PaymentBehavior:   stripe.String("allow_incomplete"),                               // 支払い処理に関するパラメータ。決済処理まで一気に処理をすすめる場合は allow_incompleteを選択する
+		// 既に契約中の場合は再登録(recreate-subscription)を利用する
+		switch ub, err := tx.GetUserSubscription(sub.UserSubscriptionID(req.CustomerID)); {
+		case err == ErrNotFound:
+		case err != nil:
+			return err
+		case ub.Status != stripe.SubscriptionStatusCanceled && ub.Status != stripe.SubscriptionStatusIncompleteExpired:
+			return apperror.Conflict("user subscription already exists")
 		}
-		params.AddMetadata("subscription_id", sub.ID)
-		params.AddMetadata("plan_id", plan.ID)
-		params.AddExpand("latest_invoice.payment_intent") // レスポンスとして最新のInvoiceに紐づくPaymentIntentを取得したいためAddExpandに指定しておく
-		params.SetIdempotencyKey(idempotencyKey)          // 冪等キー
 
-		s, err := client.Subscriptions.New(params)
-		err = handleStripeError(err) // 冪等チェックエラーだった場合は処理を続行する
-		if err != nil {
+		// Stripe上でのSubscriptionの作成はトランザクションの再実行で重複しないよう、Outboxに記録してトランザクションの外で実行する
+		op.UserSubscriptionID = sub.UserSubscriptionID(req.CustomerID)
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.PlanID = plan.ID
+		op.StripePriceID = plan.StripePriceID
+		if err := rejectPendingCreation(tx, op); err != nil {
 			return err
 		}
-		intent = s.LatestInvoice.PaymentIntent
-		ub := NewUserSubscription(sub.UserSubscriptionID(req.CustomerID), req.CustomerID, sub.ID, plan.ID, s)
-		ub, _ = CreateUserSubscriptionTx(tx, ub)
-		return nil
+		if err := applyTrial(tx, op, plan); err != nil {
+			return err
+		}
+		if req.PromotionCode != "" {
+			pc, err := findPromotionCode(req.PromotionCode, req.CustomerID, plan, time.Now())
+			if err != nil {
+				return err
+			}
+			op.PromotionCodeID = pc.ID
+		}
+		return saveOutboxOperation(tx, op)
 	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("createUserSubscriptionHandler: %v", err)
+		writeError(w, "createUserSubscriptionHandler", err)
 		return
 	}
-	res := CreateUserSubscriptionResponse{
-		Status:       intent.Status,
-		ClientSecret: intent.ClientSecret,
-	}
-	if err = json.NewEncoder(w).Encode(res); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("createUserSubscriptionHandler: %v", err)
+	s, err := dispatchOutboxOperation(ctx, op.ID)
+	if err != nil {
+		writeError(w, "createUserSubscriptionHandler", err)
 		return
 	}
+	res := CreateUserSubscriptionResponse{SubscriptionStatus: s.Status, NextStep: PaymentNextStepNone}
+	if s.LatestInvoice != nil && s.LatestInvoice.PaymentIntent != nil {
+		res.Status = s.LatestInvoice.PaymentIntent.Status
+		res.ClientSecret = s.LatestInvoice.PaymentIntent.ClientSecret
+		res.NextStep = paymentNextStep(s.LatestInvoice.PaymentIntent)
+	}
+	if s.TrialEnd > 0 {
+		trialEnd := time.Unix(s.TrialEnd, 0)
+		res.TrialEnd = &trialEnd
+	}
+	if inv := s.LatestInvoice; inv != nil {
+		res.Subtotal = inv.Subtotal
+		res.DiscountAmount = invoiceDiscountAmount(inv)
+		res.AmountDue = inv.AmountDue
+	}
+	writeJSON(w, "createUserSubscriptionHandler", res)
+}
+
+// applyTrial プランにトライアルが設定されており、CustomerがこのSubscriptionのトライアルをまだ利用していない場合、opにトライアル日数を設定する
+// Stripe上でのSubscriptionの作成に失敗した場合にトライアルを失わないよう、利用の記録は作成の成功後に recordTrialUsage で行う
+func applyTrial(tx SubscriptionTx, op *OutboxOperation, plan *Plan) error {
+	if plan.TrialDays <= 0 {
+		return nil
+	}
+	switch _, err := tx.GetTrialUsage(op.UserSubscriptionID); {
+	case err == nil:
+		// 既にトライアルを利用済み
+		return nil
+	case err != ErrNotFound:
+		return err
+	}
+	op.TrialDays = plan.TrialDays
+	return nil
+}
+
+// recordTrialUsage トライアル付きのSubscriptionを作成した操作について、トライアルの利用を記録する
+func recordTrialUsage(tx SubscriptionTx, op *OutboxOperation, now time.Time) error {
+	if op.TrialDays <= 0 {
+		return nil
+	}
+	switch _, err := tx.GetTrialUsage(op.UserSubscriptionID); {
+	case err == nil:
+		// 同時に申し込んだ別の操作で記録済み
+		return nil
+	case err != ErrNotFound:
+		return err
+	}
+	return tx.CreateTrialUsage(&TrialUsage{
+		ID:             op.UserSubscriptionID,
+		CustomerID:     op.CustomerID,
+		SubscriptionID: op.SubscriptionID,
+		PlanID:         op.PlanID,
+		TrialDays:      op.TrialDays,
+		UsedAt:         now,
+	})
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/entitlement"
+)
+
+// setTrialDays plan-aにトライアル日数を設定する
+func (e *testEnv) setTrialDays(days int64) {
+	e.t.Helper()
+	e.sub.Plan("plan-a").TrialDays = days
+	e.saveSubscription()
+}
+
+// trialUsage testCustomerIDのトライアルの利用記録を取得する。記録がない場合はnilを返す
+func (e *testEnv) trialUsage() *TrialUsage {
+	e.t.Helper()
+	var usage *TrialUsage
+	mustRunInTx(e.t, repo, func(tx SubscriptionTx) error {
+		var err error
+		usage, err = tx.GetTrialUsage(e.sub.UserSubscriptionID(testCustomerID))
+		if err == ErrNotFound {
+			usage, err = nil, nil
+		}
+		return err
+	})
+	return usage
+}
+
+func TestCreateSubscription_Trial(t *testing.T) {
+	e := newTestEnv(t)
+	e.setTrialDays(14)
+	now := time.Now().Truncate(time.Second)
+	e.fake.SetNow(func() time.Time { return now })
+
+	var res CreateUserSubscriptionResponse
+	e.mustPost("/create-subscription", createPlanA, &res)
+	wantTrialEnd := now.AddDate(0, 0, 14)
+	if res.SubscriptionStatus != stripe.SubscriptionStatusTrialing || res.TrialEnd == nil || !res.TrialEnd.Equal(wantTrialEnd) {
+		t.Errorf("response = %+v, want trialing until %v", res, wantTrialEnd)
+	}
+	// トライアル期間中は支払いが発生しない
+	if res.AmountDue != 0 || res.ClientSecret != "" || res.NextStep != PaymentNextStepNone {
+		t.Errorf("response = %+v, want no payment", res)
+	}
+	if usage := e.trialUsage(); usage == nil || usage.TrialDays != 14 || usage.PlanID != "plan-a" {
+		t.Errorf("TrialUsage = %+v, want 14 days of plan-a", usage)
+	}
+
+	e.deliverEvents()
+	ub := e.userSubscription()
+	if ub.Status != stripe.SubscriptionStatusTrialing || !ub.TrialEnd.Equal(wantTrialEnd) {
+		t.Errorf("UserSubscription = %s until %v, want trialing until %v", ub.Status, ub.TrialEnd, wantTrialEnd)
+	}
+	if res := e.checkEntitlement("b-ramen"); !res.Granted || res.Reason != entitlement.ReasonTrialing {
+		t.Errorf("entitlement = %+v, want granted while trialing", res)
+	}
+
+	// トライアル終了の事前通知を記録する
+	if err := e.fake.TrialWillEnd(ub.StripeSubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	e.deliverEvents()
+	if got := e.userSubscription().TrialWillEndNotifiedAt; !got.Equal(now) {
+		t.Errorf("TrialWillEndNotifiedAt = %v, want %v", got, now)
+	}
+}
+
+func TestCreateSubscription_TrialOnlyOnce(t *testing.T) {
+	e := newTestEnv(t)
+	e.setTrialDays(14)
+	e.subscribe("plan-a")
+	e.mustPost("/cancel-subscription-immediately", `{"subscription_id":"sub-ramen"}`, nil)
+	e.deliverEvents()
+
+	// 同じSubscriptionのトライアルは解約後に再契約しても利用できない
+	var res CreateUserSubscriptionResponse
+	e.mustPost("/create-subscription", createPlanA, &res)
+	if res.SubscriptionStatus != stripe.SubscriptionStatusActive || res.TrialEnd != nil || res.AmountDue != 3000 {
+		t.Errorf("response = %+v, want active without a trial", res)
+	}
+}
+
+func TestCreateSubscription_TrialIsNotUsedOnFailure(t *testing.T) {
+	e := newTestEnv(t)
+	e.setTrialDays(14)
+	e.fake.FailNextRequests(1)
+
+	if code, body := e.post("/create-subscription", createPlanA); code != http.StatusServiceUnavailable {
+		t.Fatalf("create = %d %s, want 503", code, body)
+	}
+	// Stripe上でのSubscriptionの作成に失敗した場合は、トライアルを利用したものとして記録しない
+	if usage := e.trialUsage(); usage != nil {
+		t.Fatalf("TrialUsage = %+v, want nil", usage)
+	}
+
+	if err := dispatchPendingOutboxOperations(context.Background(), time.Now().Add(outboxRetryDelay)); err != nil {
+		t.Fatal(err)
+	}
+	if usage := e.trialUsage(); usage == nil {
+		t.Error("TrialUsage is not recorded after the retry")
+	}
+	if s := e.stripeSubscription(); s.Status != stripe.SubscriptionStatusTrialing {
+		t.Errorf("stripe status = %s, want trialing", s.Status)
+	}
+}
@@ -0,0 +1,171 @@
+// Package entitlement ユーザーの契約状態から、特典(Benefit)を利用できるかどうかを判定する
+//
+// 判定はFirestoreやStripeに依存しないため、契約状態を取得できる他のサービスからも利用できる。
+//
+//	policy := entitlement.DefaultPolicy()
+//	d := policy.Check(subs, "benefit-id", time.Now())
+//	if d.Granted { ... }
+package entitlement
+
+import (
+	"time"
+)
+
+// Status Stripe Subscriptionのステータス https://stripe.com/docs/billing/subscriptions/overview#subscription-statuses
+type Status string
+
+const (
+	StatusActive            Status = "active"
+	StatusTrialing          Status = "trialing"
+	StatusPastDue           Status = "past_due"
+	StatusUnpaid            Status = "unpaid"
+	StatusCanceled          Status = "canceled"
+	StatusIncomplete        Status = "incomplete"
+	StatusIncompleteExpired Status = "incomplete_expired"
+)
+
+// Reason 判定の理由
+type Reason string
+
+const (
+	ReasonActive         Reason = "active"
+	ReasonTrialing       Reason = "trialing"
+	ReasonPastDueGrace   Reason = "past_due_grace_period"
+	ReasonRenewalPending Reason = "renewal_pending"
+	ReasonNotIncluded    Reason = "benefit_not_included"
+	ReasonPastDue        Reason = "past_due"
+	ReasonExpired        Reason = "expired"
+	ReasonInactive       Reason = "inactive"
+	ReasonPaused         Reason = "paused"
+	ReasonNoSubscription Reason = "no_subscription"
+)
+
+// Subscription 判定に利用するユーザーの契約状態
+type Subscription struct {
+	SubscriptionID     string
+	PlanID             string
+	Status             Status
+	CurrentPeriodStart time.Time
+	CurrentPeriodEnd   time.Time
+	CancelAtPeriodEnd  bool
+	// PausedAt、ResumesAt 請求を一時停止した日時と再開予定の日時。一時停止していない場合はゼロ値
+	PausedAt  time.Time
+	ResumesAt time.Time
+	// BenefitIDs 契約中のプランに含まれる特典
+	BenefitIDs []string
+}
+
+// paused nowの時点で請求を一時停止しているかどうか。再開予定の日時を過ぎている場合は再開したものとして扱う
+func (s Subscription) paused(now time.Time) bool {
+	return !s.PausedAt.IsZero() && (s.ResumesAt.IsZero() || now.Before(s.ResumesAt))
+}
+
+// Policy 判定のルール
+type Policy struct {
+	// PastDueGrace 更新時の支払いに失敗(past_due)してから、特典の利用を継続できる期間
+	PastDueGrace time.Duration
+	// RenewalLeeway 請求期間の終了後、自動更新の結果が反映されるまで特典の利用を継続できる期間
+	RenewalLeeway time.Duration
+	// GrantTrialing トライアル期間中に特典を利用できるかどうか
+	GrantTrialing bool
+}
+
+// DefaultPolicy 支払いの失敗から3日間、自動更新の反映待ちは1時間まで特典の利用を継続する
+func DefaultPolicy() Policy {
+	return Policy{
+		PastDueGrace:  3 * 24 * time.Hour,
+		RenewalLeeway: time.Hour,
+		GrantTrialing: true,
+	}
+}
+
+// Decision 判定結果
+type Decision struct {
+	Granted bool
+	Reason  Reason
+	// SubscriptionID、PlanID 判定に利用した契約
+	SubscriptionID string
+	PlanID         string
+	// ExpiresAt 特典を利用できる期限。Grantedがfalseの場合はゼロ値
+	ExpiresAt time.Time
+}
+
+// Check 契約中のいずれかのプランでbenefitIDの特典を利用できるかどうかを判定する
+// 複数の契約で利用できる場合は期限が最も遅いものを返す
+func (p Policy) Check(subs []Subscription, benefitID string, now time.Time) Decision {
+	best := Decision{Reason: ReasonNoSubscription}
+	for _, sub := range subs {
+		if !sub.includes(benefitID) {
+			if best.Reason == ReasonNoSubscription {
+				best = Decision{Reason: ReasonNotIncluded, SubscriptionID: sub.SubscriptionID, PlanID: sub.PlanID}
+			}
+			continue
+		}
+		d := p.evaluate(sub, now)
+		switch {
+		case d.Granted && (!best.Granted || d.ExpiresAt.After(best.ExpiresAt)):
+			best = d
+		case !d.Granted && !best.Granted:
+			// 特典を含む契約がある場合は、含まない理由より利用できない理由を優先して返す
+			best = d
+		}
+	}
+	return best
+}
+
+func (p Policy) evaluate(sub Subscription, now time.Time) Decision {
+	d := Decision{SubscriptionID: sub.SubscriptionID, PlanID: sub.PlanID}
+	grant := func(reason Reason, until time.Time) Decision {
+		if now.Before(until) {
+			d.Granted, d.Reason, d.ExpiresAt = true, reason, until
+		} else {
+			d.Reason = ReasonExpired
+		}
+		return d
+	}
+
+	// 請求を一時停止している間は、一時停止した時点から特典を利用できない
+	if sub.paused(now) && !now.Before(sub.PausedAt) {
+		d.Reason = ReasonPaused
+		return d
+	}
+
+	switch sub.Status {
+	case StatusActive, StatusTrialing:
+		reason := ReasonActive
+		if sub.Status == StatusTrialing {
+			if !p.GrantTrialing {
+				d.Reason = ReasonInactive
+				return d
+			}
+			reason = ReasonTrialing
+		}
+		if now.Before(sub.CurrentPeriodEnd) || sub.CancelAtPeriodEnd {
+			return grant(reason, sub.CurrentPeriodEnd)
+		}
+		// 請求期間は終了したが、自動更新の結果がまだ反映されていない
+		return grant(ReasonRenewalPending, sub.CurrentPeriodEnd.Add(p.RenewalLeeway))
+	case StatusPastDue:
+		if p.PastDueGrace <= 0 {
+			d.Reason = ReasonPastDue
+			return d
+		}
+		// past_dueになった時点で請求期間は更新されているため、新しい請求期間の開始から猶予期間を数える
+		d = grant(ReasonPastDueGrace, sub.CurrentPeriodStart.Add(p.PastDueGrace))
+		if !d.Granted {
+			d.Reason = ReasonPastDue
+		}
+		return d
+	}
+	d.Reason = ReasonInactive
+	return d
+}
+
+func (s Subscription) includes(benefitID string) bool {
+	for _, id := range s.BenefitIDs {
+		if id == benefitID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package entitlement
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicy_Check(t *testing.T) {
+	start := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 30)
+	active := Subscription{
+		SubscriptionID:     "sub-ramen",
+		PlanID:             "plan-a",
+		Status:             StatusActive,
+		CurrentPeriodStart: start,
+		CurrentPeriodEnd:   end,
+		BenefitIDs:         []string{"b-ramen"},
+	}
+	with := func(f func(s *Subscription)) Subscription {
+		s := active
+		f(&s)
+		return s
+	}
+
+	tests := []struct {
+		name      string
+		sub       Subscription
+		now       time.Time
+		policy    func(p *Policy)
+		granted   bool
+		reason    Reason
+		expiresAt time.Time
+	}{
+		{name: "active", sub: active, now: start.Add(time.Hour), granted: true, reason: ReasonActive, expiresAt: end},
+		{name: "trialing", sub: with(func(s *Subscription) { s.Status = StatusTrialing }), now: start, granted: true, reason: ReasonTrialing, expiresAt: end},
+		{name: "trialing not granted", sub: with(func(s *Subscription) { s.Status = StatusTrialing }), now: start, policy: func(p *Policy) { p.GrantTrialing = false }, reason: ReasonInactive},
+		// 自動更新の結果が反映されるまでの間は、RenewalLeewayの間だけ利用できる
+		{name: "renewal pending", sub: active, now: end.Add(30 * time.Minute), granted: true, reason: ReasonRenewalPending, expiresAt: end.Add(time.Hour)},
+		{name: "renewal not reflected", sub: active, now: end.Add(time.Hour), reason: ReasonExpired},
+		{name: "cancel at period end", sub: with(func(s *Subscription) { s.CancelAtPeriodEnd = true }), now: end.Add(-time.Minute), granted: true, reason: ReasonActive, expiresAt: end},
+		{name: "canceled period ended", sub: with(func(s *Subscription) { s.CancelAtPeriodEnd = true }), now: end, reason: ReasonExpired},
+		{name: "past due grace", sub: with(func(s *Subscription) { s.Status = StatusPastDue }), now: start.Add(24 * time.Hour), granted: true, reason: ReasonPastDueGrace, expiresAt: start.Add(3 * 24 * time.Hour)},
+		{name: "past due after grace", sub: with(func(s *Subscription) { s.Status = StatusPastDue }), now: start.Add(3 * 24 * time.Hour), reason: ReasonPastDue},
+		{name: "past due without grace", sub: with(func(s *Subscription) { s.Status = StatusPastDue }), now: start, policy: func(p *Policy) { p.PastDueGrace = 0 }, reason: ReasonPastDue},
+		{name: "unpaid", sub: with(func(s *Subscription) { s.Status = StatusUnpaid }), now: start, reason: ReasonInactive},
+		{name: "incomplete", sub: with(func(s *Subscription) { s.Status = StatusIncomplete }), now: start, reason: ReasonInactive},
+		{name: "canceled", sub: with(func(s *Subscription) { s.Status = StatusCanceled }), now: start, reason: ReasonInactive},
+		{name: "not included", sub: with(func(s *Subscription) { s.BenefitIDs = []string{"b-topping"} }), now: start, reason: ReasonNotIncluded},
+		// 一時停止した時点から再開するまでは利用できない
+		{name: "paused", sub: with(func(s *Subscription) { s.PausedAt = start.Add(time.Hour) }), now: start.Add(2 * time.Hour), reason: ReasonPaused},
+		{name: "paused until", sub: with(func(s *Subscription) { s.PausedAt, s.ResumesAt = start.Add(time.Hour), start.Add(48*time.Hour) }), now: start.Add(47 * time.Hour), reason: ReasonPaused},
+		{name: "resumed", sub: with(func(s *Subscription) { s.PausedAt, s.ResumesAt = start.Add(time.Hour), start.Add(48*time.Hour) }), now: start.Add(48 * time.Hour), granted: true, reason: ReasonActive, expiresAt: end},
+		{name: "before paused", sub: with(func(s *Subscription) { s.PausedAt = start.Add(time.Hour) }), now: start, granted: true, reason: ReasonActive, expiresAt: end},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := DefaultPolicy()
+			if tt.policy != nil {
+				tt.policy(&p)
+			}
+			d := p.Check([]Subscription{tt.sub}, "b-ramen", tt.now)
+			if d.Granted != tt.granted || d.Reason != tt.reason || !d.ExpiresAt.Equal(tt.expiresAt) {
+				t.Errorf("Check() = %+v, want granted=%v reason=%s expires_at=%v", d, tt.granted, tt.reason, tt.expiresAt)
+			}
+			if d.SubscriptionID != "sub-ramen" || d.PlanID != "plan-a" {
+				t.Errorf("Check() = %+v, want sub-ramen plan-a", d)
+			}
+		})
+	}
+}
+
+func TestPolicy_Check_MultipleSubscriptions(t *testing.T) {
+	now := time.Date(2022, 4, 10, 0, 0, 0, 0, time.UTC)
+	sub := func(id string, status Status, end time.Time, benefitIDs ...string) Subscription {
+		return Subscription{
+			SubscriptionID:     id,
+			PlanID:             "plan-" + id,
+			Status:             status,
+			CurrentPeriodStart: end.AddDate(0, 0, -30),
+			CurrentPeriodEnd:   end,
+			BenefitIDs:         benefitIDs,
+		}
+	}
+	p := DefaultPolicy()
+
+	tests := []struct {
+		name    string
+		subs    []Subscription
+		granted bool
+		subID   string
+		reason  Reason
+	}{
+		{name: "no subscription", reason: ReasonNoSubscription},
+		{name: "not included", subs: []Subscription{sub("a", StatusActive, now.AddDate(0, 0, 1), "b-topping")}, subID: "a", reason: ReasonNotIncluded},
+		// 特典を含む契約がある場合は、その契約で利用できない理由を返す
+		{name: "included but inactive", subs: []Subscription{sub("a", StatusActive, now.AddDate(0, 0, 1), "b-topping"), sub("b", StatusCanceled, now.AddDate(0, 0, 1), "b-ramen")}, subID: "b", reason: ReasonInactive},
+		{name: "one granted", subs: []Subscription{sub("a", StatusCanceled, now.AddDate(0, 0, 20), "b-ramen"), sub("b", StatusActive, now.AddDate(0, 0, 1), "b-ramen")}, granted: true, subID: "b", reason: ReasonActive},
+		// 複数の契約で利用できる場合は、期限が最も遅い契約を返す
+		{name: "latest expiry", subs: []Subscription{sub("a", StatusActive, now.AddDate(0, 0, 1), "b-ramen"), sub("b", StatusActive, now.AddDate(0, 0, 20), "b-ramen"), sub("c", StatusActive, now.AddDate(0, 0, 5), "b-ramen")}, granted: true, subID: "b", reason: ReasonActive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := p.Check(tt.subs, "b-ramen", now)
+			if d.Granted != tt.granted || d.SubscriptionID != tt.subID || d.Reason != tt.reason {
+				t.Errorf("Check() = %+v, want granted=%v subscription=%q reason=%s", d, tt.granted, tt.subID, tt.reason)
+			}
+		})
+	}
+}
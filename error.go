@@ -1,17 +1,79 @@
 package main
 
 import (
-	"github.com/stripe/stripe-go"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
 )
 
+// handleStripeError Stripe APIのエラーをドメインエラーに変換する
 func handleStripeError(err error) error {
-	if err != nil {
+	if err == nil {
 		return nil
 	}
-	if stripeErr, ok := err.(*stripe.Error); ok {
-		if stripeErr.Code == stripe.ErrorCodeIdempotencyKeyInUse {
-			return nil
+	if _, ok := err.(*apperror.Error); ok {
+		return err
+	}
+	stripeErr, ok := err.(*stripe.Error)
+	if !ok {
+		if isRetryableStripeError(err) {
+			// ネットワークエラー等
+			return apperror.UpstreamUnavailable(err)
 		}
+		return apperror.Internal(err)
+	}
+	switch {
+	case stripeErr.Type == stripe.ErrorTypeCard:
+		return apperror.CardError(stripeErr.Msg, string(stripeErr.DeclineCode), err)
+	case stripeErr.HTTPStatusCode == http.StatusPaymentRequired:
+		return apperror.PaymentRequired(stripeErr.Msg, err)
+	case stripeErr.HTTPStatusCode == http.StatusNotFound:
+		return &apperror.Error{Code: apperror.CodeNotFound, Message: stripeErr.Msg, Err: err}
+	case isRetryableStripeError(err):
+		return apperror.UpstreamUnavailable(err)
+	case stripeErr.Type == stripe.ErrorTypeInvalidRequest:
+		return apperror.InvalidRequest(stripeErr.Msg, err)
+	}
+	return apperror.Internal(err)
+}
+
+// isRetryableStripeError 同じ冪等キーで再実行することで成功する可能性があるエラーかどうか
+// Stripeのエラーとネットワークエラー以外(本サービス内の不整合等)は再実行しても成功しないため、再実行しない
+func isRetryableStripeError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		// タイムアウトや接続エラー等
+		return true
+	}
+	stripeErr, ok := err.(*stripe.Error)
+	if !ok {
+		return false
+	}
+	if stripeErr.Code == stripe.ErrorCodeIdempotencyKeyInUse {
+		// 同じ冪等キーのリクエストが処理中
+		return true
+	}
+	return stripeErr.HTTPStatusCode == http.StatusConflict ||
+		stripeErr.HTTPStatusCode == http.StatusTooManyRequests ||
+		stripeErr.HTTPStatusCode >= http.StatusInternalServerError
+}
+
+// writeError エラーをログに出力し、JSONのエラーレスポンスを返す
+func writeError(w http.ResponseWriter, name string, err error) {
+	log.Printf("%s: %v", name, err)
+	apperror.Write(w, err)
+}
+
+// writeJSON レスポンスをJSONで書き込む
+func writeJSON(w http.ResponseWriter, name string, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("%s: %v", name, err)
 	}
-	return err
 }
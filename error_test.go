@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// declinedGateway Subscriptionの作成時にカードが拒否されるBillingGateway
+type declinedGateway struct {
+	BillingGateway
+}
+
+func (declinedGateway) NewSubscription(*stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return nil, &stripe.Error{
+		HTTPStatusCode: http.StatusPaymentRequired,
+		Type:           stripe.ErrorTypeCard,
+		Code:           stripe.ErrorCodeCardDeclined,
+		DeclineCode:    stripe.DeclineCodeInsufficientFunds,
+		Msg:            "Your card has insufficient funds.",
+	}
+}
+
+func TestHandleStripeError_CardDeclined(t *testing.T) {
+	e := newTestEnv(t)
+	billing = declinedGateway{billing}
+
+	code, body := e.post("/create-subscription", createPlanA)
+	if code != http.StatusPaymentRequired || errorCode(t, body) != "card_error" {
+		t.Fatalf("create = %d %s, want 402 card_error", code, body)
+	}
+	var res struct {
+		Error struct {
+			DeclineCode string `json:"decline_code"`
+		} `json:"error"`
+	}
+	decodeJSON(t, body, &res)
+	if res.Error.DeclineCode != string(stripe.DeclineCodeInsufficientFunds) {
+		t.Errorf("decline_code = %q, want insufficient_funds", res.Error.DeclineCode)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/stripe/stripe-go/v72"
+	stripeClient "github.com/stripe/stripe-go/v72/client"
+)
+
+// BillingGateway サービスが利用するStripeの操作
+type BillingGateway interface {
+	NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	CancelSubscription(id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error)
+
+	NewSubscriptionSchedule(params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error)
+	GetSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error)
+	UpdateSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error)
+	ReleaseSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleReleaseParams) (*stripe.SubscriptionSchedule, error)
+
+	GetPrice(id string, params *stripe.PriceParams) (*stripe.Price, error)
+
+	ListInvoices(params *stripe.InvoiceListParams) ([]*stripe.Invoice, error)
+	// UpcomingInvoice 次回の請求、またはSubscriptionを変更した場合の請求をプレビューする
+	UpcomingInvoice(params *stripe.InvoiceParams) (*stripe.Invoice, error)
+
+	ListPromotionCodes(params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error)
+
+	NewRefund(params *stripe.RefundParams) (*stripe.Refund, error)
+}
+
+// StripeGateway stripe-goのクライアントを利用する BillingGateway
+type StripeGateway struct {
+	api *stripeClient.API
+}
+
+func NewStripeGateway(api *stripeClient.API) *StripeGateway {
+	return &StripeGateway{api: api}
+}
+
+func (g *StripeGateway) NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return g.api.Subscriptions.New(params)
+}
+
+func (g *StripeGateway) GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return g.api.Subscriptions.Get(id, params)
+}
+
+func (g *StripeGateway) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return g.api.Subscriptions.Update(id, params)
+}
+
+func (g *StripeGateway) CancelSubscription(id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error) {
+	return g.api.Subscriptions.Cancel(id, params)
+}
+
+func (g *StripeGateway) NewSubscriptionSchedule(params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error) {
+	return g.api.SubscriptionSchedules.New(params)
+}
+
+func (g *StripeGateway) GetSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error) {
+	return g.api.SubscriptionSchedules.Get(id, params)
+}
+
+func (g *StripeGateway) UpdateSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error) {
+	return g.api.SubscriptionSchedules.Update(id, params)
+}
+
+func (g *StripeGateway) ReleaseSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleReleaseParams) (*stripe.SubscriptionSchedule, error) {
+	return g.api.SubscriptionSchedules.Release(id, params)
+}
+
+func (g *StripeGateway) GetPrice(id string, params *stripe.PriceParams) (*stripe.Price, error) {
+	return g.api.Prices.Get(id, params)
+}
+
+// ListInvoices paramsに一致するInvoiceを取得する。params.Singleを指定しない場合は全てのページを取得する
+func (g *StripeGateway) ListInvoices(params *stripe.InvoiceListParams) ([]*stripe.Invoice, error) {
+	var invoices []*stripe.Invoice
+	i := g.api.Invoices.List(params)
+	for i.Next() {
+		invoices = append(invoices, i.Invoice())
+	}
+	return invoices, i.Err()
+}
+
+func (g *StripeGateway) UpcomingInvoice(params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	return g.api.Invoices.GetNext(params)
+}
+
+func (g *StripeGateway) ListPromotionCodes(params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error) {
+	var codes []*stripe.PromotionCode
+	i := g.api.PromotionCodes.List(params)
+	for i.Next() {
+		codes = append(codes, i.PromotionCode())
+	}
+	return codes, i.Err()
+}
+
+func (g *StripeGateway) NewRefund(params *stripe.RefundParams) (*stripe.Refund, error) {
+	return g.api.Refunds.New(params)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+type GetUserSubscriptionRequest struct {
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+}
+
+type BenefitResponse struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+type PlanResponse struct {
+	ID       string             `json:"id"`
+	Title    string             `json:"title"`
+	Price    int32              `json:"price"`
+	Benefits []*BenefitResponse `json:"benefits"`
+}
+
+// UserSubscriptionResponse UserSubscriptionに契約中のSubscription、プラン、特典の情報を結合したもの
+type UserSubscriptionResponse struct {
+	ID                 string                    `json:"id"`
+	SubscriptionID     string                    `json:"subscription_id"`
+	SubscriptionTitle  string                    `json:"subscription_title"`
+	Status             stripe.SubscriptionStatus `json:"status"`
+	Plan               *PlanResponse             `json:"plan"`
+	NextPlan           *PlanResponse             `json:"next_plan,omitempty"`
+	Benefits           []*BenefitResponse        `json:"benefits"`
+	StartedAt          time.Time                 `json:"started_at"`
+	CurrentPeriodStart time.Time                 `json:"current_period_start"`
+	CurrentPeriodEnd   time.Time                 `json:"current_period_end"`
+	CancelAtPeriodEnd  bool                      `json:"cancel_at_period_end"`
+	CanceledAt         *time.Time                `json:"canceled_at,omitempty"`
+	CancellationMode   CancellationMode          `json:"cancellation_mode,omitempty"`
+	CancellationReason CancellationReason        `json:"cancellation_reason,omitempty"`
+	Pause              *PauseResponse            `json:"pause,omitempty"`
+	TrialStart         *time.Time                `json:"trial_start,omitempty"`
+	TrialEnd           *time.Time                `json:"trial_end,omitempty"`
+	Discount           *DiscountResponse         `json:"discount,omitempty"`
+	// PaymentActionRequiredAt 更新時の支払いで3Dセキュア認証が必要になった日時。/payment-action で認証に必要なclient_secretを取得する
+	PaymentActionRequiredAt *time.Time `json:"payment_action_required_at,omitempty"`
+}
+
+// PauseResponse 請求の一時停止の状態
+type PauseResponse struct {
+	Behavior  stripe.SubscriptionPauseCollectionBehavior `json:"behavior"`
+	PausedAt  time.Time                                  `json:"paused_at"`
+	ResumesAt *time.Time                                 `json:"resumes_at,omitempty"`
+}
+
+// DiscountResponse 適用中の割引
+type DiscountResponse struct {
+	Code       string                `json:"code,omitempty"`
+	Name       string                `json:"name,omitempty"`
+	PercentOff float64               `json:"percent_off,omitempty"`
+	AmountOff  int64                 `json:"amount_off,omitempty"`
+	Currency   stripe.Currency       `json:"currency,omitempty"`
+	Duration   stripe.CouponDuration `json:"duration"`
+	End        *time.Time            `json:"end,omitempty"`
+}
+
+type ListUserSubscriptionsResponse struct {
+	UserSubscriptions []*UserSubscriptionResponse `json:"user_subscriptions"`
+}
+
+// GetUserSubscriptionHandler 呼び出し元が指定したSubscriptionで契約しているプランの状態を返す
+func GetUserSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, "getUserSubscriptionHandler", apperror.MethodNotAllowed(r.Method))
+		return
+	}
+	req := GetUserSubscriptionRequest{SubscriptionID: r.URL.Query().Get("subscription_id")}
+	if err := validateRequest(&req); err != nil {
+		writeError(w, "validateRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, "")
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+
+	var res *UserSubscriptionResponse
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		ub, err := getUserSubscription(tx, sub, customerID)
+		if err != nil {
+			return err
+		}
+		res = newUserSubscriptionResponse(sub, ub)
+		return nil
+	})
+	if err != nil {
+		writeError(w, "getUserSubscriptionHandler", err)
+		return
+	}
+	writeJSON(w, "getUserSubscriptionHandler", res)
+}
+
+// ListUserSubscriptionsHandler 呼び出し元が契約している全てのSubscriptionのプランの状態を返す
+func ListUserSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, "listUserSubscriptionsHandler", apperror.MethodNotAllowed(r.Method))
+		return
+	}
+	customerID, err := callerCustomerID(r, "")
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+
+	res := ListUserSubscriptionsResponse{UserSubscriptions: []*UserSubscriptionResponse{}}
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		res.UserSubscriptions = res.UserSubscriptions[:0]
+		ubs, err := tx.ListUserSubscriptionsByCustomer(customerID)
+		if err != nil {
+			return err
+		}
+		subs := map[string]*Subscription{}
+		for _, ub := range ubs {
+			sub, ok := subs[ub.SubscriptionID]
+			if !ok {
+				sub, err = tx.GetSubscription(ub.SubscriptionID)
+				if err != nil && err != ErrNotFound {
+					return err
+				}
+				if err == ErrNotFound {
+					// 削除済みのSubscriptionの場合はプランの情報を含めずに返す
+					sub = &Subscription{ID: ub.SubscriptionID}
+				}
+				subs[ub.SubscriptionID] = sub
+			}
+			res.UserSubscriptions = append(res.UserSubscriptions, newUserSubscriptionResponse(sub, ub))
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, "listUserSubscriptionsHandler", err)
+		return
+	}
+	sort.Slice(res.UserSubscriptions, func(i, j int) bool {
+		return res.UserSubscriptions[i].SubscriptionID < res.UserSubscriptions[j].SubscriptionID
+	})
+	writeJSON(w, "listUserSubscriptionsHandler", res)
+}
+
+func newUserSubscriptionResponse(sub *Subscription, ub *UserSubscription) *UserSubscriptionResponse {
+	res := &UserSubscriptionResponse{
+		ID:                 ub.ID,
+		SubscriptionID:     ub.SubscriptionID,
+		SubscriptionTitle:  sub.Title,
+		Status:             ub.Status,
+		Plan:               newPlanResponse(sub.Plan(ub.PlanID)),
+		Benefits:           []*BenefitResponse{},
+		StartedAt:          ub.StartedAt,
+		CurrentPeriodStart: ub.CurrentPeriodStart,
+		CurrentPeriodEnd:   ub.CurrentPeriodEnd,
+		CancelAtPeriodEnd:  ub.CancelAtPeriodEnd,
+		CancellationMode:   ub.CancellationMode,
+		CancellationReason: ub.CancellationReason,
+	}
+	if ub.NextPlanID != "" {
+		res.NextPlan = newPlanResponse(sub.Plan(ub.NextPlanID))
+	}
+	if res.Plan != nil {
+		res.Benefits = res.Plan.Benefits
+	}
+	if !ub.CanceledAt.IsZero() {
+		canceledAt := ub.CanceledAt
+		res.CanceledAt = &canceledAt
+	}
+	if ub.Paused() {
+		res.Pause = &PauseResponse{Behavior: ub.PauseBehavior, PausedAt: ub.PausedAt}
+		if !ub.ResumesAt.IsZero() {
+			resumesAt := ub.ResumesAt
+			res.Pause.ResumesAt = &resumesAt
+		}
+	}
+	if !ub.PaymentActionRequiredAt.IsZero() {
+		requiredAt := ub.PaymentActionRequiredAt
+		res.PaymentActionRequiredAt = &requiredAt
+	}
+	if !ub.TrialEnd.IsZero() {
+		trialStart, trialEnd := ub.TrialStart, ub.TrialEnd
+		res.TrialStart = &trialStart
+		res.TrialEnd = &trialEnd
+	}
+	if d := ub.Discount; d != nil {
+		res.Discount = &DiscountResponse{
+			Code:       d.Code,
+			Name:       d.CouponName,
+			PercentOff: d.PercentOff,
+			AmountOff:  d.AmountOff,
+			Currency:   d.Currency,
+			Duration:   d.Duration,
+		}
+		if !d.End.IsZero() {
+			end := d.End
+			res.Discount.End = &end
+		}
+	}
+	return res
+}
+
+func newPlanResponse(plan *Plan) *PlanResponse {
+	if plan == nil {
+		return nil
+	}
+	res := &PlanResponse{
+		ID:       plan.ID,
+		Title:    plan.Title,
+		Price:    plan.Price,
+		Benefits: make([]*BenefitResponse, 0, len(plan.Benefits)),
+	}
+	for _, b := range plan.Benefits {
+		res.Benefits = append(res.Benefits, &BenefitResponse{ID: b.ID, Title: b.Title})
+	}
+	return res
+}
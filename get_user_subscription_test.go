@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/auth"
+)
+
+// listUserSubscriptions header(名前と値を交互に指定)を付けて /user-subscriptions を呼び出す
+func (e *testEnv) listUserSubscriptions(header ...string) []*UserSubscriptionResponse {
+	e.t.Helper()
+	w := e.serve(http.MethodGet, "/user-subscriptions", "", header...)
+	if w.Code != http.StatusOK {
+		e.t.Fatalf("GET /user-subscriptions = %d %s", w.Code, w.Body)
+	}
+	var res ListUserSubscriptionsResponse
+	decodeJSON(e.t, w.Body.String(), &res)
+	return res.UserSubscriptions
+}
+
+func TestListUserSubscriptions(t *testing.T) {
+	e := newTestEnv(t)
+
+	// 契約がない場合はnullではなく空の配列を返す
+	if code, body := e.get("/user-subscriptions"); code != http.StatusOK || body != "{\"user_subscriptions\":[]}\n" {
+		t.Errorf("empty list = %d %s, want an empty array", code, body)
+	}
+
+	coffee := e.fake.CreatePrice("coffee", 500, stripe.PriceRecurringIntervalMonth, 1)
+	mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+		return tx.UpdateSubscription(&Subscription{
+			ID:    "sub-coffee",
+			Title: "coffee",
+			Plans: []*Plan{{ID: "plan-c", Title: "C", StripePriceID: coffee.ID, Price: 500, Currency: stripe.CurrencyJPY}},
+		})
+	})
+	e.mustPost("/create-subscription", `{"subscription_id":"sub-coffee","plan_id":"plan-c"}`, nil)
+	e.subscribe("plan-a")
+
+	got := e.listUserSubscriptions()
+	if len(got) != 2 {
+		t.Fatalf("len(user_subscriptions) = %d, want 2", len(got))
+	}
+	for i, want := range []struct{ sub, plan string }{{"sub-coffee", "plan-c"}, {"sub-ramen", "plan-a"}} {
+		if got[i].SubscriptionID != want.sub || got[i].Plan == nil || got[i].Plan.ID != want.plan {
+			t.Errorf("user_subscriptions[%d] = %s %+v, want %s %s", i, got[i].SubscriptionID, got[i].Plan, want.sub, want.plan)
+		}
+		if got[i].Status != stripe.SubscriptionStatusActive {
+			t.Errorf("user_subscriptions[%d].Status = %s, want active", i, got[i].Status)
+		}
+	}
+}
+
+func TestListUserSubscriptions_OtherCustomer(t *testing.T) {
+	e := newTestEnv(t)
+	e.subscribe("plan-a")
+	e.fake.CreateCustomer("cus_2")
+
+	// 呼び出し元のCustomer以外の契約は、クエリで指定しても返さない
+	w := e.serve(http.MethodGet, "/user-subscriptions?customer_id="+testCustomerID, "", auth.CustomerHeader, "cus_2")
+	if w.Code != http.StatusOK || w.Body.String() != "{\"user_subscriptions\":[]}\n" {
+		t.Errorf("list as cus_2 = %d %s, want an empty array", w.Code, w.Body)
+	}
+
+	w = e.serve(http.MethodPost, "/create-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-b"}`, auth.CustomerHeader, "cus_2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("create as cus_2 = %d %s", w.Code, w.Body)
+	}
+	e.deliverEvents()
+	for _, tt := range []struct{ customer, plan string }{{testCustomerID, "plan-a"}, {"cus_2", "plan-b"}} {
+		got := e.listUserSubscriptions(auth.CustomerHeader, tt.customer)
+		if len(got) != 1 || got[0].Plan.ID != tt.plan {
+			t.Errorf("list as %s = %+v, want only %s", tt.customer, got, tt.plan)
+		}
+	}
+}
@@ -4,7 +4,9 @@ go 1.17
 
 require (
 	cloud.google.com/go/firestore v1.6.1
+	github.com/google/uuid v1.1.2
 	github.com/stripe/stripe-go/v72 v72.85.0
+	google.golang.org/grpc v1.40.0
 )
 
 require (
@@ -22,6 +24,5 @@ require (
 	google.golang.org/api v0.59.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/genproto v0.0.0-20211028162531-8db9c33dc351 // indirect
-	google.golang.org/grpc v1.40.0 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 )
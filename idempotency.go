@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+	"github.com/ogiogi93/stripe-subscription-samples/auth"
+)
+
+const (
+	// idempotencyKeyRetention Idempotency-Keyとレスポンスを保持する期間
+	idempotencyKeyRetention = 24 * time.Hour
+	// idempotencyLockTimeout 処理中のまま残っているリクエストを中断されたものとみなすまでの時間
+	idempotencyLockTimeout = time.Minute
+	// maxIdempotentRequestBytes Idempotency-Keyを指定したリクエストのボディの上限
+	maxIdempotentRequestBytes = int64(65536)
+)
+
+// withIdempotency Idempotency-Keyヘッダーを指定したリクエストを1度だけ処理する
+// 同じキーで再送されたリクエストには初回のレスポンスを返し、異なるリクエストボディで再利用された場合は422を返す
+func withIdempotency(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			h(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentRequestBytes))
+		if err != nil {
+			writeError(w, "withIdempotency", apperror.RequestTooLarge(err))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		ctx := context.Background()
+		now := time.Now()
+		id := idempotencyRecordID(idempotencyScope(r), r.URL.Path, key)
+		fingerprint := requestFingerprint(r.Method, r.URL.Path, body)
+
+		var replay *IdempotencyRecord
+		var rejected error
+		err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+			replay, rejected = nil, nil
+			rec, err := tx.GetIdempotencyRecord(id)
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+			if err == nil && rec.ExpireAt.After(now) {
+				if rec.Fingerprint != fingerprint {
+					rejected = apperror.IdempotencyKeyReused()
+					return nil
+				}
+				if rec.Status == IdempotencyStatusCompleted {
+					replay = rec
+					return nil
+				}
+				if rec.Status == IdempotencyStatusProcessing && rec.CreatedAt.After(now.Add(-idempotencyLockTimeout)) {
+					// 同じキーのリクエストを処理中
+					rejected = apperror.Conflict("a request with the same Idempotency-Key is in progress")
+					return nil
+				}
+			}
+			return tx.CreateIdempotencyRecord(&IdempotencyRecord{
+				ID:          id,
+				Key:         key,
+				Path:        r.URL.Path,
+				Fingerprint: fingerprint,
+				Status:      IdempotencyStatusProcessing,
+				CreatedAt:   now,
+				ExpireAt:    now.Add(idempotencyKeyRetention),
+			})
+		})
+		if err != nil {
+			writeError(w, "withIdempotency", err)
+			return
+		}
+		switch {
+		case rejected != nil:
+			apperror.Write(w, rejected)
+			return
+		case replay != nil:
+			if replay.ResponseContentType != "" {
+				w.Header().Set("Content-Type", replay.ResponseContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(replay.ResponseStatus)
+			_, _ = w.Write(replay.ResponseBody)
+			return
+		}
+
+		rw := &responseRecorder{ResponseWriter: w}
+		h(rw, r.WithContext(context.WithValue(r.Context(), idempotencyContextKey{}, id)))
+
+		err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+			rec, err := tx.GetIdempotencyRecord(id)
+			if err != nil {
+				return err
+			}
+			if !replayableStatus(rw.statusCode()) {
+				// 一時的なエラーのレスポンスを再送時に返し続けないよう、次の再送で処理をやり直す
+				rec.Status = IdempotencyStatusRetryable
+				return tx.UpdateIdempotencyRecord(rec)
+			}
+			rec.Status = IdempotencyStatusCompleted
+			rec.ResponseStatus = rw.statusCode()
+			rec.ResponseContentType = rw.Header().Get("Content-Type")
+			rec.ResponseBody = rw.body.Bytes()
+			return tx.UpdateIdempotencyRecord(rec)
+		})
+		if err != nil {
+			log.Printf("withIdempotency: %v", err)
+		}
+	}
+}
+
+type idempotencyContextKey struct{}
+
+// outboxOperationID リクエストで記録するOutboxの操作のID
+// Idempotency-Keyを指定したリクエストでは、一時的なエラーの後の再送で新しい操作(Stripeの冪等キー)を作らず、記録済みの操作を再利用するためキーから決める
+func outboxOperationID(r *http.Request) string {
+	if id, ok := r.Context().Value(idempotencyContextKey{}).(string); ok {
+		return "idem-" + id
+	}
+	return uuid.New().String()
+}
+
+// replayableStatus 同じキーの再送に保存したレスポンスを返すステータスコードかどうか
+// 5xxや429等の一時的なエラーは再送時に結果が変わる可能性があるため、2xxと再送しても結果が変わらない4xxのみ保存する
+func replayableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return status < http.StatusInternalServerError
+}
+
+// idempotencyScope 異なる呼び出し元が同じキーを利用しても衝突しないよう、キーの有効範囲を呼び出し元毎に分ける
+func idempotencyScope(r *http.Request) string {
+	caller, ok := auth.CallerFromContext(r.Context())
+	if !ok {
+		return ""
+	}
+	return caller.Subject + "\n" + caller.CustomerID
+}
+
+// idempotencyRecordID キーにはFirestoreのドキュメントIDに利用できない文字が含まれる可能性があるため、ハッシュ値をIDとする
+func idempotencyRecordID(scope, path, key string) string {
+	sum := sha256.Sum256([]byte(scope + "\n" + path + "\n" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+func requestFingerprint(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder クライアントへのレスポンスを保存のために記録する
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *responseRecorder) statusCode() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
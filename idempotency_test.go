@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ogiogi93/stripe-subscription-samples/auth"
+)
+
+const createPlanA = `{"subscription_id":"sub-ramen","plan_id":"plan-a"}`
+
+func TestIdempotency_Replay(t *testing.T) {
+	e := newTestEnv(t)
+
+	first := e.serve(http.MethodPost, "/create-subscription", createPlanA, "Idempotency-Key", "key-1")
+	if first.Code != http.StatusOK {
+		t.Fatalf("create = %d %s", first.Code, first.Body)
+	}
+	// 同じキーで再送されたリクエストは処理せずに初回のレスポンスを返す
+	second := e.serve(http.MethodPost, "/create-subscription", createPlanA, "Idempotency-Key", "key-1")
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %s, want %d %s", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Idempotent-Replayed header is not set")
+	}
+	if got := second.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if n := e.countRequests(http.MethodPost, "/v1/subscriptions"); n != 1 {
+		t.Errorf("POST /v1/subscriptions called %d times, want 1", n)
+	}
+
+	// キーを指定しない場合は毎回処理する
+	if code, _ := e.post("/create-subscription", createPlanA); code != http.StatusConflict {
+		t.Errorf("create without a key = %d, want 409", code)
+	}
+}
+
+func TestIdempotency_KeyReusedWithDifferentBody(t *testing.T) {
+	e := newTestEnv(t)
+	e.mustPost("/create-subscription", createPlanA, nil)
+
+	body := `{"subscription_id":"sub-ramen","reason":"too_expensive","decline_retention_offer":true}`
+	if code, res := e.post("/cancel-subscription", body, "Idempotency-Key", "key-1"); code != http.StatusOK {
+		t.Fatalf("cancel = %d %s", code, res)
+	}
+	code, res := e.post("/cancel-subscription", `{"subscription_id":"sub-ramen","decline_retention_offer":true}`, "Idempotency-Key", "key-1")
+	if code != http.StatusUnprocessableEntity || errorCode(t, res) != "idempotency_key_reused" {
+		t.Errorf("reused key = %d %s, want 422 idempotency_key_reused", code, res)
+	}
+}
+
+func TestIdempotency_ScopedByCaller(t *testing.T) {
+	e := newTestEnv(t)
+	e.fake.CreateCustomer("cus_2")
+
+	if code, res := e.post("/create-subscription", createPlanA, "Idempotency-Key", "key-1"); code != http.StatusOK {
+		t.Fatalf("create = %d %s", code, res)
+	}
+	// 別のCustomerが同じキーを利用しても、初回のレスポンスを返さない
+	w := e.serve(http.MethodPost, "/create-subscription", createPlanA, "Idempotency-Key", "key-1", auth.CustomerHeader, "cus_2")
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("create as cus_2 = %d replayed=%q, want a new response", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if n := e.countRequests(http.MethodPost, "/v1/subscriptions"); n != 2 {
+		t.Errorf("POST /v1/subscriptions called %d times, want 2", n)
+	}
+}
+
+func TestIdempotency_TransientErrorIsNotReplayed(t *testing.T) {
+	e := newTestEnv(t)
+	e.fake.FailNextRequests(1)
+
+	if code, res := e.post("/create-subscription", createPlanA, "Idempotency-Key", "key-1"); code != http.StatusServiceUnavailable {
+		t.Fatalf("create = %d %s, want 503", code, res)
+	}
+	// 一時的なエラーは保存せず、同じキーの再送で処理をやり直す
+	w := e.serve(http.MethodPost, "/create-subscription", createPlanA, "Idempotency-Key", "key-1")
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("retry = %d %s replayed=%q, want a new 200 response", w.Code, w.Body, w.Header().Get("Idempotent-Replayed"))
+	}
+	if code, _ := e.post("/create-subscription", createPlanA, "Idempotency-Key", "key-1"); code != http.StatusOK {
+		t.Errorf("replay after the retry = %d, want 200", code)
+	}
+}
+
+func TestIdempotency_RetryReusesOutboxOperation(t *testing.T) {
+	e := newTestEnv(t)
+	e.fake.FailNextRequests(1)
+
+	if code, res := e.post("/create-subscription", createPlanA, "Idempotency-Key", "key-1"); code != http.StatusServiceUnavailable {
+		t.Fatalf("create = %d %s, want 503", code, res)
+	}
+	// 再送では新しい操作を作らず、Outboxに残っている操作を同じStripeの冪等キーで実行する
+	if code, res := e.post("/create-subscription", createPlanA, "Idempotency-Key", "key-1"); code != http.StatusOK {
+		t.Fatalf("retry = %d %s", code, res)
+	}
+	if err := dispatchPendingOutboxOperations(context.Background(), time.Now().Add(outboxRetryDelay)); err != nil {
+		t.Fatal(err)
+	}
+
+	subs := e.fake.Subscriptions(testCustomerID)
+	if len(subs) != 1 {
+		t.Fatalf("len(Subscriptions()) = %d, want 1", len(subs))
+	}
+	if got := e.userSubscription().StripeSubscriptionID; got != subs[0].ID {
+		t.Errorf("StripeSubscriptionID = %s, want %s", got, subs[0].ID)
+	}
+	mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+		ops, err := tx.ListPendingOutboxOperations(outboxBatchSize)
+		if len(ops) != 0 {
+			t.Errorf("len(pending) = %d, want 0", len(ops))
+		}
+		return err
+	})
+}
+
+func TestIdempotency_ClientErrorIsReplayed(t *testing.T) {
+	e := newTestEnv(t)
+	body := `{"subscription_id":"sub-ramen","plan_id":"plan-c"}`
+
+	if code, _ := e.post("/create-subscription", body, "Idempotency-Key", "key-1"); code != http.StatusBadRequest {
+		t.Fatalf("create = %d, want 400", code)
+	}
+	// 再送しても結果が変わらない4xxは保存したレスポンスを返す
+	e.sub.Plans = append(e.sub.Plans, &Plan{ID: "plan-c", StripePriceID: e.sub.Plan("plan-a").StripePriceID})
+	e.saveSubscription()
+	w := e.serve(http.MethodPost, "/create-subscription", body, "Idempotency-Key", "key-1")
+	if w.Code != http.StatusBadRequest || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replay = %d replayed=%q, want the stored 400", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+}
+
+func TestIdempotency_InProgress(t *testing.T) {
+	tests := []struct {
+		name      string
+		createdAt time.Duration
+		want      int
+	}{
+		{name: "in progress", createdAt: 0, want: http.StatusConflict},
+		// 処理中のまま idempotencyLockTimeout が経過したリクエストは中断されたものとみなして処理する
+		{name: "abandoned", createdAt: -idempotencyLockTimeout, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			now := time.Now()
+			mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+				return tx.CreateIdempotencyRecord(&IdempotencyRecord{
+					ID:          idempotencyRecordID("test\n"+testCustomerID, "/create-subscription", "key-1"),
+					Key:         "key-1",
+					Path:        "/create-subscription",
+					Fingerprint: requestFingerprint(http.MethodPost, "/create-subscription", []byte(createPlanA)),
+					Status:      IdempotencyStatusProcessing,
+					CreatedAt:   now.Add(tt.createdAt),
+					ExpireAt:    now.Add(idempotencyKeyRetention),
+				})
+			})
+
+			if code, res := e.post("/create-subscription", createPlanA, "Idempotency-Key", "key-1"); code != tt.want {
+				t.Errorf("create = %d %s, want %d", code, res, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayableStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{status: http.StatusOK, want: true},
+		{status: http.StatusBadRequest, want: true},
+		{status: http.StatusConflict, want: true},
+		{status: http.StatusUnprocessableEntity, want: true},
+		{status: http.StatusRequestTimeout, want: false},
+		{status: http.StatusTooManyRequests, want: false},
+		{status: http.StatusInternalServerError, want: false},
+		{status: http.StatusServiceUnavailable, want: false},
+	}
+	for _, tt := range tests {
+		if got := replayableStatus(tt.status); got != tt.want {
+			t.Errorf("replayableStatus(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
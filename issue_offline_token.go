@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+	"github.com/ogiogi93/stripe-subscription-samples/entitlement"
+	"github.com/ogiogi93/stripe-subscription-samples/offlinetoken"
+)
+
+type IssueOfflineTokenRequest struct {
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+}
+
+type IssueOfflineTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IssueOfflineTokenHandler 店頭で提示する、契約中のプランと利用できる特典を含む署名付きのトークンを発行する
+// トークンの有効期限はofflineTokenTTLと、特典を利用できる期限のうち早い方
+func IssueOfflineTokenHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, "issueOfflineTokenHandler", apperror.MethodNotAllowed(r.Method))
+		return
+	}
+	if offlineTokenSigner == nil {
+		writeError(w, "issueOfflineTokenHandler", apperror.NotFound("offline tokens are not enabled"))
+		return
+	}
+	req := IssueOfflineTokenRequest{SubscriptionID: r.URL.Query().Get("subscription_id")}
+	if err := validateRequest(&req); err != nil {
+		writeError(w, "validateRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, "")
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+
+	var sub *Subscription
+	var ub *UserSubscription
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		var err error
+		sub, err = getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		ub, err = getUserSubscription(tx, sub, customerID)
+		return err
+	})
+	if err != nil {
+		writeError(w, "issueOfflineTokenHandler", err)
+		return
+	}
+
+	now := time.Now()
+	claims := &offlinetoken.Claims{
+		TokenID:        uuid.New().String(),
+		CustomerID:     customerID,
+		SubscriptionID: sub.ID,
+		PlanID:         ub.PlanID,
+		BenefitIDs:     []string{},
+		IssuedAt:       now.Unix(),
+	}
+	expiresAt := now.Add(offlineTokenTTL)
+	subs := []entitlement.Subscription{ub.Entitlement(sub)}
+	reason := entitlement.ReasonNotIncluded
+	for _, benefitID := range subs[0].BenefitIDs {
+		d := entitlementPolicy.Check(subs, benefitID, now)
+		if !d.Granted {
+			reason = d.Reason
+			continue
+		}
+		claims.BenefitIDs = append(claims.BenefitIDs, benefitID)
+		if d.ExpiresAt.Before(expiresAt) {
+			expiresAt = d.ExpiresAt
+		}
+	}
+	if len(claims.BenefitIDs) == 0 {
+		writeError(w, "issueOfflineTokenHandler", apperror.BenefitNotGranted(string(reason)))
+		return
+	}
+	claims.ExpiresAt = expiresAt.Unix()
+
+	token, err := offlineTokenSigner.Sign(claims)
+	if err != nil {
+		writeError(w, "offlineTokenSigner.Sign", err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, "issueOfflineTokenHandler", IssueOfflineTokenResponse{Token: token, ExpiresAt: time.Unix(claims.ExpiresAt, 0)})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ogiogi93/stripe-subscription-samples/offlinetoken"
+)
+
+// enableOfflineTokens トークンの署名鍵を設定し、検証に利用する公開鍵を返す
+func enableOfflineTokens(t *testing.T) offlinetoken.KeySet {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := offlineTokenSigner
+	t.Cleanup(func() { offlineTokenSigner = prev })
+	offlineTokenSigner = &offlinetoken.Signer{KeyID: "key-1", PrivateKey: priv}
+	return offlinetoken.KeySet{"key-1": pub}
+}
+
+func TestIssueOfflineToken(t *testing.T) {
+	e := newTestEnv(t)
+	keys := enableOfflineTokens(t)
+	if code, _ := e.get("/offline-token?subscription_id=sub-ramen"); code != http.StatusNotFound {
+		t.Errorf("before subscribing = %d, want 404", code)
+	}
+	e.subscribe("plan-a")
+
+	w := e.serve(http.MethodGet, "/offline-token?subscription_id=sub-ramen", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /offline-token = %d %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+	var res IssueOfflineTokenResponse
+	decodeJSON(t, w.Body.String(), &res)
+	claims, err := offlinetoken.Verify(res.Token, keys, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.CustomerID != testCustomerID || claims.PlanID != "plan-a" || !claims.HasBenefit("b-ramen") || claims.HasBenefit("b-topping") {
+		t.Errorf("claims = %+v, want plan-a with b-ramen", claims)
+	}
+	if ttl := time.Unix(claims.ExpiresAt, 0).Sub(time.Unix(claims.IssuedAt, 0)); ttl != offlineTokenTTL {
+		t.Errorf("token TTL = %v, want %v", ttl, offlineTokenTTL)
+	}
+	if !res.ExpiresAt.Equal(time.Unix(claims.ExpiresAt, 0)) {
+		t.Errorf("ExpiresAt = %v, want %v", res.ExpiresAt, time.Unix(claims.ExpiresAt, 0))
+	}
+
+	// 特典を利用できない契約にはトークンを発行しない
+	e.mustPost("/cancel-subscription-immediately", `{"subscription_id":"sub-ramen"}`, nil)
+	e.deliverEvents()
+	code, body := e.get("/offline-token?subscription_id=sub-ramen")
+	if code != http.StatusForbidden || errorCode(t, body) != "benefit_not_granted" {
+		t.Errorf("after canceling = %d %s, want 403 benefit_not_granted", code, body)
+	}
+}
+
+func TestIssueOfflineToken_ExpiresWithEntitlement(t *testing.T) {
+	e := newTestEnv(t)
+	keys := enableOfflineTokens(t)
+	ub := e.subscribe("plan-a")
+
+	// 特典を利用できる期限がofflineTokenTTLより早い場合は、その期限までのトークンを発行する
+	mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+		ub.CurrentPeriodEnd = time.Now().Add(time.Minute).Truncate(time.Second)
+		ub.CancelAtPeriodEnd = true
+		return tx.UpdateUserSubscription(ub)
+	})
+	code, body := e.get("/offline-token?subscription_id=sub-ramen")
+	if code != http.StatusOK {
+		t.Fatalf("GET /offline-token = %d %s", code, body)
+	}
+	var res IssueOfflineTokenResponse
+	decodeJSON(t, body, &res)
+	claims, err := offlinetoken.Verify(res.Token, keys, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.ExpiresAt != ub.CurrentPeriodEnd.Unix() {
+		t.Errorf("ExpiresAt = %d, want %d", claims.ExpiresAt, ub.CurrentPeriodEnd.Unix())
+	}
+}
+
+func TestIssueOfflineToken_Disabled(t *testing.T) {
+	e := newTestEnv(t)
+	e.subscribe("plan-a")
+	prev := offlineTokenSigner
+	t.Cleanup(func() { offlineTokenSigner = prev })
+	offlineTokenSigner = nil
+
+	if code, body := e.get("/offline-token?subscription_id=sub-ramen"); code != http.StatusNotFound {
+		t.Errorf("GET /offline-token = %d %s, want 404", code, body)
+	}
+}
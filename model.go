@@ -1,39 +1,127 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
-	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/entitlement"
 )
 
 const (
 	CollectionNameSubscription     = "Subscription"
 	CollectionNameUserSubscription = "UserSubscription"
+	CollectionNameProcessedEvent   = "ProcessedEvent"
+	CollectionNameOutbox           = "Outbox"
+	CollectionNameIdempotencyKey   = "IdempotencyKey"
+	CollectionNameRedemption       = "Redemption"
+	CollectionNameTrialUsage       = "TrialUsage"
 )
 
+// LocalizedTitles ロケール(ja、en-US等)毎のタイトル
+type LocalizedTitles map[string]string
+
+// Localize localesの優先順に翻訳されたタイトルを返す。該当する翻訳がない場合はfallbackを返す
+func (t LocalizedTitles) Localize(locales []string, fallback string) string {
+	for _, locale := range locales {
+		if title, ok := t[locale]; ok {
+			return title
+		}
+		// en-USに対してenの翻訳を利用する
+		if i := strings.IndexByte(locale, '-'); i > 0 {
+			if title, ok := t[locale[:i]]; ok {
+				return title
+			}
+		}
+	}
+	return fallback
+}
+
 // Plan サブスクリプションのプラン
 type Plan struct {
-	ID              string     `firestore:"id"`
-	Title           string     `firestore:"title"`
-	StripeProductID string     `firestore:"stripe_product_id"`
-	StripePriceID   string     `firestore:"stripe_price_id"`
-	Price           int32      `firestore:"price"`
-	Benefits        []*Benefit `firestore:"benefits"`
+	ID              string          `firestore:"id"`
+	Title           string          `firestore:"title"`
+	Titles          LocalizedTitles `firestore:"titles"`
+	StripeProductID string          `firestore:"stripe_product_id"`
+	StripePriceID   string          `firestore:"stripe_price_id"`
+	Price           int32           `firestore:"price"`
+	// Currency、Interval、IntervalCount StripeのPriceに設定した通貨と請求間隔
+	Currency      stripe.Currency               `firestore:"currency"`
+	Interval      stripe.PriceRecurringInterval `firestore:"interval"`
+	IntervalCount int64                         `firestore:"interval_count"`
+	// Rank プランの上位・下位を明示的に指定する場合の順位。値が大きいほど上位のプラン
+	Rank int64 `firestore:"rank"`
+	// TrialDays 新規契約時のトライアル日数。トライアルはCustomer毎にSubscription毎に1度のみ利用できる
+	TrialDays int64 `firestore:"trial_days"`
+	// Archived 新規の契約・プラン変更を受け付けないプラン。カタログには表示しない
+	Archived bool       `firestore:"archived"`
+	Benefits []*Benefit `firestore:"benefits"`
 }
 
-// Benefit サブスクリプション適用のためのデータを定義(割引額等)。今回は触れない
+// Benefit プランに含まれる特典を返す
+func (p *Plan) Benefit(benefitID string) *Benefit {
+	for _, b := range p.Benefits {
+		if b.ID == benefitID {
+			return b
+		}
+	}
+	return nil
+}
+
+// Benefit サブスクリプション適用のためのデータを定義(割引額等)。利用可否は entitlement パッケージで判定する
 type Benefit struct {
-	ID    string `firestore:"id"`
-	Title string `firestore:"title"`
+	ID     string          `firestore:"id"`
+	Title  string          `firestore:"title"`
+	Titles LocalizedTitles `firestore:"titles"`
+	// QuotaPeriod、QuotaLimit 期間毎に利用できる回数。QuotaPeriodが未設定の場合は無制限
+	QuotaPeriod BenefitQuotaPeriod `firestore:"quota_period"`
+	QuotaLimit  int64              `firestore:"quota_limit"`
 	// DiscountValue int32 `firestore:"discount_value"`
 }
 
+// BenefitQuotaPeriod 特典の利用回数を数える期間
+type BenefitQuotaPeriod string
+
+const (
+	BenefitQuotaUnlimited     BenefitQuotaPeriod = ""
+	BenefitQuotaDaily         BenefitQuotaPeriod = "day"            // 1日(日本時間)毎
+	BenefitQuotaBillingPeriod BenefitQuotaPeriod = "billing_period" // 請求期間毎。更新時にリセットする
+)
+
+// quotaLocation 1日毎の利用回数を区切るタイムゾーン
+var quotaLocation = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+// quotaPeriodKey 利用回数を数える期間の識別子。期間が変わると利用回数を0から数え直す
+func (b *Benefit) quotaPeriodKey(us *UserSubscription, now time.Time) string {
+	switch b.QuotaPeriod {
+	case BenefitQuotaDaily:
+		return "day:" + now.In(quotaLocation).Format("2006-01-02")
+	case BenefitQuotaBillingPeriod:
+		return billingPeriodKeyPrefix + fmt.Sprint(us.CurrentPeriodStart.Unix())
+	}
+	return ""
+}
+
+const billingPeriodKeyPrefix = "period:"
+
+// ErrQuotaExceeded 期間内の利用回数の上限に達している
+var ErrQuotaExceeded = errors.New("benefit quota exceeded")
+
 // Subscription サブスクリプションは複数のプランを保持できる
 type Subscription struct {
-	ID    string  `firestore:"-"`
-	Title string  `firestore:"title"`
-	Plans []*Plan `firestore:"plans"`
+	ID     string          `firestore:"-"`
+	Title  string          `firestore:"title"`
+	Titles LocalizedTitles `firestore:"titles"`
+	// Archived 販売を終了したSubscription。カタログには表示しない
+	Archived bool    `firestore:"archived"`
+	Plans    []*Plan `firestore:"plans"`
+	// PlanChangePolicy プラン変更を即時に行うか、請求期間の終了時に行うかを決めるルール
+	PlanChangePolicy PlanChangePolicy `firestore:"plan_change_policy"`
+	// RetentionOffers 解約の前に提示する引き止めの特典。先頭から順に、解約理由に該当し提示できるものを1つ提示する
+	RetentionOffers []*RetentionOffer `firestore:"retention_offers"`
 }
 
 func (s *Subscription) Plan(planID string) *Plan {
@@ -45,6 +133,16 @@ func (s *Subscription) Plan(planID string) *Plan {
 	return nil
 }
 
+// PlanByStripePriceID StripeのPriceIDに対応するプランを返す
+func (s *Subscription) PlanByStripePriceID(priceID string) *Plan {
+	for _, plan := range s.Plans {
+		if priceID == plan.StripePriceID {
+			return plan
+		}
+	}
+	return nil
+}
+
 func (s *Subscription) UserSubscriptionID(customerID string) string {
 	return fmt.Sprintf("%s-%s", customerID, s.ID)
 }
@@ -59,12 +157,132 @@ type UserSubscription struct {
 	Status                stripe.SubscriptionStatus `firestore:"status"`
 	LatestPaymentIntentID string                    `firestore:"latest_payment_intent_id"`
 	StartedAt             time.Time                 `firestore:"started_at"`
+	// LatestPaymentIntentStatus 最新の請求の支払い状態。3Dセキュア認証が必要な場合はrequires_actionになる
+	LatestPaymentIntentStatus stripe.PaymentIntentStatus `firestore:"latest_payment_intent_status"`
+	// PaymentActionRequiredAt 更新時の支払いで3Dセキュア認証が必要になったこと(invoice.payment_action_required)を受け取った日時
+	// 顧客に認証を促す通知に利用する。認証が完了するか、別の支払い結果を反映した時点でゼロ値に戻す
+	PaymentActionRequiredAt time.Time `firestore:"payment_action_required_at"`
 
 	StripeSubscriptionID     string `firestore:"stripe_subscription_id"`
 	StripeSubscriptionItemID string `firestore:"stripe_subscription_item_id"`
+	// StripeScheduleID 次回更新時のプラン変更を予約したSubscription ScheduleのID。予約がない場合は空文字
+	StripeScheduleID string `firestore:"stripe_schedule_id"`
+	// PreviewPlanID、PreviewProrationDate /preview-plan-change で最後に返したプランと日割り計算の基準日時
+	// 即時のプラン変更では、この日時を発行から一定時間内に限り基準日時として受け付ける
+	PreviewPlanID        string `firestore:"preview_plan_id"`
+	PreviewProrationDate int64  `firestore:"preview_proration_date"`
 
 	CurrentPeriodStart time.Time `firestore:"current_period_start"`
 	CurrentPeriodEnd   time.Time `firestore:"current_period_end"`
+
+	CancelAtPeriodEnd bool      `firestore:"cancel_at_period_end"`
+	CanceledAt        time.Time `firestore:"canceled_at"`
+	// CancellationMode 本サービスから行った解約の方法。解約していない場合は空文字
+	CancellationMode CancellationMode `firestore:"cancellation_mode"`
+	// RefundMode、RefundAmount 即時解約時に最新の請求に対して行った返金
+	RefundMode   RefundMode `firestore:"refund_mode"`
+	RefundAmount int64      `firestore:"refund_amount"`
+	// CancellationReason、CancellationComment 解約時に顧客が選択した理由と自由記述のコメント
+	CancellationReason  CancellationReason `firestore:"cancellation_reason"`
+	CancellationComment string             `firestore:"cancellation_comment"`
+	// RetentionOfferID、RetentionOfferAcceptedAt 顧客が受け入れた引き止めの特典。特典は1度のみ受け入れられる
+	RetentionOfferID         string    `firestore:"retention_offer_id"`
+	RetentionOfferAcceptedAt time.Time `firestore:"retention_offer_accepted_at"`
+
+	// PauseBehavior 請求の一時停止中に作成されるInvoiceの扱い。一時停止していない場合は空文字
+	PauseBehavior stripe.SubscriptionPauseCollectionBehavior `firestore:"pause_behavior"`
+	// PausedAt、ResumesAt 請求を一時停止した日時と再開予定の日時。再開予定の日時を指定しない場合はゼロ値
+	PausedAt  time.Time `firestore:"paused_at"`
+	ResumesAt time.Time `firestore:"resumes_at"`
+
+	TrialStart time.Time `firestore:"trial_start"`
+	TrialEnd   time.Time `firestore:"trial_end"`
+	// TrialWillEndNotifiedAt トライアル終了の事前通知(customer.subscription.trial_will_end)を受け取った日時
+	TrialWillEndNotifiedAt time.Time `firestore:"trial_will_end_notified_at"`
+
+	// Discount 適用中のクーポン・プロモーションコードによる割引
+	Discount *AppliedDiscount `firestore:"discount"`
+
+	// BenefitUsages 特典毎の期間内の利用回数
+	BenefitUsages map[string]*BenefitUsage `firestore:"benefit_usages"`
+
+	// Webhookは順序が保証されないため、最後に反映したイベントの作成日時と元となったオブジェクトのバージョン(請求期間の終了日時)を保持する
+	LastEventCreatedAt     time.Time `firestore:"last_event_created_at"`
+	LastEventObjectVersion int64     `firestore:"last_event_object_version"`
+}
+
+// CancellationMode 解約の方法
+type CancellationMode string
+
+const (
+	// CancellationAtPeriodEnd 現在の請求期間の終了時に解約する(自動更新の無効化)
+	CancellationAtPeriodEnd CancellationMode = "at_period_end"
+	// CancellationImmediately 即時に解約する
+	CancellationImmediately CancellationMode = "immediately"
+)
+
+// RefundMode 即時解約時の最新の請求に対する返金方法
+type RefundMode string
+
+const (
+	RefundNone RefundMode = "none"
+	// RefundProrated 請求期間の残り期間分を日割りで返金する
+	RefundProrated RefundMode = "prorated"
+	// RefundFull 請求額の全額を返金する
+	RefundFull RefundMode = "full"
+)
+
+// AppliedDiscount Stripe Subscriptionに適用した割引
+type AppliedDiscount struct {
+	PromotionCodeID string `firestore:"promotion_code_id"`
+	// Code 顧客が入力したプロモーションコード
+	Code             string                `firestore:"code"`
+	CouponID         string                `firestore:"coupon_id"`
+	CouponName       string                `firestore:"coupon_name"`
+	PercentOff       float64               `firestore:"percent_off"`
+	AmountOff        int64                 `firestore:"amount_off"`
+	Currency         stripe.Currency       `firestore:"currency"`
+	Duration         stripe.CouponDuration `firestore:"duration"`
+	DurationInMonths int64                 `firestore:"duration_in_months"`
+	Start            time.Time             `firestore:"start"`
+	// End 割引が終了する日時。durationがrepeating以外の場合はゼロ値
+	End time.Time `firestore:"end"`
+}
+
+// BenefitUsage 特典の期間内の利用回数
+type BenefitUsage struct {
+	PeriodKey string `firestore:"period_key"`
+	Count     int64  `firestore:"count"`
+}
+
+// Redeem 特典の利用を記録し、期間内の残り回数を返す。無制限の特典の場合は-1を返す
+func (us *UserSubscription) Redeem(b *Benefit, now time.Time) (int64, error) {
+	if b.QuotaPeriod == BenefitQuotaUnlimited {
+		return -1, nil
+	}
+	key := b.quotaPeriodKey(us, now)
+	usage := us.BenefitUsages[b.ID]
+	if usage == nil || usage.PeriodKey != key {
+		usage = &BenefitUsage{PeriodKey: key}
+	}
+	if usage.Count >= b.QuotaLimit {
+		return 0, ErrQuotaExceeded
+	}
+	usage.Count++
+	if us.BenefitUsages == nil {
+		us.BenefitUsages = map[string]*BenefitUsage{}
+	}
+	us.BenefitUsages[b.ID] = usage
+	return b.QuotaLimit - usage.Count, nil
+}
+
+// ResetBillingPeriodUsage 請求期間毎の特典の利用回数をリセットする
+func (us *UserSubscription) ResetBillingPeriodUsage() {
+	for id, usage := range us.BenefitUsages {
+		if strings.HasPrefix(usage.PeriodKey, billingPeriodKeyPrefix) {
+			delete(us.BenefitUsages, id)
+		}
+	}
 }
 
 func (us *UserSubscription) Renewal(planID string) {
@@ -72,29 +290,333 @@ func (us *UserSubscription) Renewal(planID string) {
 	us.NextPlanID = ""
 }
 
-func (us *UserSubscription) RenewalAll(planID string, sub *stripe.Subscription) {
+func (us *UserSubscription) RenewalAll(planID string, sub *stripe.Subscription, at time.Time) {
 	us.Renewal(planID)
 
 	us.StripeSubscriptionID = sub.ID
 	us.StripeSubscriptionItemID = sub.Items.Data[0].ID
+	us.syncLatestPaymentIntent(sub)
+	us.SyncStatus(sub, at)
+}
+
+// ResetCancellation 解約の方法・理由と即時解約時の返金の記録を削除する
+func (us *UserSubscription) ResetCancellation() {
+	us.CancellationMode = ""
+	us.CancellationReason = ""
+	us.CancellationComment = ""
+	us.RefundMode = ""
+	us.RefundAmount = 0
+}
+
+// syncLatestPaymentIntent 最新の請求のPaymentIntentを反映する。3Dセキュア認証が不要になった場合は通知の記録を削除する
+func (us *UserSubscription) syncLatestPaymentIntent(sub *stripe.Subscription) {
+	us.LatestPaymentIntentID = latestPaymentIntentID(sub)
+	us.LatestPaymentIntentStatus = ""
+	if us.LatestPaymentIntentID != "" {
+		us.LatestPaymentIntentStatus = sub.LatestInvoice.PaymentIntent.Status
+	}
+	if us.LatestPaymentIntentStatus != stripe.PaymentIntentStatusRequiresAction {
+		us.PaymentActionRequiredAt = time.Time{}
+	}
+}
+
+// latestPaymentIntentID 最新のInvoiceのPaymentIntentのID。トライアル中等、支払いが発生しない場合は空文字を返す
+func latestPaymentIntentID(sub *stripe.Subscription) string {
+	if sub.LatestInvoice == nil || sub.LatestInvoice.PaymentIntent == nil {
+		return ""
+	}
+	return sub.LatestInvoice.PaymentIntent.ID
+}
+
+// scheduleID Subscriptionを管理しているSubscription ScheduleのID。解放済みの場合は空文字を返す
+func scheduleID(sub *stripe.Subscription) string {
+	if sub.Schedule == nil {
+		return ""
+	}
+	return sub.Schedule.ID
+}
+
+// SyncStatus Stripe上のSubscriptionのステータス、請求期間、キャンセル予約、プラン変更の予約の状態を反映する
+// atは反映する状態になった日時で、Webhookではイベントの作成日時、Outboxでは操作を実行した日時を指定する
+func (us *UserSubscription) SyncStatus(sub *stripe.Subscription, at time.Time) {
 	us.Status = sub.Status
 	us.CurrentPeriodStart = time.Unix(sub.CurrentPeriodStart, 0)
 	us.CurrentPeriodEnd = time.Unix(sub.CurrentPeriodEnd, 0)
-	us.LatestPaymentIntentID = sub.LatestInvoice.PaymentIntent.ID
+	us.CancelAtPeriodEnd = sub.CancelAtPeriodEnd
+	if us.CancellationMode == CancellationAtPeriodEnd && !sub.CancelAtPeriodEnd && sub.Status != stripe.SubscriptionStatusCanceled {
+		// 再開やダッシュボードからの操作で解約の予約が取り消された
+		us.CancellationMode = ""
+		us.CancellationReason = ""
+		us.CancellationComment = ""
+	}
+	us.StripeScheduleID = scheduleID(sub)
+	us.syncPauseCollection(sub.PauseCollection, at)
+	us.CanceledAt = unixTime(sub.CanceledAt)
+	us.TrialStart = unixTime(sub.TrialStart)
+	us.TrialEnd = unixTime(sub.TrialEnd)
+	us.syncDiscount(sub.Discount)
+}
+
+// syncPauseCollection 請求の一時停止の状態を反映する。再開予定の日時を過ぎるとStripe上で一時停止が解除される
+func (us *UserSubscription) syncPauseCollection(pc stripe.SubscriptionPauseCollection, at time.Time) {
+	if pc.Behavior == "" {
+		us.PauseBehavior = ""
+		us.PausedAt = time.Time{}
+		us.ResumesAt = time.Time{}
+		return
+	}
+	if us.PausedAt.IsZero() {
+		// Stripeは一時停止した日時を保持しないため、一時停止を最初に反映したイベントや操作の日時を記録する
+		us.PausedAt = at
+	}
+	us.PauseBehavior = pc.Behavior
+	us.ResumesAt = unixTime(pc.ResumesAt)
+}
+
+// Paused 請求を一時停止しているかどうか
+func (us *UserSubscription) Paused() bool {
+	return us.PauseBehavior != ""
+}
+
+// syncDiscount Subscriptionに適用中の割引を反映する。割引の期間が終了した場合は削除する
+func (us *UserSubscription) syncDiscount(d *stripe.Discount) {
+	if d == nil || d.Coupon == nil {
+		us.Discount = nil
+		return
+	}
+	applied := &AppliedDiscount{
+		CouponID:         d.Coupon.ID,
+		CouponName:       d.Coupon.Name,
+		PercentOff:       d.Coupon.PercentOff,
+		AmountOff:        d.Coupon.AmountOff,
+		Currency:         d.Coupon.Currency,
+		Duration:         d.Coupon.Duration,
+		DurationInMonths: d.Coupon.DurationInMonths,
+		Start:            unixTime(d.Start),
+		End:              unixTime(d.End),
+	}
+	if pc := d.PromotionCode; pc != nil {
+		applied.PromotionCodeID = pc.ID
+		applied.Code = pc.Code
+		// Webhookのペイロードではプロモーションコードが展開されないため、記録済みのコードを引き継ぐ
+		if applied.Code == "" && us.Discount != nil && us.Discount.PromotionCodeID == pc.ID {
+			applied.Code = us.Discount.Code
+		}
+	}
+	us.Discount = applied
 }
 
-func NewUserSubscription(id, customerID, subscriptionID, planID string, sub *stripe.Subscription) *UserSubscription {
-	return &UserSubscription{
+// IsStaleEvent 最後に反映したイベントより古いイベントかどうか
+// Stripeのイベントの作成日時は秒単位のため、同時刻の場合はオブジェクトのバージョンで比較する
+func (us *UserSubscription) IsStaleEvent(created int64, version int64) bool {
+	last := us.LastEventCreatedAt.Unix()
+	if us.LastEventCreatedAt.IsZero() || created > last {
+		return false
+	}
+	return created < last || version < us.LastEventObjectVersion
+}
+
+func (us *UserSubscription) MarkEventApplied(created int64, version int64) {
+	us.LastEventCreatedAt = time.Unix(created, 0)
+	us.LastEventObjectVersion = version
+}
+
+// Entitlement 特典の利用可否の判定に利用する契約状態
+func (us *UserSubscription) Entitlement(sub *Subscription) entitlement.Subscription {
+	e := entitlement.Subscription{
+		SubscriptionID:     us.SubscriptionID,
+		PlanID:             us.PlanID,
+		Status:             entitlement.Status(us.Status),
+		CurrentPeriodStart: us.CurrentPeriodStart,
+		CurrentPeriodEnd:   us.CurrentPeriodEnd,
+		CancelAtPeriodEnd:  us.CancelAtPeriodEnd,
+		PausedAt:           us.PausedAt,
+		ResumesAt:          us.ResumesAt,
+	}
+	if plan := sub.Plan(us.PlanID); plan != nil {
+		for _, b := range plan.Benefits {
+			e.BenefitIDs = append(e.BenefitIDs, b.ID)
+		}
+	}
+	return e
+}
+
+func NewUserSubscription(id, customerID, subscriptionID, planID string, sub *stripe.Subscription, now time.Time) *UserSubscription {
+	us := &UserSubscription{
 		ID:                       id,
 		CustomerID:               customerID,
 		SubscriptionID:           subscriptionID,
 		PlanID:                   planID,
 		StripeSubscriptionID:     sub.ID,
 		StripeSubscriptionItemID: sub.Items.Data[0].ID,
-		Status:                   sub.Status,
-		LatestPaymentIntentID:    sub.LatestInvoice.PaymentIntent.ID,
-		StartedAt:                time.Now(),
-		CurrentPeriodStart:       time.Unix(sub.CurrentPeriodStart, 0),
-		CurrentPeriodEnd:         time.Unix(sub.CurrentPeriodEnd, 0),
+		StartedAt:                now,
+	}
+	us.syncLatestPaymentIntent(sub)
+	us.SyncStatus(sub, now)
+	return us
+}
+
+// TrialUsage Customerが利用したトライアル。同じSubscriptionのトライアルは1度のみ利用できる
+type TrialUsage struct {
+	ID             string    `firestore:"-"` // UserSubscriptionと同じID
+	CustomerID     string    `firestore:"customer_id"`
+	SubscriptionID string    `firestore:"subscription_id"`
+	PlanID         string    `firestore:"plan_id"`
+	TrialDays      int64     `firestore:"trial_days"`
+	UsedAt         time.Time `firestore:"used_at"`
+}
+
+// ProcessedEvent 処理済みのWebhookイベント。Stripeは同じイベントを複数回送信することがあるため、重複して処理しないよう記録する
+// ExpireAtを過ぎたドキュメントはFirestoreのTTLポリシーにより削除される
+type ProcessedEvent struct {
+	ID          string    `firestore:"-"`
+	Type        string    `firestore:"type"`
+	ProcessedAt time.Time `firestore:"processed_at"`
+	ExpireAt    time.Time `firestore:"expire_at"`
+}
+
+func NewProcessedEvent(ev stripe.Event, now time.Time, retention time.Duration) *ProcessedEvent {
+	return &ProcessedEvent{
+		ID:          ev.ID,
+		Type:        ev.Type,
+		ProcessedAt: now,
+		ExpireAt:    now.Add(retention),
+	}
+}
+
+// OutboxOperationKind Outboxに記録するStripeの操作の種類
+type OutboxOperationKind string
+
+const (
+	OutboxOperationCreateSubscription    OutboxOperationKind = "create_subscription"
+	OutboxOperationReCreateSubscription  OutboxOperationKind = "recreate_subscription"
+	OutboxOperationChangePlanAtPeriodEnd OutboxOperationKind = "change_plan_at_period_end"
+	OutboxOperationChangePlanImmediately OutboxOperationKind = "change_plan_immediately"
+	OutboxOperationCancelPlanChange      OutboxOperationKind = "cancel_plan_change"
+	OutboxOperationCancelAtPeriodEnd     OutboxOperationKind = "cancel_at_period_end"
+	OutboxOperationResumeSubscription    OutboxOperationKind = "resume_subscription"
+	OutboxOperationCancelImmediately     OutboxOperationKind = "cancel_immediately"
+	OutboxOperationApplyCoupon           OutboxOperationKind = "apply_coupon"
+	OutboxOperationPauseBilling          OutboxOperationKind = "pause_billing"
+	OutboxOperationResumeBilling         OutboxOperationKind = "resume_billing"
+	OutboxOperationUpdatePaymentSource   OutboxOperationKind = "update_payment_source"
+)
+
+// OutboxStatus Outboxに記録した操作の状態
+type OutboxStatus string
+
+const (
+	OutboxStatusPending OutboxStatus = "pending" // 未実行、または一時的なエラーにより再実行待ち
+	OutboxStatusDone    OutboxStatus = "done"
+	OutboxStatusFailed  OutboxStatus = "failed" // 再実行しても成功しないエラー
+)
+
+// OutboxOperation トランザクション内で記録する、Stripeに対して実行予定の操作
+// Firestoreのトランザクションは競合時に再実行されるため、Stripeの操作はトランザクションの外で冪等キーを指定して実行する
+type OutboxOperation struct {
+	ID                 string              `firestore:"-"`
+	Kind               OutboxOperationKind `firestore:"kind"`
+	UserSubscriptionID string              `firestore:"user_subscription_id"`
+	CustomerID         string              `firestore:"customer_id"`
+	SubscriptionID     string              `firestore:"subscription_id"`
+	PlanID             string              `firestore:"plan_id"`
+	StripePriceID      string              `firestore:"stripe_price_id"`
+	SourceID           string              `firestore:"source_id"`
+	// TrialDays Subscriptionの作成時に設定するトライアル日数
+	TrialDays int64 `firestore:"trial_days"`
+	// PromotionCodeID Subscriptionの作成時に適用するプロモーションコード
+	PromotionCodeID string `firestore:"promotion_code_id"`
+	// ProrationDate 即時のプラン変更で日割り計算の基準とする日時(Unix時間)。プレビューと同じ金額を請求するため指定する
+	ProrationDate int64 `firestore:"proration_date"`
+	// RefundMode 即時解約時の返金方法
+	RefundMode RefundMode `firestore:"refund_mode"`
+	// CancellationReason、CancellationComment 解約時にStripeのcancellation_detailsに記録する解約理由
+	CancellationReason  CancellationReason `firestore:"cancellation_reason"`
+	CancellationComment string             `firestore:"cancellation_comment"`
+	// StripeCouponID 引き止めの特典として適用するクーポン
+	StripeCouponID string `firestore:"stripe_coupon_id"`
+	// RetentionOfferID 操作の元となった引き止めの特典。実行後にUserSubscriptionに記録する
+	RetentionOfferID string `firestore:"retention_offer_id"`
+	// PauseBehavior、ResumesAt 請求の一時停止時に設定するpause_collection。ResumesAtはUnix時間で、0の場合は再開するまで停止する
+	PauseBehavior stripe.SubscriptionPauseCollectionBehavior `firestore:"pause_behavior"`
+	ResumesAt     int64                                      `firestore:"resumes_at"`
+
+	// 操作対象のStripeのオブジェクト
+	StripeSubscriptionID     string `firestore:"stripe_subscription_id"`
+	StripeSubscriptionItemID string `firestore:"stripe_subscription_item_id"`
+	StripeScheduleID         string `firestore:"stripe_schedule_id"`
+
+	// Stripeの冪等キー。トランザクションの再実行やOutboxの再実行で同じ値を利用する
+	IdempotencyKey string       `firestore:"idempotency_key"`
+	Status         OutboxStatus `firestore:"status"`
+	Attempts       int          `firestore:"attempts"`
+	LastError      string       `firestore:"last_error"`
+	// 実行結果のStripe SubscriptionのID
+	ResultStripeSubscriptionID string `firestore:"result_stripe_subscription_id"`
+
+	CreatedAt time.Time `firestore:"created_at"`
+	UpdatedAt time.Time `firestore:"updated_at"`
+}
+
+func NewOutboxOperation(id string, kind OutboxOperationKind, now time.Time) *OutboxOperation {
+	return &OutboxOperation{
+		ID:             id,
+		Kind:           kind,
+		IdempotencyKey: id,
+		Status:         OutboxStatusPending,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+}
+
+// StepIdempotencyKey 1つの操作で複数のStripe APIを呼び出す場合に、呼び出し毎に異なる冪等キーを返す
+func (op *OutboxOperation) StepIdempotencyKey(step string) string {
+	return op.IdempotencyKey + "-" + step
+}
+
+// IdempotencyStatus Idempotency-Keyを指定したリクエストの処理状態
+type IdempotencyStatus string
+
+const (
+	IdempotencyStatusProcessing IdempotencyStatus = "processing"
+	IdempotencyStatusCompleted  IdempotencyStatus = "completed"
+	// IdempotencyStatusRetryable 一時的なエラーで終了したリクエスト。レスポンスは保存せず、同じキーで再送された場合は再度処理する
+	IdempotencyStatusRetryable IdempotencyStatus = "retryable"
+)
+
+// IdempotencyRecord クライアントが指定したIdempotency-Keyと、そのリクエストに対するレスポンス
+// 同じキーで再送されたリクエストには保存したレスポンスを返す
+type IdempotencyRecord struct {
+	ID          string            `firestore:"-"`
+	Key         string            `firestore:"key"`
+	Path        string            `firestore:"path"`
+	Fingerprint string            `firestore:"fingerprint"` // リクエストボディのハッシュ値
+	Status      IdempotencyStatus `firestore:"status"`
+
+	ResponseStatus      int    `firestore:"response_status"`
+	ResponseContentType string `firestore:"response_content_type"`
+	ResponseBody        []byte `firestore:"response_body"`
+
+	CreatedAt time.Time `firestore:"created_at"`
+	ExpireAt  time.Time `firestore:"expire_at"`
+}
+
+// Redemption 特典の利用履歴
+type Redemption struct {
+	ID                 string    `firestore:"-"`
+	UserSubscriptionID string    `firestore:"user_subscription_id"`
+	CustomerID         string    `firestore:"customer_id"`
+	SubscriptionID     string    `firestore:"subscription_id"`
+	PlanID             string    `firestore:"plan_id"`
+	BenefitID          string    `firestore:"benefit_id"`
+	PeriodKey          string    `firestore:"period_key"`
+	RedeemedAt         time.Time `firestore:"redeemed_at"`
+}
+
+// unixTime Stripeのタイムスタンプをtime.Timeに変換する。未設定(0)の場合はゼロ値を返す
+func unixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
 	}
+	return time.Unix(sec, 0)
 }
@@ -0,0 +1,189 @@
+// Package offlinetoken 店頭で契約者をオフラインで確認するための、Ed25519で署名した短期間有効なトークンを発行・検証する
+//
+// トークンはJWS Compact Serialization(alg: EdDSA)形式で、契約中のCustomer、プラン、利用できる特典、有効期限を含む。
+// 検証には公開鍵のみを利用するため、店舗の端末がネットワークに接続できない状態でも確認できる。
+//
+//	claims, err := offlinetoken.Verify(token, offlinetoken.KeySet{"key-1": pub}, time.Now())
+package offlinetoken
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	algorithm = "EdDSA"
+	tokenType = "offline-entitlement+jwt"
+	// clockSkew 店舗の端末の時計の遅れを考慮し、発行日時の検証で許容するずれ
+	clockSkew = time.Minute
+)
+
+var (
+	ErrMalformed        = errors.New("offlinetoken: malformed token")
+	ErrUnknownKey       = errors.New("offlinetoken: unknown key id")
+	ErrInvalidSignature = errors.New("offlinetoken: invalid signature")
+	ErrExpired          = errors.New("offlinetoken: token is expired")
+	ErrNotYetValid      = errors.New("offlinetoken: token is not valid yet")
+)
+
+// Claims トークンに含める契約の情報
+type Claims struct {
+	// TokenID トークン毎に一意なID
+	TokenID        string   `json:"jti"`
+	CustomerID     string   `json:"sub"`
+	SubscriptionID string   `json:"subscription_id"`
+	PlanID         string   `json:"plan_id"`
+	BenefitIDs     []string `json:"benefits"`
+	// IssuedAt、ExpiresAt Unix時間(秒)
+	IssuedAt  int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+// HasBenefit トークンに特典が含まれるかどうか
+func (c *Claims) HasBenefit(benefitID string) bool {
+	for _, id := range c.BenefitIDs {
+		if id == benefitID {
+			return true
+		}
+	}
+	return false
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// Signer 秘密鍵でトークンに署名する
+type Signer struct {
+	KeyID      string
+	PrivateKey ed25519.PrivateKey
+}
+
+// Sign claimsに署名したトークンを返す
+func (s *Signer) Sign(claims *Claims) (string, error) {
+	h, err := json.Marshal(header{Alg: algorithm, Typ: tokenType, Kid: s.KeyID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encodeSegment(h) + "." + encodeSegment(c)
+	sig := ed25519.Sign(s.PrivateKey, []byte(signingInput))
+	return signingInput + "." + encodeSegment(sig), nil
+}
+
+// KeySet 鍵ID毎の公開鍵。鍵のローテーション中は新旧両方の公開鍵を登録しておく
+type KeySet map[string]ed25519.PublicKey
+
+// Verify トークンの署名と有効期限を検証し、含まれる契約の情報を返す
+func Verify(token string, keys KeySet, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrMalformed
+	}
+	if h.Alg != algorithm || h.Typ != tokenType {
+		return nil, fmt.Errorf("%w: unexpected alg %q or typ %q", ErrMalformed, h.Alg, h.Typ)
+	}
+	pub, ok := keys[h.Kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, h.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ErrInvalidSignature
+	}
+
+	var c Claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, ErrMalformed
+	}
+	if now.Unix() >= c.ExpiresAt {
+		return &c, ErrExpired
+	}
+	if now.Add(clockSkew).Unix() < c.IssuedAt {
+		return &c, ErrNotYetValid
+	}
+	return &c, nil
+}
+
+// ParsePrivateKeyPEM PEM形式(PKCS #8)のEd25519秘密鍵を読み込む
+func ParsePrivateKeyPEM(b []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("offlinetoken: no PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("offlinetoken: %T is not an Ed25519 private key", key)
+	}
+	return priv, nil
+}
+
+// ParsePublicKeyPEM PEM形式(PKIX)のEd25519公開鍵を読み込む
+func ParsePublicKeyPEM(b []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("offlinetoken: no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("offlinetoken: %T is not an Ed25519 public key", key)
+	}
+	return pub, nil
+}
+
+// MarshalPrivateKeyPEM 秘密鍵をPEM形式(PKCS #8)に変換する
+func MarshalPrivateKeyPEM(priv ed25519.PrivateKey) ([]byte, error) {
+	b, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), nil
+}
+
+// MarshalPublicKeyPEM 公開鍵をPEM形式(PKIX)に変換する
+func MarshalPublicKeyPEM(pub ed25519.PublicKey) ([]byte, error) {
+	b, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), nil
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,124 @@
+package offlinetoken
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func generateKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func TestVerify(t *testing.T) {
+	pub, priv := generateKey(t)
+	otherPub, otherPriv := generateKey(t)
+	now := time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC)
+	claims := &Claims{
+		TokenID:        "token-1",
+		CustomerID:     "cus_1",
+		SubscriptionID: "sub-ramen",
+		PlanID:         "plan-a",
+		BenefitIDs:     []string{"b-ramen"},
+		IssuedAt:       now.Unix(),
+		ExpiresAt:      now.Add(10 * time.Minute).Unix(),
+	}
+	token, err := (&Signer{KeyID: "key-1", PrivateKey: priv}).Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := (&Signer{KeyID: "key-1", PrivateKey: otherPriv}).Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := KeySet{"key-1": pub, "key-2": otherPub}
+
+	tests := []struct {
+		name    string
+		token   string
+		keys    KeySet
+		now     time.Time
+		wantErr error
+	}{
+		{name: "valid", token: token, keys: keys, now: now},
+		// 店舗の端末の時計が遅れていても、clockSkewの範囲であれば受け付ける
+		{name: "clock behind", token: token, keys: keys, now: now.Add(-clockSkew)},
+		{name: "not yet valid", token: token, keys: keys, now: now.Add(-clockSkew - time.Second), wantErr: ErrNotYetValid},
+		{name: "expired", token: token, keys: keys, now: now.Add(10 * time.Minute), wantErr: ErrExpired},
+		{name: "unknown key", token: token, keys: KeySet{"key-2": pub}, now: now, wantErr: ErrUnknownKey},
+		{name: "signed with another key", token: otherToken, keys: keys, now: now, wantErr: ErrInvalidSignature},
+		{name: "tampered claims", token: replaceSegment(token, 1, `{"sub":"cus_2","exp":9999999999}`), keys: keys, now: now, wantErr: ErrInvalidSignature},
+		{name: "other algorithm", token: replaceSegment(token, 0, `{"alg":"none","typ":"offline-entitlement+jwt","kid":"key-1"}`), keys: keys, now: now, wantErr: ErrMalformed},
+		{name: "other type", token: replaceSegment(token, 0, `{"alg":"EdDSA","typ":"JWT","kid":"key-1"}`), keys: keys, now: now, wantErr: ErrMalformed},
+		{name: "malformed", token: "token", keys: keys, now: now, wantErr: ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Verify(tt.token, tt.keys, tt.now)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Verify() = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, claims) {
+				t.Errorf("Verify() = %+v, want %+v", got, claims)
+			}
+			if !got.HasBenefit("b-ramen") || got.HasBenefit("b-topping") {
+				t.Errorf("HasBenefit() = %v, want only b-ramen", got.BenefitIDs)
+			}
+		})
+	}
+}
+
+// replaceSegment トークンのi番目のセグメントをjsonに置き換える
+func replaceSegment(token string, i int, json string) string {
+	parts := strings.Split(token, ".")
+	parts[i] = base64.RawURLEncoding.EncodeToString([]byte(json))
+	return strings.Join(parts, ".")
+}
+
+func TestPEM(t *testing.T) {
+	pub, priv := generateKey(t)
+
+	b, err := MarshalPrivateKeyPEM(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotPriv, err := ParsePrivateKeyPEM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotPriv.Equal(priv) {
+		t.Error("ParsePrivateKeyPEM() returned a different key")
+	}
+
+	b, err = MarshalPublicKeyPEM(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotPub, err := ParsePublicKeyPEM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotPub.Equal(pub) {
+		t.Error("ParsePublicKeyPEM() returned a different key")
+	}
+
+	if _, err := ParsePublicKeyPEM([]byte("not a PEM")); err == nil {
+		t.Error("ParsePublicKeyPEM() with an invalid PEM succeeded")
+	}
+}
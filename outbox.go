@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+const (
+	// outboxRetryDelay リクエスト内で同期的に実行中の操作と重複しないよう、最後の更新からこの時間が経過した操作のみ再実行する
+	outboxRetryDelay = time.Minute
+	outboxBatchSize  = 20
+	// outboxMaxAttempts 一時的なエラーで失敗し続けた操作は、この回数で失敗として終了する
+	outboxMaxAttempts = 10
+	// outboxMaxAge Stripeの冪等キーは24時間で失効し、再実行で同じ処理が2重に行われる可能性があるため、作成からこの時間が経過した操作は実行しない
+	outboxMaxAge = 23 * time.Hour
+)
+
+// errOutboxExpired 作成からoutboxMaxAgeが経過し、実行せずに失敗とした操作のエラー
+var errOutboxExpired = errors.New("outbox operation expired before it could be executed")
+
+// dispatchOutboxOperation Outboxに記録した操作をStripeに対して実行し、結果をUserSubscriptionに反映する
+// Stripeの操作には操作毎の冪等キーを指定するため、同じ操作を複数回実行してもStripe上の処理は1度しか行われない
+func dispatchOutboxOperation(ctx context.Context, id string) (*stripe.Subscription, error) {
+	var op *OutboxOperation
+	err := repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		var err error
+		op, err = tx.GetOutboxOperation(id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if op.Status != OutboxStatusPending {
+		return nil, apperror.Conflict(fmt.Sprintf("outbox operation %s is already %s", op.ID, op.Status))
+	}
+	if time.Since(op.CreatedAt) >= outboxMaxAge {
+		if rerr := recordOutboxFailure(ctx, op.ID, errOutboxExpired); rerr != nil {
+			log.Printf("recordOutboxFailure: %v", rerr)
+		}
+		return nil, apperror.Internal(fmt.Errorf("outbox operation %s: %w", op.ID, errOutboxExpired))
+	}
+
+	s, err := executeOutboxOperation(op)
+	if err != nil {
+		if rerr := recordOutboxFailure(ctx, op.ID, err); rerr != nil {
+			log.Printf("recordOutboxFailure: %v", rerr)
+		}
+		return nil, handleStripeError(err)
+	}
+
+	var orphaned bool
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		orphaned = false
+		op, err := tx.GetOutboxOperation(id)
+		if err != nil {
+			return err
+		}
+		if op.Status == OutboxStatusDone {
+			// 別の実行で既に反映済み
+			return nil
+		}
+
+		var ub *UserSubscription
+		if op.Kind == OutboxOperationCreateSubscription {
+			// 別の操作で作成したUserSubscriptionを上書きせず、作成したStripe Subscriptionは紐付けずにキャンセルする
+			switch prev, err := tx.GetUserSubscription(op.UserSubscriptionID); {
+			case err == ErrNotFound:
+			case err != nil:
+				return err
+			case prev.StripeSubscriptionID != s.ID && prev.Status != stripe.SubscriptionStatusCanceled && prev.Status != stripe.SubscriptionStatusIncompleteExpired:
+				orphaned = true
+				op.Status = OutboxStatusFailed
+				op.LastError = fmt.Sprintf("user subscription %s already has stripe subscription %s", prev.ID, prev.StripeSubscriptionID)
+				op.ResultStripeSubscriptionID = s.ID
+				op.UpdatedAt = time.Now()
+				return tx.UpdateOutboxOperation(op)
+			}
+		} else {
+			ub, err = tx.GetUserSubscription(op.UserSubscriptionID)
+			if err != nil {
+				return err
+			}
+		}
+
+		// トライアルの利用はStripe上での作成に成功した場合のみ記録する
+		// Firestoreのトランザクションでは読み込みを書き込みより前に行う必要があるため、操作の更新より前に記録する
+		now := time.Now()
+		if err := recordTrialUsage(tx, op, now); err != nil {
+			return err
+		}
+
+		op.Status = OutboxStatusDone
+		op.ResultStripeSubscriptionID = s.ID
+		op.UpdatedAt = now
+		if err := tx.UpdateOutboxOperation(op); err != nil {
+			return err
+		}
+
+		if op.RetentionOfferID != "" {
+			ub.RetentionOfferID = op.RetentionOfferID
+			ub.RetentionOfferAcceptedAt = op.UpdatedAt
+		}
+		switch op.Kind {
+		case OutboxOperationCreateSubscription:
+			ub = NewUserSubscription(op.UserSubscriptionID, op.CustomerID, op.SubscriptionID, op.PlanID, s, op.UpdatedAt)
+			_, err := tx.CreateUserSubscription(ub)
+			return err
+		case OutboxOperationReCreateSubscription:
+			// 解約したSubscriptionの解約・返金の記録は、再登録した新しいSubscriptionに引き継がない
+			ub.ResetCancellation()
+			ub.RenewalAll(op.PlanID, s, op.UpdatedAt)
+		case OutboxOperationChangePlanImmediately:
+			// サブスクリプションプランのデータを更新する
+			ub.RenewalAll(op.PlanID, s, op.UpdatedAt)
+		case OutboxOperationChangePlanAtPeriodEnd:
+			// アプリ上で変更後のプランに関する情報を表示するため、DB上に変更後のPlanIDとScheduleのIDを保持しておく
+			ub.NextPlanID = op.PlanID
+			ub.StripeScheduleID = scheduleID(s)
+		case OutboxOperationCancelPlanChange:
+			ub.NextPlanID = ""
+			ub.SyncStatus(s, op.UpdatedAt)
+		case OutboxOperationCancelAtPeriodEnd:
+			if op.StripeScheduleID != "" {
+				ub.NextPlanID = ""
+			}
+			ub.CancellationMode = CancellationAtPeriodEnd
+			ub.CancellationReason = op.CancellationReason
+			ub.CancellationComment = op.CancellationComment
+			ub.SyncStatus(s, op.UpdatedAt)
+		case OutboxOperationResumeSubscription, OutboxOperationApplyCoupon, OutboxOperationPauseBilling, OutboxOperationResumeBilling:
+			ub.SyncStatus(s, op.UpdatedAt)
+		case OutboxOperationCancelImmediately:
+			ub.NextPlanID = ""
+			ub.CancellationMode = CancellationImmediately
+			ub.CancellationReason = op.CancellationReason
+			ub.CancellationComment = op.CancellationComment
+			ub.RefundMode = op.RefundMode
+			ub.RefundAmount = cancellationRefundAmount(op.RefundMode, s)
+			ub.SyncStatus(s, op.UpdatedAt)
+		case OutboxOperationUpdatePaymentSource:
+			return nil
+		}
+		return tx.UpdateUserSubscription(ub)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if orphaned {
+		if err := cancelOrphanedSubscription(op, s.ID); err != nil {
+			log.Printf("cancelOrphanedSubscription: stripe subscription %s is not linked to any user subscription and must be canceled, %v", s.ID, err)
+		}
+		return nil, apperror.Conflict("user subscription already exists")
+	}
+	return s, nil
+}
+
+// cancelOrphanedSubscription UserSubscriptionに紐付けられなかったStripe Subscriptionを即時にキャンセルし、支払い済みの請求を全額返金する
+func cancelOrphanedSubscription(op *OutboxOperation, id string) error {
+	params := &stripe.SubscriptionCancelParams{}
+	params.AddExpand("latest_invoice")
+	params.SetIdempotencyKey(op.StepIdempotencyKey("cancel-orphan"))
+	s, err := billing.CancelSubscription(id, params)
+	if err != nil {
+		return err
+	}
+	amount := cancellationRefundAmount(RefundFull, s)
+	if amount <= 0 {
+		return nil
+	}
+	refund := &stripe.RefundParams{
+		PaymentIntent: stripe.String(s.LatestInvoice.PaymentIntent.ID),
+		Amount:        stripe.Int64(amount),
+		Reason:        stripe.String(string(stripe.RefundReasonDuplicate)),
+	}
+	refund.AddMetadata("subscription_id", op.SubscriptionID)
+	refund.SetIdempotencyKey(op.StepIdempotencyKey("refund-orphan"))
+	_, err = billing.NewRefund(refund)
+	return err
+}
+
+// rejectPendingCreation UserSubscriptionのStripe Subscriptionを作成する別の操作が未実行の場合、2重に作成しないようConflictを返す
+func rejectPendingCreation(tx SubscriptionTx, op *OutboxOperation) error {
+	pending, err := tx.ListPendingOutboxOperationsByUserSubscription(op.UserSubscriptionID)
+	if err != nil {
+		return err
+	}
+	for _, p := range pending {
+		if p.ID != op.ID && (p.Kind == OutboxOperationCreateSubscription || p.Kind == OutboxOperationReCreateSubscription) {
+			return apperror.Conflict("user subscription is being created by another request")
+		}
+	}
+	return nil
+}
+
+// saveOutboxOperation opを記録する
+// Idempotency-Keyを指定したリクエストの再送で同じIDの操作が記録済みの場合は、opを記録済みの操作で置き換えて再利用する
+func saveOutboxOperation(tx SubscriptionTx, op *OutboxOperation) error {
+	switch prev, err := tx.GetOutboxOperation(op.ID); {
+	case err == ErrNotFound:
+		return tx.CreateOutboxOperation(op)
+	case err != nil:
+		return err
+	default:
+		*op = *prev
+		return nil
+	}
+}
+
+// recordOutboxFailure 操作の失敗を記録する。再実行しても成功しないエラーの場合や、再実行の上限に達した場合は操作を失敗として終了する
+func recordOutboxFailure(ctx context.Context, id string, cause error) error {
+	return repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		op, err := tx.GetOutboxOperation(id)
+		if err != nil {
+			return err
+		}
+		op.Attempts++
+		op.LastError = cause.Error()
+		op.UpdatedAt = time.Now()
+		if !isRetryableStripeError(cause) || op.Attempts >= outboxMaxAttempts || op.UpdatedAt.Sub(op.CreatedAt) >= outboxMaxAge {
+			op.Status = OutboxStatusFailed
+		}
+		return tx.UpdateOutboxOperation(op)
+	})
+}
+
+// dispatchPendingOutboxOperations 一時的なエラー等で実行されずに残っている操作を再実行する
+func dispatchPendingOutboxOperations(ctx context.Context, now time.Time) error {
+	var ops []*OutboxOperation
+	err := repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		var err error
+		ops, err = tx.ListPendingOutboxOperations(outboxBatchSize)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.UpdatedAt.After(now.Add(-outboxRetryDelay)) {
+			continue
+		}
+		if _, err := dispatchOutboxOperation(ctx, op.ID); err != nil {
+			log.Printf("dispatchOutboxOperation: id=%s, %v", op.ID, err)
+		}
+	}
+	return nil
+}
+
+// runOutboxDispatcher ctxがキャンセルされるまで、interval毎に未実行の操作を再実行する
+func runOutboxDispatcher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := dispatchPendingOutboxOperations(ctx, now); err != nil {
+				log.Printf("dispatchPendingOutboxOperations: %v", err)
+			}
+		}
+	}
+}
+
+func executeOutboxOperation(op *OutboxOperation) (*stripe.Subscription, error) {
+	switch op.Kind {
+	case OutboxOperationCreateSubscription:
+		return newStripeSubscription(op, op.IdempotencyKey)
+	case OutboxOperationReCreateSubscription:
+		// 既存のStripe Subscriptionをキャンセルする
+		params := &stripe.SubscriptionCancelParams{}
+		params.SetIdempotencyKey(op.StepIdempotencyKey("cancel"))
+		_, err := billing.CancelSubscription(op.StripeSubscriptionID, params)
+		if err != nil {
+			if stripeErr, ok := err.(*stripe.Error); ok {
+				if stripeErr.HTTPStatusCode == 404 {
+					// already canceled
+				} else {
+					return nil, err
+				}
+			} else {
+				return nil, err
+			}
+		}
+		// Subscriptionを新規登録する
+		return newStripeSubscription(op, op.StepIdempotencyKey("create"))
+	case OutboxOperationChangePlanAtPeriodEnd:
+		// 現在の請求期間の終了時に変更後のプランへ切り替えるSubscription Scheduleを設定する https://stripe.com/docs/billing/subscriptions/subscription-schedules
+		// 請求期間の途中の請求やダッシュボード上の表示は、切り替えまで変更前のプランのままとなる
+		if err := scheduleStripePlanChange(op); err != nil {
+			return nil, err
+		}
+		return billing.GetSubscription(op.StripeSubscriptionID, nil)
+	case OutboxOperationChangePlanImmediately:
+		// 予約中のプラン変更を取り消してから、プランを変更して請求期間をリセットする
+		// 変更前のプランの未使用期間分は日割りで返金し、新しいプランの全額と相殺して即時に請求する
+		if err := releaseStripeSchedule(op); err != nil {
+			return nil, err
+		}
+		params := &stripe.SubscriptionParams{
+			Items:                 immediatePlanChangeItems(op.StripeSubscriptionItemID, op.StripePriceID),
+			BillingCycleAnchorNow: stripe.Bool(true),
+			ProrationBehavior:     stripe.String(string(immediatePlanChangeProrationBehavior)),
+			CancelAtPeriodEnd:     stripe.Bool(false),
+		}
+		if op.ProrationDate > 0 {
+			params.ProrationDate = stripe.Int64(op.ProrationDate)
+		}
+		params.AddMetadata("plan_id", op.PlanID)
+		params.AddExpand("latest_invoice.payment_intent") // レスポンスとして最新のInvoiceに紐づくPaymentIntentを取得したいためAddExpandに指定しておく
+		params.SetIdempotencyKey(op.StepIdempotencyKey("subscription"))
+		return billing.UpdateSubscription(op.StripeSubscriptionID, params)
+	case OutboxOperationCancelPlanChange:
+		// 予約中のプラン変更のSubscription Scheduleを解放し、SubscriptionItemのPriceとmetadataを現在のプランに揃える
+		// Scheduleの導入前にPriceを直接差し替えていたSubscriptionも、この更新で現在のプランに戻る
+		if err := releaseStripeSchedule(op); err != nil {
+			return nil, err
+		}
+		params := &stripe.SubscriptionParams{
+			Items:             immediatePlanChangeItems(op.StripeSubscriptionItemID, op.StripePriceID),
+			ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorNone)),
+		}
+		params.AddMetadata("plan_id", op.PlanID)
+		params.SetIdempotencyKey(op.StepIdempotencyKey("restore"))
+		return billing.UpdateSubscription(op.StripeSubscriptionID, params)
+	case OutboxOperationCancelAtPeriodEnd:
+		// 予約中のプラン変更を取り消し、自動更新を無効にする https://stripe.com/docs/billing/subscriptions/cancel
+		if err := releaseStripeSchedule(op); err != nil {
+			return nil, err
+		}
+		params := &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(true),
+		}
+		addCancellationDetails(&params.Params, op)
+		params.SetIdempotencyKey(op.IdempotencyKey)
+		return billing.UpdateSubscription(op.StripeSubscriptionID, params)
+	case OutboxOperationResumeSubscription:
+		// 解約の予約を取り消し、自動更新を再開する
+		params := &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(false),
+		}
+		params.SetIdempotencyKey(op.IdempotencyKey)
+		return billing.UpdateSubscription(op.StripeSubscriptionID, params)
+	case OutboxOperationCancelImmediately:
+		// Subscriptionを即時にキャンセルし、返金方法に従って最新の請求を返金する
+		// 予約中のプラン変更のSubscription ScheduleはSubscriptionと共にキャンセルされる
+		params := &stripe.SubscriptionCancelParams{}
+		addCancellationDetails(&params.Params, op)
+		params.AddExpand("latest_invoice") // 返金額の計算に最新の請求の支払い額を利用する
+		params.SetIdempotencyKey(op.StepIdempotencyKey("cancel"))
+		s, err := billing.CancelSubscription(op.StripeSubscriptionID, params)
+		if err != nil {
+			return nil, err
+		}
+		if err := refundLatestInvoice(op, s); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case OutboxOperationApplyCoupon:
+		// 引き止めの特典のクーポンを適用する。適用中の割引は置き換えられる
+		params := &stripe.SubscriptionParams{
+			Coupon: stripe.String(op.StripeCouponID),
+		}
+		params.SetIdempotencyKey(op.IdempotencyKey)
+		return billing.UpdateSubscription(op.StripeSubscriptionID, params)
+	case OutboxOperationPauseBilling:
+		// 請求を一時停止する。請求期間は継続し、一時停止中に作成されるInvoiceはbehaviorに従って処理される
+		// https://stripe.com/docs/billing/subscriptions/pause
+		params := &stripe.SubscriptionParams{
+			PauseCollection: &stripe.SubscriptionPauseCollectionParams{
+				Behavior: stripe.String(string(op.PauseBehavior)),
+			},
+		}
+		if op.ResumesAt > 0 {
+			params.PauseCollection.ResumesAt = stripe.Int64(op.ResumesAt)
+		}
+		params.SetIdempotencyKey(op.IdempotencyKey)
+		return billing.UpdateSubscription(op.StripeSubscriptionID, params)
+	case OutboxOperationResumeBilling:
+		// pause_collectionに空文字を指定して一時停止を解除する。stripe-go v72のパラメータでは空文字を送信できないためExtraで指定する
+		params := &stripe.SubscriptionParams{}
+		params.AddExtra("pause_collection", "")
+		params.SetIdempotencyKey(op.IdempotencyKey)
+		return billing.UpdateSubscription(op.StripeSubscriptionID, params)
+	case OutboxOperationUpdatePaymentSource:
+		// 支払い方法を変更する https://stripe.com/docs/api/subscriptions/update
+		params := &stripe.SubscriptionParams{
+			DefaultSource: stripe.String(op.SourceID),
+		}
+		params.SetIdempotencyKey(op.IdempotencyKey)
+		return billing.UpdateSubscription(op.StripeSubscriptionID, params)
+	}
+	return nil, fmt.Errorf("unknown outbox operation kind: %s", op.Kind)
+}
+
+// newStripeSubscription Stripe上にてSubscriptionを作成する https://stripe.com/docs/api/subscriptions/create
+func newStripeSubscription(op *OutboxOperation, idempotencyKey string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{
+		Customer: stripe.String(op.CustomerID),
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				Price:    stripe.String(op.StripePriceID), // ユーザーが選択したサブスクリプションプランのPriceIDをセットする
+				Quantity: stripe.Int64(1),                 // 数量、今回は1プランを契約する
+			},
+		},
+		CancelAtPeriodEnd: stripe.Bool(false),                                              // 自動更新有無、falseにすることで期限が切れたらStripe側で自動更新される
+		ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorNone)), // 日割り計算に関するパラメータ。今回は日割りなしを想定しているのでNoneを選択する https://stripe.com/docs/billing/subscriptions/prorations
+		PaymentBehavior:   stripe.String("allow_incomplete"),                               // 支払い処理に関するパラメータ。決済処理まで一気に処理をすすめる場合は allow_incompleteを選択する
+	}
+	if op.TrialDays > 0 {
+		params.TrialPeriodDays = stripe.Int64(op.TrialDays) // トライアル期間中は請求されず、終了時に最初の請求が行われる
+	}
+	if op.PromotionCodeID != "" {
+		params.PromotionCode = stripe.String(op.PromotionCodeID)
+		params.AddExpand("discount.promotion_code") // 入力されたコードを記録するため展開する
+	}
+	params.AddMetadata("subscription_id", op.SubscriptionID)
+	params.AddMetadata("plan_id", op.PlanID)
+	params.AddExpand("latest_invoice.payment_intent") // レスポンスとして最新のInvoiceに紐づくPaymentIntentを取得したいためAddExpandに指定しておく
+	params.SetIdempotencyKey(idempotencyKey)          // 冪等キー
+	return billing.NewSubscription(params)
+}
+
+// scheduleStripePlanChange 現在のフェーズを維持したまま、次の請求期間から変更後のプランを適用するフェーズを設定する
+// 既にプラン変更を予約している場合は、同じScheduleの次のフェーズを置き換える
+func scheduleStripePlanChange(op *OutboxOperation) error {
+	var schedule *stripe.SubscriptionSchedule
+	var err error
+	if op.StripeScheduleID == "" {
+		params := &stripe.SubscriptionScheduleParams{
+			FromSubscription: stripe.String(op.StripeSubscriptionID),
+		}
+		params.SetIdempotencyKey(op.StepIdempotencyKey("schedule"))
+		schedule, err = billing.NewSubscriptionSchedule(params)
+	} else {
+		schedule, err = billing.GetSubscriptionSchedule(op.StripeScheduleID, nil)
+	}
+	if err != nil {
+		return err
+	}
+	current := currentSchedulePhase(schedule)
+	if current == nil {
+		return fmt.Errorf("subscription schedule %s has no current phase", schedule.ID)
+	}
+
+	currentPhase := &stripe.SubscriptionSchedulePhaseParams{
+		StartDate: stripe.Int64(current.StartDate),
+		EndDate:   stripe.Int64(current.EndDate),
+	}
+	for _, item := range current.Items {
+		currentPhase.Items = append(currentPhase.Items, &stripe.SubscriptionSchedulePhaseItemParams{
+			Price:    stripe.String(item.Price.ID),
+			Quantity: stripe.Int64(item.Quantity),
+		})
+	}
+	if current.TrialEnd > 0 {
+		currentPhase.TrialEnd = stripe.Int64(current.TrialEnd)
+	}
+	params := &stripe.SubscriptionScheduleParams{
+		EndBehavior: stripe.String(string(stripe.SubscriptionScheduleEndBehaviorRelease)), // 切り替え後はScheduleを解放し、通常のSubscriptionとして自動更新する
+		Phases: []*stripe.SubscriptionSchedulePhaseParams{
+			currentPhase,
+			{
+				Items: []*stripe.SubscriptionSchedulePhaseItemParams{
+					{Price: stripe.String(op.StripePriceID), Quantity: stripe.Int64(1)},
+				},
+				Iterations:        stripe.Int64(1),
+				ProrationBehavior: stripe.String(string(stripe.SubscriptionSchedulePhaseProrationBehaviorNone)),
+			},
+		},
+	}
+	// 切り替え時にSubscriptionのMetadataを変更後のプランのIDに更新する。stripe-goのフェーズのパラメータにmetadataがないため直接指定する
+	params.AddExtra("phases[1][metadata][plan_id]", op.PlanID)
+	params.SetIdempotencyKey(op.StepIdempotencyKey("phases"))
+	_, err = billing.UpdateSubscriptionSchedule(schedule.ID, params)
+	return err
+}
+
+// currentSchedulePhase Scheduleの現在のフェーズ
+func currentSchedulePhase(schedule *stripe.SubscriptionSchedule) *stripe.SubscriptionSchedulePhase {
+	if schedule.CurrentPhase == nil {
+		return nil
+	}
+	for _, phase := range schedule.Phases {
+		if phase.StartDate == schedule.CurrentPhase.StartDate {
+			return phase
+		}
+	}
+	return nil
+}
+
+// releaseStripeSchedule プラン変更を予約したSubscription Scheduleを解放する。Subscriptionは現在のプランのまま継続する
+func releaseStripeSchedule(op *OutboxOperation) error {
+	if op.StripeScheduleID == "" {
+		return nil
+	}
+	params := &stripe.SubscriptionScheduleReleaseParams{}
+	params.SetIdempotencyKey(op.StepIdempotencyKey("release"))
+	_, err := billing.ReleaseSubscriptionSchedule(op.StripeScheduleID, params)
+	if err == nil {
+		return nil
+	}
+	// 切り替えの完了やダッシュボードからの操作で既に解放されている場合は成功として扱う
+	schedule, gerr := billing.GetSubscriptionSchedule(op.StripeScheduleID, nil)
+	if gerr != nil || schedule.Status == stripe.SubscriptionScheduleStatusActive || schedule.Status == stripe.SubscriptionScheduleStatusNotStarted {
+		return err
+	}
+	return nil
+}
+
+// addCancellationDetails 解約理由をStripeのSubscriptionのcancellation_detailsに記録する
+// stripe-goのパラメータにcancellation_detailsがないため直接指定する
+func addCancellationDetails(params *stripe.Params, op *OutboxOperation) {
+	if op.CancellationReason != "" {
+		params.AddExtra("cancellation_details[feedback]", string(op.CancellationReason))
+	}
+	if op.CancellationComment != "" {
+		params.AddExtra("cancellation_details[comment]", op.CancellationComment)
+	}
+}
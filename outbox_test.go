@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+func TestOutbox_RetryAfterTransientError(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	e.fake.FailNextRequests(1)
+
+	code, body := e.post("/create-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-a"}`)
+	if code != http.StatusServiceUnavailable || errorCode(t, body) != "upstream_unavailable" {
+		t.Fatalf("create = %d %s, want 503 upstream_unavailable", code, body)
+	}
+	var op *OutboxOperation
+	mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+		ops, err := tx.ListPendingOutboxOperations(outboxBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(ops) != 1 {
+			t.Fatalf("len(pending) = %d, want 1", len(ops))
+		}
+		op = ops[0]
+		return nil
+	})
+	if op.Attempts != 1 || op.LastError == "" {
+		t.Errorf("Attempts = %d LastError = %q, want 1 and the error", op.Attempts, op.LastError)
+	}
+
+	// リクエスト内で実行中の操作と重複しないよう、最後の更新から outboxRetryDelay が経過するまでは再実行しない
+	if err := dispatchPendingOutboxOperations(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n := e.countRequests(http.MethodPost, "/v1/subscriptions"); n != 1 {
+		t.Fatalf("POST /v1/subscriptions called %d times, want 1", n)
+	}
+
+	if err := dispatchPendingOutboxOperations(ctx, time.Now().Add(outboxRetryDelay)); err != nil {
+		t.Fatal(err)
+	}
+	ub := e.userSubscription()
+	if ub.Status != stripe.SubscriptionStatusActive {
+		t.Errorf("Status = %s, want %s", ub.Status, stripe.SubscriptionStatusActive)
+	}
+	// 再実行でも同じ冪等キーを指定する
+	for _, r := range e.fake.Requests() {
+		if r.Method == http.MethodPost && r.Path == "/v1/subscriptions" && r.IdempotencyKey != op.IdempotencyKey {
+			t.Errorf("Idempotency-Key = %q, want %q", r.IdempotencyKey, op.IdempotencyKey)
+		}
+	}
+	mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+		got, err := tx.GetOutboxOperation(op.ID)
+		if err != nil {
+			return err
+		}
+		if got.Status != OutboxStatusDone || got.ResultStripeSubscriptionID != ub.StripeSubscriptionID {
+			t.Errorf("operation = %s %s, want done %s", got.Status, got.ResultStripeSubscriptionID, ub.StripeSubscriptionID)
+		}
+		return nil
+	})
+}
+
+func TestOutbox_DoneOperationIsNotExecutedAgain(t *testing.T) {
+	e := newTestEnv(t)
+	e.subscribe("plan-a")
+	reqs := e.fake.Requests()
+	var opID string
+	for _, r := range reqs {
+		if r.Method == http.MethodPost && r.Path == "/v1/subscriptions" {
+			opID = r.IdempotencyKey
+		}
+	}
+
+	_, err := dispatchOutboxOperation(context.Background(), opID)
+	if apperror.From(err).Code != apperror.CodeConflict {
+		t.Fatalf("dispatchOutboxOperation() on a done operation = %v, want conflict", err)
+	}
+	if n := len(e.fake.Requests()); n != len(reqs) {
+		t.Errorf("done operation called Stripe %d times", n-len(reqs))
+	}
+}
+
+func TestRecordOutboxFailure(t *testing.T) {
+	stripe500 := &stripe.Error{HTTPStatusCode: http.StatusInternalServerError, Type: stripe.ErrorTypeAPI}
+	now := time.Now()
+	tests := []struct {
+		name     string
+		cause    error
+		attempts int
+		age      time.Duration
+		want     OutboxStatus
+	}{
+		{name: "stripe 5xx", cause: stripe500, want: OutboxStatusPending},
+		{name: "stripe rate limit", cause: &stripe.Error{HTTPStatusCode: http.StatusTooManyRequests}, want: OutboxStatusPending},
+		{name: "network error", cause: &net.DNSError{Err: "timeout", IsTimeout: true}, want: OutboxStatusPending},
+		{name: "stripe invalid request", cause: &stripe.Error{HTTPStatusCode: http.StatusBadRequest, Type: stripe.ErrorTypeInvalidRequest}, want: OutboxStatusFailed},
+		{name: "local error", cause: errors.New("unknown outbox operation kind"), want: OutboxStatusFailed},
+		{name: "max attempts", cause: stripe500, attempts: outboxMaxAttempts - 1, want: OutboxStatusFailed},
+		{name: "max age", cause: stripe500, age: outboxMaxAge, want: OutboxStatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prevRepo := repo
+			t.Cleanup(func() { repo = prevRepo })
+			repo = NewMemoryRepository()
+			op := NewOutboxOperation("op-1", OutboxOperationCreateSubscription, now.Add(-tt.age))
+			op.Attempts = tt.attempts
+			mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+				return tx.CreateOutboxOperation(op)
+			})
+
+			if err := recordOutboxFailure(context.Background(), op.ID, tt.cause); err != nil {
+				t.Fatal(err)
+			}
+			mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+				got, err := tx.GetOutboxOperation(op.ID)
+				if err != nil {
+					return err
+				}
+				if got.Status != tt.want || got.Attempts != tt.attempts+1 || got.LastError != tt.cause.Error() {
+					t.Errorf("operation = %s attempts=%d error=%q, want %s attempts=%d", got.Status, got.Attempts, got.LastError, tt.want, tt.attempts+1)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestDispatchOutboxOperation_Expired(t *testing.T) {
+	e := newTestEnv(t)
+	op := NewOutboxOperation("op-1", OutboxOperationCreateSubscription, time.Now().Add(-outboxMaxAge))
+	op.UserSubscriptionID = e.sub.UserSubscriptionID(testCustomerID)
+	op.CustomerID = testCustomerID
+	op.SubscriptionID = e.sub.ID
+	op.PlanID = "plan-a"
+	op.StripePriceID = e.sub.Plan("plan-a").StripePriceID
+	mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+		return tx.CreateOutboxOperation(op)
+	})
+
+	// Stripeの冪等キーが失効している可能性があるため、実行せずに失敗とする
+	if _, err := dispatchOutboxOperation(context.Background(), op.ID); err == nil {
+		t.Fatal("dispatchOutboxOperation() succeeded")
+	}
+	if n := len(e.fake.Requests()); n != 0 {
+		t.Errorf("expired operation called Stripe %d times", n)
+	}
+	mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+		got, err := tx.GetOutboxOperation(op.ID)
+		if err != nil {
+			return err
+		}
+		if got.Status != OutboxStatusFailed || got.LastError != errOutboxExpired.Error() {
+			t.Errorf("operation = %s %q, want failed %q", got.Status, got.LastError, errOutboxExpired)
+		}
+		return nil
+	})
+}
+
+func TestCreateSubscription_RejectsWhilePendingCreation(t *testing.T) {
+	e := newTestEnv(t)
+	e.fake.FailNextRequests(1)
+	if code, body := e.post("/create-subscription", createPlanA); code != http.StatusServiceUnavailable {
+		t.Fatalf("create = %d %s, want 503", code, body)
+	}
+
+	// Outboxに作成の操作が残っている間は、別のリクエストで作成しない
+	if code, body := e.post("/create-subscription", createPlanA); code != http.StatusConflict {
+		t.Errorf("second create = %d %s, want 409", code, body)
+	}
+	if err := dispatchPendingOutboxOperations(context.Background(), time.Now().Add(outboxRetryDelay)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.fake.Subscriptions(testCustomerID)); n != 1 {
+		t.Errorf("len(Subscriptions()) = %d, want 1", n)
+	}
+}
+
+func TestDispatchOutboxOperation_OrphanedCreation(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-a")
+	op := NewOutboxOperation("op-1", OutboxOperationCreateSubscription, time.Now())
+	op.UserSubscriptionID = ub.ID
+	op.CustomerID = testCustomerID
+	op.SubscriptionID = e.sub.ID
+	op.PlanID = "plan-b"
+	op.StripePriceID = e.sub.Plan("plan-b").StripePriceID
+	mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+		return tx.CreateOutboxOperation(op)
+	})
+
+	// 既に契約中のUserSubscriptionは上書きせず、作成したStripe Subscriptionをキャンセルして返金する
+	_, err := dispatchOutboxOperation(context.Background(), op.ID)
+	if apperror.From(err).Code != apperror.CodeConflict {
+		t.Fatalf("dispatchOutboxOperation() = %v, want conflict", err)
+	}
+	if got := e.userSubscription(); got.StripeSubscriptionID != ub.StripeSubscriptionID || got.PlanID != "plan-a" {
+		t.Errorf("UserSubscription = %s %s, want %s plan-a", got.StripeSubscriptionID, got.PlanID, ub.StripeSubscriptionID)
+	}
+	var orphan *stripe.Subscription
+	for _, s := range e.fake.Subscriptions(testCustomerID) {
+		if s.ID != ub.StripeSubscriptionID {
+			orphan = s
+		}
+	}
+	if orphan == nil || orphan.Status != stripe.SubscriptionStatusCanceled {
+		t.Fatalf("orphaned subscription = %+v, want canceled", orphan)
+	}
+	var refunded int64
+	for _, r := range e.fake.Refunds(orphan.LatestInvoice.PaymentIntent.ID) {
+		refunded += r.Amount
+	}
+	if refunded != 350 {
+		t.Errorf("refunded = %d, want 350", refunded)
+	}
+	mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+		got, err := tx.GetOutboxOperation(op.ID)
+		if err != nil {
+			return err
+		}
+		if got.Status != OutboxStatusFailed || got.ResultStripeSubscriptionID != orphan.ID {
+			t.Errorf("operation = %s %s, want failed %s", got.Status, got.ResultStripeSubscriptionID, orphan.ID)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+type PauseBillingRequest struct {
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+	// Behavior 一時停止中に作成されるInvoiceの扱い。省略した場合は請求を行わずに無効化する(void)
+	Behavior stripe.SubscriptionPauseCollectionBehavior `json:"behavior,omitempty" validate:"pause_behavior"`
+	// ResumesAt 請求を再開する日時(Unix時間)。省略した場合は /resume-billing を呼び出すまで一時停止する
+	ResumesAt int64 `json:"resumes_at,omitempty"`
+}
+
+type PauseBillingResponse struct {
+	Behavior  stripe.SubscriptionPauseCollectionBehavior `json:"behavior"`
+	ResumesAt *time.Time                                 `json:"resumes_at,omitempty"`
+	// CurrentPeriodEnd 現在の請求期間の終了日時。一時停止中もこの日時に請求期間は更新されるが、請求は行われない
+	CurrentPeriodEnd time.Time `json:"current_period_end"`
+}
+
+// PauseBillingHandler 解約せずに請求を一時停止する。一時停止している間は特典を利用できない
+func PauseBillingHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	var req PauseBillingRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
+	if req.Behavior == "" {
+		req.Behavior = stripe.SubscriptionPauseCollectionBehaviorVoid
+	}
+	if req.ResumesAt != 0 && req.ResumesAt <= time.Now().Unix() {
+		writeError(w, "pauseBillingHandler", apperror.ValidationFailed([]apperror.FieldError{{
+			Field:   "resumes_at",
+			Message: "must be in the future",
+		}}))
+		return
+	}
+
+	op := NewOutboxOperation(outboxOperationID(r), OutboxOperationPauseBilling, time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case ub.Status == stripe.SubscriptionStatusCanceled || ub.CancelAtPeriodEnd:
+			return apperror.Conflict("subscription is already canceled")
+		case ub.Status == stripe.SubscriptionStatusIncomplete || ub.Status == stripe.SubscriptionStatusIncompleteExpired:
+			return apperror.Conflict("subscription is not active")
+		case ub.Paused():
+			return apperror.Conflict("billing is already paused")
+		}
+
+		op.UserSubscriptionID = ub.ID
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.StripeSubscriptionID = ub.StripeSubscriptionID
+		op.PauseBehavior = req.Behavior
+		op.ResumesAt = req.ResumesAt
+		return saveOutboxOperation(tx, op)
+	})
+	if err != nil {
+		writeError(w, "pauseBillingHandler", err)
+		return
+	}
+	s, err := dispatchOutboxOperation(ctx, op.ID)
+	if err != nil {
+		writeError(w, "pauseBillingHandler", err)
+		return
+	}
+
+	res := PauseBillingResponse{
+		Behavior:         s.PauseCollection.Behavior,
+		CurrentPeriodEnd: time.Unix(s.CurrentPeriodEnd, 0),
+	}
+	if s.PauseCollection.ResumesAt > 0 {
+		resumesAt := time.Unix(s.PauseCollection.ResumesAt, 0)
+		res.ResumesAt = &resumesAt
+	}
+	writeJSON(w, "pauseBillingHandler", res)
+}
+
+type ResumeBillingRequest struct {
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+}
+
+// ResumeBillingHandler 一時停止中の請求を再開する。次回の請求期間の更新から請求が行われる
+func ResumeBillingHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	var req ResumeBillingRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
+
+	op := NewOutboxOperation(outboxOperationID(r), OutboxOperationResumeBilling, time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case ub.Status == stripe.SubscriptionStatusCanceled:
+			return apperror.Conflict("subscription is already canceled")
+		case !ub.Paused():
+			return apperror.Conflict("billing is not paused")
+		}
+
+		op.UserSubscriptionID = ub.ID
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.StripeSubscriptionID = ub.StripeSubscriptionID
+		return saveOutboxOperation(tx, op)
+	})
+	if err != nil {
+		writeError(w, "resumeBillingHandler", err)
+		return
+	}
+	if _, err := dispatchOutboxOperation(ctx, op.ID); err != nil {
+		writeError(w, "resumeBillingHandler", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
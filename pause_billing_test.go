@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/entitlement"
+)
+
+func TestPauseBilling(t *testing.T) {
+	e := newTestEnv(t)
+	e.subscribe("plan-a")
+	resumesAt := time.Now().AddDate(0, 0, 10).Unix()
+
+	var res PauseBillingResponse
+	e.mustPost("/pause-billing", fmt.Sprintf(`{"subscription_id":"sub-ramen","behavior":"keep_as_draft","resumes_at":%d}`, resumesAt), &res)
+	if res.Behavior != stripe.SubscriptionPauseCollectionBehaviorKeepAsDraft || res.ResumesAt == nil || res.ResumesAt.Unix() != resumesAt {
+		t.Errorf("response = %+v, want keep_as_draft until %d", res, resumesAt)
+	}
+	if pc := e.stripeSubscription().PauseCollection; pc.Behavior != stripe.SubscriptionPauseCollectionBehaviorKeepAsDraft || pc.ResumesAt != resumesAt {
+		t.Errorf("stripe pause_collection = %+v, want keep_as_draft until %d", pc, resumesAt)
+	}
+	ub := e.userSubscription()
+	if !ub.Paused() || ub.PausedAt.IsZero() || ub.ResumesAt.Unix() != resumesAt {
+		t.Errorf("UserSubscription pause = %s paused_at %v resumes_at %v, want paused until %d", ub.PauseBehavior, ub.PausedAt, ub.ResumesAt, resumesAt)
+	}
+
+	// Webhookで反映しても一時停止した日時は変わらない
+	e.deliverEvents()
+	if got := e.userSubscription(); !got.Paused() || !got.PausedAt.Equal(ub.PausedAt) {
+		t.Errorf("after the webhook paused = %v paused_at %v, want paused at %v", got.Paused(), got.PausedAt, ub.PausedAt)
+	}
+	if res := e.checkEntitlement("b-ramen"); res.Granted || res.Reason != entitlement.ReasonPaused {
+		t.Errorf("entitlement while paused = %+v, want paused", res)
+	}
+	if code, body := e.post("/pause-billing", `{"subscription_id":"sub-ramen"}`); code != http.StatusConflict {
+		t.Errorf("pause twice = %d %s, want 409", code, body)
+	}
+
+	e.mustPost("/resume-billing", `{"subscription_id":"sub-ramen"}`, nil)
+	if pc := e.stripeSubscription().PauseCollection; pc.Behavior != "" {
+		t.Errorf("stripe pause_collection = %+v, want cleared", pc)
+	}
+	e.deliverEvents()
+	if got := e.userSubscription(); got.Paused() || !got.PausedAt.IsZero() || !got.ResumesAt.IsZero() {
+		t.Errorf("after resuming pause = %q paused_at %v resumes_at %v, want cleared", got.PauseBehavior, got.PausedAt, got.ResumesAt)
+	}
+	if res := e.checkEntitlement("b-ramen"); !res.Granted {
+		t.Errorf("entitlement after resuming = %+v, want granted", res)
+	}
+	if code, body := e.post("/resume-billing", `{"subscription_id":"sub-ramen"}`); code != http.StatusConflict {
+		t.Errorf("resume twice = %d %s, want 409", code, body)
+	}
+}
+
+func TestPauseBilling_Rejected(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(e *testEnv)
+		body  string
+		want  int
+	}{
+		{name: "canceled", setup: func(e *testEnv) {
+			e.mustPost("/cancel-subscription-immediately", `{"subscription_id":"sub-ramen"}`, nil)
+		}, body: `{"subscription_id":"sub-ramen"}`, want: http.StatusConflict},
+		{name: "cancel at period end", setup: func(e *testEnv) {
+			e.mustPost("/cancel-subscription", `{"subscription_id":"sub-ramen","decline_retention_offer":true}`, nil)
+		}, body: `{"subscription_id":"sub-ramen"}`, want: http.StatusConflict},
+		{name: "already paused", setup: func(e *testEnv) {
+			e.mustPost("/pause-billing", `{"subscription_id":"sub-ramen","behavior":"void"}`, nil)
+		}, body: `{"subscription_id":"sub-ramen","behavior":"mark_uncollectible"}`, want: http.StatusConflict},
+		{name: "resumes_at in the past", body: fmt.Sprintf(`{"subscription_id":"sub-ramen","resumes_at":%d}`, time.Now().Add(-time.Hour).Unix()), want: http.StatusBadRequest},
+		{name: "unknown behavior", body: `{"subscription_id":"sub-ramen","behavior":"stop"}`, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.subscribe("plan-a")
+			if tt.setup != nil {
+				tt.setup(e)
+				e.deliverEvents()
+			}
+			before := e.countRequests(http.MethodPost, "/v1/subscriptions/")
+			if code, body := e.post("/pause-billing", tt.body); code != tt.want {
+				t.Errorf("pause = %d %s, want %d", code, body, tt.want)
+			}
+			if n := e.countRequests(http.MethodPost, "/v1/subscriptions/"); n != before {
+				t.Errorf("rejected pause called Stripe %d times", n-before)
+			}
+		})
+	}
+}
+
+func TestPauseBilling_Webhook(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-a")
+
+	// ダッシュボードで一時停止した場合も、Webhookで一時停止を反映する
+	params := &stripe.SubscriptionParams{PauseCollection: &stripe.SubscriptionPauseCollectionParams{
+		Behavior: stripe.String(string(stripe.SubscriptionPauseCollectionBehaviorMarkUncollectible)),
+	}}
+	if _, err := billing.UpdateSubscription(ub.StripeSubscriptionID, params); err != nil {
+		t.Fatal(err)
+	}
+	paused := e.lastEvent("customer.subscription.updated")
+	e.deliverEvents()
+	got := e.userSubscription()
+	if got.PauseBehavior != stripe.SubscriptionPauseCollectionBehaviorMarkUncollectible || !got.PausedAt.Equal(time.Unix(paused.Created, 0)) {
+		t.Errorf("UserSubscription pause = %q paused_at %v, want mark_uncollectible at %v", got.PauseBehavior, got.PausedAt, time.Unix(paused.Created, 0))
+	}
+
+	resume := &stripe.SubscriptionParams{}
+	resume.AddExtra("pause_collection", "")
+	if _, err := billing.UpdateSubscription(ub.StripeSubscriptionID, resume); err != nil {
+		t.Fatal(err)
+	}
+	e.deliverEvents()
+	if got := e.userSubscription(); got.Paused() || !got.PausedAt.IsZero() {
+		t.Errorf("after resuming pause = %q paused_at %v, want cleared", got.PauseBehavior, got.PausedAt)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+// PaymentNextStep 支払いの結果を受けてクライアントが次に行うこと
+type PaymentNextStep string
+
+const (
+	// PaymentNextStepNone 支払いが完了した、または支払いが発生しない
+	PaymentNextStepNone PaymentNextStep = "none"
+	// PaymentNextStepConfirmPayment 3Dセキュア認証が必要。client_secretを指定してStripe.jsのconfirmCardPaymentを呼び出す
+	PaymentNextStepConfirmPayment PaymentNextStep = "confirm_payment"
+	// PaymentNextStepUpdatePaymentMethod カードが拒否された。/update-subscription-payment で支払い方法を変更するか、別のカードでconfirmCardPaymentを呼び出す
+	PaymentNextStepUpdatePaymentMethod PaymentNextStep = "update_payment_method"
+	// PaymentNextStepWait 決済の処理中。結果はWebhookで反映されるため、時間をおいて契約状態を確認する
+	PaymentNextStepWait PaymentNextStep = "wait"
+)
+
+// paymentNextStep PaymentIntentのstatusからクライアントが次に行うことを返す https://stripe.com/docs/payments/intents#intent-statuses
+func paymentNextStep(intent *stripe.PaymentIntent) PaymentNextStep {
+	if intent == nil {
+		return PaymentNextStepNone
+	}
+	switch intent.Status {
+	case stripe.PaymentIntentStatusRequiresAction, stripe.PaymentIntentStatusRequiresConfirmation:
+		return PaymentNextStepConfirmPayment
+	case stripe.PaymentIntentStatusRequiresPaymentMethod:
+		return PaymentNextStepUpdatePaymentMethod
+	case stripe.PaymentIntentStatusProcessing:
+		return PaymentNextStepWait
+	}
+	return PaymentNextStepNone
+}
+
+type GetPaymentActionRequest struct {
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+}
+
+// PaymentActionResponse 未払いの最新の請求と、支払いを完了するためにクライアントが行うこと
+type PaymentActionResponse struct {
+	InvoiceID    string                     `json:"invoice_id"`
+	AmountDue    int64                      `json:"amount_due"`
+	Currency     stripe.Currency            `json:"currency"`
+	Status       stripe.PaymentIntentStatus `json:"status"`
+	ClientSecret string                     `json:"client_secret"`
+	NextStep     PaymentNextStep            `json:"next_step"`
+}
+
+// GetPaymentActionHandler 呼び出し元のSubscriptionの未払いの最新の請求について、PaymentIntentの最新のclient_secretを返す
+// 更新時の3Dセキュア認証(invoice.payment_action_required)や支払いの失敗の後、クライアントで支払いをやり直すために利用する
+func GetPaymentActionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, "getPaymentActionHandler", apperror.MethodNotAllowed(r.Method))
+		return
+	}
+	req := GetPaymentActionRequest{SubscriptionID: r.URL.Query().Get("subscription_id")}
+	if err := validateRequest(&req); err != nil {
+		writeError(w, "validateRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, "")
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+
+	var ub *UserSubscription
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		ub, err = getUserSubscription(tx, sub, customerID)
+		return err
+	})
+	if err != nil {
+		writeError(w, "getPaymentActionHandler", err)
+		return
+	}
+	if ub.Status == stripe.SubscriptionStatusCanceled || ub.Status == stripe.SubscriptionStatusIncompleteExpired {
+		writeError(w, "getPaymentActionHandler", apperror.Conflict("subscription is already canceled"))
+		return
+	}
+
+	params := &stripe.InvoiceListParams{
+		Subscription: stripe.String(ub.StripeSubscriptionID),
+		Status:       stripe.String(string(stripe.InvoiceStatusOpen)),
+	}
+	params.Limit = stripe.Int64(1)
+	params.Single = true
+	params.AddExpand("data.payment_intent")
+	invoices, err := billing.ListInvoices(params)
+	if err != nil {
+		writeError(w, "getPaymentActionHandler", handleStripeError(err))
+		return
+	}
+	if len(invoices) == 0 || invoices[0].PaymentIntent == nil || paymentNextStep(invoices[0].PaymentIntent) == PaymentNextStepNone {
+		writeError(w, "getPaymentActionHandler", apperror.Conflict("no open invoice requires payment"))
+		return
+	}
+
+	inv := invoices[0]
+	writeJSON(w, "getPaymentActionHandler", PaymentActionResponse{
+		InvoiceID:    inv.ID,
+		AmountDue:    inv.AmountDue,
+		Currency:     inv.Currency,
+		Status:       inv.PaymentIntent.Status,
+		ClientSecret: inv.PaymentIntent.ClientSecret,
+		NextStep:     paymentNextStep(inv.PaymentIntent),
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestGetPaymentAction(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-a")
+	if code, body := e.get("/payment-action?subscription_id=sub-ramen"); code != http.StatusConflict {
+		t.Errorf("payment action of a paid subscription = %d %s, want 409", code, body)
+	}
+
+	// 更新時の支払いで3Dセキュア認証が必要になる
+	e.fake.SetPaymentOutcome(testCustomerID, stripe.PaymentIntentStatusRequiresAction)
+	inv, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.deliverEvents()
+	if got := e.userSubscription(); got.PaymentActionRequiredAt.IsZero() {
+		t.Error("PaymentActionRequiredAt is zero, want the time of invoice.payment_action_required")
+	}
+
+	code, body := e.get("/payment-action?subscription_id=sub-ramen")
+	if code != http.StatusOK {
+		t.Fatalf("payment action = %d %s", code, body)
+	}
+	var res PaymentActionResponse
+	decodeJSON(t, body, &res)
+	want := PaymentActionResponse{
+		InvoiceID:    inv.ID,
+		AmountDue:    3000,
+		Currency:     stripe.CurrencyJPY,
+		Status:       stripe.PaymentIntentStatusRequiresAction,
+		ClientSecret: inv.PaymentIntent.ClientSecret,
+		NextStep:     PaymentNextStepConfirmPayment,
+	}
+	if res != want {
+		t.Errorf("response = %+v, want %+v", res, want)
+	}
+
+	// クライアントで認証が完了すると、Webhookで支払い済みが反映される
+	if err := e.fake.CompletePaymentAction(inv.PaymentIntent.ID); err != nil {
+		t.Fatal(err)
+	}
+	e.deliverEvents()
+	got := e.userSubscription()
+	if got.Status != stripe.SubscriptionStatusActive || !got.PaymentActionRequiredAt.IsZero() {
+		t.Errorf("UserSubscription = %s payment_action_required_at %v, want active without a payment action", got.Status, got.PaymentActionRequiredAt)
+	}
+	if code, body := e.get("/payment-action?subscription_id=sub-ramen"); code != http.StatusConflict {
+		t.Errorf("payment action after the authentication = %d %s, want 409", code, body)
+	}
+}
+
+func TestGetPaymentAction_InvalidRequest(t *testing.T) {
+	e := newTestEnv(t)
+	if code, body := e.get("/payment-action"); code != http.StatusBadRequest || errorCode(t, body) != "validation_failed" {
+		t.Errorf("payment action without subscription_id = %d %s, want 400 validation_failed", code, body)
+	}
+	if code, body := e.get("/payment-action?subscription_id=sub-ramen"); code != http.StatusNotFound {
+		t.Errorf("payment action without a subscription = %d %s, want 404", code, body)
+	}
+	if code, body := e.post("/payment-action", `{"subscription_id":"sub-ramen"}`); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /payment-action = %d %s, want 405", code, body)
+	}
+}
+
+func TestPaymentNextStep(t *testing.T) {
+	tests := []struct {
+		status stripe.PaymentIntentStatus
+		want   PaymentNextStep
+	}{
+		{status: stripe.PaymentIntentStatusRequiresAction, want: PaymentNextStepConfirmPayment},
+		{status: stripe.PaymentIntentStatusRequiresConfirmation, want: PaymentNextStepConfirmPayment},
+		{status: stripe.PaymentIntentStatusRequiresPaymentMethod, want: PaymentNextStepUpdatePaymentMethod},
+		{status: stripe.PaymentIntentStatusProcessing, want: PaymentNextStepWait},
+		{status: stripe.PaymentIntentStatusSucceeded, want: PaymentNextStepNone},
+	}
+	for _, tt := range tests {
+		if got := paymentNextStep(&stripe.PaymentIntent{Status: tt.status}); got != tt.want {
+			t.Errorf("paymentNextStep(%s) = %s, want %s", tt.status, got, tt.want)
+		}
+	}
+	if got := paymentNextStep(nil); got != PaymentNextStepNone {
+		t.Errorf("paymentNextStep(nil) = %s, want none", got)
+	}
+}
+
+// noLatestInvoiceGateway 作成・更新したSubscriptionを最新のInvoiceなしで返す BillingGateway
+// 請求が発生しないトライアルや、展開に失敗したレスポンスを再現する
+type noLatestInvoiceGateway struct {
+	BillingGateway
+}
+
+func (g noLatestInvoiceGateway) NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	s, err := g.BillingGateway.NewSubscription(params)
+	if s != nil {
+		s.LatestInvoice = nil
+	}
+	return s, err
+}
+
+func (g noLatestInvoiceGateway) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	s, err := g.BillingGateway.UpdateSubscription(id, params)
+	if s != nil {
+		s.LatestInvoice = nil
+	}
+	return s, err
+}
+
+func TestPaymentNextStep_NoLatestInvoice(t *testing.T) {
+	e := newTestEnv(t)
+	billing = noLatestInvoiceGateway{billing}
+
+	tests := []struct {
+		path string
+		body string
+	}{
+		{path: "/create-subscription", body: createPlanA},
+		{path: "/update-subscription-immediately", body: `{"subscription_id":"sub-ramen","plan_id":"plan-b"}`},
+		{path: "/recreate-subscription", body: createPlanA},
+	}
+	for _, tt := range tests {
+		code, body := e.post(tt.path, tt.body)
+		if code != http.StatusOK {
+			t.Fatalf("POST %s = %d %s", tt.path, code, body)
+		}
+		var res struct {
+			NextStep PaymentNextStep `json:"next_step"`
+		}
+		decodeJSON(t, body, &res)
+		if res.NextStep != PaymentNextStepNone {
+			t.Errorf("POST %s next_step = %s, want none", tt.path, res.NextStep)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+// immediatePlanChangeProrationBehavior 即時のプラン変更で、変更前のプランの未使用期間分を返金し、その場で請求する
+const immediatePlanChangeProrationBehavior = stripe.SubscriptionProrationBehaviorAlwaysInvoice
+
+// prorationPreviewTTL プレビューで返した日割り計算の基準日時を、即時のプラン変更に指定できる期間
+const prorationPreviewTTL = 5 * time.Minute
+
+type PreviewPlanChangeRequest struct {
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+	PlanID         string `json:"plan_id" validate:"required,document_id"`
+}
+
+type InvoiceLineResponse struct {
+	Description string    `json:"description"`
+	Amount      int64     `json:"amount"`
+	Proration   bool      `json:"proration"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+}
+
+// PreviewPlanChangeResponse 即時にプランを変更した場合の請求内容
+type PreviewPlanChangeResponse struct {
+	PlanID string `json:"plan_id"`
+	// ProrationDate 日割り計算の基準日時(Unix時間)。5分以内に /update-subscription-immediately に指定するとプレビューと同じ金額で請求する
+	ProrationDate int64                  `json:"proration_date"`
+	Currency      stripe.Currency        `json:"currency"`
+	Lines         []*InvoiceLineResponse `json:"lines"`
+	// ProrationCredit 変更前のプランの未使用期間分の返金額(負の値)
+	ProrationCredit int64 `json:"proration_credit"`
+	Subtotal        int64 `json:"subtotal"`
+	DiscountAmount  int64 `json:"discount_amount"`
+	Tax             int64 `json:"tax"`
+	Total           int64 `json:"total"`
+	AmountDue       int64 `json:"amount_due"`
+}
+
+// PreviewPlanChangeHandler 契約中のプランを即時に変更した場合の請求内容を、StripeのUpcoming Invoiceで計算して返す
+// GETだが、返した日割り計算の基準日時を即時のプラン変更で検証するため、UserSubscriptionに書き込む。
+// 保存するのは契約毎に最後のプレビューのみで、並行してプレビューした場合は後から保存したものが先のものを上書きする。
+// 上書きされたプレビューのproration_dateを指定した即時のプラン変更はvalidation_failedとなるため、クライアントはプレビューからやり直す
+func PreviewPlanChangeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, "previewPlanChangeHandler", apperror.MethodNotAllowed(r.Method))
+		return
+	}
+	q := r.URL.Query()
+	req := PreviewPlanChangeRequest{SubscriptionID: q.Get("subscription_id"), PlanID: q.Get("plan_id")}
+	if err := validateRequest(&req); err != nil {
+		writeError(w, "validateRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, "")
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+
+	var ub *UserSubscription
+	var plan *Plan
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		plan, err = getPlan(sub, req.PlanID)
+		if err != nil {
+			return err
+		}
+		ub, err = getUserSubscription(tx, sub, customerID)
+		return err
+	})
+	if err != nil {
+		writeError(w, "previewPlanChangeHandler", err)
+		return
+	}
+
+	prorationDate := time.Now().Unix()
+	params := &stripe.InvoiceParams{
+		Customer:                          stripe.String(ub.CustomerID),
+		Subscription:                      stripe.String(ub.StripeSubscriptionID),
+		SubscriptionItems:                 immediatePlanChangeItems(ub.StripeSubscriptionItemID, plan.StripePriceID),
+		SubscriptionBillingCycleAnchorNow: stripe.Bool(true),
+		SubscriptionProrationBehavior:     stripe.String(string(immediatePlanChangeProrationBehavior)),
+		SubscriptionProrationDate:         stripe.Int64(prorationDate),
+	}
+	inv, err := billing.UpcomingInvoice(params)
+	if err != nil {
+		writeError(w, "previewPlanChangeHandler", handleStripeError(err))
+		return
+	}
+
+	// 即時のプラン変更で指定できる基準日時は、最後にプレビューで返したもののみとする(先に返したものは無効になる)
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		latest, err := tx.GetUserSubscription(ub.ID)
+		if err != nil {
+			return err
+		}
+		latest.PreviewPlanID = plan.ID
+		latest.PreviewProrationDate = prorationDate
+		return tx.UpdateUserSubscription(latest)
+	})
+	if err != nil {
+		writeError(w, "previewPlanChangeHandler", err)
+		return
+	}
+
+	res := PreviewPlanChangeResponse{
+		PlanID:         plan.ID,
+		ProrationDate:  prorationDate,
+		Currency:       inv.Currency,
+		Lines:          []*InvoiceLineResponse{},
+		Subtotal:       inv.Subtotal,
+		DiscountAmount: invoiceDiscountAmount(inv),
+		Tax:            inv.Tax,
+		Total:          inv.Total,
+		AmountDue:      inv.AmountDue,
+	}
+	if inv.Lines != nil {
+		for _, line := range inv.Lines.Data {
+			l := &InvoiceLineResponse{Description: line.Description, Amount: line.Amount, Proration: line.Proration}
+			if line.Period != nil {
+				l.PeriodStart = time.Unix(line.Period.Start, 0)
+				l.PeriodEnd = time.Unix(line.Period.End, 0)
+			}
+			if line.Proration && line.Amount < 0 {
+				res.ProrationCredit += line.Amount
+			}
+			res.Lines = append(res.Lines, l)
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, "previewPlanChangeHandler", res)
+}
+
+// immediatePlanChangeItems 即時のプラン変更で、契約中のSubscriptionItemのPriceを差し替えるパラメータ
+// プレビューと実際の変更で同じパラメータを利用する
+func immediatePlanChangeItems(itemID, priceID string) []*stripe.SubscriptionItemsParams {
+	return []*stripe.SubscriptionItemsParams{
+		{
+			ID:    stripe.String(itemID),
+			Price: stripe.String(priceID),
+		},
+	}
+}
+
+// resolveProrationDate 即時のプラン変更の日割り計算の基準日時を返す。指定しない場合は現在日時とする
+// 過去の日時を指定して返金額を増やせないよう、同じプランのプレビューで最後に返した日時を、発行から prorationPreviewTTL 以内に限り受け付ける
+func resolveProrationDate(requested int64, planID string, ub *UserSubscription, now time.Time) (int64, error) {
+	if requested == 0 {
+		return now.Unix(), nil
+	}
+	if requested != ub.PreviewProrationDate || planID != ub.PreviewPlanID ||
+		now.Sub(time.Unix(requested, 0)) > prorationPreviewTTL || requested < ub.CurrentPeriodStart.Unix() {
+		return 0, apperror.ValidationFailed([]apperror.FieldError{{
+			Field:   "proration_date",
+			Message: "must be the proration_date returned by /preview-plan-change for this plan within the last 5 minutes",
+		}})
+	}
+	return requested, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+// subscribeMidPeriod testCustomerIDでplanIDのプランを契約し、請求期間の半分が経過した状態にする
+func (e *testEnv) subscribeMidPeriod(planID string) *UserSubscription {
+	e.t.Helper()
+	start := time.Now().AddDate(0, 0, -15)
+	e.fake.SetNow(func() time.Time { return start })
+	ub := e.subscribe(planID)
+	e.fake.SetNow(time.Now)
+	return ub
+}
+
+// previewPlanChange planIDのプランに即時に変更した場合の請求内容を取得する
+func (e *testEnv) previewPlanChange(planID string) PreviewPlanChangeResponse {
+	e.t.Helper()
+	w := e.serve(http.MethodGet, "/preview-plan-change?subscription_id=sub-ramen&plan_id="+planID, "")
+	if w.Code != http.StatusOK {
+		e.t.Fatalf("GET /preview-plan-change = %d %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		e.t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+	var res PreviewPlanChangeResponse
+	decodeJSON(e.t, w.Body.String(), &res)
+	return res
+}
+
+func TestPreviewPlanChange(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribeMidPeriod("plan-b")
+
+	preview := e.previewPlanChange("plan-a")
+	// plan-bの未使用期間分を返金し、plan-aの新しい請求期間の全額を請求する
+	start, end := ub.CurrentPeriodStart.Unix(), ub.CurrentPeriodEnd.Unix()
+	wantCredit := -int64(math.Round(350 * float64(end-preview.ProrationDate) / float64(end-start)))
+	if preview.ProrationCredit != wantCredit || preview.AmountDue != 3000+wantCredit {
+		t.Errorf("preview = credit %d amount_due %d, want %d and %d", preview.ProrationCredit, preview.AmountDue, wantCredit, 3000+wantCredit)
+	}
+	if preview.PlanID != "plan-a" || preview.Currency != "jpy" || len(preview.Lines) != 2 {
+		t.Errorf("preview = %+v, want 2 lines of plan-a in jpy", preview)
+	}
+	// プレビューではStripe上のSubscriptionを変更しない
+	if s := e.stripeSubscription(); s.Items.Data[0].Price.ID != e.sub.Plan("plan-b").StripePriceID {
+		t.Errorf("preview changed the price to %s", s.Items.Data[0].Price.ID)
+	}
+
+	// プレビューで返した基準日時を指定すると、プレビューと同じ金額で請求する
+	e.mustPost("/update-subscription-immediately", `{"subscription_id":"sub-ramen","plan_id":"plan-a","proration_date":`+strconv.FormatInt(preview.ProrationDate, 10)+`}`, nil)
+	if inv := e.stripeSubscription().LatestInvoice; inv.AmountDue != preview.AmountDue {
+		t.Errorf("AmountDue = %d, want %d as previewed", inv.AmountDue, preview.AmountDue)
+	}
+	if got := e.userSubscription().PlanID; got != "plan-a" {
+		t.Errorf("PlanID = %s, want plan-a", got)
+	}
+}
+
+func TestPreviewPlanChange_RejectsOtherProrationDates(t *testing.T) {
+	e := newTestEnv(t)
+	e.subscribeMidPeriod("plan-b")
+	preview := e.previewPlanChange("plan-a")
+	// 最後のプレビューで返した基準日時のみ受け付ける
+	other := e.previewPlanChange("plan-b")
+
+	tests := []struct {
+		name string
+		path string
+		date int64
+	}{
+		{name: "replaced by another preview", path: "/update-subscription-immediately", date: preview.ProrationDate},
+		{name: "preview for another plan", path: "/update-subscription-immediately", date: other.ProrationDate},
+		{name: "arbitrary past date", path: "/update-subscription-immediately", date: other.ProrationDate - 60},
+		{name: "change plan", path: "/change-plan", date: other.ProrationDate - 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := e.post(tt.path, `{"subscription_id":"sub-ramen","plan_id":"plan-a","proration_date":`+strconv.FormatInt(tt.date, 10)+`}`)
+			if code != http.StatusBadRequest || errorCode(t, body) != "validation_failed" {
+				t.Errorf("POST %s = %d %s, want 400 validation_failed", tt.path, code, body)
+			}
+		})
+	}
+	if got := e.userSubscription().PlanID; got != "plan-b" {
+		t.Errorf("PlanID = %s, want plan-b", got)
+	}
+}
+
+func TestResolveProrationDate(t *testing.T) {
+	now := time.Date(2022, 4, 16, 12, 0, 0, 0, time.UTC)
+	previewed := now.Add(-time.Minute).Unix()
+	ub := &UserSubscription{
+		CurrentPeriodStart:   time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC),
+		PreviewPlanID:        "plan-a",
+		PreviewProrationDate: previewed,
+	}
+	tests := []struct {
+		name      string
+		requested int64
+		planID    string
+		now       time.Time
+		want      int64
+		wantErr   bool
+	}{
+		{name: "not requested", planID: "plan-a", now: now, want: now.Unix()},
+		{name: "previewed", requested: previewed, planID: "plan-a", now: now, want: previewed},
+		{name: "within TTL", requested: previewed, planID: "plan-a", now: time.Unix(previewed, 0).Add(prorationPreviewTTL), want: previewed},
+		{name: "expired", requested: previewed, planID: "plan-a", now: time.Unix(previewed, 0).Add(prorationPreviewTTL + time.Second), wantErr: true},
+		{name: "other plan", requested: previewed, planID: "plan-b", now: now, wantErr: true},
+		{name: "not previewed", requested: previewed - 1, planID: "plan-a", now: now, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveProrationDate(tt.requested, tt.planID, ub, tt.now)
+			if tt.wantErr {
+				if appErr := apperror.From(err); appErr.Code != apperror.CodeValidationFailed || appErr.Fields[0].Field != "proration_date" {
+					t.Errorf("resolveProrationDate() = %d, %v, want a validation error on proration_date", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("resolveProrationDate() = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+
+	// 更新により請求期間が変わった後は、前の請求期間のプレビューの日時を受け付けない
+	renewed := *ub
+	renewed.CurrentPeriodStart = now
+	if _, err := resolveProrationDate(previewed, "plan-a", &renewed, now); err == nil {
+		t.Error("resolveProrationDate() with a date before the current period succeeded")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+// findPromotionCode 顧客が入力したプロモーションコードをStripeから取得し、planの新規契約に利用できるか検証する
+// Stripeでも契約の作成時に検証されるが、利用できない理由をクライアントに返すため事前に検証する
+func findPromotionCode(code, customerID string, plan *Plan, now time.Time) (*stripe.PromotionCode, error) {
+	params := &stripe.PromotionCodeListParams{
+		Code:   stripe.String(code),
+		Active: stripe.Bool(true),
+	}
+	params.AddExpand("data.coupon.applies_to")
+	codes, err := billing.ListPromotionCodes(params)
+	if err != nil {
+		return nil, handleStripeError(err)
+	}
+
+	// 同じコードでも顧客毎に別のプロモーションコードを発行できるため、呼び出し元が利用できるものを探す
+	var pc *stripe.PromotionCode
+	for _, c := range codes {
+		if c.Customer == nil || c.Customer.ID == customerID {
+			pc = c
+			break
+		}
+	}
+	switch {
+	case len(codes) == 0:
+		return nil, apperror.InvalidPromotionCode("code is not found or no longer active")
+	case pc == nil:
+		return nil, apperror.InvalidPromotionCode("code is restricted to another customer")
+	case pc.Coupon == nil || !pc.Coupon.Valid:
+		return nil, apperror.InvalidPromotionCode("coupon is no longer valid")
+	case pc.ExpiresAt > 0 && now.Unix() >= pc.ExpiresAt:
+		return nil, apperror.InvalidPromotionCode("code has expired")
+	case pc.MaxRedemptions > 0 && pc.TimesRedeemed >= pc.MaxRedemptions:
+		return nil, apperror.InvalidPromotionCode("code has reached its redemption limit")
+	}
+
+	if applies := pc.Coupon.AppliesTo; applies != nil && len(applies.Products) > 0 && !containsString(applies.Products, plan.StripeProductID) {
+		return nil, apperror.InvalidPromotionCode("code does not apply to this plan")
+	}
+	if r := pc.Restrictions; r != nil {
+		if r.MinimumAmount > 0 {
+			currency, err := planCurrency(plan)
+			if err != nil {
+				return nil, err
+			}
+			if int64(plan.Price) < r.MinimumAmount || !strings.EqualFold(string(r.MinimumAmountCurrency), string(currency)) {
+				return nil, apperror.InvalidPromotionCode("plan price is below the minimum amount")
+			}
+		}
+		if r.FirstTimeTransaction {
+			firstTime, err := isFirstTimeCustomer(customerID)
+			if err != nil {
+				return nil, err
+			}
+			if !firstTime {
+				return nil, apperror.InvalidPromotionCode("code is only available for the first purchase")
+			}
+		}
+	}
+	return pc, nil
+}
+
+// planCurrency プランの通貨。通貨を保持していない古いプランの場合はStripeのPriceから取得する
+func planCurrency(plan *Plan) (stripe.Currency, error) {
+	if plan.Currency != "" {
+		return plan.Currency, nil
+	}
+	price, err := billing.GetPrice(plan.StripePriceID, nil)
+	if err != nil {
+		return "", handleStripeError(err)
+	}
+	return price.Currency, nil
+}
+
+// isFirstTimeCustomer 支払い済みのInvoiceがない顧客かどうか
+func isFirstTimeCustomer(customerID string) (bool, error) {
+	params := &stripe.InvoiceListParams{
+		Customer: stripe.String(customerID),
+		Status:   stripe.String(string(stripe.InvoiceStatusPaid)),
+	}
+	params.Limit = stripe.Int64(1)
+	params.Single = true
+	invoices, err := billing.ListInvoices(params)
+	if err != nil {
+		return false, handleStripeError(err)
+	}
+	return len(invoices) == 0, nil
+}
+
+// invoiceDiscountAmount Invoiceに適用された割引額の合計
+func invoiceDiscountAmount(inv *stripe.Invoice) int64 {
+	var amount int64
+	for _, d := range inv.TotalDiscountAmounts {
+		amount += d.Amount
+	}
+	return amount
+}
+
+func containsString(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/auth"
+)
+
+// createPromotionCode 20%割引のクーポンにcodeのプロモーションコードを登録する
+// fでクーポンとプロモーションコードの設定を変更できる
+func (e *testEnv) createPromotionCode(code string, f func(c *stripe.Coupon, pc *stripe.PromotionCode)) *stripe.PromotionCode {
+	e.t.Helper()
+	c := &stripe.Coupon{Name: "20% off", PercentOff: 20}
+	pc := &stripe.PromotionCode{Code: code}
+	if f != nil {
+		f(c, pc)
+	}
+	pc.Coupon = e.fake.CreateCoupon(c)
+	return e.fake.CreatePromotionCode(pc)
+}
+
+func TestCreateSubscription_PromotionCode(t *testing.T) {
+	e := newTestEnv(t)
+	e.createPromotionCode("SPRING", nil)
+
+	// プロモーションコードは大文字と小文字を区別しない
+	var res CreateUserSubscriptionResponse
+	e.mustPost("/create-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-a","promotion_code":"spring"}`, &res)
+	if res.Subtotal != 3000 || res.DiscountAmount != 600 || res.AmountDue != 2400 {
+		t.Errorf("response = %+v, want 3000 - 600 = 2400", res)
+	}
+	// durationがonceの割引は最初の請求のみに適用され、適用後はSubscriptionから削除される
+	e.deliverEvents()
+	if d := e.userSubscription().Discount; d != nil {
+		t.Errorf("Discount after the first invoice = %+v, want nil", d)
+	}
+	inv, err := e.fake.AdvancePeriod(e.userSubscription().StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.AmountDue != 3000 {
+		t.Errorf("renewal AmountDue = %d, want 3000", inv.AmountDue)
+	}
+}
+
+func TestCreateSubscription_RepeatingPromotionCode(t *testing.T) {
+	e := newTestEnv(t)
+	e.createPromotionCode("SPRING", func(c *stripe.Coupon, pc *stripe.PromotionCode) {
+		c.Duration, c.DurationInMonths = stripe.CouponDurationRepeating, 3
+	})
+	e.mustPost("/create-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-a","promotion_code":"SPRING"}`, nil)
+	e.deliverEvents()
+
+	// durationがrepeatingの割引は終了日時まで更新時の請求にも適用する
+	ub := e.userSubscription()
+	d := ub.Discount
+	if d == nil || d.Code != "SPRING" || d.PercentOff != 20 || !d.End.Equal(d.Start.AddDate(0, 3, 0)) {
+		t.Fatalf("Discount = %+v, want SPRING 20%% for 3 months", d)
+	}
+	inv, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.AmountDue != 2400 {
+		t.Errorf("renewal AmountDue = %d, want 2400", inv.AmountDue)
+	}
+	e.deliverEvents()
+	if d := e.userSubscription().Discount; d == nil || d.Code != "SPRING" {
+		t.Errorf("Discount after renewal = %+v, want SPRING", d)
+	}
+}
+
+func TestCreateSubscription_InvalidPromotionCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(e *testEnv)
+	}{
+		{name: "not found", setup: func(e *testEnv) {}},
+		{name: "inactive coupon", setup: func(e *testEnv) {
+			e.createPromotionCode("SPRING", func(c *stripe.Coupon, pc *stripe.PromotionCode) { c.MaxRedemptions = 1 })
+			e.fake.CreateCustomer("cus_2")
+			e.serve(http.MethodPost, "/create-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-a","promotion_code":"SPRING"}`, auth.CustomerHeader, "cus_2")
+		}},
+		{name: "another customer", setup: func(e *testEnv) {
+			e.createPromotionCode("SPRING", func(c *stripe.Coupon, pc *stripe.PromotionCode) { pc.Customer = &stripe.Customer{ID: "cus_2"} })
+		}},
+		{name: "expired", setup: func(e *testEnv) {
+			e.createPromotionCode("SPRING", func(c *stripe.Coupon, pc *stripe.PromotionCode) { pc.ExpiresAt = time.Now().Add(-time.Minute).Unix() })
+		}},
+		{name: "other product", setup: func(e *testEnv) {
+			e.createPromotionCode("SPRING", func(c *stripe.Coupon, pc *stripe.PromotionCode) {
+				c.AppliesTo = &stripe.CouponAppliesTo{Products: []string{"prod_other"}}
+			})
+		}},
+		{name: "below the minimum amount", setup: func(e *testEnv) {
+			e.createPromotionCode("SPRING", func(c *stripe.Coupon, pc *stripe.PromotionCode) {
+				pc.Restrictions = &stripe.PromotionCodeRestrictions{MinimumAmount: 5000, MinimumAmountCurrency: stripe.CurrencyJPY}
+			})
+		}},
+		{name: "minimum amount in another currency", setup: func(e *testEnv) {
+			e.createPromotionCode("SPRING", func(c *stripe.Coupon, pc *stripe.PromotionCode) {
+				pc.Restrictions = &stripe.PromotionCodeRestrictions{MinimumAmount: 1000, MinimumAmountCurrency: stripe.CurrencyUSD}
+			})
+		}},
+		{name: "not the first purchase", setup: func(e *testEnv) {
+			e.createPromotionCode("SPRING", func(c *stripe.Coupon, pc *stripe.PromotionCode) {
+				pc.Restrictions = &stripe.PromotionCodeRestrictions{FirstTimeTransaction: true}
+			})
+			e.subscribe("plan-a")
+			e.mustPost("/cancel-subscription-immediately", `{"subscription_id":"sub-ramen"}`, nil)
+			e.deliverEvents()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			tt.setup(e)
+			creates := e.countRequests(http.MethodPost, "/v1/subscriptions")
+
+			code, body := e.post("/create-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-a","promotion_code":"SPRING"}`)
+			if code != http.StatusBadRequest || errorCode(t, body) != "invalid_promotion_code" {
+				t.Errorf("create = %d %s, want 400 invalid_promotion_code", code, body)
+			}
+			if n := e.countRequests(http.MethodPost, "/v1/subscriptions"); n != creates {
+				t.Errorf("invalid promotion code called Stripe %d times", n-creates)
+			}
+		})
+	}
+}
+
+func TestCreateSubscription_PromotionCodeRestrictions(t *testing.T) {
+	e := newTestEnv(t)
+	price, err := billing.GetPrice(e.sub.Plan("plan-a").StripePriceID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.sub.Plan("plan-a").StripeProductID = price.Product.ID
+	// 通貨を保持していないプランは、StripeのPriceの通貨で最低金額を判定する
+	e.sub.Plan("plan-a").Currency = ""
+	e.saveSubscription()
+	e.createPromotionCode("SPRING", func(c *stripe.Coupon, pc *stripe.PromotionCode) {
+		c.AppliesTo = &stripe.CouponAppliesTo{Products: []string{price.Product.ID}}
+		pc.Restrictions = &stripe.PromotionCodeRestrictions{MinimumAmount: 3000, MinimumAmountCurrency: stripe.CurrencyJPY, FirstTimeTransaction: true}
+	})
+
+	var res CreateUserSubscriptionResponse
+	e.mustPost("/create-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-a","promotion_code":"SPRING"}`, &res)
+	if res.DiscountAmount != 600 {
+		t.Errorf("DiscountAmount = %d, want 600", res.DiscountAmount)
+	}
+}
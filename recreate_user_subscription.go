@@ -2,99 +2,108 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"log"
 	"net/http"
+	"time"
 
-	"cloud.google.com/go/firestore"
-	"github.com/google/uuid"
-	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/v72"
 )
 
 type ReCreateUserSubscriptionRequest struct {
-	CustomerID     string `json:"customer_id"`
-	SubscriptionID string `json:"subscription_id"`
-	PlanID         string `json:"plan_id"`
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+	PlanID         string `json:"plan_id" validate:"required,document_id"`
+	PromotionCode  string `json:"promotion_code,omitempty" validate:"promotion_code"`
 }
 
 type ReCreateUserSubscriptionResponse struct {
 	Status       stripe.PaymentIntentStatus `json:"status"`
 	ClientSecret string                     `json:"client_secret"`
+	// NextStep 支払いを完了するためにクライアントが次に行うこと
+	NextStep PaymentNextStep `json:"next_step"`
+	// SubscriptionStatus トライアル中は支払いが発生しないため、statusとclient_secretは空になり trialing を返す
+	SubscriptionStatus stripe.SubscriptionStatus `json:"subscription_status"`
+	TrialEnd           *time.Time                `json:"trial_end,omitempty"`
+	// Subtotal、DiscountAmount、AmountDue 最初の請求の割引前の金額、割引額、請求額
+	Subtotal       int64 `json:"subtotal"`
+	DiscountAmount int64 `json:"discount_amount"`
+	AmountDue      int64 `json:"amount_due"`
 }
 
 func ReCreateUserSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 
-	var req *ReCreateUserSubscriptionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("json.NewDecoder.Decode: %v", err)
+	var req ReCreateUserSubscriptionRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
 		return
 	}
-	idempotencyKey := uuid.New().String()
-	var intent *stripe.PaymentIntent
-	err := fsClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		sub, _ := GetSubscriptionTx(tx, req.SubscriptionID)
-		ub, _ := GetUserSubscriptionTx(tx, sub.UserSubscriptionID(req.CustomerID))
-
-		plan := sub.Plan(req.PlanID)
-
-		// 既存のStripe Subscriptionをキャンセルする
-		_, err := client.Subscriptions.Cancel(ub.StripeSubscriptionID, nil)
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
+	op := NewOutboxOperation(outboxOperationID(r), OutboxOperationReCreateSubscription, time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
 		if err != nil {
-			if stripeErr, ok := err.(*stripe.Error); ok {
-				if stripeErr.HTTPStatusCode == 404 {
-					// already canceled
-				} else {
-					return err
-				}
-			} else {
-				return err
-			}
+			return err
 		}
-
-		// Subscriptionを新規登録する
-		// create_user_subscription.go と同様の処理
-		params := &stripe.SubscriptionParams{
-			Customer: stripe.String(req.CustomerID),
-			Items: []*stripe.SubscriptionItemsParams{
-				{
-					Price:    stripe.String(plan.StripePriceID),
-					Quantity: stripe.Int64(1),
-				},
-			},
-			CancelAtPeriodEnd: stripe.Bool(false),
-			ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorNone)),
-			PaymentBehavior:   stripe.String("allow_incomplete"),
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
 		}
-		params.AddMetadata("subscription_id", sub.ID)
-		params.AddMetadata("plan_id", plan.ID)
-		params.AddExpand("latest_invoice.payment_intent")
-		params.SetIdempotencyKey(idempotencyKey)
 
-		s, err := client.Subscriptions.New(params)
-		err = handleStripeError(err)
+		plan, err := getPlan(sub, req.PlanID)
 		if err != nil {
 			return err
 		}
 
-		intent = s.LatestInvoice.PaymentIntent
-		ub.RenewalAll(plan.ID, s)
-		ub, _ = CreateUserSubscriptionTx(tx, ub)
-		return nil
+		// 既存のStripe Subscriptionのキャンセルと新規登録はOutboxに記録してトランザクションの外で実行する
+		op.UserSubscriptionID = ub.ID
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.PlanID = plan.ID
+		op.StripePriceID = plan.StripePriceID
+		if err := rejectPendingCreation(tx, op); err != nil {
+			return err
+		}
+		if err := applyTrial(tx, op, plan); err != nil {
+			return err
+		}
+		if req.PromotionCode != "" {
+			pc, err := findPromotionCode(req.PromotionCode, req.CustomerID, plan, time.Now())
+			if err != nil {
+				return err
+			}
+			op.PromotionCodeID = pc.ID
+		}
+		op.StripeSubscriptionID = ub.StripeSubscriptionID
+		return saveOutboxOperation(tx, op)
 	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("ReCreateUserSubscriptionHandler: %v", err)
+		writeError(w, "ReCreateUserSubscriptionHandler", err)
 		return
 	}
-	res := ReCreateUserSubscriptionResponse{
-		Status:       intent.Status,
-		ClientSecret: intent.ClientSecret,
-	}
-	if err = json.NewEncoder(w).Encode(res); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("ReCreateUserSubscriptionHandler: %v", err)
+	s, err := dispatchOutboxOperation(ctx, op.ID)
+	if err != nil {
+		writeError(w, "ReCreateUserSubscriptionHandler", err)
 		return
 	}
+	res := ReCreateUserSubscriptionResponse{SubscriptionStatus: s.Status, NextStep: PaymentNextStepNone}
+	if s.LatestInvoice != nil && s.LatestInvoice.PaymentIntent != nil {
+		res.Status = s.LatestInvoice.PaymentIntent.Status
+		res.ClientSecret = s.LatestInvoice.PaymentIntent.ClientSecret
+		res.NextStep = paymentNextStep(s.LatestInvoice.PaymentIntent)
+	}
+	if s.TrialEnd > 0 {
+		trialEnd := time.Unix(s.TrialEnd, 0)
+		res.TrialEnd = &trialEnd
+	}
+	if inv := s.LatestInvoice; inv != nil {
+		res.Subtotal = inv.Subtotal
+		res.DiscountAmount = invoiceDiscountAmount(inv)
+		res.AmountDue = inv.AmountDue
+	}
+	writeJSON(w, "ReCreateUserSubscriptionHandler", res)
 }
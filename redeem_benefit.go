@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+	"github.com/ogiogi93/stripe-subscription-samples/entitlement"
+)
+
+// maxRedemptionHistory 利用履歴として返す最大件数
+const maxRedemptionHistory = 100
+
+type RedeemBenefitRequest struct {
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+	BenefitID      string `json:"benefit_id" validate:"required,document_id"`
+}
+
+type RedeemBenefitResponse struct {
+	RedemptionID string             `json:"redemption_id"`
+	BenefitID    string             `json:"benefit_id"`
+	RedeemedAt   time.Time          `json:"redeemed_at"`
+	QuotaPeriod  BenefitQuotaPeriod `json:"quota_period,omitempty"`
+	// Remaining 期間内の残り回数。無制限の特典の場合はnull
+	Remaining *int64 `json:"remaining"`
+}
+
+// RedeemBenefitHandler 特典の利用を記録する。期間内の利用回数の上限に達している場合は429を返す
+func RedeemBenefitHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	var req RedeemBenefitRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
+
+	var res RedeemBenefitResponse
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		now := time.Now()
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
+		}
+
+		// 利用できる特典かどうかを判定してから利用回数を加算する
+		d := entitlementPolicy.Check([]entitlement.Subscription{ub.Entitlement(sub)}, req.BenefitID, now)
+		if !d.Granted {
+			return apperror.BenefitNotGranted(string(d.Reason))
+		}
+		benefit := sub.Plan(ub.PlanID).Benefit(req.BenefitID)
+		remaining, err := ub.Redeem(benefit, now)
+		if err == ErrQuotaExceeded {
+			return apperror.QuotaExceeded()
+		}
+		if err != nil {
+			return err
+		}
+
+		redemption := &Redemption{
+			ID:                 uuid.New().String(),
+			UserSubscriptionID: ub.ID,
+			CustomerID:         req.CustomerID,
+			SubscriptionID:     sub.ID,
+			PlanID:             ub.PlanID,
+			BenefitID:          benefit.ID,
+			PeriodKey:          benefit.quotaPeriodKey(ub, now),
+			RedeemedAt:         now,
+		}
+		if err := tx.UpdateUserSubscription(ub); err != nil {
+			return err
+		}
+		if err := tx.CreateRedemption(redemption); err != nil {
+			return err
+		}
+
+		res = RedeemBenefitResponse{
+			RedemptionID: redemption.ID,
+			BenefitID:    benefit.ID,
+			RedeemedAt:   now,
+			QuotaPeriod:  benefit.QuotaPeriod,
+		}
+		if remaining >= 0 {
+			res.Remaining = &remaining
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, "redeemBenefitHandler", err)
+		return
+	}
+	writeJSON(w, "redeemBenefitHandler", res)
+}
+
+type ListRedemptionsRequest struct {
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+}
+
+type RedemptionResponse struct {
+	ID         string    `json:"id"`
+	PlanID     string    `json:"plan_id"`
+	BenefitID  string    `json:"benefit_id"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+}
+
+type ListRedemptionsResponse struct {
+	Redemptions []*RedemptionResponse `json:"redemptions"`
+}
+
+// ListRedemptionsHandler 指定したSubscriptionでの特典の利用履歴を新しい順に返す
+func ListRedemptionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, "listRedemptionsHandler", apperror.MethodNotAllowed(r.Method))
+		return
+	}
+	req := ListRedemptionsRequest{SubscriptionID: r.URL.Query().Get("subscription_id")}
+	if err := validateRequest(&req); err != nil {
+		writeError(w, "validateRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, "")
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+
+	res := ListRedemptionsResponse{Redemptions: []*RedemptionResponse{}}
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		res.Redemptions = res.Redemptions[:0]
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		rs, err := tx.ListRedemptions(sub.UserSubscriptionID(customerID), maxRedemptionHistory)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			res.Redemptions = append(res.Redemptions, &RedemptionResponse{
+				ID:         r.ID,
+				PlanID:     r.PlanID,
+				BenefitID:  r.BenefitID,
+				RedeemedAt: r.RedeemedAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, "listRedemptionsHandler", err)
+		return
+	}
+	writeJSON(w, "listRedemptionsHandler", res)
+}
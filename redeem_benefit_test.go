@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUserSubscription_Redeem(t *testing.T) {
+	// 日本時間の2022/04/01 23:00
+	now := time.Date(2022, 4, 1, 14, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		benefit *Benefit
+		// next 2回目の利用日時
+		next time.Time
+		// renew 2回目の利用までに請求期間が更新されるかどうか
+		renew    bool
+		want     int64
+		exceeded bool
+	}{
+		{name: "unlimited", benefit: &Benefit{ID: "b-1"}, next: now, want: -1},
+		{name: "daily", benefit: &Benefit{ID: "b-1", QuotaPeriod: BenefitQuotaDaily, QuotaLimit: 1}, next: now.Add(59 * time.Minute), exceeded: true},
+		// 日付は日本時間で区切る
+		{name: "next day", benefit: &Benefit{ID: "b-1", QuotaPeriod: BenefitQuotaDaily, QuotaLimit: 1}, next: now.Add(time.Hour), want: 0},
+		{name: "billing period", benefit: &Benefit{ID: "b-1", QuotaPeriod: BenefitQuotaBillingPeriod, QuotaLimit: 2}, next: now.AddDate(0, 0, 3), want: 0},
+		{name: "billing period exceeded", benefit: &Benefit{ID: "b-1", QuotaPeriod: BenefitQuotaBillingPeriod, QuotaLimit: 1}, next: now.AddDate(0, 0, 3), exceeded: true},
+		{name: "next billing period", benefit: &Benefit{ID: "b-1", QuotaPeriod: BenefitQuotaBillingPeriod, QuotaLimit: 1}, next: now, renew: true, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := &UserSubscription{CurrentPeriodStart: now.AddDate(0, 0, -1)}
+			if _, err := us.Redeem(tt.benefit, now); err != nil {
+				t.Fatal(err)
+			}
+			if tt.renew {
+				us.CurrentPeriodStart = us.CurrentPeriodStart.AddDate(0, 0, 30)
+			}
+			remaining, err := us.Redeem(tt.benefit, tt.next)
+			if tt.exceeded {
+				if err != ErrQuotaExceeded {
+					t.Errorf("Redeem() = %d, %v, want ErrQuotaExceeded", remaining, err)
+				}
+				return
+			}
+			if err != nil || remaining != tt.want {
+				t.Errorf("Redeem() = %d, %v, want %d", remaining, err, tt.want)
+			}
+		})
+	}
+}
+
+// redeem testCustomerIDでbenefitIDの特典を利用する
+func (e *testEnv) redeem(benefitID string) (int, RedeemBenefitResponse) {
+	e.t.Helper()
+	code, body := e.post("/redeem-benefit", `{"subscription_id":"sub-ramen","benefit_id":"`+benefitID+`"}`)
+	var res RedeemBenefitResponse
+	if code == http.StatusOK {
+		decodeJSON(e.t, body, &res)
+	}
+	return code, res
+}
+
+func TestRedeemBenefit(t *testing.T) {
+	e := newTestEnv(t)
+	ramen := e.sub.Plan("plan-a").Benefit("b-ramen")
+	ramen.QuotaPeriod, ramen.QuotaLimit = BenefitQuotaBillingPeriod, 2
+	e.saveSubscription()
+	ub := e.subscribe("plan-a")
+
+	for _, want := range []int64{1, 0} {
+		code, res := e.redeem("b-ramen")
+		if code != http.StatusOK || res.Remaining == nil || *res.Remaining != want {
+			t.Fatalf("redeem = %d %+v, want remaining %d", code, res, want)
+		}
+	}
+	code, body := e.post("/redeem-benefit", `{"subscription_id":"sub-ramen","benefit_id":"b-ramen"}`)
+	if code != http.StatusTooManyRequests || errorCode(t, body) != "quota_exceeded" {
+		t.Errorf("redeem over the quota = %d %s, want 429 quota_exceeded", code, body)
+	}
+	// 契約中のプランに含まれない特典は利用できない
+	code, body = e.post("/redeem-benefit", `{"subscription_id":"sub-ramen","benefit_id":"b-topping"}`)
+	if code != http.StatusForbidden || errorCode(t, body) != "benefit_not_granted" {
+		t.Errorf("redeem b-topping = %d %s, want 403 benefit_not_granted", code, body)
+	}
+
+	code, body = e.get("/redemptions?subscription_id=sub-ramen")
+	if code != http.StatusOK {
+		t.Fatalf("GET /redemptions = %d %s", code, body)
+	}
+	var history ListRedemptionsResponse
+	decodeJSON(t, body, &history)
+	if len(history.Redemptions) != 2 {
+		t.Errorf("len(redemptions) = %d, want 2", len(history.Redemptions))
+	}
+
+	// 請求期間が更新されると利用回数を数え直す
+	if _, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	e.deliverEvents()
+	if code, res := e.redeem("b-ramen"); code != http.StatusOK || res.Remaining == nil || *res.Remaining != 1 {
+		t.Errorf("redeem after renewal = %d %+v, want remaining 1", code, res)
+	}
+}
+
+func TestRedeemBenefit_Unlimited(t *testing.T) {
+	e := newTestEnv(t)
+	e.subscribe("plan-a")
+
+	for i := 0; i < 3; i++ {
+		code, res := e.redeem("b-ramen")
+		if code != http.StatusOK || res.Remaining != nil {
+			t.Fatalf("redeem = %d %+v, want unlimited", code, res)
+		}
+	}
+}
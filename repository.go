@@ -1,46 +1,337 @@
 package main
 
 import (
+	"context"
+	"errors"
+
 	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
 )
 
-func GetSubscriptionTx(tx *firestore.Transaction, id string) (*Subscription, error) {
-	dr := fsClient.Collection(CollectionNameSubscription).Doc(id)
-	ds, err := tx.Get(dr)
+// ErrNotFound 指定したドキュメントが存在しない
+var ErrNotFound = errors.New("document not found")
+
+// SubscriptionRepository Subscription及びUserSubscriptionの永続化を担う
+type SubscriptionRepository interface {
+	// RunInTx トランザクション内でfを実行する。fがエラーを返した場合、トランザクション内の書き込みは破棄される
+	RunInTx(ctx context.Context, f func(ctx context.Context, tx SubscriptionTx) error) error
+	// WatchSubscriptions Subscriptionのドキュメントが変更される度にfを呼び出す。ctxがキャンセルされるかエラーが発生するまで戻らない
+	WatchSubscriptions(ctx context.Context, f func()) error
+}
+
+// SubscriptionTx トランザクション内で実行できる操作
+type SubscriptionTx interface {
+	GetSubscription(id string) (*Subscription, error)
+	// ListSubscriptions 全てのSubscriptionをID順に取得する
+	ListSubscriptions() ([]*Subscription, error)
+	CreateSubscription(s *Subscription) (*Subscription, error)
+	UpdateSubscription(s *Subscription) error
+
+	GetUserSubscription(id string) (*UserSubscription, error)
+	CreateUserSubscription(ub *UserSubscription) (*UserSubscription, error)
+	UpdateUserSubscription(ub *UserSubscription) error
+	// ListUserSubscriptionsByCustomer Customerが保持するUserSubscriptionをSubscription横断で取得する
+	ListUserSubscriptionsByCustomer(customerID string) ([]*UserSubscription, error)
+
+	GetProcessedEvent(id string) (*ProcessedEvent, error)
+	CreateProcessedEvent(e *ProcessedEvent) error
+
+	GetOutboxOperation(id string) (*OutboxOperation, error)
+	CreateOutboxOperation(op *OutboxOperation) error
+	UpdateOutboxOperation(op *OutboxOperation) error
+	// ListPendingOutboxOperations 未実行の操作を最大limit件取得する
+	ListPendingOutboxOperations(limit int) ([]*OutboxOperation, error)
+	// ListPendingOutboxOperationsByUserSubscription UserSubscriptionに対する未実行の操作を取得する
+	ListPendingOutboxOperationsByUserSubscription(userSubscriptionID string) ([]*OutboxOperation, error)
+
+	GetIdempotencyRecord(id string) (*IdempotencyRecord, error)
+	CreateIdempotencyRecord(rec *IdempotencyRecord) error
+	UpdateIdempotencyRecord(rec *IdempotencyRecord) error
+
+	CreateRedemption(r *Redemption) error
+	// ListRedemptions UserSubscriptionの特典の利用履歴を新しい順に最大limit件取得する
+	ListRedemptions(userSubscriptionID string, limit int) ([]*Redemption, error)
+
+	GetTrialUsage(id string) (*TrialUsage, error)
+	CreateTrialUsage(u *TrialUsage) error
+}
+
+// FirestoreRepository Firestoreをバックエンドとする SubscriptionRepository
+type FirestoreRepository struct {
+	client *firestore.Client
+}
+
+func NewFirestoreRepository(client *firestore.Client) *FirestoreRepository {
+	return &FirestoreRepository{client: client}
+}
+
+func (r *FirestoreRepository) RunInTx(ctx context.Context, f func(ctx context.Context, tx SubscriptionTx) error) error {
+	return r.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		return f(ctx, &firestoreTx{client: r.client, tx: tx})
+	})
+}
+
+func (r *FirestoreRepository) WatchSubscriptions(ctx context.Context, f func()) error {
+	it := r.client.Collection(CollectionNameSubscription).Snapshots(ctx)
+	defer it.Stop()
+	for {
+		if _, err := it.Next(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		f()
+	}
+}
+
+type firestoreTx struct {
+	client *firestore.Client
+	tx     *firestore.Transaction
+}
+
+func (t *firestoreTx) get(collection, id string, v interface{}) (string, error) {
+	dr := t.client.Collection(collection).Doc(id)
+	ds, err := t.tx.Get(dr)
 	if err != nil {
-		return nil, err
+		if status.Code(err) == codes.NotFound {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	if err := ds.DataTo(v); err != nil {
+		return "", err
 	}
+	return ds.Ref.ID, nil
+}
+
+func (t *firestoreTx) set(collection, id string, v interface{}) error {
+	dr := t.client.Collection(collection).Doc(id)
+	return t.tx.Set(dr, v)
+}
+
+func (t *firestoreTx) GetSubscription(id string) (*Subscription, error) {
 	var s Subscription
-	if err := ds.DataTo(&s); err != nil {
+	docID, err := t.get(CollectionNameSubscription, id, &s)
+	if err != nil {
 		return nil, err
 	}
-	s.ID = ds.Ref.ID
+	s.ID = docID
 	return &s, nil
 }
 
-func GetUserSubscriptionTx(tx *firestore.Transaction, id string) (*UserSubscription, error) {
-	dr := fsClient.Collection(CollectionNameUserSubscription).Doc(id)
-	ds, err := tx.Get(dr)
+func (t *firestoreTx) ListSubscriptions() ([]*Subscription, error) {
+	q := t.client.Collection(CollectionNameSubscription).OrderBy(firestore.DocumentID, firestore.Asc)
+	docs, err := t.tx.Documents(q).GetAll()
 	if err != nil {
 		return nil, err
 	}
+	subs := make([]*Subscription, 0, len(docs))
+	for _, ds := range docs {
+		var s Subscription
+		if err := ds.DataTo(&s); err != nil {
+			return nil, err
+		}
+		s.ID = ds.Ref.ID
+		subs = append(subs, &s)
+	}
+	return subs, nil
+}
+
+func (t *firestoreTx) CreateSubscription(s *Subscription) (*Subscription, error) {
+	if err := t.set(CollectionNameSubscription, s.ID, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (t *firestoreTx) UpdateSubscription(s *Subscription) error {
+	return t.set(CollectionNameSubscription, s.ID, s)
+}
+
+func (t *firestoreTx) GetUserSubscription(id string) (*UserSubscription, error) {
 	var s UserSubscription
-	if err := ds.DataTo(&s); err != nil {
+	docID, err := t.get(CollectionNameUserSubscription, id, &s)
+	if err != nil {
 		return nil, err
 	}
-	s.ID = ds.Ref.ID
+	s.ID = docID
 	return &s, nil
 }
 
-func CreateUserSubscriptionTx(tx *firestore.Transaction, ub *UserSubscription) (*UserSubscription, error) {
-	dr := fsClient.Collection(CollectionNameUserSubscription).Doc(ub.ID)
-	if err := tx.Set(dr, ub); err != nil {
+func (t *firestoreTx) CreateUserSubscription(ub *UserSubscription) (*UserSubscription, error) {
+	if err := t.set(CollectionNameUserSubscription, ub.ID, ub); err != nil {
 		return nil, err
 	}
 	return ub, nil
 }
 
-func UpdateUserSubscriptionTx(tx *firestore.Transaction, ub *UserSubscription) error {
-	dr := fsClient.Collection(CollectionNameUserSubscription).Doc(ub.ID)
-	return tx.Set(dr, ub)
+func (t *firestoreTx) UpdateUserSubscription(ub *UserSubscription) error {
+	return t.set(CollectionNameUserSubscription, ub.ID, ub)
+}
+
+func (t *firestoreTx) ListUserSubscriptionsByCustomer(customerID string) ([]*UserSubscription, error) {
+	q := t.client.Collection(CollectionNameUserSubscription).Where("customer_id", "==", customerID)
+	docs, err := t.tx.Documents(q).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	ubs := make([]*UserSubscription, 0, len(docs))
+	for _, ds := range docs {
+		var ub UserSubscription
+		if err := ds.DataTo(&ub); err != nil {
+			return nil, err
+		}
+		ub.ID = ds.Ref.ID
+		ubs = append(ubs, &ub)
+	}
+	return ubs, nil
+}
+
+func (t *firestoreTx) GetProcessedEvent(id string) (*ProcessedEvent, error) {
+	var e ProcessedEvent
+	docID, err := t.get(CollectionNameProcessedEvent, id, &e)
+	if err != nil {
+		return nil, err
+	}
+	e.ID = docID
+	return &e, nil
+}
+
+func (t *firestoreTx) CreateProcessedEvent(e *ProcessedEvent) error {
+	return t.set(CollectionNameProcessedEvent, e.ID, e)
+}
+
+func (t *firestoreTx) GetOutboxOperation(id string) (*OutboxOperation, error) {
+	var op OutboxOperation
+	docID, err := t.get(CollectionNameOutbox, id, &op)
+	if err != nil {
+		return nil, err
+	}
+	op.ID = docID
+	return &op, nil
+}
+
+func (t *firestoreTx) CreateOutboxOperation(op *OutboxOperation) error {
+	return t.set(CollectionNameOutbox, op.ID, op)
+}
+
+func (t *firestoreTx) UpdateOutboxOperation(op *OutboxOperation) error {
+	return t.set(CollectionNameOutbox, op.ID, op)
+}
+
+func (t *firestoreTx) ListPendingOutboxOperations(limit int) ([]*OutboxOperation, error) {
+	q := t.client.Collection(CollectionNameOutbox).Where("status", "==", string(OutboxStatusPending)).Limit(limit)
+	return t.listOutboxOperations(q)
+}
+
+func (t *firestoreTx) ListPendingOutboxOperationsByUserSubscription(userSubscriptionID string) ([]*OutboxOperation, error) {
+	q := t.client.Collection(CollectionNameOutbox).
+		Where("user_subscription_id", "==", userSubscriptionID).
+		Where("status", "==", string(OutboxStatusPending))
+	return t.listOutboxOperations(q)
+}
+
+func (t *firestoreTx) listOutboxOperations(q firestore.Query) ([]*OutboxOperation, error) {
+	docs, err := t.tx.Documents(q).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]*OutboxOperation, 0, len(docs))
+	for _, ds := range docs {
+		var op OutboxOperation
+		if err := ds.DataTo(&op); err != nil {
+			return nil, err
+		}
+		op.ID = ds.Ref.ID
+		ops = append(ops, &op)
+	}
+	return ops, nil
+}
+
+func (t *firestoreTx) GetIdempotencyRecord(id string) (*IdempotencyRecord, error) {
+	var rec IdempotencyRecord
+	docID, err := t.get(CollectionNameIdempotencyKey, id, &rec)
+	if err != nil {
+		return nil, err
+	}
+	rec.ID = docID
+	return &rec, nil
+}
+
+func (t *firestoreTx) CreateIdempotencyRecord(rec *IdempotencyRecord) error {
+	return t.set(CollectionNameIdempotencyKey, rec.ID, rec)
+}
+
+func (t *firestoreTx) UpdateIdempotencyRecord(rec *IdempotencyRecord) error {
+	return t.set(CollectionNameIdempotencyKey, rec.ID, rec)
+}
+
+func (t *firestoreTx) CreateRedemption(r *Redemption) error {
+	return t.set(CollectionNameRedemption, r.ID, r)
+}
+
+func (t *firestoreTx) ListRedemptions(userSubscriptionID string, limit int) ([]*Redemption, error) {
+	q := t.client.Collection(CollectionNameRedemption).
+		Where("user_subscription_id", "==", userSubscriptionID).
+		OrderBy("redeemed_at", firestore.Desc).
+		Limit(limit)
+	docs, err := t.tx.Documents(q).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	rs := make([]*Redemption, 0, len(docs))
+	for _, ds := range docs {
+		var r Redemption
+		if err := ds.DataTo(&r); err != nil {
+			return nil, err
+		}
+		r.ID = ds.Ref.ID
+		rs = append(rs, &r)
+	}
+	return rs, nil
+}
+
+func (t *firestoreTx) GetTrialUsage(id string) (*TrialUsage, error) {
+	var u TrialUsage
+	docID, err := t.get(CollectionNameTrialUsage, id, &u)
+	if err != nil {
+		return nil, err
+	}
+	u.ID = docID
+	return &u, nil
+}
+
+func (t *firestoreTx) CreateTrialUsage(u *TrialUsage) error {
+	return t.set(CollectionNameTrialUsage, u.ID, u)
+}
+
+// getSubscription Subscriptionを取得する。存在しない場合はapperror.NotFoundを返す
+func getSubscription(tx SubscriptionTx, id string) (*Subscription, error) {
+	sub, err := tx.GetSubscription(id)
+	if err == ErrNotFound {
+		return nil, apperror.NotFound("subscription is not found")
+	}
+	return sub, err
+}
+
+// getUserSubscription 顧客のUserSubscriptionを取得する。存在しない場合はapperror.NotFoundを返す
+func getUserSubscription(tx SubscriptionTx, sub *Subscription, customerID string) (*UserSubscription, error) {
+	ub, err := tx.GetUserSubscription(sub.UserSubscriptionID(customerID))
+	if err == ErrNotFound {
+		return nil, apperror.NotFound("user subscription is not found")
+	}
+	return ub, err
+}
+
+// getPlan 契約・変更先として選択できるSubscriptionのプランを取得する。存在しない、または販売を終了したプランの場合はapperror.InvalidPlanを返す
+func getPlan(sub *Subscription, planID string) (*Plan, error) {
+	plan := sub.Plan(planID)
+	if plan == nil || plan.Archived {
+		return nil, apperror.InvalidPlan(planID)
+	}
+	return plan, nil
 }
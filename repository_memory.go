@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// MemoryRepository メモリ上で動作する SubscriptionRepository。テストやローカルでの動作確認に利用する
+// RunInTxは排他的に実行され、fがエラーを返した場合はトランザクション内の書き込みを破棄する
+type MemoryRepository struct {
+	mu       sync.Mutex
+	docs     map[string]map[string][]byte
+	watchers map[chan struct{}]struct{}
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{docs: map[string]map[string][]byte{}, watchers: map[chan struct{}]struct{}{}}
+}
+
+func (r *MemoryRepository) RunInTx(ctx context.Context, f func(ctx context.Context, tx SubscriptionTx) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx := &memoryTx{repo: r, writes: map[string]map[string][]byte{}}
+	if err := f(ctx, tx); err != nil {
+		return err
+	}
+	// fが成功した場合のみ書き込みを反映する
+	for collection, docs := range tx.writes {
+		if r.docs[collection] == nil {
+			r.docs[collection] = map[string][]byte{}
+		}
+		for id, b := range docs {
+			r.docs[collection][id] = b
+		}
+	}
+	if len(tx.writes[CollectionNameSubscription]) > 0 {
+		for ch := range r.watchers {
+			select {
+			case ch <- struct{}{}:
+			default:
+				// 未処理の通知が残っている
+			}
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) WatchSubscriptions(ctx context.Context, f func()) error {
+	ch := make(chan struct{}, 1)
+	r.mu.Lock()
+	r.watchers[ch] = struct{}{}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.watchers, ch)
+		r.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch:
+			f()
+		}
+	}
+}
+
+type memoryTx struct {
+	repo   *MemoryRepository
+	writes map[string]map[string][]byte
+}
+
+// get ドキュメントをvに読み込む。呼び出し元が値を書き換えてもストアに影響しないようJSONを経由してコピーする
+func (t *memoryTx) get(collection, id string, v interface{}) error {
+	b, ok := t.writes[collection][id]
+	if !ok {
+		b, ok = t.repo.docs[collection][id]
+	}
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(b, v)
+}
+
+// list コレクション内の全てのドキュメントをID順に返す
+func (t *memoryTx) list(collection string) (ids []string, docs [][]byte) {
+	merged := map[string][]byte{}
+	for id, b := range t.repo.docs[collection] {
+		merged[id] = b
+	}
+	for id, b := range t.writes[collection] {
+		merged[id] = b
+	}
+	for id := range merged {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		docs = append(docs, merged[id])
+	}
+	return ids, docs
+}
+
+func (t *memoryTx) set(collection, id string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if t.writes[collection] == nil {
+		t.writes[collection] = map[string][]byte{}
+	}
+	t.writes[collection][id] = b
+	return nil
+}
+
+func (t *memoryTx) GetSubscription(id string) (*Subscription, error) {
+	var s Subscription
+	if err := t.get(CollectionNameSubscription, id, &s); err != nil {
+		return nil, err
+	}
+	s.ID = id
+	return &s, nil
+}
+
+func (t *memoryTx) ListSubscriptions() ([]*Subscription, error) {
+	var subs []*Subscription
+	ids, docs := t.list(CollectionNameSubscription)
+	for i, b := range docs {
+		var s Subscription
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, err
+		}
+		s.ID = ids[i]
+		subs = append(subs, &s)
+	}
+	return subs, nil
+}
+
+func (t *memoryTx) CreateSubscription(s *Subscription) (*Subscription, error) {
+	if err := t.set(CollectionNameSubscription, s.ID, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (t *memoryTx) UpdateSubscription(s *Subscription) error {
+	return t.set(CollectionNameSubscription, s.ID, s)
+}
+
+func (t *memoryTx) GetUserSubscription(id string) (*UserSubscription, error) {
+	var s UserSubscription
+	if err := t.get(CollectionNameUserSubscription, id, &s); err != nil {
+		return nil, err
+	}
+	s.ID = id
+	return &s, nil
+}
+
+func (t *memoryTx) CreateUserSubscription(ub *UserSubscription) (*UserSubscription, error) {
+	if err := t.set(CollectionNameUserSubscription, ub.ID, ub); err != nil {
+		return nil, err
+	}
+	return ub, nil
+}
+
+func (t *memoryTx) UpdateUserSubscription(ub *UserSubscription) error {
+	return t.set(CollectionNameUserSubscription, ub.ID, ub)
+}
+
+func (t *memoryTx) ListUserSubscriptionsByCustomer(customerID string) ([]*UserSubscription, error) {
+	var ubs []*UserSubscription
+	ids, docs := t.list(CollectionNameUserSubscription)
+	for i, b := range docs {
+		var ub UserSubscription
+		if err := json.Unmarshal(b, &ub); err != nil {
+			return nil, err
+		}
+		if ub.CustomerID != customerID {
+			continue
+		}
+		ub.ID = ids[i]
+		ubs = append(ubs, &ub)
+	}
+	return ubs, nil
+}
+
+func (t *memoryTx) GetProcessedEvent(id string) (*ProcessedEvent, error) {
+	var e ProcessedEvent
+	if err := t.get(CollectionNameProcessedEvent, id, &e); err != nil {
+		return nil, err
+	}
+	e.ID = id
+	return &e, nil
+}
+
+func (t *memoryTx) CreateProcessedEvent(e *ProcessedEvent) error {
+	return t.set(CollectionNameProcessedEvent, e.ID, e)
+}
+
+func (t *memoryTx) GetOutboxOperation(id string) (*OutboxOperation, error) {
+	var op OutboxOperation
+	if err := t.get(CollectionNameOutbox, id, &op); err != nil {
+		return nil, err
+	}
+	op.ID = id
+	return &op, nil
+}
+
+func (t *memoryTx) CreateOutboxOperation(op *OutboxOperation) error {
+	return t.set(CollectionNameOutbox, op.ID, op)
+}
+
+func (t *memoryTx) UpdateOutboxOperation(op *OutboxOperation) error {
+	return t.set(CollectionNameOutbox, op.ID, op)
+}
+
+func (t *memoryTx) ListPendingOutboxOperations(limit int) ([]*OutboxOperation, error) {
+	var ops []*OutboxOperation
+	ids, docs := t.list(CollectionNameOutbox)
+	for i, b := range docs {
+		if len(ops) >= limit {
+			break
+		}
+		var op OutboxOperation
+		if err := json.Unmarshal(b, &op); err != nil {
+			return nil, err
+		}
+		if op.Status != OutboxStatusPending {
+			continue
+		}
+		op.ID = ids[i]
+		ops = append(ops, &op)
+	}
+	return ops, nil
+}
+
+func (t *memoryTx) ListPendingOutboxOperationsByUserSubscription(userSubscriptionID string) ([]*OutboxOperation, error) {
+	var ops []*OutboxOperation
+	ids, docs := t.list(CollectionNameOutbox)
+	for i, b := range docs {
+		var op OutboxOperation
+		if err := json.Unmarshal(b, &op); err != nil {
+			return nil, err
+		}
+		if op.Status != OutboxStatusPending || op.UserSubscriptionID != userSubscriptionID {
+			continue
+		}
+		op.ID = ids[i]
+		ops = append(ops, &op)
+	}
+	return ops, nil
+}
+
+func (t *memoryTx) GetIdempotencyRecord(id string) (*IdempotencyRecord, error) {
+	var rec IdempotencyRecord
+	if err := t.get(CollectionNameIdempotencyKey, id, &rec); err != nil {
+		return nil, err
+	}
+	rec.ID = id
+	return &rec, nil
+}
+
+func (t *memoryTx) CreateIdempotencyRecord(rec *IdempotencyRecord) error {
+	return t.set(CollectionNameIdempotencyKey, rec.ID, rec)
+}
+
+func (t *memoryTx) UpdateIdempotencyRecord(rec *IdempotencyRecord) error {
+	return t.set(CollectionNameIdempotencyKey, rec.ID, rec)
+}
+
+func (t *memoryTx) CreateRedemption(r *Redemption) error {
+	return t.set(CollectionNameRedemption, r.ID, r)
+}
+
+func (t *memoryTx) ListRedemptions(userSubscriptionID string, limit int) ([]*Redemption, error) {
+	var rs []*Redemption
+	ids, docs := t.list(CollectionNameRedemption)
+	for i, b := range docs {
+		var r Redemption
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, err
+		}
+		if r.UserSubscriptionID != userSubscriptionID {
+			continue
+		}
+		r.ID = ids[i]
+		rs = append(rs, &r)
+	}
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].RedeemedAt.After(rs[j].RedeemedAt) })
+	if len(rs) > limit {
+		rs = rs[:limit]
+	}
+	return rs, nil
+}
+
+func (t *memoryTx) GetTrialUsage(id string) (*TrialUsage, error) {
+	var u TrialUsage
+	if err := t.get(CollectionNameTrialUsage, id, &u); err != nil {
+		return nil, err
+	}
+	u.ID = id
+	return &u, nil
+}
+
+func (t *memoryTx) CreateTrialUsage(u *TrialUsage) error {
+	return t.set(CollectionNameTrialUsage, u.ID, u)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+func TestMemoryRepository_RunInTx(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryRepository()
+
+	err := r.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		if _, err := tx.CreateSubscription(&Subscription{ID: "sub-1", Title: "ramen"}); err != nil {
+			return err
+		}
+		// 同じトランザクション内では書き込んだ内容を読み込める
+		s, err := tx.GetSubscription("sub-1")
+		if err != nil {
+			return err
+		}
+		if s.Title != "ramen" {
+			t.Errorf("Title = %q, want %q", s.Title, "ramen")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errAbort := errors.New("abort")
+	err = r.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		if err := tx.UpdateSubscription(&Subscription{ID: "sub-1", Title: "udon"}); err != nil {
+			return err
+		}
+		if _, err := tx.CreateSubscription(&Subscription{ID: "sub-2"}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("RunInTx() = %v, want %v", err, errAbort)
+	}
+
+	// fがエラーを返した場合、書き込みは破棄される
+	err = r.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		s, err := tx.GetSubscription("sub-1")
+		if err != nil {
+			return err
+		}
+		if s.Title != "ramen" {
+			t.Errorf("Title = %q, want %q", s.Title, "ramen")
+		}
+		if _, err := tx.GetSubscription("sub-2"); err != ErrNotFound {
+			t.Errorf("GetSubscription(sub-2) = %v, want ErrNotFound", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryRepository_GetReturnsCopy(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryRepository()
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		_, err := tx.CreateUserSubscription(&UserSubscription{ID: "cus_1-sub-1", CustomerID: "cus_1", PlanID: "plan-a"})
+		return err
+	})
+
+	// 読み込んだ値を書き換えても、Updateするまではストアに反映されない
+	err := r.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		ub, err := tx.GetUserSubscription("cus_1-sub-1")
+		if err != nil {
+			return err
+		}
+		ub.PlanID = "plan-b"
+		again, err := tx.GetUserSubscription("cus_1-sub-1")
+		if err != nil {
+			return err
+		}
+		if again.PlanID != "plan-a" {
+			t.Errorf("PlanID = %q, want %q", again.PlanID, "plan-a")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryRepository_ListUserSubscriptionsByCustomer(t *testing.T) {
+	r := NewMemoryRepository()
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		for _, ub := range []*UserSubscription{
+			{ID: "cus_1-sub-2", CustomerID: "cus_1"},
+			{ID: "cus_2-sub-1", CustomerID: "cus_2"},
+			{ID: "cus_1-sub-1", CustomerID: "cus_1"},
+		} {
+			if _, err := tx.CreateUserSubscription(ub); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		ubs, err := tx.ListUserSubscriptionsByCustomer("cus_1")
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for _, ub := range ubs {
+			ids = append(ids, ub.ID)
+		}
+		if len(ids) != 2 || ids[0] != "cus_1-sub-1" || ids[1] != "cus_1-sub-2" {
+			t.Errorf("ListUserSubscriptionsByCustomer() = %v, want [cus_1-sub-1 cus_1-sub-2]", ids)
+		}
+		return nil
+	})
+}
+
+func TestMemoryRepository_ListPendingOutboxOperations(t *testing.T) {
+	r := NewMemoryRepository()
+	now := time.Now()
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		for _, id := range []string{"op-1", "op-2", "op-3", "op-4"} {
+			op := NewOutboxOperation(id, OutboxOperationCreateSubscription, now)
+			if id == "op-2" {
+				op.Status = OutboxStatusDone
+			}
+			if err := tx.CreateOutboxOperation(op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		ops, err := tx.ListPendingOutboxOperations(2)
+		if err != nil {
+			return err
+		}
+		if len(ops) != 2 || ops[0].ID != "op-1" || ops[1].ID != "op-3" {
+			t.Errorf("ListPendingOutboxOperations(2) = %v, want [op-1 op-3]", outboxOperationIDs(ops))
+		}
+		return nil
+	})
+}
+
+func TestMemoryRepository_ListPendingOutboxOperationsByUserSubscription(t *testing.T) {
+	r := NewMemoryRepository()
+	now := time.Now()
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		for _, id := range []string{"op-1", "op-2", "op-3", "op-4"} {
+			op := NewOutboxOperation(id, OutboxOperationCreateSubscription, now)
+			op.UserSubscriptionID = "cus_1-sub-1"
+			switch id {
+			case "op-2":
+				op.Status = OutboxStatusDone
+			case "op-3":
+				op.UserSubscriptionID = "cus_2-sub-1"
+			}
+			if err := tx.CreateOutboxOperation(op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		ops, err := tx.ListPendingOutboxOperationsByUserSubscription("cus_1-sub-1")
+		if err != nil {
+			return err
+		}
+		if len(ops) != 2 || ops[0].ID != "op-1" || ops[1].ID != "op-4" {
+			t.Errorf("ListPendingOutboxOperationsByUserSubscription() = %v, want [op-1 op-4]", outboxOperationIDs(ops))
+		}
+		return nil
+	})
+}
+
+func TestMemoryRepository_ListRedemptions(t *testing.T) {
+	r := NewMemoryRepository()
+	base := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		for i, ubID := range []string{"cus_1-sub-1", "cus_2-sub-1", "cus_1-sub-1", "cus_1-sub-1"} {
+			rd := &Redemption{ID: string(rune('a' + i)), UserSubscriptionID: ubID, RedeemedAt: base.Add(time.Duration(i) * time.Hour)}
+			if err := tx.CreateRedemption(rd); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		rs, err := tx.ListRedemptions("cus_1-sub-1", 2)
+		if err != nil {
+			return err
+		}
+		// 新しい順に最大2件
+		var ids []string
+		for _, rd := range rs {
+			ids = append(ids, rd.ID)
+		}
+		if len(ids) != 2 || ids[0] != "d" || ids[1] != "c" {
+			t.Errorf("ListRedemptions() = %v, want [d c]", ids)
+		}
+		return nil
+	})
+}
+
+func TestMemoryRepository_WatchSubscriptions(t *testing.T) {
+	r := NewMemoryRepository()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notified := make(chan struct{}, 1)
+	done := make(chan error)
+	go func() {
+		done <- r.WatchSubscriptions(ctx, func() {
+			select {
+			case notified <- struct{}{}:
+			default:
+			}
+		})
+	}()
+
+	// 監視の登録を待ってから書き込む
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.mu.Lock()
+		n := len(r.watchers)
+		r.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("WatchSubscriptions did not register a watcher")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Subscription以外の書き込みでは通知しない
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		_, err := tx.CreateUserSubscription(&UserSubscription{ID: "cus_1-sub-1"})
+		return err
+	})
+	select {
+	case <-notified:
+		t.Fatal("notified on a UserSubscription write")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		_, err := tx.CreateSubscription(&Subscription{ID: "sub-1"})
+		return err
+	})
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("not notified on a Subscription write")
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("WatchSubscriptions() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestGetHelpers(t *testing.T) {
+	r := NewMemoryRepository()
+	sub := &Subscription{ID: "sub-1", Plans: []*Plan{
+		{ID: "plan-a"},
+		{ID: "plan-old", Archived: true},
+	}}
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		_, err := tx.CreateSubscription(sub)
+		return err
+	})
+
+	mustRunInTx(t, r, func(tx SubscriptionTx) error {
+		if _, err := getSubscription(tx, "sub-unknown"); apperror.From(err).Code != apperror.CodeNotFound {
+			t.Errorf("getSubscription() = %v, want not_found", err)
+		}
+		if _, err := getUserSubscription(tx, sub, "cus_1"); apperror.From(err).Code != apperror.CodeNotFound {
+			t.Errorf("getUserSubscription() = %v, want not_found", err)
+		}
+		return nil
+	})
+
+	tests := []struct {
+		planID  string
+		wantErr bool
+	}{
+		{planID: "plan-a"},
+		{planID: "plan-old", wantErr: true},
+		{planID: "plan-unknown", wantErr: true},
+	}
+	for _, tt := range tests {
+		_, err := getPlan(sub, tt.planID)
+		if tt.wantErr && apperror.From(err).Code != apperror.CodeInvalidPlan {
+			t.Errorf("getPlan(%q) = %v, want invalid_plan", tt.planID, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("getPlan(%q) = %v", tt.planID, err)
+		}
+	}
+}
+
+func mustRunInTx(t *testing.T, r SubscriptionRepository, f func(tx SubscriptionTx) error) {
+	t.Helper()
+	err := r.RunInTx(context.Background(), func(ctx context.Context, tx SubscriptionTx) error {
+		return f(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func outboxOperationIDs(ops []*OutboxOperation) []string {
+	var ids []string
+	for _, op := range ops {
+		ids = append(ids, op.ID)
+	}
+	return ids
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+type ResumeUserSubscriptionRequest struct {
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+}
+
+// ResumeUserSubscriptionHandler 請求期間の終了時の解約を取り消し、自動更新を再開する
+func ResumeUserSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	var req ResumeUserSubscriptionRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
+
+	op := NewOutboxOperation(outboxOperationID(r), OutboxOperationResumeSubscription, time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
+		}
+		// 期間が終了して解約済みの場合は再開できないため、/recreate-subscription で再契約する
+		switch {
+		case ub.Status == stripe.SubscriptionStatusCanceled:
+			return apperror.Conflict("subscription is already canceled")
+		case !ub.CancelAtPeriodEnd:
+			return apperror.Conflict("subscription is not scheduled for cancellation")
+		}
+
+		op.UserSubscriptionID = ub.ID
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.StripeSubscriptionID = ub.StripeSubscriptionID
+		return saveOutboxOperation(tx, op)
+	})
+	if err != nil {
+		writeError(w, "resumeUserSubscriptionHandler", err)
+		return
+	}
+	if _, err := dispatchOutboxOperation(ctx, op.ID); err != nil {
+		writeError(w, "resumeUserSubscriptionHandler", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestResumeSubscription(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-a")
+	if code, body := e.post("/resume-subscription", `{"subscription_id":"sub-ramen"}`); code != http.StatusConflict {
+		t.Errorf("resume before canceling = %d %s, want 409", code, body)
+	}
+
+	e.mustPost("/cancel-subscription", `{"subscription_id":"sub-ramen","reason":"too_expensive","decline_retention_offer":true}`, nil)
+	e.deliverEvents()
+	if got := e.userSubscription(); !got.CancelAtPeriodEnd || got.CancellationMode != CancellationAtPeriodEnd {
+		t.Fatalf("CancelAtPeriodEnd = %v mode %s, want a cancellation at the period end", got.CancelAtPeriodEnd, got.CancellationMode)
+	}
+
+	// 請求期間の終了前であれば解約の予約を取り消せる
+	e.mustPost("/resume-subscription", `{"subscription_id":"sub-ramen"}`, nil)
+	e.deliverEvents()
+	got := e.userSubscription()
+	if got.CancelAtPeriodEnd || got.CancellationMode != "" || got.CancellationReason != "" {
+		t.Errorf("UserSubscription = cancel %v mode %q reason %q, want the cancellation withdrawn", got.CancelAtPeriodEnd, got.CancellationMode, got.CancellationReason)
+	}
+	if s := e.stripeSubscription(); s.CancelAtPeriodEnd {
+		t.Error("stripe CancelAtPeriodEnd = true, want false")
+	}
+	if _, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	e.deliverEvents()
+	if got := e.userSubscription(); got.Status != stripe.SubscriptionStatusActive {
+		t.Errorf("Status after the renewal = %s, want active", got.Status)
+	}
+}
+
+func TestResumeSubscription_AfterPeriodEnd(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-a")
+	e.mustPost("/cancel-subscription", `{"subscription_id":"sub-ramen","decline_retention_offer":true}`, nil)
+	if _, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	e.deliverEvents()
+
+	// 解約済みのSubscriptionは再開できない
+	if code, body := e.post("/resume-subscription", `{"subscription_id":"sub-ramen"}`); code != http.StatusConflict {
+		t.Errorf("resume after the period end = %d %s, want 409", code, body)
+	}
+}
+
+func TestReCreateSubscription_AfterImmediateCancellation(t *testing.T) {
+	e := newTestEnv(t)
+	canceled := e.subscribe("plan-a")
+	e.mustPost("/cancel-subscription-immediately", `{"subscription_id":"sub-ramen","refund":"full","reason":"too_expensive","comment":"高い"}`, nil)
+	e.deliverEvents()
+
+	e.mustPost("/recreate-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-b"}`, nil)
+	e.deliverEvents()
+
+	// 解約したSubscriptionの解約・返金の記録は、再登録した新しいSubscriptionに引き継がない
+	got := e.userSubscription()
+	if got.Status != stripe.SubscriptionStatusActive || got.PlanID != "plan-b" || got.StripeSubscriptionID == canceled.StripeSubscriptionID {
+		t.Errorf("UserSubscription = %s %s %s, want a new active plan-b subscription", got.Status, got.PlanID, got.StripeSubscriptionID)
+	}
+	if got.CancellationMode != "" || got.CancellationReason != "" || got.CancellationComment != "" || got.RefundMode != "" || got.RefundAmount != 0 {
+		t.Errorf("cancellation = mode %q reason %q comment %q refund %q %d, want none", got.CancellationMode, got.CancellationReason, got.CancellationComment, got.RefundMode, got.RefundAmount)
+	}
+}
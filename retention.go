@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+// CancellationReason 解約理由。StripeのSubscriptionのcancellation_details.feedbackと同じ値を利用する
+type CancellationReason string
+
+const (
+	CancellationReasonCustomerService CancellationReason = "customer_service"
+	CancellationReasonLowQuality      CancellationReason = "low_quality"
+	CancellationReasonMissingFeatures CancellationReason = "missing_features"
+	CancellationReasonOther           CancellationReason = "other"
+	CancellationReasonSwitchedService CancellationReason = "switched_service"
+	CancellationReasonTooComplex      CancellationReason = "too_complex"
+	CancellationReasonTooExpensive    CancellationReason = "too_expensive"
+	CancellationReasonUnused          CancellationReason = "unused"
+)
+
+var cancellationReasons = []CancellationReason{
+	CancellationReasonCustomerService,
+	CancellationReasonLowQuality,
+	CancellationReasonMissingFeatures,
+	CancellationReasonOther,
+	CancellationReasonSwitchedService,
+	CancellationReasonTooComplex,
+	CancellationReasonTooExpensive,
+	CancellationReasonUnused,
+}
+
+// maxCancellationCommentLength 解約時のコメントの最大文字数
+const maxCancellationCommentLength = 500
+
+func (r CancellationReason) valid() bool {
+	for _, v := range cancellationReasons {
+		if r == v {
+			return true
+		}
+	}
+	return false
+}
+
+func cancellationReasonValues() []string {
+	values := make([]string, len(cancellationReasons))
+	for i, r := range cancellationReasons {
+		values[i] = string(r)
+	}
+	return values
+}
+
+// RetentionOfferKind 引き止めの特典の種類
+type RetentionOfferKind string
+
+const (
+	// RetentionOfferCoupon Stripeのクーポンを適用する
+	RetentionOfferCoupon RetentionOfferKind = "coupon"
+	// RetentionOfferDowngrade 同じSubscriptionのより安いプランへの変更を提案する。変更は請求期間の終了時に行う
+	RetentionOfferDowngrade RetentionOfferKind = "downgrade"
+)
+
+// RetentionOffer 解約の前に提示する引き止めの特典
+type RetentionOffer struct {
+	ID    string             `firestore:"id"`
+	Kind  RetentionOfferKind `firestore:"kind"`
+	Title string             `firestore:"title"`
+	// Reasons 特典を提示する解約理由。空の場合は理由に関わらず提示する
+	Reasons []CancellationReason `firestore:"reasons"`
+	// StripeCouponID Kindがcouponの場合に適用するクーポン
+	StripeCouponID string `firestore:"stripe_coupon_id"`
+	// PlanID Kindがdowngradeの場合の変更先のプラン。空の場合は契約中のプランの次に安いプランを提案する
+	PlanID string `firestore:"plan_id"`
+}
+
+func (o *RetentionOffer) matches(reason CancellationReason) bool {
+	if len(o.Reasons) == 0 {
+		return true
+	}
+	for _, r := range o.Reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// RetentionOffer 解約理由に対してubに提示する引き止めの特典を返す。特典を受け入れたことがある場合や解約を予約済みの場合は提示しない
+func (s *Subscription) RetentionOffer(ub *UserSubscription, reason CancellationReason) (*RetentionOffer, *Plan) {
+	if !ub.RetentionOfferAcceptedAt.IsZero() || ub.CancelAtPeriodEnd {
+		return nil, nil
+	}
+	for _, o := range s.RetentionOffers {
+		if !o.matches(reason) {
+			continue
+		}
+		if plan, ok := s.availableRetentionOffer(o, ub); ok {
+			return o, plan
+		}
+	}
+	return nil, nil
+}
+
+// availableRetentionOffer oをubに提示できるかどうか。ダウングレードの場合は変更先のプランも返す
+func (s *Subscription) availableRetentionOffer(o *RetentionOffer, ub *UserSubscription) (*Plan, bool) {
+	switch o.Kind {
+	case RetentionOfferCoupon:
+		// 割引を適用中の場合は置き換えになるため提示しない
+		return nil, o.StripeCouponID != "" && ub.Discount == nil
+	case RetentionOfferDowngrade:
+		plan := s.downgradePlan(s.Plan(ub.PlanID), o.PlanID)
+		return plan, plan != nil && plan.ID != ub.NextPlanID
+	}
+	return nil, false
+}
+
+// downgradePlan currentより安い販売中のプランを返す。planIDを指定しない場合は、currentより安いプランのうち最も高いプランを返す
+func (s *Subscription) downgradePlan(current *Plan, planID string) *Plan {
+	if current == nil {
+		return nil
+	}
+	cheaper := func(p *Plan) bool {
+		return p.ID != current.ID && !p.Archived && p.Currency == current.Currency && p.dailyPrice() < current.dailyPrice()
+	}
+	if planID != "" {
+		if p := s.Plan(planID); p != nil && cheaper(p) {
+			return p
+		}
+		return nil
+	}
+	var next *Plan
+	for _, p := range s.Plans {
+		if cheaper(p) && (next == nil || p.dailyPrice() > next.dailyPrice()) {
+			next = p
+		}
+	}
+	return next
+}
+
+// RetentionOfferResponse 解約の代わりに提示する引き止めの特典
+type RetentionOfferResponse struct {
+	ID    string             `json:"id"`
+	Kind  RetentionOfferKind `json:"kind"`
+	Title string             `json:"title"`
+	// Plan Kindがdowngradeの場合の変更先のプラン
+	Plan *PlanResponse `json:"plan,omitempty"`
+}
+
+func newRetentionOfferResponse(o *RetentionOffer, plan *Plan) *RetentionOfferResponse {
+	res := &RetentionOfferResponse{ID: o.ID, Kind: o.Kind, Title: o.Title}
+	if plan != nil {
+		res.Plan = newPlanResponse(plan)
+	}
+	return res
+}
+
+type AcceptRetentionOfferRequest struct {
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+	OfferID        string `json:"offer_id" validate:"required,document_id"`
+}
+
+type AcceptRetentionOfferResponse struct {
+	OfferID string             `json:"offer_id"`
+	Kind    RetentionOfferKind `json:"kind"`
+	// PlanID、EffectiveAt ダウングレードの場合の変更後のプランと、変更が反映される日時
+	PlanID      string     `json:"plan_id,omitempty"`
+	EffectiveAt *time.Time `json:"effective_at,omitempty"`
+}
+
+// AcceptRetentionOfferHandler 解約時に提示した引き止めの特典を受け入れ、クーポンの適用または請求期間の終了時のプラン変更を行う
+func AcceptRetentionOfferHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	var req AcceptRetentionOfferRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
+		return
+	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
+
+	res := AcceptRetentionOfferResponse{OfferID: req.OfferID}
+	op := NewOutboxOperation(outboxOperationID(r), "", time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
+		}
+		var offer *RetentionOffer
+		for _, o := range sub.RetentionOffers {
+			if o.ID == req.OfferID {
+				offer = o
+			}
+		}
+		if offer == nil {
+			return apperror.NotFound("retention offer is not found")
+		}
+		switch {
+		case ub.Status == stripe.SubscriptionStatusCanceled || ub.CancelAtPeriodEnd:
+			return apperror.Conflict("subscription is already canceled")
+		case !ub.RetentionOfferAcceptedAt.IsZero():
+			return apperror.Conflict("retention offer has already been accepted")
+		}
+		plan, ok := sub.availableRetentionOffer(offer, ub)
+		if !ok {
+			return apperror.Conflict("retention offer is not available")
+		}
+
+		op.UserSubscriptionID = ub.ID
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.StripeSubscriptionID = ub.StripeSubscriptionID
+		op.RetentionOfferID = offer.ID
+		res.Kind = offer.Kind
+		switch offer.Kind {
+		case RetentionOfferCoupon:
+			op.Kind = OutboxOperationApplyCoupon
+			op.StripeCouponID = offer.StripeCouponID
+		case RetentionOfferDowngrade:
+			op.Kind = OutboxOperationChangePlanAtPeriodEnd
+			op.PlanID = plan.ID
+			op.StripePriceID = plan.StripePriceID
+			op.StripeSubscriptionItemID = ub.StripeSubscriptionItemID
+			op.StripeScheduleID = ub.StripeScheduleID
+			effectiveAt := ub.CurrentPeriodEnd
+			res.PlanID = plan.ID
+			res.EffectiveAt = &effectiveAt
+		}
+		return saveOutboxOperation(tx, op)
+	})
+	if err != nil {
+		writeError(w, "acceptRetentionOfferHandler", err)
+		return
+	}
+	if _, err := dispatchOutboxOperation(ctx, op.ID); err != nil {
+		writeError(w, "acceptRetentionOfferHandler", err)
+		return
+	}
+	writeJSON(w, "acceptRetentionOfferHandler", res)
+}
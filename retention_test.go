@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// setRetentionOffers 解約理由がtoo_expensiveの場合に、3か月間50%割引のクーポンを提示する
+func (e *testEnv) setRetentionOffers() *stripe.Coupon {
+	e.t.Helper()
+	coupon := e.fake.CreateCoupon(&stripe.Coupon{Name: "50% off", PercentOff: 50, Duration: stripe.CouponDurationRepeating, DurationInMonths: 3})
+	e.sub.RetentionOffers = []*RetentionOffer{
+		{ID: "offer-coupon", Kind: RetentionOfferCoupon, Title: "50% off", Reasons: []CancellationReason{CancellationReasonTooExpensive}, StripeCouponID: coupon.ID},
+		{ID: "offer-downgrade", Kind: RetentionOfferDowngrade, Title: "B", Reasons: []CancellationReason{CancellationReasonUnused}},
+	}
+	e.saveSubscription()
+	return coupon
+}
+
+func TestRetentionOffer_Coupon(t *testing.T) {
+	e := newTestEnv(t)
+	coupon := e.setRetentionOffers()
+	e.subscribe("plan-a")
+
+	// 特典を提示した場合は解約しない
+	requests := e.countRequests(http.MethodPost, "/v1/subscriptions/")
+	var canceled CancelUserSubscriptionResponse
+	e.mustPost("/cancel-subscription", `{"subscription_id":"sub-ramen","reason":"too_expensive"}`, &canceled)
+	if canceled.Canceled || canceled.RetentionOffer == nil || canceled.RetentionOffer.ID != "offer-coupon" || canceled.RetentionOffer.Kind != RetentionOfferCoupon {
+		t.Fatalf("cancel = %+v, want the coupon offer", canceled)
+	}
+	if n := e.countRequests(http.MethodPost, "/v1/subscriptions/"); n != requests {
+		t.Errorf("offering called Stripe %d times, want 0", n-requests)
+	}
+
+	var res AcceptRetentionOfferResponse
+	e.mustPost("/accept-retention-offer", `{"subscription_id":"sub-ramen","offer_id":"offer-coupon"}`, &res)
+	if res.OfferID != "offer-coupon" || res.Kind != RetentionOfferCoupon {
+		t.Errorf("accept = %+v, want offer-coupon", res)
+	}
+	if d := e.stripeSubscription().Discount; d == nil || d.Coupon.ID != coupon.ID {
+		t.Errorf("stripe discount = %+v, want %s", d, coupon.ID)
+	}
+	e.deliverEvents()
+	ub := e.userSubscription()
+	if ub.RetentionOfferID != "offer-coupon" || ub.RetentionOfferAcceptedAt.IsZero() || ub.Discount == nil || ub.Discount.CouponID != coupon.ID {
+		t.Errorf("UserSubscription offer = %q accepted_at %v discount %+v, want offer-coupon with %s", ub.RetentionOfferID, ub.RetentionOfferAcceptedAt, ub.Discount, coupon.ID)
+	}
+	if ub.CancelAtPeriodEnd || ub.CancellationMode != "" || ub.Status != stripe.SubscriptionStatusActive {
+		t.Errorf("UserSubscription = %s cancel %v mode %q, want active without a cancellation", ub.Status, ub.CancelAtPeriodEnd, ub.CancellationMode)
+	}
+
+	// 特典は1度のみ受け入れられ、以降の解約では提示しない
+	if code, body := e.post("/accept-retention-offer", `{"subscription_id":"sub-ramen","offer_id":"offer-coupon"}`); code != http.StatusConflict {
+		t.Errorf("accept twice = %d %s, want 409", code, body)
+	}
+	var again CancelUserSubscriptionResponse
+	e.mustPost("/cancel-subscription", `{"subscription_id":"sub-ramen","reason":"too_expensive"}`, &again)
+	if !again.Canceled || again.RetentionOffer != nil {
+		t.Errorf("cancel after accepting = %+v, want canceled without an offer", again)
+	}
+}
+
+func TestRetentionOffer_Downgrade(t *testing.T) {
+	e := newTestEnv(t)
+	e.setRetentionOffers()
+	e.subscribe("plan-a")
+
+	var canceled CancelUserSubscriptionResponse
+	e.mustPost("/cancel-subscription", `{"subscription_id":"sub-ramen","reason":"unused"}`, &canceled)
+	if canceled.Canceled || canceled.RetentionOffer == nil || canceled.RetentionOffer.Plan == nil || canceled.RetentionOffer.Plan.ID != "plan-b" {
+		t.Fatalf("cancel = %+v, want the downgrade offer to plan-b", canceled)
+	}
+
+	var res AcceptRetentionOfferResponse
+	e.mustPost("/accept-retention-offer", `{"subscription_id":"sub-ramen","offer_id":"offer-downgrade"}`, &res)
+	ub := e.userSubscription()
+	if res.PlanID != "plan-b" || res.EffectiveAt == nil || !res.EffectiveAt.Equal(ub.CurrentPeriodEnd) {
+		t.Errorf("accept = %+v, want plan-b at %v", res, ub.CurrentPeriodEnd)
+	}
+	if ub.PlanID != "plan-a" || ub.NextPlanID != "plan-b" || ub.StripeScheduleID == "" || ub.RetentionOfferID != "offer-downgrade" {
+		t.Errorf("UserSubscription = plan %s next %s schedule %q offer %q, want plan-a next plan-b", ub.PlanID, ub.NextPlanID, ub.StripeScheduleID, ub.RetentionOfferID)
+	}
+}
+
+func TestRetentionOffer_NotEligible(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(e *testEnv)
+		offer string
+		want  int
+	}{
+		{name: "unknown offer", offer: "offer-unknown", want: http.StatusNotFound},
+		{name: "canceled", setup: func(e *testEnv) {
+			e.mustPost("/cancel-subscription", `{"subscription_id":"sub-ramen","reason":"too_expensive","decline_retention_offer":true}`, nil)
+		}, offer: "offer-coupon", want: http.StatusConflict},
+		// 割引を適用中の場合はクーポンの特典を受け入れられない
+		{name: "discounted", setup: func(e *testEnv) {
+			coupon := e.fake.CreateCoupon(&stripe.Coupon{Name: "10% off", PercentOff: 10, Duration: stripe.CouponDurationForever})
+			if _, err := billing.UpdateSubscription(e.userSubscription().StripeSubscriptionID, &stripe.SubscriptionParams{Coupon: stripe.String(coupon.ID)}); err != nil {
+				e.t.Fatal(err)
+			}
+		}, offer: "offer-coupon", want: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.setRetentionOffers()
+			e.subscribe("plan-a")
+			if tt.setup != nil {
+				tt.setup(e)
+				e.deliverEvents()
+			}
+			requests := e.countRequests(http.MethodPost, "/v1/subscriptions/")
+			if code, body := e.post("/accept-retention-offer", `{"subscription_id":"sub-ramen","offer_id":"`+tt.offer+`"}`); code != tt.want {
+				t.Errorf("accept = %d %s, want %d", code, body, tt.want)
+			}
+			if n := e.countRequests(http.MethodPost, "/v1/subscriptions/"); n != requests {
+				t.Errorf("rejected offer called Stripe %d times", n-requests)
+			}
+		})
+	}
+
+	// 解約理由に該当する特典がない場合は、提示せずに解約する
+	e := newTestEnv(t)
+	e.setRetentionOffers()
+	e.subscribe("plan-a")
+	var canceled CancelUserSubscriptionResponse
+	e.mustPost("/cancel-subscription", `{"subscription_id":"sub-ramen","reason":"switched_service"}`, &canceled)
+	if !canceled.Canceled || canceled.RetentionOffer != nil {
+		t.Errorf("cancel = %+v, want canceled without an offer", canceled)
+	}
+}
@@ -2,42 +2,135 @@ package main
 
 import (
 	"context"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"cloud.google.com/go/firestore"
-	stripeClient "github.com/stripe/stripe-go/client"
+	stripeClient "github.com/stripe/stripe-go/v72/client"
+
+	"github.com/ogiogi93/stripe-subscription-samples/auth"
+	"github.com/ogiogi93/stripe-subscription-samples/entitlement"
+	"github.com/ogiogi93/stripe-subscription-samples/offlinetoken"
 )
 
 var (
-	client   *stripeClient.API
-	fsClient *firestore.Client
+	billing       BillingGateway
+	repo          SubscriptionRepository
+	authenticator auth.Authenticator
+
+	// processedEventRetention 処理済みのWebhookイベントを保持する期間
+	processedEventRetention = 30 * 24 * time.Hour
+	// entitlementPolicy 特典の利用可否の判定ルール
+	entitlementPolicy = entitlement.DefaultPolicy()
+	// offlineTokenSigner 店頭での確認に利用するトークンの署名鍵。未設定の場合はトークンを発行しない
+	offlineTokenSigner *offlinetoken.Signer
+	// offlineTokenTTL 店頭での確認に利用するトークンの有効期間
+	offlineTokenTTL = 10 * time.Minute
 )
 
-func main() {
+func newServeMux() *http.ServeMux {
 	mainMux := http.NewServeMux()
 
-	mainMux.HandleFunc("/create-subscription", CreateUserSubscriptionHandler)
-	mainMux.HandleFunc("/update-subscription", UpdateUserSubscriptionHandler)
-	mainMux.HandleFunc("/update-subscription-immediately", UpdateUserSubscriptionImmediatelyHandler)
-	mainMux.HandleFunc("/cancel-subscription", CancelUserSubscriptionHandler)
-	mainMux.HandleFunc("/update-subscription-payment", UpdateUserSubscriptionPaymentHandler)
-	mainMux.HandleFunc("/recreate-subscription", ReCreateUserSubscriptionHandler)
+	mainMux.HandleFunc("/create-subscription", withAuth(withIdempotency(CreateUserSubscriptionHandler)))
+	mainMux.HandleFunc("/update-subscription", withAuth(withIdempotency(UpdateUserSubscriptionHandler)))
+	mainMux.HandleFunc("/update-subscription-immediately", withAuth(withIdempotency(UpdateUserSubscriptionImmediatelyHandler)))
+	mainMux.HandleFunc("/cancel-plan-change", withAuth(withIdempotency(CancelPlanChangeHandler)))
+	mainMux.HandleFunc("/change-plan", withAuth(withIdempotency(ChangePlanHandler)))
+	mainMux.HandleFunc("/cancel-subscription", withAuth(withIdempotency(CancelUserSubscriptionHandler)))
+	mainMux.HandleFunc("/cancel-subscription-immediately", withAuth(withIdempotency(CancelUserSubscriptionImmediatelyHandler)))
+	mainMux.HandleFunc("/resume-subscription", withAuth(withIdempotency(ResumeUserSubscriptionHandler)))
+	mainMux.HandleFunc("/pause-billing", withAuth(withIdempotency(PauseBillingHandler)))
+	mainMux.HandleFunc("/resume-billing", withAuth(withIdempotency(ResumeBillingHandler)))
+	mainMux.HandleFunc("/accept-retention-offer", withAuth(withIdempotency(AcceptRetentionOfferHandler)))
+	mainMux.HandleFunc("/update-subscription-payment", withAuth(withIdempotency(UpdateUserSubscriptionPaymentHandler)))
+	mainMux.HandleFunc("/recreate-subscription", withAuth(withIdempotency(ReCreateUserSubscriptionHandler)))
+	mainMux.HandleFunc("/redeem-benefit", withAuth(withIdempotency(RedeemBenefitHandler)))
+
+	mainMux.HandleFunc("/catalog", CatalogHandler)
+	mainMux.HandleFunc("/user-subscription", withAuth(GetUserSubscriptionHandler))
+	mainMux.HandleFunc("/user-subscriptions", withAuth(ListUserSubscriptionsHandler))
+	mainMux.HandleFunc("/entitlement", withAuth(CheckEntitlementHandler))
+	mainMux.HandleFunc("/redemptions", withAuth(ListRedemptionsHandler))
+	mainMux.HandleFunc("/offline-token", withAuth(IssueOfflineTokenHandler))
+	mainMux.HandleFunc("/preview-plan-change", withAuth(PreviewPlanChangeHandler))
+	mainMux.HandleFunc("/payment-action", withAuth(GetPaymentActionHandler))
 
 	mainMux.HandleFunc("/webhook", WebhookHandler)
+	return mainMux
+}
 
+func main() {
 	mainSrv := &http.Server{
-		Addr:    "4321",
-		Handler: mainMux,
+		Addr:    ":4321",
+		Handler: newServeMux(),
 	}
 
-	client = stripeClient.New(os.Getenv("STRIPE_API_KEY"), nil)
-	cli, err := firestore.NewClient(context.Background(), os.Getenv("GCP_PROJECT"))
+	if os.Getenv("STRIPE_FAKE") != "" {
+		// Stripeに接続せずにローカルで動作確認する場合
+		gw, closeFake, err := newFakeBillingGateway()
+		if err != nil {
+			log.Fatalf("Failed to configure fake stripe server: %v", err)
+		}
+		defer closeFake()
+		billing = gw
+	} else {
+		billing = NewStripeGateway(stripeClient.New(os.Getenv("STRIPE_API_KEY"), nil))
+	}
+	if v := os.Getenv("PROCESSED_EVENT_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Failed to parse PROCESSED_EVENT_RETENTION: %v", err)
+		}
+		processedEventRetention = d
+	}
+	if v := os.Getenv("ENTITLEMENT_PAST_DUE_GRACE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Failed to parse ENTITLEMENT_PAST_DUE_GRACE: %v", err)
+		}
+		entitlementPolicy.PastDueGrace = d
+	}
+	if v := os.Getenv("OFFLINE_TOKEN_PRIVATE_KEY_FILE"); v != "" {
+		b, err := ioutil.ReadFile(v)
+		if err != nil {
+			log.Fatalf("Failed to read OFFLINE_TOKEN_PRIVATE_KEY_FILE: %v", err)
+		}
+		key, err := offlinetoken.ParsePrivateKeyPEM(b)
+		if err != nil {
+			log.Fatalf("Failed to parse OFFLINE_TOKEN_PRIVATE_KEY_FILE: %v", err)
+		}
+		offlineTokenSigner = &offlinetoken.Signer{KeyID: os.Getenv("OFFLINE_TOKEN_KEY_ID"), PrivateKey: key}
+	}
+	if v := os.Getenv("OFFLINE_TOKEN_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Failed to parse OFFLINE_TOKEN_TTL: %v", err)
+		}
+		offlineTokenTTL = d
+	}
+	a, err := newAuthenticatorFromEnv()
 	if err != nil {
-		log.Fatalf("Failed to create firestore client: %v", err)
+		log.Fatalf("Failed to configure authentication: %v", err)
+	}
+	authenticator = a
+	if os.Getenv("REPOSITORY") == "memory" {
+		// Firestoreを利用せずにローカルで動作確認する場合
+		repo = NewMemoryRepository()
+	} else {
+		cli, err := firestore.NewClient(context.Background(), os.Getenv("GCP_PROJECT"))
+		if err != nil {
+			log.Fatalf("Failed to create firestore client: %v", err)
+		}
+		repo = NewFirestoreRepository(cli)
 	}
-	fsClient = cli
+
+	// Subscriptionのドキュメントが変更された場合にカタログのキャッシュを破棄する
+	go watchCatalog(context.Background())
+	// リクエスト内で実行できなかったStripeの操作を再実行する
+	go runOutboxDispatcher(context.Background(), time.Minute)
 
 	if err := mainSrv.ListenAndServe(); err != nil {
 		return
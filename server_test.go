@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/auth"
+	"github.com/ogiogi93/stripe-subscription-samples/stripefake"
+)
+
+const (
+	testAPIKey        = "test-api-key"
+	testCustomerID    = "cus_1"
+	testWebhookSecret = "whsec_test"
+)
+
+// testEnv ハンドラーをStripeのフェイクとメモリ上のリポジトリに接続したテスト環境
+type testEnv struct {
+	t    *testing.T
+	fake *stripefake.Server
+	mux  *http.ServeMux
+	// sub テスト用のSubscription。plan-a(3000円/30日)とplan-b(350円/30日)を提供する
+	sub *Subscription
+	// delivered Webhookとして送信済みのフェイクのイベント数
+	delivered int
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	fake := stripefake.NewServer()
+	prevBilling, prevRepo, prevAuthenticator, prevCatalog := billing, repo, authenticator, catalog
+	t.Cleanup(func() {
+		fake.Close()
+		billing, repo, authenticator, catalog = prevBilling, prevRepo, prevAuthenticator, prevCatalog
+	})
+	billing = NewStripeGateway(fake.Client())
+	repo = NewMemoryRepository()
+	authenticator = &auth.APIKeyAuthenticator{Keys: map[string]string{"test": testAPIKey}}
+	catalog = newCatalogCache(catalogCacheTTL)
+	t.Setenv("STRIPE_WEBHOOK_SIGNATURE", testWebhookSecret)
+
+	ramen := fake.CreatePrice("ramen", 3000, stripe.PriceRecurringIntervalDay, 30)
+	topping := fake.CreatePrice("topping", 350, stripe.PriceRecurringIntervalDay, 30)
+	e := &testEnv{t: t, fake: fake, mux: newServeMux(), sub: &Subscription{
+		ID:    "sub-ramen",
+		Title: "ramen",
+		Plans: []*Plan{
+			{ID: "plan-a", Title: "A", StripePriceID: ramen.ID, Price: 3000, Currency: stripe.CurrencyJPY, Benefits: []*Benefit{{ID: "b-ramen", Title: "ramen"}}},
+			{ID: "plan-b", Title: "B", StripePriceID: topping.ID, Price: 350, Currency: stripe.CurrencyJPY, Benefits: []*Benefit{{ID: "b-topping", Title: "topping"}}},
+		},
+	}}
+	e.saveSubscription()
+	fake.CreateCustomer(testCustomerID)
+	return e
+}
+
+// saveSubscription e.subの変更をリポジトリに保存する
+func (e *testEnv) saveSubscription() {
+	e.t.Helper()
+	mustRunInTx(e.t, repo, func(tx SubscriptionTx) error {
+		return tx.UpdateSubscription(e.sub)
+	})
+}
+
+// request APIキーで認証し、testCustomerIDの呼び出しとしてリクエストする
+// headerには名前と値を交互に指定し、値が空文字のヘッダーは送信しない
+func (e *testEnv) request(method, path, body string, header ...string) (int, string) {
+	e.t.Helper()
+	w := e.serve(method, path, body, header...)
+	return w.Code, w.Body.String()
+}
+
+// serve requestと同様にリクエストし、レスポンスヘッダーを含むレスポンスを返す
+func (e *testEnv) serve(method, path, body string, header ...string) *httptest.ResponseRecorder {
+	e.t.Helper()
+	r := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	r.Header.Set("Authorization", "Bearer "+testAPIKey)
+	r.Header.Set(auth.CustomerHeader, testCustomerID)
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		if header[i+1] == "" {
+			r.Header.Del(header[i])
+			continue
+		}
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	e.mux.ServeHTTP(w, r)
+	return w
+}
+
+func (e *testEnv) post(path, body string, header ...string) (int, string) {
+	e.t.Helper()
+	return e.request(http.MethodPost, path, body, header...)
+}
+
+func (e *testEnv) get(path string, header ...string) (int, string) {
+	e.t.Helper()
+	return e.request(http.MethodGet, path, "", header...)
+}
+
+// mustPost ステータスコードが200であることを確認してレスポンスをvに読み込む。vがnilの場合は読み込まない
+func (e *testEnv) mustPost(path, body string, v interface{}) {
+	e.t.Helper()
+	code, res := e.post(path, body)
+	if code != http.StatusOK {
+		e.t.Fatalf("POST %s = %d %s", path, code, res)
+	}
+	if v != nil {
+		decodeJSON(e.t, res, v)
+	}
+}
+
+// userSubscription testCustomerIDのUserSubscriptionを取得する
+func (e *testEnv) userSubscription() *UserSubscription {
+	e.t.Helper()
+	var ub *UserSubscription
+	mustRunInTx(e.t, repo, func(tx SubscriptionTx) error {
+		var err error
+		ub, err = tx.GetUserSubscription(e.sub.UserSubscriptionID(testCustomerID))
+		return err
+	})
+	return ub
+}
+
+// stripeSubscription testCustomerIDのStripe上のSubscriptionを取得する
+func (e *testEnv) stripeSubscription() *stripe.Subscription {
+	e.t.Helper()
+	s, ok := e.fake.Subscription(e.userSubscription().StripeSubscriptionID)
+	if !ok {
+		e.t.Fatal("stripe subscription is not found")
+	}
+	return s
+}
+
+// subscribe testCustomerIDでplanIDのプランを契約し、発生したWebhookを全て送信する
+func (e *testEnv) subscribe(planID string) *UserSubscription {
+	e.t.Helper()
+	e.mustPost("/create-subscription", `{"subscription_id":"sub-ramen","plan_id":"`+planID+`"}`, nil)
+	e.deliverEvents()
+	return e.userSubscription()
+}
+
+// deliver Stripeと同じ署名を付けてイベントをWebhookとして送信する
+func (e *testEnv) deliver(ev *stripe.Event) (int, string) {
+	e.t.Helper()
+	payload, sig, err := stripefake.SignedPayload(ev, testWebhookSecret)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return e.post("/webhook", string(payload), "Stripe-Signature", sig, "Authorization", "", auth.CustomerHeader, "")
+}
+
+// deliverEvents フェイクで発生したイベントのうち、まだ送信していないものを順に送信する
+func (e *testEnv) deliverEvents() {
+	e.t.Helper()
+	evs := e.fake.Events()
+	for _, ev := range evs[e.delivered:] {
+		if code, body := e.deliver(ev); code != http.StatusOK {
+			e.t.Fatalf("webhook %s %s = %d %s", ev.ID, ev.Type, code, body)
+		}
+	}
+	e.delivered = len(evs)
+}
+
+func decodeJSON(t *testing.T, body string, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		t.Fatalf("json.Unmarshal(%s) = %v", body, err)
+	}
+}
+
+// errorCode エラーレスポンスのcode
+func errorCode(t *testing.T, body string) string {
+	t.Helper()
+	var res struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	decodeJSON(t, body, &res)
+	return res.Error.Code
+}
+
+func TestCreateSubscription(t *testing.T) {
+	e := newTestEnv(t)
+
+	var res CreateUserSubscriptionResponse
+	e.mustPost("/create-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-a"}`, &res)
+	if res.Status != stripe.PaymentIntentStatusSucceeded || res.NextStep != PaymentNextStepNone || res.AmountDue != 3000 {
+		t.Errorf("response = %+v, want succeeded with amount_due 3000", res)
+	}
+	e.deliverEvents()
+
+	ub := e.userSubscription()
+	if ub.PlanID != "plan-a" || ub.Status != stripe.SubscriptionStatusActive || ub.CustomerID != testCustomerID {
+		t.Errorf("UserSubscription = %+v", ub)
+	}
+	s := e.stripeSubscription()
+	if s.Metadata["subscription_id"] != "sub-ramen" || s.Metadata["plan_id"] != "plan-a" {
+		t.Errorf("stripe metadata = %v", s.Metadata)
+	}
+	if s.Items.Data[0].ID != ub.StripeSubscriptionItemID {
+		t.Errorf("StripeSubscriptionItemID = %s, want %s", ub.StripeSubscriptionItemID, s.Items.Data[0].ID)
+	}
+
+	code, body := e.post("/create-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-b"}`)
+	if code != http.StatusConflict {
+		t.Errorf("second create = %d %s, want 409", code, body)
+	}
+}
+
+func TestCreateSubscription_CardDeclined(t *testing.T) {
+	e := newTestEnv(t)
+	e.fake.SetPaymentOutcome(testCustomerID, stripe.PaymentIntentStatusRequiresPaymentMethod)
+
+	var res CreateUserSubscriptionResponse
+	e.mustPost("/create-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-a"}`, &res)
+	if res.NextStep != PaymentNextStepUpdatePaymentMethod {
+		t.Errorf("NextStep = %s, want %s", res.NextStep, PaymentNextStepUpdatePaymentMethod)
+	}
+	if ub := e.userSubscription(); ub.Status != stripe.SubscriptionStatusIncomplete {
+		t.Errorf("Status = %s, want %s", ub.Status, stripe.SubscriptionStatusIncomplete)
+	}
+}
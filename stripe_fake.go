@@ -0,0 +1,18 @@
+//go:build stripefake
+// +build stripefake
+
+package main
+
+import (
+	"log"
+
+	"github.com/ogiogi93/stripe-subscription-samples/stripefake"
+)
+
+// newFakeBillingGateway Stripeに接続せずにローカルで動作確認するため、プロセス内のフェイクサーバーに接続する
+// 本番のバイナリにフェイクサーバーが含まれないよう、stripefakeビルドタグを指定した場合のみ利用できる
+func newFakeBillingGateway() (BillingGateway, func(), error) {
+	fake := stripefake.NewServer()
+	log.Printf("fake stripe server is listening on %s", fake.URL())
+	return NewStripeGateway(fake.Client()), fake.Close, nil
+}
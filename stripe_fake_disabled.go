@@ -0,0 +1,11 @@
+//go:build !stripefake
+// +build !stripefake
+
+package main
+
+import "errors"
+
+// newFakeBillingGateway stripefakeビルドタグを指定せずにビルドした場合はフェイクサーバーを利用できない
+func newFakeBillingGateway() (BillingGateway, func(), error) {
+	return nil, nil, errors.New("STRIPE_FAKE requires a binary built with -tags stripefake")
+}
@@ -0,0 +1,231 @@
+package stripefake
+
+import (
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// CreateCoupon クーポンを登録する。IDを指定しない場合は採番する
+func (s *Server) CreateCoupon(c *stripe.Coupon) *stripe.Coupon {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.ID == "" {
+		c.ID = s.newID("coupon")
+	}
+	c.Object = "coupon"
+	c.Created = s.now().Unix()
+	c.Valid = true
+	if c.Duration == "" {
+		c.Duration = stripe.CouponDurationOnce
+	}
+	s.coupons[c.ID] = c
+	return c
+}
+
+// CreatePromotionCode pc.Couponに指定したクーポンのプロモーションコードを登録する
+func (s *Server) CreatePromotionCode(pc *stripe.PromotionCode) *stripe.PromotionCode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pc.ID = s.newID("promo")
+	pc.Object = "promotion_code"
+	pc.Created = s.now().Unix()
+	pc.Active = true
+	pc.Coupon = s.coupons[pc.Coupon.ID]
+	if pc.Restrictions == nil {
+		pc.Restrictions = &stripe.PromotionCodeRestrictions{}
+	}
+	s.promotionCodes[pc.ID] = pc
+	return pc
+}
+
+// listPromotionCodes https://stripe.com/docs/api/promotion_codes/list
+func (s *Server) listPromotionCodes(form url.Values) *list {
+	var codes []interface{}
+	for _, pc := range s.sortedPromotionCodes() {
+		if code := form.Get("code"); code != "" && !strings.EqualFold(pc.Code, code) {
+			continue
+		}
+		if v, ok := boolParam(form, "active"); ok && pc.Active != v {
+			continue
+		}
+		if customer := form.Get("customer"); customer != "" && (pc.Customer == nil || pc.Customer.ID != customer) {
+			continue
+		}
+		codes = append(codes, pc)
+	}
+	return newList("/v1/promotion_codes", codes)
+}
+
+func (s *Server) getPromotionCode(id string) (*stripe.PromotionCode, *stripe.Error) {
+	pc, ok := s.promotionCodes[id]
+	if !ok {
+		return nil, resourceMissing("promotion_code", id)
+	}
+	return pc, nil
+}
+
+func (s *Server) sortedPromotionCodes() []*stripe.PromotionCode {
+	codes := make([]*stripe.PromotionCode, 0, len(s.promotionCodes))
+	for _, pc := range s.promotionCodes {
+		codes = append(codes, pc)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].ID < codes[j].ID })
+	return codes
+}
+
+// newDiscount プロモーションコードを検証し、Subscriptionに適用する割引を作成する
+func (s *Server) newDiscount(sub *stripe.Subscription, promotionCodeID string, now time.Time) (*stripe.Discount, *stripe.Error) {
+	pc, ok := s.promotionCodes[promotionCodeID]
+	if !ok {
+		err := resourceMissing("promotion_code", promotionCodeID)
+		err.Param = "promotion_code"
+		return nil, err
+	}
+	coupon := pc.Coupon
+	switch {
+	case !pc.Active || !coupon.Valid || (pc.ExpiresAt > 0 && now.Unix() >= pc.ExpiresAt):
+		return nil, invalidRequest("promotion_code", "This promotion code is inactive.")
+	case pc.Customer != nil && pc.Customer.ID != sub.Customer.ID:
+		return nil, invalidRequest("promotion_code", "This promotion code cannot be redeemed by this customer.")
+	case pc.Restrictions.FirstTimeTransaction && s.hasPaidInvoice(sub.Customer.ID):
+		return nil, invalidRequest("promotion_code", "This promotion code cannot be redeemed because the associated customer has prior transactions.")
+	}
+
+	pc.TimesRedeemed++
+	if pc.MaxRedemptions > 0 && pc.TimesRedeemed >= pc.MaxRedemptions {
+		pc.Active = false
+	}
+	d := s.redeemCoupon(sub, coupon, now)
+	d.PromotionCode = pc
+	return d, nil
+}
+
+// newCouponDiscount プロモーションコードを介さずに、couponパラメータで指定したクーポンの割引を作成する
+func (s *Server) newCouponDiscount(sub *stripe.Subscription, couponID string, now time.Time) (*stripe.Discount, *stripe.Error) {
+	coupon, ok := s.coupons[couponID]
+	if !ok {
+		err := resourceMissing("coupon", couponID)
+		err.Param = "coupon"
+		return nil, err
+	}
+	if !coupon.Valid {
+		return nil, invalidRequest("coupon", "Coupon expired: "+coupon.ID)
+	}
+	return s.redeemCoupon(sub, coupon, now), nil
+}
+
+// redeemCoupon クーポンの利用回数を数え、Subscriptionに適用する割引を作成する
+func (s *Server) redeemCoupon(sub *stripe.Subscription, coupon *stripe.Coupon, now time.Time) *stripe.Discount {
+	coupon.TimesRedeemed++
+	if coupon.MaxRedemptions > 0 && coupon.TimesRedeemed >= coupon.MaxRedemptions {
+		coupon.Valid = false
+	}
+	d := &stripe.Discount{
+		ID:           s.newID("di"),
+		Object:       "discount",
+		Coupon:       coupon,
+		Customer:     sub.Customer.ID,
+		Start:        now.Unix(),
+		Subscription: sub.ID,
+	}
+	if coupon.Duration == stripe.CouponDurationRepeating {
+		d.End = now.AddDate(0, int(coupon.DurationInMonths), 0).Unix()
+	}
+	return d
+}
+
+// applyDiscount Subscriptionの割引をInvoiceに適用し、割引額を返す
+// durationがonceの割引は最初の請求、repeatingの割引は終了日時までの請求に適用し、適用が終わった割引はSubscriptionから削除する
+func (s *Server) applyDiscount(sub *stripe.Subscription, inv *stripe.Invoice) int64 {
+	d := sub.Discount
+	if d == nil || inv.Subtotal <= 0 {
+		return 0
+	}
+	if d.End > 0 && s.now().Unix() >= d.End {
+		sub.Discount = nil
+		return 0
+	}
+
+	amount := d.Coupon.AmountOff
+	if d.Coupon.PercentOff > 0 {
+		amount = int64(math.Round(float64(inv.Subtotal) * d.Coupon.PercentOff / 100))
+	}
+	if amount > inv.Subtotal {
+		amount = inv.Subtotal
+	}
+	inv.Discount = d
+	inv.Discounts = []*stripe.Discount{{ID: d.ID}}
+	inv.TotalDiscountAmounts = []*stripe.InvoiceDiscountAmount{{Amount: amount, Discount: &stripe.Discount{ID: d.ID}}}
+	if d.Coupon.Duration == stripe.CouponDurationOnce {
+		sub.Discount = nil
+	}
+	return amount
+}
+
+// listInvoices https://stripe.com/docs/api/invoices/list
+func (s *Server) listInvoices(form url.Values) (*list, *stripe.Error) {
+	limit, err := int64Param(form, "limit")
+	if err != nil {
+		return nil, err
+	}
+	invoices := make([]*stripe.Invoice, 0, len(s.invoices))
+	for _, inv := range s.invoices {
+		if customer := form.Get("customer"); customer != "" && inv.Customer.ID != customer {
+			continue
+		}
+		if status := form.Get("status"); status != "" && string(inv.Status) != status {
+			continue
+		}
+		if sub := form.Get("subscription"); sub != "" && inv.Subscription.ID != sub {
+			continue
+		}
+		invoices = append(invoices, inv)
+	}
+	// 新しい順に返す
+	sort.Slice(invoices, func(i, j int) bool {
+		if invoices[i].Created != invoices[j].Created {
+			return invoices[i].Created > invoices[j].Created
+		}
+		return invoices[i].ID > invoices[j].ID
+	})
+	data := make([]interface{}, 0, len(invoices))
+	for _, inv := range invoices {
+		data = append(data, inv)
+	}
+	l := newList("/v1/invoices", data)
+	if limit > 0 && int64(len(l.Data)) > limit {
+		l.Data = l.Data[:limit]
+		l.HasMore = true
+	}
+	return l, nil
+}
+
+// hasPaidInvoice 支払い済みのInvoiceがある顧客かどうか。プロモーションコードのfirst_time_transactionの判定に利用する
+func (s *Server) hasPaidInvoice(customerID string) bool {
+	for _, inv := range s.invoices {
+		if inv.Customer.ID == customerID && inv.Paid {
+			return true
+		}
+	}
+	return false
+}
+
+// list Stripe APIのリストオブジェクト https://stripe.com/docs/api/pagination
+type list struct {
+	Object  string        `json:"object"`
+	URL     string        `json:"url"`
+	HasMore bool          `json:"has_more"`
+	Data    []interface{} `json:"data"`
+}
+
+func newList(url string, data []interface{}) *list {
+	if data == nil {
+		data = []interface{}{}
+	}
+	return &list{Object: "list", URL: url, Data: data}
+}
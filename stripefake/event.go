@@ -0,0 +1,73 @@
+package stripefake
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// emit objの現時点の状態をイベントとして記録する
+func (s *Server) emit(eventType string, obj interface{}) {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return
+	}
+	s.events = append(s.events, &stripe.Event{
+		ID:         s.newID("evt"),
+		Object:     "event",
+		APIVersion: stripe.APIVersion,
+		Created:    s.now().Unix(),
+		Type:       eventType,
+		Data:       &stripe.EventData{Raw: raw},
+	})
+}
+
+func (s *Server) emitInvoice(inv *stripe.Invoice) {
+	switch {
+	case inv.Paid:
+		s.emit("invoice.payment_succeeded", inv)
+	case inv.PaymentIntent != nil && inv.PaymentIntent.Status == stripe.PaymentIntentStatusRequiresAction:
+		s.emit("invoice.payment_action_required", inv)
+	default:
+		s.emit("invoice.payment_failed", inv)
+	}
+}
+
+// NewEvent objをデータとするイベントを作成する
+func NewEvent(eventType string, obj interface{}) (*stripe.Event, error) {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &stripe.Event{
+		ID:         fmt.Sprintf("evt_fake%d", now.UnixNano()),
+		Object:     "event",
+		APIVersion: stripe.APIVersion,
+		Created:    now.Unix(),
+		Type:       eventType,
+		Data:       &stripe.EventData{Raw: raw},
+	}, nil
+}
+
+// SignedPayload イベントをWebhookとして送信するためのリクエストボディとStripe-Signatureヘッダーを返す
+func SignedPayload(ev *stripe.Event, secret string) ([]byte, string, error) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return nil, "", err
+	}
+	return payload, SignPayload(payload, secret, time.Now()), nil
+}
+
+// SignPayload Stripe-Signatureヘッダーの値を計算する https://stripe.com/docs/webhooks/signatures
+func SignPayload(payload []byte, secret string, t time.Time) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%d.", t.Unix())))
+	mac.Write(payload)
+	return fmt.Sprintf("t=%d,v1=%s", t.Unix(), hex.EncodeToString(mac.Sum(nil)))
+}
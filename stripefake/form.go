@@ -0,0 +1,87 @@
+package stripefake
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// mapParam `name[key]=value` 形式のパラメータをmapとして取り出す
+func mapParam(form url.Values, name string) map[string]string {
+	m := map[string]string{}
+	prefix := name + "["
+	for k, vs := range form {
+		if !strings.HasPrefix(k, prefix) || !strings.HasSuffix(k, "]") {
+			continue
+		}
+		key := strings.TrimSuffix(strings.TrimPrefix(k, prefix), "]")
+		if strings.Contains(key, "[") {
+			continue
+		}
+		m[key] = vs[0]
+	}
+	return m
+}
+
+// listParam `name[0][key]=value` 形式のパラメータを要素毎のurl.Valuesとして取り出す
+func listParam(form url.Values, name string) []url.Values {
+	items := map[int]url.Values{}
+	prefix := name + "["
+	for k, vs := range form {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(k, prefix)
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			continue
+		}
+		i, err := strconv.Atoi(rest[:end])
+		if err != nil {
+			continue
+		}
+		// `[price]` -> `price`, `[metadata][plan_id]` -> `metadata[plan_id]`
+		key := rest[end+1:]
+		if strings.HasPrefix(key, "[") {
+			key = strings.Replace(strings.TrimPrefix(key, "["), "]", "", 1)
+		}
+		if items[i] == nil {
+			items[i] = url.Values{}
+		}
+		items[i][key] = vs
+	}
+	indexes := make([]int, 0, len(items))
+	for i := range items {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	list := make([]url.Values, 0, len(items))
+	for _, i := range indexes {
+		list = append(list, items[i])
+	}
+	return list
+}
+
+func int64Param(form url.Values, name string) (int64, *stripe.Error) {
+	v := form.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, invalidRequest(name, "Invalid integer: "+v)
+	}
+	return n, nil
+}
+
+// boolParam パラメータが指定されていない場合はokがfalseになる
+func boolParam(form url.Values, name string) (value bool, ok bool) {
+	v, ok := form[name]
+	if !ok {
+		return false, false
+	}
+	return v[0] == "true", true
+}
@@ -0,0 +1,41 @@
+package stripefake
+
+import (
+	"fmt"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// CompletePaymentAction クライアントで3Dセキュア認証が完了し、requires_actionのPaymentIntentの支払いが成功したことを再現する
+// Invoiceを支払い済みにしてSubscriptionのstatusを更新し、invoice.payment_succeededとcustomer.subscription.updatedを送信する
+func (s *Server) CompletePaymentAction(paymentIntentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pi, ok := s.paymentIntents[paymentIntentID]
+	if !ok {
+		return fmt.Errorf("no such payment_intent: %s", paymentIntentID)
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresAction {
+		return fmt.Errorf("payment_intent %s is %s", pi.ID, pi.Status)
+	}
+	inv, ok := s.invoices[pi.Invoice.ID]
+	if !ok {
+		return fmt.Errorf("no such invoice: %s", pi.Invoice.ID)
+	}
+
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	pi.NextAction = nil
+	pi.AmountReceived = pi.Amount
+	inv.Paid = true
+	inv.Status = stripe.InvoiceStatusPaid
+	inv.AmountPaid = inv.AmountDue
+	inv.AmountRemaining = 0
+	s.emitInvoice(inv)
+
+	if sub, ok := s.subscriptions[inv.Subscription.ID]; ok && sub.Status != stripe.SubscriptionStatusCanceled {
+		sub.Status = stripe.SubscriptionStatusActive
+		s.emit("customer.subscription.updated", sub)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package stripefake
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// prorationParams 日割り計算に関するパラメータ https://stripe.com/docs/billing/subscriptions/prorations
+type prorationParams struct {
+	behavior stripe.SubscriptionProrationBehavior
+	date     int64
+}
+
+// parseProrationParams prefixには更新時は空文字、請求のプレビュー時は `subscription_` を指定する
+// proration_behaviorを指定しない場合はStripeと同様にcreate_prorationsとして扱う
+func parseProrationParams(form url.Values, prefix string, now time.Time) (prorationParams, *stripe.Error) {
+	p := prorationParams{
+		behavior: stripe.SubscriptionProrationBehavior(form.Get(prefix + "proration_behavior")),
+		date:     now.Unix(),
+	}
+	if p.behavior == "" {
+		p.behavior = stripe.SubscriptionProrationBehaviorCreateProrations
+	}
+	if form.Get(prefix+"proration_date") != "" {
+		date, err := int64Param(form, prefix+"proration_date")
+		if err != nil {
+			return p, err
+		}
+		p.date = date
+	}
+	return p, nil
+}
+
+// prorationLines 請求期間の途中でSubscriptionItemを変更した場合の日割り計算の明細を作成する
+// 変更前のSubscriptionItemの残り期間分を返金し、resetAnchorがfalseの場合は変更後のSubscriptionItemの残り期間分を請求する
+// resetAnchorがtrueの場合は新しい請求期間の全額を通常の明細として請求するため、変更後の残り期間分は請求しない
+func (s *Server) prorationLines(sub *stripe.Subscription, prev []stripe.SubscriptionItem, date int64, resetAnchor bool) []*stripe.InvoiceLine {
+	if sub.Status == stripe.SubscriptionStatusTrialing || !itemsChanged(prev, sub.Items.Data) {
+		return nil
+	}
+	start, end := sub.CurrentPeriodStart, sub.CurrentPeriodEnd
+	if date < start {
+		date = start
+	}
+	if date >= end {
+		return nil
+	}
+	remaining := float64(end-date) / float64(end-start)
+	at := time.Unix(date, 0).UTC().Format("02 Jan 2006")
+
+	var lines []*stripe.InvoiceLine
+	add := func(item *stripe.SubscriptionItem, sign float64, format string) {
+		amount := int64(math.Round(sign * float64(item.Price.UnitAmount*item.Quantity) * remaining))
+		lines = append(lines, &stripe.InvoiceLine{
+			ID:               s.newID("il"),
+			Object:           "line_item",
+			Amount:           amount,
+			Currency:         item.Price.Currency,
+			Description:      fmt.Sprintf(format, s.productName(item.Price), at),
+			Metadata:         copyMetadata(sub.Metadata),
+			Period:           &stripe.Period{Start: date, End: end},
+			Price:            item.Price,
+			Proration:        true,
+			Quantity:         item.Quantity,
+			Subscription:     sub.ID,
+			SubscriptionItem: item.ID,
+			Type:             stripe.InvoiceLineTypeSubscription,
+		})
+	}
+	for i := range prev {
+		add(&prev[i], -1, "Unused time on %s after %s")
+	}
+	if !resetAnchor {
+		for _, item := range sub.Items.Data {
+			add(item, 1, "Remaining time on %s after %s")
+		}
+	}
+	return lines
+}
+
+// takePendingProrations 次回の請求に含める予定だった明細にlinesを加えて返し、予定を削除する
+func (s *Server) takePendingProrations(subscriptionID string, lines []*stripe.InvoiceLine) []*stripe.InvoiceLine {
+	pending := s.pendingProrations[subscriptionID]
+	delete(s.pendingProrations, subscriptionID)
+	return append(pending, lines...)
+}
+
+// newProrationInvoice 日割り計算の明細のみのInvoiceを作成する
+func (s *Server) newProrationInvoice(sub *stripe.Subscription, lines []*stripe.InvoiceLine) *stripe.Invoice {
+	inv := &stripe.Invoice{
+		ID:            s.newID("in"),
+		Object:        "invoice",
+		BillingReason: stripe.InvoiceBillingReasonSubscriptionUpdate,
+		Created:       s.now().Unix(),
+		Customer:      &stripe.Customer{ID: sub.Customer.ID},
+		Subscription:  &stripe.Subscription{ID: sub.ID},
+		PeriodStart:   sub.CurrentPeriodStart,
+		PeriodEnd:     sub.CurrentPeriodEnd,
+		Status:        stripe.InvoiceStatusOpen,
+		Lines:         &stripe.InvoiceLineList{Data: lines},
+	}
+	inv.Lines.TotalCount = uint32(len(lines))
+	for _, line := range lines {
+		inv.Currency = line.Currency
+		inv.Subtotal += line.Amount
+	}
+	inv.Total = inv.Subtotal
+	if inv.Total > 0 {
+		inv.AmountDue = inv.Total
+	}
+	inv.AmountRemaining = inv.AmountDue
+	s.invoices[inv.ID] = inv
+	return inv
+}
+
+// upcomingInvoice https://stripe.com/docs/api/invoices/upcoming
+// subscription_itemsやsubscription_billing_cycle_anchorを指定した場合は、Subscriptionを変更した場合の次回の請求をプレビューする
+func (s *Server) upcomingInvoice(form url.Values) (*stripe.Invoice, *stripe.Error) {
+	id := form.Get("subscription")
+	sub, ok := s.subscriptions[id]
+	if !ok || sub.Status == stripe.SubscriptionStatusCanceled {
+		return nil, &stripe.Error{
+			HTTPStatusCode: 404,
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Code:           stripe.ErrorCodeInvoiceUpcomingNone,
+			Msg:            "No upcoming invoices for customer",
+		}
+	}
+
+	// Subscriptionのコピーに変更を適用し、保存せずにInvoiceを組み立てる
+	var preview stripe.Subscription
+	if err := copyObject(sub, &preview); err != nil {
+		return nil, &stripe.Error{HTTPStatusCode: 500, Type: stripe.ErrorTypeAPI, Msg: err.Error()}
+	}
+	prev := copyItems(preview.Items.Data)
+	for _, p := range listParam(form, "subscription_items") {
+		item := findItem(&preview, p.Get("id"))
+		if item == nil {
+			return nil, resourceMissing("subscription_item", p.Get("id"))
+		}
+		if err := s.applyItemParams(item, p); err != nil {
+			return nil, err
+		}
+	}
+	now := s.now()
+	proration, err := parseProrationParams(form, "subscription_", now)
+	if err != nil {
+		return nil, err
+	}
+	resetAnchor := form.Get("subscription_billing_cycle_anchor") == "now"
+
+	prorations := append([]*stripe.InvoiceLine(nil), s.pendingProrations[sub.ID]...)
+	if proration.behavior != stripe.SubscriptionProrationBehaviorNone {
+		prorations = append(prorations, s.prorationLines(&preview, prev, proration.date, resetAnchor)...)
+	}
+	reason := stripe.InvoiceBillingReasonSubscriptionCycle
+	start := time.Unix(preview.CurrentPeriodEnd, 0)
+	if resetAnchor {
+		reason = stripe.InvoiceBillingReasonSubscriptionUpdate
+		start = now
+	}
+	preview.CurrentPeriodStart = start.Unix()
+	preview.CurrentPeriodEnd = s.periodEnd(&preview, start).Unix()
+	return s.buildInvoice(&preview, reason, prorations), nil
+}
+
+// productName PriceのProductの名前
+func (s *Server) productName(price *stripe.Price) string {
+	if price.Product != nil {
+		if p, ok := s.products[price.Product.ID]; ok && p.Name != "" {
+			return p.Name
+		}
+	}
+	return price.ID
+}
+
+func copyItems(items []*stripe.SubscriptionItem) []stripe.SubscriptionItem {
+	c := make([]stripe.SubscriptionItem, len(items))
+	for i, item := range items {
+		c[i] = *item
+	}
+	return c
+}
+
+func itemsChanged(prev []stripe.SubscriptionItem, items []*stripe.SubscriptionItem) bool {
+	if len(prev) != len(items) {
+		return true
+	}
+	for i, item := range items {
+		if prev[i].ID != item.ID || prev[i].Price.ID != item.Price.ID || prev[i].Quantity != item.Quantity {
+			return true
+		}
+	}
+	return false
+}
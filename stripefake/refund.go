@@ -0,0 +1,65 @@
+package stripefake
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// createRefund https://stripe.com/docs/api/refunds/create
+// PaymentIntentを指定した返金のみ対応する。amountを指定しない場合は未返金の全額を返金する
+func (s *Server) createRefund(form url.Values) (*stripe.Refund, *stripe.Error) {
+	id := form.Get("payment_intent")
+	pi, ok := s.paymentIntents[id]
+	if !ok {
+		err := resourceMissing("payment_intent", id)
+		err.Param = "payment_intent"
+		return nil, err
+	}
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		return nil, invalidRequest("payment_intent", "This PaymentIntent does not have a successful charge to refund.")
+	}
+	remaining := pi.AmountReceived - s.refunded[pi.ID]
+	amount := remaining
+	if form.Get("amount") != "" {
+		var err *stripe.Error
+		if amount, err = int64Param(form, "amount"); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case amount <= 0:
+		return nil, invalidRequest("amount", "Refund amount must be greater than 0.")
+	case amount > remaining:
+		return nil, invalidRequest("amount", fmt.Sprintf("Refund amount (%d) is greater than unrefunded amount on charge (%d)", amount, remaining))
+	}
+
+	r := &stripe.Refund{
+		ID:            s.newID("re"),
+		Object:        "refund",
+		Amount:        amount,
+		Created:       s.now().Unix(),
+		Currency:      stripe.Currency(pi.Currency),
+		Metadata:      mapParam(form, "metadata"),
+		PaymentIntent: &stripe.PaymentIntent{ID: pi.ID},
+		Reason:        stripe.RefundReason(form.Get("reason")),
+		Status:        stripe.RefundStatusSucceeded,
+	}
+	s.refunded[pi.ID] += amount
+	s.refunds[r.ID] = r
+	return r, nil
+}
+
+// Refunds PaymentIntentに対して行われた返金
+func (s *Server) Refunds(paymentIntentID string) []*stripe.Refund {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var refunds []*stripe.Refund
+	for _, r := range s.refunds {
+		if r.PaymentIntent.ID == paymentIntentID {
+			refunds = append(refunds, r)
+		}
+	}
+	return refunds
+}
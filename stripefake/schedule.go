@@ -0,0 +1,267 @@
+package stripefake
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// createSubscriptionSchedule https://stripe.com/docs/api/subscription_schedules/create
+// 既存のSubscriptionから作成する(from_subscription)場合のみ対応する
+func (s *Server) createSubscriptionSchedule(form url.Values) (*stripe.SubscriptionSchedule, *stripe.Error) {
+	id := form.Get("from_subscription")
+	if id == "" {
+		return nil, invalidRequest("from_subscription", "Missing required param: from_subscription.")
+	}
+	sub, ok := s.subscriptions[id]
+	if !ok || sub.Status == stripe.SubscriptionStatusCanceled {
+		err := resourceMissing("subscription", id)
+		err.Param = "from_subscription"
+		return nil, err
+	}
+	if sub.Schedule != nil {
+		return nil, invalidRequest("from_subscription", "You cannot migrate a subscription that is already attached to a schedule: `"+sub.Schedule.ID+"`.")
+	}
+
+	// 現在の請求期間を最初のフェーズとする
+	phase := &stripe.SubscriptionSchedulePhase{
+		StartDate:         sub.CurrentPeriodStart,
+		EndDate:           sub.CurrentPeriodEnd,
+		ProrationBehavior: stripe.SubscriptionSchedulePhaseProrationBehaviorCreateProrations,
+	}
+	if sub.TrialEnd > sub.CurrentPeriodStart {
+		phase.TrialEnd = sub.TrialEnd
+	}
+	for _, item := range sub.Items.Data {
+		phase.Items = append(phase.Items, &stripe.SubscriptionSchedulePhaseItem{Price: item.Price, Quantity: item.Quantity})
+	}
+	sched := &stripe.SubscriptionSchedule{
+		ID:           s.newID("sub_sched"),
+		Object:       "subscription_schedule",
+		Created:      s.now().Unix(),
+		Customer:     &stripe.Customer{ID: sub.Customer.ID},
+		EndBehavior:  stripe.SubscriptionScheduleEndBehaviorRelease,
+		Metadata:     mapParam(form, "metadata"),
+		Phases:       []*stripe.SubscriptionSchedulePhase{phase},
+		Status:       stripe.SubscriptionScheduleStatusActive,
+		Subscription: &stripe.Subscription{ID: sub.ID},
+	}
+	sched.CurrentPhase = &stripe.SubscriptionScheduleCurrentPhase{StartDate: phase.StartDate, EndDate: phase.EndDate}
+	s.schedules[sched.ID] = sched
+	s.phaseMetadata[sched.ID] = []map[string]string{nil}
+	sub.Schedule = &stripe.SubscriptionSchedule{ID: sched.ID}
+
+	s.emit("subscription_schedule.created", sched)
+	s.emit("customer.subscription.updated", sub)
+	return sched, nil
+}
+
+func (s *Server) getSubscriptionSchedule(id string) (*stripe.SubscriptionSchedule, *stripe.Error) {
+	sched, ok := s.schedules[id]
+	if !ok {
+		return nil, resourceMissing("subscription_schedule", id)
+	}
+	return sched, nil
+}
+
+// updateSubscriptionSchedule https://stripe.com/docs/api/subscription_schedules/update
+// phasesを指定した場合は全てのフェーズを置き換える。各フェーズの終了日時はend_dateかiterationsから決める
+func (s *Server) updateSubscriptionSchedule(id string, form url.Values) (*stripe.SubscriptionSchedule, *stripe.Error) {
+	sched, ok := s.schedules[id]
+	if !ok {
+		return nil, resourceMissing("subscription_schedule", id)
+	}
+	if !scheduleUpdatable(sched) {
+		return nil, invalidRequest("", "You cannot update a subscription schedule that is currently in the `"+string(sched.Status)+"` status.")
+	}
+	if v := form.Get("end_behavior"); v != "" {
+		sched.EndBehavior = stripe.SubscriptionScheduleEndBehavior(v)
+	}
+	mergeMetadata(&sched.Metadata, mapParam(form, "metadata"))
+
+	if params := listParam(form, "phases"); len(params) > 0 {
+		phases, metadata, err := s.parsePhases(params)
+		if err != nil {
+			return nil, err
+		}
+		if sched.CurrentPhase != nil && phases[0].StartDate != sched.CurrentPhase.StartDate {
+			return nil, invalidRequest("phases[0][start_date]", "You cannot change the start date of the current phase.")
+		}
+		sched.Phases = phases
+		s.phaseMetadata[sched.ID] = metadata
+		sched.CurrentPhase = &stripe.SubscriptionScheduleCurrentPhase{StartDate: phases[0].StartDate, EndDate: phases[0].EndDate}
+	}
+	s.emit("subscription_schedule.updated", sched)
+	return sched, nil
+}
+
+func (s *Server) parsePhases(params []url.Values) ([]*stripe.SubscriptionSchedulePhase, []map[string]string, *stripe.Error) {
+	var phases []*stripe.SubscriptionSchedulePhase
+	var metadata []map[string]string
+	for i, p := range params {
+		phase := &stripe.SubscriptionSchedulePhase{
+			ProrationBehavior: stripe.SubscriptionSchedulePhaseProrationBehavior(p.Get("proration_behavior")),
+		}
+		if phase.ProrationBehavior == "" {
+			phase.ProrationBehavior = stripe.SubscriptionSchedulePhaseProrationBehaviorCreateProrations
+		}
+		for _, ip := range listParam(p, "items") {
+			price, ok := s.prices[ip.Get("price")]
+			if !ok {
+				err := resourceMissing("price", ip.Get("price"))
+				err.Param = "phases[items][price]"
+				return nil, nil, err
+			}
+			item := &stripe.SubscriptionSchedulePhaseItem{Price: price, Quantity: 1}
+			if ip.Get("quantity") != "" {
+				q, err := int64Param(ip, "quantity")
+				if err != nil {
+					return nil, nil, err
+				}
+				item.Quantity = q
+			}
+			phase.Items = append(phase.Items, item)
+		}
+		if len(phase.Items) == 0 {
+			return nil, nil, invalidRequest("phases[items]", "Missing required param: phases[items].")
+		}
+
+		var err *stripe.Error
+		if phase.StartDate, err = int64Param(p, "start_date"); err != nil {
+			return nil, nil, err
+		}
+		if i == 0 && phase.StartDate == 0 {
+			return nil, nil, invalidRequest("phases[0][start_date]", "Missing required param: phases[0][start_date].")
+		}
+		if i > 0 {
+			phase.StartDate = phases[i-1].EndDate
+		}
+		if phase.TrialEnd, err = int64Param(p, "trial_end"); err != nil {
+			return nil, nil, err
+		}
+		if phase.EndDate, err = int64Param(p, "end_date"); err != nil {
+			return nil, nil, err
+		}
+		iterations, err := int64Param(p, "iterations")
+		if err != nil {
+			return nil, nil, err
+		}
+		if phase.EndDate == 0 {
+			if iterations == 0 {
+				iterations = 1
+			}
+			phase.EndDate = phaseEnd(phase, iterations)
+		}
+		if phase.EndDate <= phase.StartDate {
+			return nil, nil, invalidRequest("phases[end_date]", "The phase end date must be after its start date.")
+		}
+		phases = append(phases, phase)
+		metadata = append(metadata, mapParam(p, "metadata"))
+	}
+	return phases, metadata, nil
+}
+
+// releaseSubscriptionSchedule https://stripe.com/docs/api/subscription_schedules/release
+// フェーズの適用を止め、Subscriptionは現在の内容のまま継続する
+func (s *Server) releaseSubscriptionSchedule(id string) (*stripe.SubscriptionSchedule, *stripe.Error) {
+	sched, ok := s.schedules[id]
+	if !ok {
+		return nil, resourceMissing("subscription_schedule", id)
+	}
+	if !scheduleUpdatable(sched) {
+		return nil, invalidRequest("", "You cannot release a subscription schedule that is currently in the `"+string(sched.Status)+"` status.")
+	}
+	s.endSchedule(sched, stripe.SubscriptionScheduleStatusReleased)
+	return sched, nil
+}
+
+// endSchedule Subscription Scheduleを終了し、Subscriptionとの紐付けを解除する
+func (s *Server) endSchedule(sched *stripe.SubscriptionSchedule, status stripe.SubscriptionScheduleStatus) {
+	now := s.now().Unix()
+	sched.Status = status
+	sched.CurrentPhase = nil
+	switch status {
+	case stripe.SubscriptionScheduleStatusReleased:
+		sched.ReleasedAt = now
+		sched.ReleasedSubscription = sched.Subscription
+	case stripe.SubscriptionScheduleStatusCanceled:
+		sched.CanceledAt = now
+	}
+	sub := s.subscriptions[sched.Subscription.ID]
+	sched.Subscription = nil
+	s.emit("subscription_schedule."+string(status), sched)
+	if sub != nil {
+		sub.Schedule = nil
+		if status == stripe.SubscriptionScheduleStatusReleased {
+			s.emit("customer.subscription.updated", sub)
+		}
+	}
+}
+
+// advanceSchedule 請求期間の更新時に、startから始まるフェーズの内容をSubscriptionに適用する
+// 最後のフェーズが終了した場合はScheduleを解放する(end_behaviorはreleaseのみ対応する)
+func (s *Server) advanceSchedule(sub *stripe.Subscription, start time.Time) {
+	if sub.Schedule == nil {
+		return
+	}
+	sched, ok := s.schedules[sub.Schedule.ID]
+	if !ok || !scheduleUpdatable(sched) {
+		return
+	}
+	for i, phase := range sched.Phases {
+		if phase.StartDate != start.Unix() {
+			continue
+		}
+		// SubscriptionItemのIDは維持したままPriceと数量を差し替える
+		for j, item := range phase.Items {
+			if j < len(sub.Items.Data) {
+				sub.Items.Data[j].Price = item.Price
+				sub.Items.Data[j].Quantity = item.Quantity
+			}
+		}
+		mergeMetadata(&sub.Metadata, s.phaseMetadata[sched.ID][i])
+		sched.CurrentPhase = &stripe.SubscriptionScheduleCurrentPhase{StartDate: phase.StartDate, EndDate: phase.EndDate}
+		s.emit("subscription_schedule.updated", sched)
+		return
+	}
+	if last := sched.Phases[len(sched.Phases)-1]; start.Unix() >= last.EndDate {
+		s.endSchedule(sched, stripe.SubscriptionScheduleStatusReleased)
+	}
+}
+
+// cancelScheduleOf Subscriptionのキャンセル時に、紐づくSubscription Scheduleもキャンセルする
+func (s *Server) cancelScheduleOf(sub *stripe.Subscription) {
+	if sub.Schedule == nil {
+		return
+	}
+	if sched, ok := s.schedules[sub.Schedule.ID]; ok && scheduleUpdatable(sched) {
+		s.endSchedule(sched, stripe.SubscriptionScheduleStatusCanceled)
+	}
+	sub.Schedule = nil
+}
+
+func scheduleUpdatable(sched *stripe.SubscriptionSchedule) bool {
+	return sched.Status == stripe.SubscriptionScheduleStatusActive || sched.Status == stripe.SubscriptionScheduleStatusNotStarted
+}
+
+// phaseEnd iterations回の請求期間後のフェーズの終了日時。請求期間はフェーズの最初の項目のPriceから決まる
+func phaseEnd(phase *stripe.SubscriptionSchedulePhase, iterations int64) int64 {
+	r := phase.Items[0].Price.Recurring
+	if r == nil {
+		return phase.StartDate
+	}
+	start := time.Unix(phase.StartDate, 0)
+	n := int(r.IntervalCount * iterations)
+	switch r.Interval {
+	case stripe.PriceRecurringIntervalDay:
+		return start.AddDate(0, 0, n).Unix()
+	case stripe.PriceRecurringIntervalWeek:
+		return start.AddDate(0, 0, 7*n).Unix()
+	case stripe.PriceRecurringIntervalMonth:
+		return start.AddDate(0, n, 0).Unix()
+	case stripe.PriceRecurringIntervalYear:
+		return start.AddDate(n, 0, 0).Unix()
+	}
+	return phase.StartDate
+}
@@ -0,0 +1,474 @@
+// Package stripefake Stripe APIの一部をメモリ上で再現するHTTPサーバー
+//
+// stripe-goのBackendの接続先をこのサーバーに向けることで、ネットワークに接続せずに
+// Subscriptionの作成・更新・キャンセルや請求(Invoice, PaymentIntent)の状態遷移を確認できる。
+package stripefake
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+	stripeClient "github.com/stripe/stripe-go/v72/client"
+)
+
+// Server Stripe APIを模したインメモリのHTTPサーバー
+type Server struct {
+	srv *httptest.Server
+
+	mu  sync.Mutex
+	seq int
+	now func() time.Time
+
+	customers      map[string]*stripe.Customer
+	products       map[string]*stripe.Product
+	prices         map[string]*stripe.Price
+	subscriptions  map[string]*stripe.Subscription
+	invoices       map[string]*stripe.Invoice
+	paymentIntents map[string]*stripe.PaymentIntent
+	refunds        map[string]*stripe.Refund
+	// PaymentIntent毎の返金済みの金額
+	refunded       map[string]int64
+	coupons        map[string]*stripe.Coupon
+	promotionCodes map[string]*stripe.PromotionCode
+	schedules      map[string]*stripe.SubscriptionSchedule
+	// Subscription Schedule毎のフェーズのmetadata。stripe-goのSubscriptionSchedulePhaseにはmetadataがないため別に保持する
+	phaseMetadata map[string][]map[string]string
+	// Subscription毎の次回の請求に含める日割り計算の明細
+	pendingProrations map[string][]*stripe.InvoiceLine
+
+	// 顧客毎の決済結果。未設定の場合は決済に成功する
+	outcomes map[string]stripe.PaymentIntentStatus
+	// 冪等キー毎のレスポンス
+	idempotency map[string]*recordedResponse
+	requests    []Request
+	events      []*stripe.Event
+	// 一時的な障害を再現するため、500エラーを返す残りの更新リクエスト数
+	failures int
+}
+
+// Request サーバーが受け付けたリクエスト
+type Request struct {
+	Method         string
+	Path           string
+	Form           url.Values
+	IdempotencyKey string
+}
+
+type recordedResponse struct {
+	fingerprint string
+	status      int
+	body        []byte
+}
+
+func NewServer() *Server {
+	s := &Server{
+		now:               time.Now,
+		customers:         map[string]*stripe.Customer{},
+		products:          map[string]*stripe.Product{},
+		prices:            map[string]*stripe.Price{},
+		subscriptions:     map[string]*stripe.Subscription{},
+		invoices:          map[string]*stripe.Invoice{},
+		paymentIntents:    map[string]*stripe.PaymentIntent{},
+		refunds:           map[string]*stripe.Refund{},
+		refunded:          map[string]int64{},
+		coupons:           map[string]*stripe.Coupon{},
+		promotionCodes:    map[string]*stripe.PromotionCode{},
+		schedules:         map[string]*stripe.SubscriptionSchedule{},
+		phaseMetadata:     map[string][]map[string]string{},
+		pendingProrations: map[string][]*stripe.InvoiceLine{},
+		outcomes:          map[string]stripe.PaymentIntentStatus{},
+		idempotency:       map[string]*recordedResponse{},
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Backends stripe-goの接続先をこのサーバーに向けたBackends
+func (s *Server) Backends() *stripe.Backends {
+	config := &stripe.BackendConfig{
+		URL:               stripe.String(s.srv.URL),
+		MaxNetworkRetries: stripe.Int64(0),
+		LeveledLogger:     &stripe.LeveledLogger{Level: stripe.LevelNull},
+	}
+	return &stripe.Backends{
+		API:     stripe.GetBackendWithConfig(stripe.APIBackend, config),
+		Connect: stripe.GetBackendWithConfig(stripe.ConnectBackend, config),
+		Uploads: stripe.GetBackendWithConfig(stripe.UploadsBackend, config),
+	}
+}
+
+// Client このサーバーに接続するstripe-goのクライアント
+func (s *Server) Client() *stripeClient.API {
+	return stripeClient.New("sk_test_fake", s.Backends())
+}
+
+// SetNow サーバー内の現在時刻を差し替える
+func (s *Server) SetNow(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// SetPaymentOutcome 指定した顧客の以降の決済結果を設定する
+// stripe.PaymentIntentStatusRequiresAction は3Dセキュア認証が必要な場合、
+// stripe.PaymentIntentStatusRequiresPaymentMethod はカードが拒否された場合を再現する
+func (s *Server) SetPaymentOutcome(customerID string, status stripe.PaymentIntentStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outcomes[customerID] = status
+}
+
+// CreateCustomer 指定したIDで顧客を登録する
+func (s *Server) CreateCustomer(id string) *stripe.Customer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &stripe.Customer{ID: id, Object: "customer", Created: s.now().Unix(), Metadata: map[string]string{}}
+	s.customers[id] = c
+	return c
+}
+
+// CreatePrice Productと定期支払いのPriceを登録する
+func (s *Server) CreatePrice(name string, unitAmount int64, interval stripe.PriceRecurringInterval, intervalCount int64) *stripe.Price {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	product := s.newProduct(url.Values{"name": {name}})
+	return s.newPrice(product, unitAmount, stripe.CurrencyJPY, interval, intervalCount, nil)
+}
+
+// Subscription 保持しているSubscriptionのコピーを返す
+func (s *Server) Subscription(id string) (*stripe.Subscription, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return nil, false
+	}
+	var c stripe.Subscription
+	if err := copyObject(sub, &c); err != nil {
+		return nil, false
+	}
+	return &c, true
+}
+
+// Subscriptions 指定した顧客のSubscriptionのコピーを作成順に返す
+func (s *Server) Subscriptions(customerID string) []*stripe.Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var subs []*stripe.Subscription
+	for _, sub := range s.subscriptions {
+		if sub.Customer.ID != customerID {
+			continue
+		}
+		var c stripe.Subscription
+		if err := copyObject(sub, &c); err != nil {
+			continue
+		}
+		subs = append(subs, &c)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs
+}
+
+// FailNextRequests 以降n件の更新リクエストに対して、処理を行わずに500エラーを返す
+func (s *Server) FailNextRequests(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+// Requests これまでに受け付けたリクエスト
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Events これまでに発生したイベント
+func (s *Server) Events() []*stripe.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*stripe.Event(nil), s.events...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, &stripe.Error{HTTPStatusCode: http.StatusBadRequest, Type: stripe.ErrorTypeInvalidRequest, Msg: err.Error()})
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, &stripe.Error{HTTPStatusCode: http.StatusBadRequest, Type: stripe.ErrorTypeInvalidRequest, Msg: err.Error()})
+		return
+	}
+	for k, vs := range r.URL.Query() {
+		form[k] = append(form[k], vs...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := r.Header.Get("Idempotency-Key")
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Form: form, IdempotencyKey: key})
+
+	if s.failures > 0 && r.Method != http.MethodGet {
+		s.failures--
+		writeError(w, &stripe.Error{HTTPStatusCode: http.StatusInternalServerError, Type: stripe.ErrorTypeAPI, Msg: "An unknown error occurred"})
+		return
+	}
+
+	// 冪等キーが同一のリクエストは初回のレスポンスを返す https://stripe.com/docs/api/idempotent_requests
+	fingerprint := r.Method + " " + r.URL.Path + "?" + form.Encode()
+	if key != "" && r.Method != http.MethodGet {
+		if rec, ok := s.idempotency[key]; ok {
+			if rec.fingerprint != fingerprint {
+				writeError(w, &stripe.Error{
+					HTTPStatusCode: http.StatusBadRequest,
+					Type:           stripe.ErrorTypeIdempotency,
+					Msg:            fmt.Sprintf("Keys for idempotent requests can only be used with the same parameters they were first used with. Try using a key other than '%s' if you meant to execute a different request.", key),
+				})
+				return
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeRaw(w, rec.status, rec.body)
+			return
+		}
+	}
+
+	status, res := s.route(r.Method, strings.TrimPrefix(r.URL.Path, "/v1/"), form)
+	b, err := json.Marshal(res)
+	if err != nil {
+		writeError(w, &stripe.Error{HTTPStatusCode: http.StatusInternalServerError, Type: stripe.ErrorTypeAPI, Msg: err.Error()})
+		return
+	}
+	if key != "" && r.Method != http.MethodGet {
+		s.idempotency[key] = &recordedResponse{fingerprint: fingerprint, status: status, body: b}
+	}
+	writeRaw(w, status, b)
+}
+
+func (s *Server) route(method, path string, form url.Values) (int, interface{}) {
+	parts := strings.Split(path, "/")
+	resource, id := parts[0], ""
+	if len(parts) > 1 {
+		id = parts[1]
+	}
+
+	var res interface{}
+	var err *stripe.Error
+	switch {
+	case resource == "customers" && method == http.MethodPost && id == "":
+		res = s.postCustomer(form)
+	case resource == "customers" && method == http.MethodGet:
+		res, err = s.getCustomer(id)
+	case resource == "products" && method == http.MethodPost && id == "":
+		res = s.newProduct(form)
+	case resource == "prices" && method == http.MethodPost && id == "":
+		res, err = s.postPrice(form)
+	case resource == "prices" && method == http.MethodGet:
+		res, err = s.getPrice(id)
+	case resource == "subscriptions" && method == http.MethodPost && id == "":
+		res, err = s.createSubscription(form)
+	case resource == "subscriptions" && method == http.MethodPost:
+		res, err = s.updateSubscription(id, form)
+	case resource == "subscriptions" && method == http.MethodGet:
+		res, err = s.getSubscription(id)
+	case resource == "subscriptions" && method == http.MethodDelete:
+		res, err = s.cancelSubscription(id, form)
+	case resource == "subscription_items" && method == http.MethodPost:
+		res, err = s.updateSubscriptionItem(id, form)
+	case resource == "subscription_schedules" && method == http.MethodPost && id == "":
+		res, err = s.createSubscriptionSchedule(form)
+	case resource == "subscription_schedules" && method == http.MethodPost && len(parts) > 2 && parts[2] == "release":
+		res, err = s.releaseSubscriptionSchedule(id)
+	case resource == "subscription_schedules" && method == http.MethodPost:
+		res, err = s.updateSubscriptionSchedule(id, form)
+	case resource == "subscription_schedules" && method == http.MethodGet:
+		res, err = s.getSubscriptionSchedule(id)
+	case resource == "invoices" && method == http.MethodGet && id == "":
+		res, err = s.listInvoices(form)
+	case resource == "invoices" && method == http.MethodGet && id == "upcoming":
+		res, err = s.upcomingInvoice(form)
+	case resource == "invoices" && method == http.MethodGet:
+		res, err = s.getInvoice(id)
+	case resource == "promotion_codes" && method == http.MethodGet && id == "":
+		res = s.listPromotionCodes(form)
+	case resource == "promotion_codes" && method == http.MethodGet:
+		res, err = s.getPromotionCode(id)
+	case resource == "refunds" && method == http.MethodPost && id == "":
+		res, err = s.createRefund(form)
+	case resource == "payment_intents" && method == http.MethodGet:
+		res, err = s.getPaymentIntent(id)
+	default:
+		err = &stripe.Error{
+			HTTPStatusCode: http.StatusNotFound,
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Msg:            fmt.Sprintf("Unrecognized request URL (%s: /v1/%s).", method, path),
+		}
+	}
+	if err != nil {
+		return err.HTTPStatusCode, map[string]*stripe.Error{"error": err}
+	}
+	return http.StatusOK, res
+}
+
+func (s *Server) newID(prefix string) string {
+	s.seq++
+	return fmt.Sprintf("%s_fake%08d", prefix, s.seq)
+}
+
+func (s *Server) postCustomer(form url.Values) *stripe.Customer {
+	c := &stripe.Customer{
+		ID:       s.newID("cus"),
+		Object:   "customer",
+		Created:  s.now().Unix(),
+		Email:    form.Get("email"),
+		Name:     form.Get("name"),
+		Metadata: mapParam(form, "metadata"),
+	}
+	s.customers[c.ID] = c
+	return c
+}
+
+func (s *Server) getCustomer(id string) (*stripe.Customer, *stripe.Error) {
+	c, ok := s.customers[id]
+	if !ok {
+		return nil, resourceMissing("customer", id)
+	}
+	return c, nil
+}
+
+func (s *Server) newProduct(form url.Values) *stripe.Product {
+	p := &stripe.Product{
+		ID:                  s.newID("prod"),
+		Object:              "product",
+		Active:              true,
+		Created:             s.now().Unix(),
+		Name:                form.Get("name"),
+		StatementDescriptor: form.Get("statement_descriptor"),
+		Metadata:            mapParam(form, "metadata"),
+	}
+	s.products[p.ID] = p
+	return p
+}
+
+func (s *Server) postPrice(form url.Values) (*stripe.Price, *stripe.Error) {
+	product, ok := s.products[form.Get("product")]
+	if !ok {
+		return nil, resourceMissing("product", form.Get("product"))
+	}
+	unitAmount, err := int64Param(form, "unit_amount")
+	if err != nil {
+		return nil, err
+	}
+	count, err := int64Param(form, "recurring[interval_count]")
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		count = 1
+	}
+	interval := stripe.PriceRecurringInterval(form.Get("recurring[interval]"))
+	return s.newPrice(product, unitAmount, stripe.Currency(form.Get("currency")), interval, count, mapParam(form, "metadata")), nil
+}
+
+func (s *Server) newPrice(product *stripe.Product, unitAmount int64, currency stripe.Currency, interval stripe.PriceRecurringInterval, intervalCount int64, metadata map[string]string) *stripe.Price {
+	p := &stripe.Price{
+		ID:         s.newID("price"),
+		Object:     "price",
+		Active:     true,
+		Created:    s.now().Unix(),
+		Currency:   currency,
+		Product:    &stripe.Product{ID: product.ID},
+		Type:       stripe.PriceTypeOneTime,
+		UnitAmount: unitAmount,
+		Metadata:   metadata,
+	}
+	if interval != "" {
+		p.Type = stripe.PriceTypeRecurring
+		p.Recurring = &stripe.PriceRecurring{Interval: interval, IntervalCount: intervalCount}
+	}
+	s.prices[p.ID] = p
+	return p
+}
+
+func (s *Server) getPrice(id string) (*stripe.Price, *stripe.Error) {
+	p, ok := s.prices[id]
+	if !ok {
+		return nil, resourceMissing("price", id)
+	}
+	return p, nil
+}
+
+func (s *Server) getInvoice(id string) (*stripe.Invoice, *stripe.Error) {
+	inv, ok := s.invoices[id]
+	if !ok {
+		return nil, resourceMissing("invoice", id)
+	}
+	return inv, nil
+}
+
+func (s *Server) getPaymentIntent(id string) (*stripe.PaymentIntent, *stripe.Error) {
+	pi, ok := s.paymentIntents[id]
+	if !ok {
+		return nil, resourceMissing("payment_intent", id)
+	}
+	return pi, nil
+}
+
+func resourceMissing(object, id string) *stripe.Error {
+	return &stripe.Error{
+		HTTPStatusCode: http.StatusNotFound,
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodeResourceMissing,
+		Param:          "id",
+		Msg:            fmt.Sprintf("No such %s: '%s'", object, id),
+	}
+}
+
+func invalidRequest(param, msg string) *stripe.Error {
+	return &stripe.Error{
+		HTTPStatusCode: http.StatusBadRequest,
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Param:          param,
+		Msg:            msg,
+	}
+}
+
+func writeError(w http.ResponseWriter, err *stripe.Error) {
+	b, _ := json.Marshal(map[string]*stripe.Error{"error": err})
+	writeRaw(w, err.HTTPStatusCode, b)
+}
+
+func writeRaw(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// copyObject srcをJSONを経由してdstにコピーする
+func copyObject(src, dst interface{}) error {
+	b, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(bytes.NewReader(b)).Decode(dst)
+}
@@ -0,0 +1,286 @@
+package stripefake
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+	stripeClient "github.com/stripe/stripe-go/v72/client"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+func newTestServer(t *testing.T) (*Server, *stripeClient.API) {
+	t.Helper()
+	s := NewServer()
+	t.Cleanup(s.Close)
+	return s, s.Client()
+}
+
+func newSubscriptionParams(customerID, priceID string) *stripe.SubscriptionParams {
+	return &stripe.SubscriptionParams{
+		Customer: stripe.String(customerID),
+		Items:    []*stripe.SubscriptionItemsParams{{Price: stripe.String(priceID)}},
+	}
+}
+
+func eventTypes(evs []*stripe.Event) []string {
+	var types []string
+	for _, ev := range evs {
+		types = append(types, ev.Type)
+	}
+	return types
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServer_CreateSubscription(t *testing.T) {
+	s, sc := newTestServer(t)
+	s.CreateCustomer("cus_1")
+	price := s.CreatePrice("ramen", 3000, stripe.PriceRecurringIntervalMonth, 1)
+
+	params := newSubscriptionParams("cus_1", price.ID)
+	params.AddExpand("latest_invoice.payment_intent")
+	sub, err := sc.Subscriptions.New(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != stripe.SubscriptionStatusActive {
+		t.Errorf("Status = %s, want %s", sub.Status, stripe.SubscriptionStatusActive)
+	}
+	start := time.Unix(sub.CurrentPeriodStart, 0)
+	if want := start.AddDate(0, 1, 0).Unix(); sub.CurrentPeriodEnd != want {
+		t.Errorf("CurrentPeriodEnd = %d, want %d", sub.CurrentPeriodEnd, want)
+	}
+	if !sub.LatestInvoice.Paid || sub.LatestInvoice.AmountPaid != 3000 {
+		t.Errorf("LatestInvoice paid = %v amount_paid = %d, want paid 3000", sub.LatestInvoice.Paid, sub.LatestInvoice.AmountPaid)
+	}
+	if got := sub.LatestInvoice.PaymentIntent.Status; got != stripe.PaymentIntentStatusSucceeded {
+		t.Errorf("PaymentIntent.Status = %s, want %s", got, stripe.PaymentIntentStatusSucceeded)
+	}
+	want := []string{"customer.subscription.created", "invoice.payment_succeeded"}
+	if got := eventTypes(s.Events()); !equalStrings(got, want) {
+		t.Errorf("Events() = %v, want %v", got, want)
+	}
+
+	if _, err := sc.Subscriptions.New(newSubscriptionParams("cus_unknown", price.ID)); err == nil {
+		t.Error("Subscriptions.New() with an unknown customer succeeded")
+	}
+}
+
+func TestServer_SetPaymentOutcome(t *testing.T) {
+	s, sc := newTestServer(t)
+	s.CreateCustomer("cus_1")
+	price := s.CreatePrice("ramen", 3000, stripe.PriceRecurringIntervalMonth, 1)
+	s.SetPaymentOutcome("cus_1", stripe.PaymentIntentStatusRequiresPaymentMethod)
+
+	params := newSubscriptionParams("cus_1", price.ID)
+	params.PaymentBehavior = stripe.String("error_if_incomplete")
+	_, err := sc.Subscriptions.New(params)
+	stripeErr, ok := err.(*stripe.Error)
+	if !ok || stripeErr.Code != stripe.ErrorCodeCardDeclined {
+		t.Fatalf("Subscriptions.New() = %v, want card_declined", err)
+	}
+
+	sub, err := sc.Subscriptions.New(newSubscriptionParams("cus_1", price.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != stripe.SubscriptionStatusIncomplete {
+		t.Errorf("Status = %s, want %s", sub.Status, stripe.SubscriptionStatusIncomplete)
+	}
+}
+
+func TestServer_IdempotencyKey(t *testing.T) {
+	s, sc := newTestServer(t)
+	s.CreateCustomer("cus_1")
+	price := s.CreatePrice("ramen", 3000, stripe.PriceRecurringIntervalMonth, 1)
+
+	params := newSubscriptionParams("cus_1", price.ID)
+	params.SetIdempotencyKey("key-1")
+	first, err := sc.Subscriptions.New(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同じ冪等キーのリクエストは処理せずに初回のレスポンスを返す
+	second, err := sc.Subscriptions.New(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != second.ID {
+		t.Errorf("replayed subscription = %s, want %s", second.ID, first.ID)
+	}
+	if n := len(s.Events()); n != 2 {
+		t.Errorf("len(Events()) = %d, want 2", n)
+	}
+
+	other := newSubscriptionParams("cus_1", price.ID)
+	other.CancelAtPeriodEnd = stripe.Bool(true)
+	other.SetIdempotencyKey("key-1")
+	_, err = sc.Subscriptions.New(other)
+	if stripeErr, ok := err.(*stripe.Error); !ok || stripeErr.Type != stripe.ErrorTypeIdempotency {
+		t.Errorf("Subscriptions.New() with different params = %v, want idempotency_error", err)
+	}
+}
+
+func TestServer_FailNextRequests(t *testing.T) {
+	s, sc := newTestServer(t)
+	s.CreateCustomer("cus_1")
+	price := s.CreatePrice("ramen", 3000, stripe.PriceRecurringIntervalMonth, 1)
+	s.FailNextRequests(1)
+
+	_, err := sc.Subscriptions.New(newSubscriptionParams("cus_1", price.ID))
+	if stripeErr, ok := err.(*stripe.Error); !ok || stripeErr.HTTPStatusCode != 500 {
+		t.Fatalf("Subscriptions.New() = %v, want a 500 error", err)
+	}
+	if n := len(s.Events()); n != 0 {
+		t.Errorf("len(Events()) = %d, want 0", n)
+	}
+	if _, err := sc.Subscriptions.New(newSubscriptionParams("cus_1", price.ID)); err != nil {
+		t.Errorf("Subscriptions.New() after the failure = %v", err)
+	}
+}
+
+func TestServer_AdvancePeriod(t *testing.T) {
+	s, sc := newTestServer(t)
+	s.CreateCustomer("cus_1")
+	price := s.CreatePrice("ramen", 3000, stripe.PriceRecurringIntervalDay, 30)
+	sub, err := sc.Subscriptions.New(newSubscriptionParams("cus_1", price.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err := s.AdvancePeriod(sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.BillingReason != stripe.InvoiceBillingReasonSubscriptionCycle || !inv.Paid {
+		t.Errorf("renewal invoice reason = %s paid = %v", inv.BillingReason, inv.Paid)
+	}
+	renewed, _ := s.Subscription(sub.ID)
+	if renewed.CurrentPeriodStart != sub.CurrentPeriodEnd {
+		t.Errorf("CurrentPeriodStart = %d, want %d", renewed.CurrentPeriodStart, sub.CurrentPeriodEnd)
+	}
+
+	if _, err := sc.Subscriptions.Update(sub.ID, &stripe.SubscriptionParams{CancelAtPeriodEnd: stripe.Bool(true)}); err != nil {
+		t.Fatal(err)
+	}
+	inv, err = s.AdvancePeriod(sub.ID)
+	if err != nil || inv != nil {
+		t.Fatalf("AdvancePeriod() = %v, %v, want nil, nil", inv, err)
+	}
+	canceled, _ := s.Subscription(sub.ID)
+	if canceled.Status != stripe.SubscriptionStatusCanceled {
+		t.Errorf("Status = %s, want %s", canceled.Status, stripe.SubscriptionStatusCanceled)
+	}
+	evs := s.Events()
+	if last := evs[len(evs)-1].Type; last != "customer.subscription.deleted" {
+		t.Errorf("last event = %s, want customer.subscription.deleted", last)
+	}
+	if _, err := s.AdvancePeriod(sub.ID); err == nil {
+		t.Error("AdvancePeriod() on a canceled subscription succeeded")
+	}
+}
+
+func TestServer_UnrecognizedRequest(t *testing.T) {
+	_, sc := newTestServer(t)
+	_, err := sc.Coupons.Get("coupon_1", nil)
+	if stripeErr, ok := err.(*stripe.Error); !ok || stripeErr.HTTPStatusCode != 404 {
+		t.Errorf("Coupons.Get() = %v, want a 404 error", err)
+	}
+}
+
+func TestSignedPayload(t *testing.T) {
+	ev, err := NewEvent("customer.subscription.updated", &stripe.Subscription{ID: "sub_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, err := SignedPayload(ev, "whsec_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := webhook.ConstructEvent(payload, sig, "whsec_test")
+	if err != nil {
+		t.Fatalf("ConstructEvent() = %v", err)
+	}
+	if got.ID != ev.ID || got.Type != ev.Type {
+		t.Errorf("ConstructEvent() = %s %s, want %s %s", got.ID, got.Type, ev.ID, ev.Type)
+	}
+	if _, err := webhook.ConstructEvent(payload, sig, "whsec_other"); err == nil {
+		t.Error("ConstructEvent() with a different secret succeeded")
+	}
+}
+
+func TestServer_CompletePaymentAction(t *testing.T) {
+	s, sc := newTestServer(t)
+	s.CreateCustomer("cus_1")
+	price := s.CreatePrice("ramen", 3000, stripe.PriceRecurringIntervalDay, 30)
+	sub, err := sc.Subscriptions.New(newSubscriptionParams("cus_1", price.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 更新時の支払いで3Dセキュア認証が必要になる
+	s.SetPaymentOutcome("cus_1", stripe.PaymentIntentStatusRequiresAction)
+	before := len(s.Events())
+	inv, err := s.AdvancePeriod(sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := inv.PaymentIntent
+	if inv.Paid || pi.Status != stripe.PaymentIntentStatusRequiresAction || pi.NextAction == nil || pi.ClientSecret == "" {
+		t.Fatalf("renewal invoice paid = %v payment_intent = %+v, want requires_action", inv.Paid, pi)
+	}
+	if pastDue, _ := s.Subscription(sub.ID); pastDue.Status != stripe.SubscriptionStatusPastDue {
+		t.Errorf("Status = %s, want %s", pastDue.Status, stripe.SubscriptionStatusPastDue)
+	}
+	if got := eventTypes(s.Events()[before:]); !containsString(got, "invoice.payment_action_required") {
+		t.Errorf("Events() = %v, want invoice.payment_action_required", got)
+	}
+
+	before = len(s.Events())
+	if err := s.CompletePaymentAction(pi.ID); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"invoice.payment_succeeded", "customer.subscription.updated"}
+	if got := eventTypes(s.Events()[before:]); !equalStrings(got, want) {
+		t.Errorf("Events() = %v, want %v", got, want)
+	}
+	paid, err := sc.Invoices.Get(inv.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !paid.Paid || paid.AmountPaid != 3000 || paid.AmountRemaining != 0 {
+		t.Errorf("invoice paid = %v amount_paid = %d amount_remaining = %d, want paid 3000", paid.Paid, paid.AmountPaid, paid.AmountRemaining)
+	}
+	if active, _ := s.Subscription(sub.ID); active.Status != stripe.SubscriptionStatusActive {
+		t.Errorf("Status = %s, want %s", active.Status, stripe.SubscriptionStatusActive)
+	}
+
+	// 認証が必要ではないPaymentIntentは完了できない
+	if err := s.CompletePaymentAction(pi.ID); err == nil {
+		t.Error("CompletePaymentAction() on a succeeded payment_intent succeeded")
+	}
+	if err := s.CompletePaymentAction("pi_unknown"); err == nil {
+		t.Error("CompletePaymentAction() with an unknown payment_intent succeeded")
+	}
+}
@@ -0,0 +1,594 @@
+package stripefake
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// createSubscription https://stripe.com/docs/api/subscriptions/create
+// 日割り計算(proration_behavior)は考慮せず、常に日割りなしとして扱う
+func (s *Server) createSubscription(form url.Values) (*stripe.Subscription, *stripe.Error) {
+	customerID := form.Get("customer")
+	if _, ok := s.customers[customerID]; !ok {
+		err := resourceMissing("customer", customerID)
+		err.Param = "customer"
+		return nil, err
+	}
+	params := listParam(form, "items")
+	if len(params) == 0 {
+		return nil, invalidRequest("items", "Missing required param: items.")
+	}
+
+	now := s.now()
+	sub := &stripe.Subscription{
+		ID:                 s.newID("sub"),
+		Object:             "subscription",
+		Customer:           &stripe.Customer{ID: customerID},
+		CollectionMethod:   stripe.SubscriptionCollectionMethodChargeAutomatically,
+		Created:            now.Unix(),
+		StartDate:          now.Unix(),
+		BillingCycleAnchor: now.Unix(),
+		Metadata:           mapParam(form, "metadata"),
+		Items:              &stripe.SubscriptionItemList{},
+	}
+	for _, p := range params {
+		item, err := s.newSubscriptionItem(sub.ID, p)
+		if err != nil {
+			return nil, err
+		}
+		sub.Items.Data = append(sub.Items.Data, item)
+	}
+	sub.Items.TotalCount = uint32(len(sub.Items.Data))
+	if v, ok := boolParam(form, "cancel_at_period_end"); ok {
+		sub.CancelAtPeriodEnd = v
+	}
+	if source := form.Get("default_source"); source != "" {
+		sub.DefaultSource = &stripe.PaymentSource{ID: source}
+	}
+	sub.CurrentPeriodStart = now.Unix()
+	sub.CurrentPeriodEnd = s.periodEnd(sub, now).Unix()
+	trialEnd, err := trialEndParam(form, now)
+	if err != nil {
+		return nil, err
+	}
+	if trialEnd > now.Unix() {
+		// トライアル期間中は請求期間をトライアルの終了までとし、0円のInvoiceを作成する
+		sub.TrialStart = now.Unix()
+		sub.TrialEnd = trialEnd
+		sub.CurrentPeriodEnd = trialEnd
+	}
+	if code := form.Get("promotion_code"); code != "" {
+		d, err := s.newDiscount(sub, code, now)
+		if err != nil {
+			return nil, err
+		}
+		sub.Discount = d
+	}
+
+	inv := s.newInvoice(sub, stripe.InvoiceBillingReasonSubscriptionCreate)
+	s.pay(inv)
+	if sub.TrialEnd > 0 {
+		sub.Status = stripe.SubscriptionStatusTrialing
+	} else if inv.Paid {
+		sub.Status = stripe.SubscriptionStatusActive
+	} else {
+		sub.Status = stripe.SubscriptionStatusIncomplete
+		if form.Get("payment_behavior") == "error_if_incomplete" {
+			// 決済に失敗した場合はSubscriptionを作成せずにエラーを返す
+			delete(s.invoices, inv.ID)
+			if inv.PaymentIntent != nil {
+				delete(s.paymentIntents, inv.PaymentIntent.ID)
+			}
+			return nil, cardDeclined(inv.PaymentIntent)
+		}
+	}
+	sub.LatestInvoice = inv
+	s.subscriptions[sub.ID] = sub
+
+	s.emit("customer.subscription.created", sub)
+	s.emitInvoice(inv)
+	return sub, nil
+}
+
+// updateSubscription https://stripe.com/docs/api/subscriptions/update
+func (s *Server) updateSubscription(id string, form url.Values) (*stripe.Subscription, *stripe.Error) {
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return nil, resourceMissing("subscription", id)
+	}
+	if sub.Status == stripe.SubscriptionStatusCanceled {
+		return nil, invalidRequest("", "A canceled subscription can only update its cancellation_details.")
+	}
+	proration, err := parseProrationParams(form, "", s.now())
+	if err != nil {
+		return nil, err
+	}
+	prev := copyItems(sub.Items.Data)
+
+	for _, p := range listParam(form, "items") {
+		if p.Get("id") == "" {
+			item, err := s.newSubscriptionItem(sub.ID, p)
+			if err != nil {
+				return nil, err
+			}
+			sub.Items.Data = append(sub.Items.Data, item)
+			continue
+		}
+		item := findItem(sub, p.Get("id"))
+		if item == nil {
+			return nil, resourceMissing("subscription_item", p.Get("id"))
+		}
+		if p.Get("deleted") == "true" {
+			removeItem(sub, item.ID)
+			continue
+		}
+		if err := s.applyItemParams(item, p); err != nil {
+			return nil, err
+		}
+	}
+	sub.Items.TotalCount = uint32(len(sub.Items.Data))
+	mergeMetadata(&sub.Metadata, mapParam(form, "metadata"))
+	if v, ok := boolParam(form, "cancel_at_period_end"); ok {
+		sub.CancelAtPeriodEnd = v
+		sub.CanceledAt = 0
+		if v {
+			sub.CanceledAt = s.now().Unix()
+		}
+	}
+	if source := form.Get("default_source"); source != "" {
+		sub.DefaultSource = &stripe.PaymentSource{ID: source}
+	}
+	if err := applyPauseCollection(sub, form, s.now()); err != nil {
+		return nil, err
+	}
+	if coupon := form.Get("coupon"); coupon != "" {
+		// 適用中の割引は置き換える
+		d, err := s.newCouponDiscount(sub, coupon, s.now())
+		if err != nil {
+			return nil, err
+		}
+		sub.Discount = d
+	}
+
+	if form.Get("trial_end") == "now" && sub.Status == stripe.SubscriptionStatusTrialing {
+		// トライアルを終了し、新しい請求期間の請求を即時に行う
+		sub.TrialEnd = s.now().Unix()
+		form.Set("billing_cycle_anchor", "now")
+	}
+	resetAnchor := form.Get("billing_cycle_anchor") == "now"
+	var prorations []*stripe.InvoiceLine
+	if proration.behavior != stripe.SubscriptionProrationBehaviorNone {
+		prorations = s.prorationLines(sub, prev, proration.date, resetAnchor)
+	}
+	switch {
+	case resetAnchor:
+		// 請求期間をリセットし、日割り計算の返金と新しい期間の請求を即時に行う
+		now := s.now()
+		sub.BillingCycleAnchor = now.Unix()
+		sub.CurrentPeriodStart = now.Unix()
+		sub.CurrentPeriodEnd = s.periodEnd(sub, now).Unix()
+		inv := s.newInvoiceWithProrations(sub, stripe.InvoiceBillingReasonSubscriptionUpdate, s.takePendingProrations(sub.ID, prorations))
+		s.pay(inv)
+		sub.LatestInvoice = inv
+		sub.Status = statusAfterPayment(sub, inv)
+		s.emitInvoice(inv)
+	case len(prorations) > 0 && proration.behavior == stripe.SubscriptionProrationBehaviorAlwaysInvoice:
+		// 日割り計算の明細のみのInvoiceを作成して即時に請求する
+		inv := s.newProrationInvoice(sub, s.takePendingProrations(sub.ID, prorations))
+		s.pay(inv)
+		sub.LatestInvoice = inv
+		s.emitInvoice(inv)
+	case len(prorations) > 0:
+		// 次回の請求に含める
+		s.pendingProrations[sub.ID] = append(s.pendingProrations[sub.ID], prorations...)
+	}
+
+	s.emit("customer.subscription.updated", sub)
+	return sub, nil
+}
+
+func (s *Server) getSubscription(id string) (*stripe.Subscription, *stripe.Error) {
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return nil, resourceMissing("subscription", id)
+	}
+	return sub, nil
+}
+
+// cancelSubscription https://stripe.com/docs/api/subscriptions/cancel
+func (s *Server) cancelSubscription(id string, form url.Values) (*stripe.Subscription, *stripe.Error) {
+	sub, ok := s.subscriptions[id]
+	if !ok || sub.Status == stripe.SubscriptionStatusCanceled {
+		return nil, resourceMissing("subscription", id)
+	}
+	now := s.now().Unix()
+	sub.Status = stripe.SubscriptionStatusCanceled
+	sub.CanceledAt = now
+	sub.EndedAt = now
+	sub.CancelAtPeriodEnd = false
+	s.cancelScheduleOf(sub)
+	s.emit("customer.subscription.deleted", sub)
+	return sub, nil
+}
+
+// updateSubscriptionItem https://stripe.com/docs/api/subscription_items/update
+func (s *Server) updateSubscriptionItem(id string, form url.Values) (*stripe.SubscriptionItem, *stripe.Error) {
+	for _, sub := range s.subscriptions {
+		item := findItem(sub, id)
+		if item == nil {
+			continue
+		}
+		if err := s.applyItemParams(item, form); err != nil {
+			return nil, err
+		}
+		s.emit("customer.subscription.updated", sub)
+		return item, nil
+	}
+	return nil, resourceMissing("subscription_item", id)
+}
+
+// AdvancePeriod Subscriptionを次の請求期間に進める(自動更新)
+// cancel_at_period_endが設定されている場合はSubscriptionを終了し、nilを返す
+func (s *Server) AdvancePeriod(id string) (*stripe.Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", id)
+	}
+	if sub.Status == stripe.SubscriptionStatusCanceled {
+		return nil, errors.New("subscription is already canceled")
+	}
+	if sub.CancelAtPeriodEnd {
+		sub.Status = stripe.SubscriptionStatusCanceled
+		sub.EndedAt = sub.CurrentPeriodEnd
+		s.cancelScheduleOf(sub)
+		s.emit("customer.subscription.deleted", sub)
+		return nil, nil
+	}
+
+	start := time.Unix(sub.CurrentPeriodEnd, 0)
+	if r := sub.PauseCollection.ResumesAt; r > 0 && start.Unix() >= r {
+		// 再開予定の日時を過ぎたため、請求の一時停止を解除する
+		sub.PauseCollection = stripe.SubscriptionPauseCollection{}
+	}
+	s.advanceSchedule(sub, start)
+	sub.CurrentPeriodStart = start.Unix()
+	sub.CurrentPeriodEnd = s.periodEnd(sub, start).Unix()
+	inv := s.newInvoiceWithProrations(sub, stripe.InvoiceBillingReasonSubscriptionCycle, s.takePendingProrations(sub.ID, nil))
+	sub.LatestInvoice = inv
+	if behavior := sub.PauseCollection.Behavior; behavior != "" {
+		// 請求の一時停止中は支払いを行わず、behaviorに従ってInvoiceを処理する。statusは変わらない
+		s.emitPausedInvoice(inv, behavior)
+	} else {
+		s.pay(inv)
+		sub.Status = statusAfterPayment(sub, inv)
+		s.emitInvoice(inv)
+	}
+	s.emit("customer.subscription.updated", sub)
+
+	var c stripe.Invoice
+	if err := copyObject(inv, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *Server) newSubscriptionItem(subscriptionID string, p url.Values) (*stripe.SubscriptionItem, *stripe.Error) {
+	item := &stripe.SubscriptionItem{
+		ID:           s.newID("si"),
+		Object:       "subscription_item",
+		Created:      s.now().Unix(),
+		Quantity:     1,
+		Subscription: subscriptionID,
+	}
+	if p.Get("price") == "" {
+		return nil, invalidRequest("items[0][price]", "Missing required param: items[0][price].")
+	}
+	if err := s.applyItemParams(item, p); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (s *Server) applyItemParams(item *stripe.SubscriptionItem, p url.Values) *stripe.Error {
+	if priceID := p.Get("price"); priceID != "" {
+		price, ok := s.prices[priceID]
+		if !ok {
+			err := resourceMissing("price", priceID)
+			err.Param = "price"
+			return err
+		}
+		item.Price = price
+	}
+	if p.Get("quantity") != "" {
+		q, err := int64Param(p, "quantity")
+		if err != nil {
+			return err
+		}
+		item.Quantity = q
+	}
+	mergeMetadata(&item.Metadata, mapParam(p, "metadata"))
+	return nil
+}
+
+// periodEnd startから1請求期間後の日時を返す。請求期間は最初のSubscriptionItemのPriceから決まる
+func (s *Server) periodEnd(sub *stripe.Subscription, start time.Time) time.Time {
+	if len(sub.Items.Data) == 0 || sub.Items.Data[0].Price.Recurring == nil {
+		return start
+	}
+	r := sub.Items.Data[0].Price.Recurring
+	n := int(r.IntervalCount)
+	switch r.Interval {
+	case stripe.PriceRecurringIntervalDay:
+		return start.AddDate(0, 0, n)
+	case stripe.PriceRecurringIntervalWeek:
+		return start.AddDate(0, 0, 7*n)
+	case stripe.PriceRecurringIntervalMonth:
+		return start.AddDate(0, n, 0)
+	case stripe.PriceRecurringIntervalYear:
+		return start.AddDate(n, 0, 0)
+	}
+	return start
+}
+
+// trialEndParam trial_period_days、trial_endからトライアルの終了日時を返す。トライアルを指定しない場合は0を返す
+func trialEndParam(form url.Values, now time.Time) (int64, *stripe.Error) {
+	if form.Get("trial_period_days") != "" {
+		days, err := int64Param(form, "trial_period_days")
+		if err != nil {
+			return 0, err
+		}
+		return now.AddDate(0, 0, int(days)).Unix(), nil
+	}
+	switch form.Get("trial_end") {
+	case "", "now":
+		return 0, nil
+	}
+	return int64Param(form, "trial_end")
+}
+
+// TrialWillEnd トライアル終了の3日前に送信される customer.subscription.trial_will_end イベントを発生させる
+func (s *Server) TrialWillEnd(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[id]
+	if !ok || sub.Status != stripe.SubscriptionStatusTrialing {
+		return fmt.Errorf("no such trialing subscription: %s", id)
+	}
+	s.emit("customer.subscription.trial_will_end", sub)
+	return nil
+}
+
+// newInvoice Subscriptionの現在の請求期間に対するInvoiceを作成する
+func (s *Server) newInvoice(sub *stripe.Subscription, reason stripe.InvoiceBillingReason) *stripe.Invoice {
+	return s.newInvoiceWithProrations(sub, reason, nil)
+}
+
+// newInvoiceWithProrations 日割り計算の明細を含むInvoiceを作成する
+func (s *Server) newInvoiceWithProrations(sub *stripe.Subscription, reason stripe.InvoiceBillingReason, prorations []*stripe.InvoiceLine) *stripe.Invoice {
+	inv := s.buildInvoice(sub, reason, prorations)
+	inv.ID = s.newID("in")
+	s.invoices[inv.ID] = inv
+	return inv
+}
+
+// buildInvoice Subscriptionの現在の請求期間に対するInvoiceを組み立てる。保存はしない
+func (s *Server) buildInvoice(sub *stripe.Subscription, reason stripe.InvoiceBillingReason, prorations []*stripe.InvoiceLine) *stripe.Invoice {
+	inv := &stripe.Invoice{
+		Object:        "invoice",
+		BillingReason: reason,
+		Created:       s.now().Unix(),
+		Customer:      &stripe.Customer{ID: sub.Customer.ID},
+		Subscription:  &stripe.Subscription{ID: sub.ID},
+		PeriodStart:   sub.CurrentPeriodStart,
+		PeriodEnd:     sub.CurrentPeriodEnd,
+		Status:        stripe.InvoiceStatusOpen,
+		Lines:         &stripe.InvoiceLineList{},
+	}
+	for _, line := range prorations {
+		inv.Lines.Data = append(inv.Lines.Data, line)
+		inv.Currency = line.Currency
+		inv.Subtotal += line.Amount
+	}
+	for _, item := range sub.Items.Data {
+		amount := item.Price.UnitAmount * item.Quantity
+		if sub.TrialEnd >= sub.CurrentPeriodEnd {
+			// トライアル期間の請求は0円
+			amount = 0
+		}
+		line := &stripe.InvoiceLine{
+			ID:               s.newID("il"),
+			Object:           "line_item",
+			Amount:           amount,
+			Currency:         item.Price.Currency,
+			Description:      fmt.Sprintf("%d × %s", item.Quantity, s.productName(item.Price)),
+			Metadata:         copyMetadata(sub.Metadata),
+			Period:           &stripe.Period{Start: sub.CurrentPeriodStart, End: sub.CurrentPeriodEnd},
+			Price:            item.Price,
+			Quantity:         item.Quantity,
+			Subscription:     sub.ID,
+			SubscriptionItem: item.ID,
+			Type:             stripe.InvoiceLineTypeSubscription,
+		}
+		inv.Lines.Data = append(inv.Lines.Data, line)
+		inv.Currency = line.Currency
+		inv.Subtotal += line.Amount
+	}
+	inv.Lines.TotalCount = uint32(len(inv.Lines.Data))
+	inv.Total = inv.Subtotal - s.applyDiscount(sub, inv)
+	inv.AmountDue = inv.Total
+	if inv.AmountDue < 0 {
+		// 返金額が請求額を上回る場合、差額は顧客の残高に計上され次回以降の請求に充当される
+		inv.AmountDue = 0
+	}
+	inv.AmountRemaining = inv.AmountDue
+	return inv
+}
+
+// pay Invoiceの支払いを行う。決済結果は SetPaymentOutcome の設定に従う
+func (s *Server) pay(inv *stripe.Invoice) {
+	inv.Attempted = true
+	inv.AttemptCount++
+	if inv.AmountDue == 0 {
+		inv.Paid = true
+		inv.Status = stripe.InvoiceStatusPaid
+		return
+	}
+
+	outcome, ok := s.outcomes[inv.Customer.ID]
+	if !ok {
+		outcome = stripe.PaymentIntentStatusSucceeded
+	}
+	pi := &stripe.PaymentIntent{
+		ID:       s.newID("pi"),
+		Object:   "payment_intent",
+		Amount:   inv.AmountDue,
+		Created:  s.now().Unix(),
+		Currency: string(inv.Currency),
+		Customer: &stripe.Customer{ID: inv.Customer.ID},
+		Invoice:  &stripe.Invoice{ID: inv.ID},
+		Status:   outcome,
+	}
+	pi.ClientSecret = fmt.Sprintf("%s_secret_%08d", pi.ID, s.seq)
+	switch outcome {
+	case stripe.PaymentIntentStatusSucceeded:
+		pi.AmountReceived = pi.Amount
+		inv.Paid = true
+		inv.Status = stripe.InvoiceStatusPaid
+		inv.AmountPaid = inv.AmountDue
+		inv.AmountRemaining = 0
+	case stripe.PaymentIntentStatusRequiresAction:
+		pi.NextAction = &stripe.PaymentIntentNextAction{Type: "use_stripe_sdk"}
+	default:
+		pi.LastPaymentError = &stripe.Error{
+			Type:        stripe.ErrorTypeCard,
+			Code:        stripe.ErrorCodeCardDeclined,
+			DeclineCode: stripe.DeclineCodeGenericDecline,
+			Msg:         "Your card was declined.",
+		}
+	}
+	s.paymentIntents[pi.ID] = pi
+	inv.PaymentIntent = pi
+}
+
+// applyPauseCollection pause_collectionパラメータを反映する https://stripe.com/docs/billing/subscriptions/pause
+// 空文字を指定した場合は請求の一時停止を解除する
+func applyPauseCollection(sub *stripe.Subscription, form url.Values, now time.Time) *stripe.Error {
+	if v, ok := form["pause_collection"]; ok && v[0] == "" {
+		sub.PauseCollection = stripe.SubscriptionPauseCollection{}
+		return nil
+	}
+	behavior := stripe.SubscriptionPauseCollectionBehavior(form.Get("pause_collection[behavior]"))
+	switch behavior {
+	case "":
+		return nil
+	case stripe.SubscriptionPauseCollectionBehaviorKeepAsDraft,
+		stripe.SubscriptionPauseCollectionBehaviorMarkUncollectible,
+		stripe.SubscriptionPauseCollectionBehaviorVoid:
+	default:
+		return invalidRequest("pause_collection[behavior]", "Invalid pause_collection[behavior]: must be one of keep_as_draft, mark_uncollectible, or void")
+	}
+	resumesAt, err := int64Param(form, "pause_collection[resumes_at]")
+	if err != nil {
+		return err
+	}
+	if resumesAt > 0 && resumesAt <= now.Unix() {
+		return invalidRequest("pause_collection[resumes_at]", "pause_collection[resumes_at] must be in the future.")
+	}
+	sub.PauseCollection = stripe.SubscriptionPauseCollection{Behavior: behavior, ResumesAt: resumesAt}
+	return nil
+}
+
+// emitPausedInvoice 請求の一時停止中に作成したInvoiceをbehaviorに従って処理する
+func (s *Server) emitPausedInvoice(inv *stripe.Invoice, behavior stripe.SubscriptionPauseCollectionBehavior) {
+	switch behavior {
+	case stripe.SubscriptionPauseCollectionBehaviorMarkUncollectible:
+		inv.Status = stripe.InvoiceStatusUncollectible
+		s.emit("invoice.marked_uncollectible", inv)
+	case stripe.SubscriptionPauseCollectionBehaviorVoid:
+		inv.Status = stripe.InvoiceStatusVoid
+		s.emit("invoice.voided", inv)
+	default:
+		inv.Status = stripe.InvoiceStatusDraft
+		s.emit("invoice.created", inv)
+	}
+}
+
+// statusAfterPayment 請求期間の更新時の支払い結果からSubscriptionのstatusを決める
+func statusAfterPayment(sub *stripe.Subscription, inv *stripe.Invoice) stripe.SubscriptionStatus {
+	if inv.Paid {
+		return stripe.SubscriptionStatusActive
+	}
+	if sub.Status == stripe.SubscriptionStatusIncomplete {
+		return sub.Status
+	}
+	return stripe.SubscriptionStatusPastDue
+}
+
+func cardDeclined(pi *stripe.PaymentIntent) *stripe.Error {
+	err := &stripe.Error{
+		HTTPStatusCode: http.StatusPaymentRequired,
+		Type:           stripe.ErrorTypeCard,
+		Code:           stripe.ErrorCodeCardDeclined,
+		DeclineCode:    stripe.DeclineCodeGenericDecline,
+		Msg:            "Your card was declined.",
+	}
+	if pi != nil && pi.LastPaymentError != nil {
+		err.Code = pi.LastPaymentError.Code
+		err.DeclineCode = pi.LastPaymentError.DeclineCode
+		err.Msg = pi.LastPaymentError.Msg
+	}
+	return err
+}
+
+func findItem(sub *stripe.Subscription, id string) *stripe.SubscriptionItem {
+	for _, item := range sub.Items.Data {
+		if item.ID == id {
+			return item
+		}
+	}
+	return nil
+}
+
+func removeItem(sub *stripe.Subscription, id string) {
+	items := sub.Items.Data[:0]
+	for _, item := range sub.Items.Data {
+		if item.ID != id {
+			items = append(items, item)
+		}
+	}
+	sub.Items.Data = items
+}
+
+// mergeMetadata 空文字が指定されたキーは削除する https://stripe.com/docs/api/metadata
+func mergeMetadata(dst *map[string]string, src map[string]string) {
+	if len(src) == 0 {
+		return
+	}
+	if *dst == nil {
+		*dst = map[string]string{}
+	}
+	for k, v := range src {
+		if v == "" {
+			delete(*dst, k)
+			continue
+		}
+		(*dst)[k] = v
+	}
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -31,21 +31,39 @@ func main() {
 	sub := &Subscription{
 		ID:    uuid.New().String(),
 		Title: "味噌ラーメンわくわく定額プラン",
+		Titles: map[string]string{
+			"en": "Miso Ramen Subscription",
+		},
 		Plans: []*Plan{
 			{
 				ID:    uuid.New().String(),
 				Title: "毎日ラーメン1杯無料プラン",
-				Price: 3000,
+				Titles: map[string]string{
+					"en": "One free ramen every day",
+				},
+				Price:         3000,
+				Currency:      string(stripe.CurrencyJPY),
+				Interval:      "day",
+				IntervalCount: 30,
+				TrialDays:     7, // 初回のみ7日間無料
 				Benefits: []*Benefit{
 					{
-						ID: uuid.New().String(),
+						ID:          uuid.New().String(),
+						QuotaPeriod: "day", // 1日1杯まで
+						QuotaLimit:  1,
 					},
 				},
 			},
 			{
 				ID:    uuid.New().String(),
 				Title: "トッピング毎回1品無料",
-				Price: 350,
+				Titles: map[string]string{
+					"en": "One free topping every time",
+				},
+				Price:         350,
+				Currency:      string(stripe.CurrencyJPY),
+				Interval:      "day",
+				IntervalCount: 30,
 				Benefits: []*Benefit{
 					{
 						ID: uuid.New().String(),
@@ -69,13 +87,13 @@ func main() {
 
 		// Priceの作成 https://stripe.com/docs/api/prices/create
 		priceParams := &stripe.PriceParams{
-			Currency: stripe.String(string(stripe.CurrencyJPY)), // 通貨の設定, JPYを設定する
-			Product:  stripe.String(product.ID),                 // 上記で作成したProductのIDを設定する
+			Currency: stripe.String(plan.Currency), // 通貨の設定, JPYを設定する
+			Product:  stripe.String(product.ID),    // 上記で作成したProductのIDを設定する
 			Recurring: &stripe.PriceRecurringParams{ // サブスク期間の設定
-				Interval:      stripe.String("day"), // 日毎
-				IntervalCount: stripe.Int64(30),     // 30日
+				Interval:      stripe.String(plan.Interval),     // 日毎
+				IntervalCount: stripe.Int64(plan.IntervalCount), // 30日
 			},
-			UnitAmount: stripe.Int64(3000), // 料金, 3000円
+			UnitAmount: stripe.Int64(int64(plan.Price)), // 料金
 		}
 		priceParams.AddMetadata("subscription_id", sub.ID)
 		priceParams.AddMetadata("plan_id", plan.ID)
@@ -2,23 +2,31 @@ package main
 
 // Plan サブスクプラン
 type Plan struct {
-	ID              string     `firestore:"id"`
-	Title           string     `firestore:"title"`
-	StripeProductID string     `firestore:"stripe_product_id"`
-	StripePriceID   string     `firestore:"stripe_price_id"`
-	Price           int32      `firestore:"price"`
-	Benefits        []*Benefit `firestore:"benefits"`
+	ID              string            `firestore:"id"`
+	Title           string            `firestore:"title"`
+	Titles          map[string]string `firestore:"titles"` // ロケール毎のタイトル
+	StripeProductID string            `firestore:"stripe_product_id"`
+	StripePriceID   string            `firestore:"stripe_price_id"`
+	Price           int32             `firestore:"price"`
+	Currency        string            `firestore:"currency"`
+	Interval        string            `firestore:"interval"`
+	IntervalCount   int64             `firestore:"interval_count"`
+	TrialDays       int64             `firestore:"trial_days"` // 新規契約時のトライアル日数
+	Benefits        []*Benefit        `firestore:"benefits"`
 }
 
 // Benefit サブスク適用のためのデータを定義(割引額等)。今回は触れない
 type Benefit struct {
-	ID string `firestore:"id"`
+	ID          string `firestore:"id"`
+	QuotaPeriod string `firestore:"quota_period"` // 利用回数を数える期間(day、billing_period)。未設定の場合は無制限
+	QuotaLimit  int64  `firestore:"quota_limit"`
 	// DiscountValue int32 `firestore:"discount_value"`
 }
 
 // Subscription サブスクは複数のプランを持っている
 type Subscription struct {
-	ID    string  `firestore:"-"`
-	Title string  `firestore:"title"`
-	Plans []*Plan `firestore:"plans"`
+	ID     string            `firestore:"-"`
+	Title  string            `firestore:"title"`
+	Titles map[string]string `firestore:"titles"` // ロケール毎のタイトル
+	Plans  []*Plan           `firestore:"plans"`
 }
@@ -0,0 +1,7 @@
+module github.com/ogiogi93/stripe-subscription-samples/tools/offline-token
+
+go 1.17
+
+require github.com/ogiogi93/stripe-subscription-samples v0.0.0-00010101000000-000000000000
+
+replace github.com/ogiogi93/stripe-subscription-samples => ../..
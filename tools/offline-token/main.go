@@ -0,0 +1,131 @@
+// offline-token 店頭での確認に利用するトークンの鍵を生成し、トークンをオフラインで検証する
+//
+//	offline-token keygen -out ./keys
+//	offline-token verify -public-key ./keys/offline-token.pub.pem -kid key-1 -benefit <benefit_id> <token>
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ogiogi93/stripe-subscription-samples/offlinetoken"
+)
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "keygen":
+		keygen(os.Args[2:])
+	case "verify":
+		os.Exit(verify(os.Args[2:]))
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: offline-token keygen [-out dir]")
+	fmt.Fprintln(os.Stderr, "       offline-token verify -public-key file [-kid id] [-benefit id] [token]")
+	os.Exit(2)
+}
+
+// keygen Ed25519の鍵ペアを生成する。秘密鍵はサーバーのOFFLINE_TOKEN_PRIVATE_KEY_FILEに、公開鍵は店舗の端末に配布する
+func keygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", ".", "鍵を出力するディレクトリ")
+	_ = fs.Parse(args)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+	privPEM, err := offlinetoken.MarshalPrivateKeyPEM(priv)
+	if err != nil {
+		log.Fatalf("Failed to marshal private key: %v", err)
+	}
+	pubPEM, err := offlinetoken.MarshalPublicKeyPEM(pub)
+	if err != nil {
+		log.Fatalf("Failed to marshal public key: %v", err)
+	}
+	privPath := filepath.Join(*out, "offline-token.pem")
+	pubPath := filepath.Join(*out, "offline-token.pub.pem")
+	if err := ioutil.WriteFile(privPath, privPEM, 0600); err != nil {
+		log.Fatalf("Failed to write private key: %v", err)
+	}
+	if err := ioutil.WriteFile(pubPath, pubPEM, 0644); err != nil {
+		log.Fatalf("Failed to write public key: %v", err)
+	}
+	fmt.Printf("private key: %s\npublic key: %s\n", privPath, pubPath)
+}
+
+// verify トークンを検証して内容を出力する。有効な場合は0、無効な場合は1を返す
+func verify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	publicKey := fs.String("public-key", "", "PEM形式の公開鍵")
+	kid := fs.String("kid", "", "公開鍵の鍵ID(サーバーのOFFLINE_TOKEN_KEY_ID)")
+	benefit := fs.String("benefit", "", "指定した場合、トークンに特典が含まれることも検証する")
+	_ = fs.Parse(args)
+	if *publicKey == "" {
+		usage()
+	}
+
+	b, err := ioutil.ReadFile(*publicKey)
+	if err != nil {
+		log.Fatalf("Failed to read public key: %v", err)
+	}
+	pub, err := offlinetoken.ParsePublicKeyPEM(b)
+	if err != nil {
+		log.Fatalf("Failed to parse public key: %v", err)
+	}
+
+	// トークンを引数で指定しない場合は標準入力から読み込む(QRコードリーダー等からの入力を想定)
+	token := fs.Arg(0)
+	if token == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatalf("Failed to read token: %v", err)
+		}
+		token = strings.TrimSpace(line)
+	}
+
+	claims, err := offlinetoken.Verify(token, offlinetoken.KeySet{*kid: pub}, time.Now())
+	result := struct {
+		Valid     bool                 `json:"valid"`
+		Error     string               `json:"error,omitempty"`
+		ExpiresAt *time.Time           `json:"expires_at,omitempty"`
+		Claims    *offlinetoken.Claims `json:"claims,omitempty"`
+	}{Valid: err == nil, Claims: claims}
+	if err == nil && *benefit != "" && !claims.HasBenefit(*benefit) {
+		err = errors.New("benefit is not included in the token")
+		result.Valid = false
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if claims != nil {
+		exp := time.Unix(claims.ExpiresAt, 0)
+		result.ExpiresAt = &exp
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(result)
+	if !result.Valid {
+		return 1
+	}
+	return 0
+}
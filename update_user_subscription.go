@@ -2,58 +2,81 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"log"
 	"net/http"
+	"time"
 
-	"cloud.google.com/go/firestore"
-	"github.com/stripe/stripe-go"
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
 )
 
 type UpdateUserSubscriptionRequest struct {
-	CustomerID     string `json:"customer_id"`
-	SubscriptionID string `json:"subscription_id"`
-	PlanID         string `json:"plan_id"`
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+	PlanID         string `json:"plan_id" validate:"required,document_id"`
 }
 
 func UpdateUserSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 
-	var req *UpdateUserSubscriptionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("json.NewDecoder.Decode: %v", err)
+	var req UpdateUserSubscriptionRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
 		return
 	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
 
-	err := fsClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		sub, _ := GetSubscriptionTx(tx, req.SubscriptionID)
+	op := NewOutboxOperation(outboxOperationID(r), OutboxOperationChangePlanAtPeriodEnd, time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
 		// 新しいサブスクリプションのプランのデータを取得する
-		plan := sub.Plan(req.PlanID)
-
-		ub, _ := GetUserSubscriptionTx(tx, sub.UserSubscriptionID(req.CustomerID))
-
-		// Subscriptionに設定されているSubscriptionItemを変更する https://stripe.com/docs/billing/subscriptions/upgrade-downgrade
-		itemParams := &stripe.SubscriptionItemParams{
-			Price:             stripe.String(plan.StripePriceID),
-			ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorNone)),
+		plan, err := getPlan(sub, req.PlanID)
+		if err != nil {
+			return err
 		}
-		_, _ = client.SubscriptionItems.Update(ub.StripeSubscriptionItemID, itemParams)
-
-		// SubscriptionのMetadataを新しいプランのIDに更新する
-		subParams := &stripe.SubscriptionParams{}
-		subParams.AddMetadata("plan_id", plan.ID)
-		_, _ = client.Subscriptions.Update(ub.StripeSubscriptionID, subParams)
 
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
+		}
+		// 変更のないリクエストでSubscription Scheduleを作り直さないよう、Stripeを呼び出す前に拒否する
+		switch plan.ID {
+		case ub.PlanID:
+			return samePlanError("plan is already active")
+		case ub.NextPlanID:
+			return samePlanError("plan change is already scheduled")
+		}
 
-		// アプリ上で変更後のプランに関する情報を表示するため、DB上に変更後のPlanIDを保持しておく
-		ub.NextPlanID = plan.ID
-		return UpdateUserSubscriptionTx(tx, ub)
+		// Subscription Scheduleの設定はOutboxに記録してトランザクションの外で実行する
+		// 変更後のPlanIDはStripeへの反映後にDBに保持する
+		op.UserSubscriptionID = ub.ID
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.PlanID = plan.ID
+		op.StripePriceID = plan.StripePriceID
+		op.StripeSubscriptionID = ub.StripeSubscriptionID
+		op.StripeSubscriptionItemID = ub.StripeSubscriptionItemID
+		op.StripeScheduleID = ub.StripeScheduleID
+		return saveOutboxOperation(tx, op)
 	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("updateUserSubscriptionHandler: %v", err)
+		writeError(w, "updateUserSubscriptionHandler", err)
+		return
+	}
+	if _, err := dispatchOutboxOperation(ctx, op.ID); err != nil {
+		writeError(w, "updateUserSubscriptionHandler", err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
+
+// samePlanError 変更後のプランが現在のプラン、または変更を予約済みのプランと同じ
+func samePlanError(message string) error {
+	return apperror.ValidationFailed([]apperror.FieldError{{Field: "plan_id", Message: message}})
+}
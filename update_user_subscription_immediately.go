@@ -2,83 +2,87 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"log"
 	"net/http"
+	"time"
 
-	"cloud.google.com/go/firestore"
-	"github.com/google/uuid"
-	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/v72"
 )
 
 type UpdateUserSubscriptionImmediatelyRequest struct {
-	CustomerID     string `json:"customer_id"`
-	SubscriptionID string `json:"subscription_id"`
-	PlanID         string `json:"plan_id"`
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+	PlanID         string `json:"plan_id" validate:"required,document_id"`
+	// ProrationDate /preview-plan-change で返した日割り計算の基準日時。指定しない場合は現在日時で計算する
+	ProrationDate int64 `json:"proration_date,omitempty"`
 }
 
 type UpdateUserSubscriptionImmediatelyResponse struct {
 	Status       stripe.PaymentIntentStatus `json:"status"`
 	ClientSecret string                     `json:"client_secret"`
+	NextStep     PaymentNextStep            `json:"next_step"`
 }
 
 func UpdateUserSubscriptionImmediatelyHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 
-	var req *UpdateUserSubscriptionImmediatelyRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("json.NewDecoder.Decode: %v", err)
+	var req UpdateUserSubscriptionImmediatelyRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
 		return
 	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
 
-	idempotencyKey := uuid.New().String()
-	var intent *stripe.PaymentIntent
-	err := fsClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		sub, _ := GetSubscriptionTx(tx, req.SubscriptionID)
+	op := NewOutboxOperation(outboxOperationID(r), OutboxOperationChangePlanImmediately, time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
+		}
 		// 新しいサブスクリプションのプランのデータを取得する
-		plan := sub.Plan(req.PlanID)
-
-		ub, _ := GetUserSubscriptionTx(tx, sub.UserSubscriptionID(req.CustomerID))
-
-		// Subscriptionに設定されているSubscriptionItemを変更する https://stripe.com/docs/billing/subscriptions/upgrade-downgrade
-		itemParams := &stripe.SubscriptionItemParams{
-			Price:             stripe.String(plan.StripePriceID),
-			ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorNone)),
+		plan, err := getPlan(sub, req.PlanID)
+		if err != nil {
+			return err
 		}
-		_, _ = client.SubscriptionItems.Update(ub.StripeSubscriptionItemID, itemParams)
 
-		// Subscriptionの更新処理を実行する
-		subParams := &stripe.SubscriptionParams{
-			BillingCycleAnchorNow: stripe.Bool(true),
-			ProrationBehavior:     stripe.String(string(stripe.SubscriptionProrationBehaviorNone)),
-			CancelAtPeriodEnd:     stripe.Bool(false),
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
 		}
-		subParams.AddMetadata("plan_id", plan.ID)
-		subParams.AddExpand("latest_invoice.payment_intent") // レスポンスとして最新のInvoiceに紐づくPaymentIntentを取得したいためAddExpandに指定しておく
-		subParams.SetIdempotencyKey(idempotencyKey)          // 冪等キー
-		s, err := client.Subscriptions.Update(ub.StripeSubscriptionID, subParams)
-		err = handleStripeError(err) // 冪等チェックエラーだった場合は処理を続行する
+
+		// SubscriptionItemの変更とSubscriptionの更新はOutboxに記録してトランザクションの外で実行する
+		op.UserSubscriptionID = ub.ID
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.PlanID = plan.ID
+		op.StripePriceID = plan.StripePriceID
+		op.StripeSubscriptionID = ub.StripeSubscriptionID
+		op.StripeSubscriptionItemID = ub.StripeSubscriptionItemID
+		op.StripeScheduleID = ub.StripeScheduleID
+		op.ProrationDate, err = resolveProrationDate(req.ProrationDate, plan.ID, ub, time.Now())
 		if err != nil {
 			return err
 		}
-		intent = s.LatestInvoice.PaymentIntent
-		// サブスクリプションプランのデータを更新する
-		ub.RenewalAll(plan.ID, s)
-		return UpdateUserSubscriptionTx(tx, ub)
+		return saveOutboxOperation(tx, op)
 	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("updateUserSubscriptionImmediatelyHandler: %v", err)
+		writeError(w, "updateUserSubscriptionImmediatelyHandler", err)
 		return
 	}
-	res := UpdateUserSubscriptionImmediatelyResponse{
-		Status:       intent.Status,
-		ClientSecret: intent.ClientSecret,
-	}
-	if err = json.NewEncoder(w).Encode(res); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("updateUserSubscriptionImmediatelyHandler: %v", err)
+	s, err := dispatchOutboxOperation(ctx, op.ID)
+	if err != nil {
+		writeError(w, "updateUserSubscriptionImmediatelyHandler", err)
 		return
 	}
+	res := UpdateUserSubscriptionImmediatelyResponse{NextStep: PaymentNextStepNone}
+	if s.LatestInvoice != nil && s.LatestInvoice.PaymentIntent != nil {
+		res.Status = s.LatestInvoice.PaymentIntent.Status
+		res.ClientSecret = s.LatestInvoice.PaymentIntent.ClientSecret
+		res.NextStep = paymentNextStep(s.LatestInvoice.PaymentIntent)
+	}
+	writeJSON(w, "updateUserSubscriptionImmediatelyHandler", res)
 }
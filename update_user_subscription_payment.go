@@ -2,44 +2,56 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"log"
 	"net/http"
-
-	"cloud.google.com/go/firestore"
-	"github.com/stripe/stripe-go"
+	"time"
 )
 
 type UpdateUserSubscriptionPaymentRequest struct {
-	CustomerID     string `json:"customer_id"`
-	SubscriptionID string `json:"subscription_id"`
-	SourceID       string `json:"source_id"`
+	CustomerID     string `json:"customer_id,omitempty" validate:"customer_id"`
+	SubscriptionID string `json:"subscription_id" validate:"required,document_id"`
+	SourceID       string `json:"source_id" validate:"required,source_id"`
 }
 
 func UpdateUserSubscriptionPaymentHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 
-	var req *UpdateUserSubscriptionPaymentRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("json.NewDecoder.Decode: %v", err)
+	var req UpdateUserSubscriptionPaymentRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, "decodeRequest", err)
 		return
 	}
+	customerID, err := callerCustomerID(r, req.CustomerID)
+	if err != nil {
+		writeError(w, "callerCustomerID", err)
+		return
+	}
+	req.CustomerID = customerID
 
-	err := fsClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		sub, _ := GetSubscriptionTx(tx, req.SubscriptionID)
-		ub, _ := GetUserSubscriptionTx(tx, sub.UserSubscriptionID(req.CustomerID))
-
-		// 支払い方法を変更する https://stripe.com/docs/api/subscriptions/update
-		params := &stripe.SubscriptionParams{
-			DefaultSource: stripe.String(req.SourceID),
+	op := NewOutboxOperation(outboxOperationID(r), OutboxOperationUpdatePaymentSource, time.Now())
+	err = repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		sub, err := getSubscription(tx, req.SubscriptionID)
+		if err != nil {
+			return err
 		}
-		_, err := client.Subscriptions.Update(ub.StripeSubscriptionID, params)
-		return err
+		ub, err := getUserSubscription(tx, sub, req.CustomerID)
+		if err != nil {
+			return err
+		}
+
+		// 支払い方法の変更はOutboxに記録してトランザクションの外で実行する
+		op.UserSubscriptionID = ub.ID
+		op.CustomerID = req.CustomerID
+		op.SubscriptionID = sub.ID
+		op.SourceID = req.SourceID
+		op.StripeSubscriptionID = ub.StripeSubscriptionID
+		return saveOutboxOperation(tx, op)
 	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("updateUserSubscriptionHandler: %v", err)
+		writeError(w, "updateUserSubscriptionHandler", err)
+		return
+	}
+	if _, err := dispatchOutboxOperation(ctx, op.ID); err != nil {
+		writeError(w, "updateUserSubscriptionHandler", err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+// maxRequestBodyBytes リクエストボディの上限
+const maxRequestBodyBytes = int64(65536)
+
+var (
+	// customerIDPattern StripeのCustomer ID
+	customerIDPattern = regexp.MustCompile(`^cus_[A-Za-z0-9]+$`)
+	// sourceIDPattern StripeのSource、Card、PaymentMethodのID
+	sourceIDPattern = regexp.MustCompile(`^(src|card|pm)_[A-Za-z0-9]+$`)
+	// documentIDPattern FirestoreのドキュメントIDとして扱うID
+	documentIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+	// promotionCodePattern 顧客が入力するStripeのプロモーションコード
+	promotionCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// validationRules validateタグに指定できるルール。値が空の場合はrequired以外のルールは検証しない
+var validationRules = map[string]func(v string) string{
+	"customer_id": func(v string) string {
+		if !customerIDPattern.MatchString(v) {
+			return "must be a Stripe customer ID (cus_...)"
+		}
+		return ""
+	},
+	"source_id": func(v string) string {
+		if !sourceIDPattern.MatchString(v) {
+			return "must be a Stripe source ID (src_..., card_... or pm_...)"
+		}
+		return ""
+	},
+	"document_id": func(v string) string {
+		if !documentIDPattern.MatchString(v) {
+			return "must be 1-128 characters of letters, digits, '-' or '_'"
+		}
+		return ""
+	},
+	"promotion_code": func(v string) string {
+		if !promotionCodePattern.MatchString(v) {
+			return "must be 1-64 characters of letters, digits, '-' or '_'"
+		}
+		return ""
+	},
+	"cancellation_reason": func(v string) string {
+		if !CancellationReason(v).valid() {
+			return "must be one of " + strings.Join(cancellationReasonValues(), ", ")
+		}
+		return ""
+	},
+	"cancellation_comment": func(v string) string {
+		if utf8.RuneCountInString(v) > maxCancellationCommentLength {
+			return fmt.Sprintf("must be at most %d characters", maxCancellationCommentLength)
+		}
+		return ""
+	},
+	"refund_mode": func(v string) string {
+		switch RefundMode(v) {
+		case RefundNone, RefundProrated, RefundFull:
+			return ""
+		}
+		return "must be one of none, prorated or full"
+	},
+	"pause_behavior": func(v string) string {
+		switch stripe.SubscriptionPauseCollectionBehavior(v) {
+		case stripe.SubscriptionPauseCollectionBehaviorKeepAsDraft,
+			stripe.SubscriptionPauseCollectionBehaviorMarkUncollectible,
+			stripe.SubscriptionPauseCollectionBehaviorVoid:
+			return ""
+		}
+		return "must be one of keep_as_draft, mark_uncollectible or void"
+	},
+}
+
+// decodeRequest リクエストボディをvにデコードし、validateタグに従って検証する
+// 未知のフィールドを含むリクエストやmaxRequestBodyBytesを超えるリクエストはエラーとする
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if err.Error() == "http: request body too large" {
+			return apperror.RequestTooLarge(err)
+		}
+		if name := strings.TrimPrefix(err.Error(), "json: unknown field "); name != err.Error() {
+			return apperror.ValidationFailed([]apperror.FieldError{{Field: strings.Trim(name, `"`), Message: "is not allowed"}})
+		}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return apperror.ValidationFailed([]apperror.FieldError{{Field: typeErr.Field, Message: "must be a " + typeErr.Type.String()}})
+		}
+		return apperror.InvalidRequest("request body is not valid JSON", err)
+	}
+	if err := dec.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return apperror.InvalidRequest("request body must contain a single JSON object", err)
+	}
+	return validateRequest(v)
+}
+
+// validateRequest 構造体のstringフィールドをvalidateタグに従って検証し、失敗した項目をまとめて返す
+func validateRequest(v interface{}) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	rt := rv.Type()
+
+	var fields []apperror.FieldError
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		tag := f.Tag.Get("validate")
+		if tag == "" || f.Type.Kind() != reflect.String {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+		value := rv.Field(i).String()
+		for _, rule := range strings.Split(tag, ",") {
+			var message string
+			switch {
+			case rule == "required":
+				if value == "" {
+					message = "is required"
+				}
+			case value == "":
+			default:
+				check, ok := validationRules[rule]
+				if !ok {
+					panic(fmt.Sprintf("unknown validation rule %q on %s.%s", rule, rt.Name(), f.Name))
+				}
+				message = check(value)
+			}
+			if message != "" {
+				fields = append(fields, apperror.FieldError{Field: name, Message: message})
+				break
+			}
+		}
+	}
+	if len(fields) > 0 {
+		return apperror.ValidationFailed(fields)
+	}
+	return nil
+}
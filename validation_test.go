@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
+)
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		req  interface{}
+		want []apperror.FieldError
+	}{
+		{
+			name: "valid",
+			req:  &CreateUserSubscriptionRequest{CustomerID: "cus_1", SubscriptionID: "sub-ramen", PlanID: "plan-a", PromotionCode: "SPRING_2022"},
+		},
+		{
+			name: "missing required fields",
+			req:  &CreateUserSubscriptionRequest{},
+			want: []apperror.FieldError{
+				{Field: "subscription_id", Message: "is required"},
+				{Field: "plan_id", Message: "is required"},
+			},
+		},
+		{
+			name: "invalid format",
+			req:  &CreateUserSubscriptionRequest{CustomerID: "user_1", SubscriptionID: "sub/ramen", PlanID: "plan-a", PromotionCode: "10% OFF"},
+			want: []apperror.FieldError{
+				{Field: "customer_id", Message: "must be a Stripe customer ID (cus_...)"},
+				{Field: "subscription_id", Message: "must be 1-128 characters of letters, digits, '-' or '_'"},
+				{Field: "promotion_code", Message: "must be 1-64 characters of letters, digits, '-' or '_'"},
+			},
+		},
+		{
+			name: "too long document id",
+			req:  &CreateUserSubscriptionRequest{SubscriptionID: strings.Repeat("a", 129), PlanID: "plan-a"},
+			want: []apperror.FieldError{
+				{Field: "subscription_id", Message: "must be 1-128 characters of letters, digits, '-' or '_'"},
+			},
+		},
+		{
+			name: "unknown enum values",
+			req:  &CancelUserSubscriptionImmediatelyRequest{SubscriptionID: "sub-ramen", Refund: "half", Reason: "bored"},
+			want: []apperror.FieldError{
+				{Field: "refund", Message: "must be one of none, prorated or full"},
+				{Field: "reason", Message: "must be one of " + strings.Join(cancellationReasonValues(), ", ")},
+			},
+		},
+		{
+			name: "too long comment",
+			req:  &CancelUserSubscriptionRequest{SubscriptionID: "sub-ramen", Comment: strings.Repeat("あ", maxCancellationCommentLength+1)},
+			want: []apperror.FieldError{
+				{Field: "comment", Message: "must be at most 500 characters"},
+			},
+		},
+		{
+			name: "multibyte comment within the limit",
+			req:  &CancelUserSubscriptionRequest{SubscriptionID: "sub-ramen", Comment: strings.Repeat("あ", maxCancellationCommentLength)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRequest(tt.req)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("validateRequest() = %v, want nil", err)
+				}
+				return
+			}
+			appErr := apperror.From(err)
+			if appErr.Code != apperror.CodeValidationFailed {
+				t.Fatalf("validateRequest() = %v, want validation_failed", err)
+			}
+			if !reflect.DeepEqual(appErr.Fields, tt.want) {
+				t.Errorf("Fields = %v, want %v", appErr.Fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRequest_UnknownRule(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("validateRequest() with an unknown rule did not panic")
+		}
+	}()
+	_ = validateRequest(&struct {
+		ID string `json:"id" validate:"uuid"`
+	}{ID: "1"})
+}
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		code  apperror.Code
+		field string
+	}{
+		{name: "unknown field", body: `{"subscription_id":"sub-ramen","plan_id":"plan-a","price":0}`, code: apperror.CodeValidationFailed, field: "price"},
+		{name: "wrong type", body: `{"subscription_id":1,"plan_id":"plan-a"}`, code: apperror.CodeValidationFailed, field: "subscription_id"},
+		{name: "invalid field", body: `{"subscription_id":"sub-ramen"}`, code: apperror.CodeValidationFailed, field: "plan_id"},
+		{name: "malformed JSON", body: `{"subscription_id":`, code: apperror.CodeInvalidRequest},
+		{name: "trailing data", body: `{"subscription_id":"sub-ramen","plan_id":"plan-a"}{}`, code: apperror.CodeInvalidRequest},
+		{name: "too large", body: `{"subscription_id":"` + strings.Repeat("a", int(maxRequestBodyBytes)) + `"}`, code: apperror.CodeRequestTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/create-subscription", strings.NewReader(tt.body))
+			var req CreateUserSubscriptionRequest
+			appErr := apperror.From(decodeRequest(httptest.NewRecorder(), r, &req))
+			if appErr.Code != tt.code {
+				t.Fatalf("decodeRequest() = %v, want %s", appErr, tt.code)
+			}
+			if tt.field != "" && (len(appErr.Fields) != 1 || appErr.Fields[0].Field != tt.field) {
+				t.Errorf("Fields = %v, want %s", appErr.Fields, tt.field)
+			}
+		})
+	}
+}
+
+func TestValidationErrorResponse(t *testing.T) {
+	e := newTestEnv(t)
+
+	code, body := e.post("/create-subscription", `{"subscription_id":"sub-ramen","plan_id":""}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("create = %d %s, want 400", code, body)
+	}
+	var res struct {
+		Error struct {
+			Code   apperror.Code         `json:"code"`
+			Fields []apperror.FieldError `json:"fields"`
+		} `json:"error"`
+	}
+	decodeJSON(t, body, &res)
+	want := []apperror.FieldError{{Field: "plan_id", Message: "is required"}}
+	if res.Error.Code != apperror.CodeValidationFailed || !reflect.DeepEqual(res.Error.Fields, want) {
+		t.Errorf("error = %+v, want validation_failed %v", res.Error, want)
+	}
+	if n := len(e.fake.Requests()); n != 0 {
+		t.Errorf("invalid request called Stripe %d times", n)
+	}
+}
@@ -6,10 +6,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"time"
 
-	"cloud.google.com/go/firestore"
-	"github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/webhook"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+
+	"github.com/ogiogi93/stripe-subscription-samples/apperror"
 )
 
 func WebhookHandler(w http.ResponseWriter, r *http.Request) {
@@ -17,7 +19,7 @@ func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
 	p, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
+		writeError(w, "WebhookHandler", apperror.RequestTooLarge(err))
 		return
 	}
 	ev, err := webhook.ConstructEvent(
@@ -26,21 +28,33 @@ func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 		os.Getenv("STRIPE_WEBHOOK_SIGNATURE"),
 	)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, "webhook.ConstructEvent", apperror.InvalidRequest("invalid webhook signature", err))
 		return
 	}
 
 	switch ev.Type {
-	case "invoice.payment_succeeded", "invoice.payment_failed":
+	case "invoice.payment_succeeded", "invoice.payment_failed", "invoice.payment_action_required":
 		var invoice stripe.Invoice
 		err := json.Unmarshal(ev.Data.Raw, &invoice)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, "json.Unmarshal", apperror.InvalidRequest("invalid event payload", err))
+			return
+		}
+		err = renewalUserSubscription(context.Background(), ev, invoice)
+		if err != nil {
+			writeError(w, "renewalUserSubscription", err)
+			return
+		}
+	case "customer.subscription.updated", "customer.subscription.deleted", "customer.subscription.trial_will_end":
+		var stripeSub stripe.Subscription
+		err := json.Unmarshal(ev.Data.Raw, &stripeSub)
+		if err != nil {
+			writeError(w, "json.Unmarshal", apperror.InvalidRequest("invalid event payload", err))
 			return
 		}
-		err = renewalUserSubscription(context.Background(), invoice)
+		err = syncUserSubscription(context.Background(), ev, stripeSub)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, "syncUserSubscription", err)
 			return
 		}
 	}
@@ -48,29 +62,159 @@ func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func renewalUserSubscription(ctx context.Context, inv stripe.Invoice) error {
+func renewalUserSubscription(ctx context.Context, ev stripe.Event, inv stripe.Invoice) error {
+	if inv.Lines == nil || len(inv.Lines.Data) == 0 {
+		return apperror.InvalidRequest("invoice has no line items", nil)
+	}
 	line := inv.Lines.Data[0]
 
 	subscriptionID := line.Metadata["subscription_id"]
 	planID := line.Metadata["plan_id"]
+	if subscriptionID == "" {
+		// 本サービス以外で作成されたSubscriptionや、Subscriptionに紐づかない請求
+		return nil
+	}
 
-	err := fsClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		sub, _ := GetSubscriptionTx(tx, subscriptionID)
-		ub, _ := GetUserSubscriptionTx(tx, sub.UserSubscriptionID(inv.Customer.ID))
+	err := repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		processed, err := isEventProcessed(tx, ev)
+		if err != nil || processed {
+			return err
+		}
+
+		sub, err := getSubscription(tx, subscriptionID)
+		if err != nil {
+			return err
+		}
+		ub, err := getUserSubscription(tx, sub, inv.Customer.ID)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.CreateProcessedEvent(NewProcessedEvent(ev, time.Now(), processedEventRetention)); err != nil {
+			return err
+		}
+		// 既に新しいイベントを反映済みの場合、古い請求の結果で上書きしないようスキップする
+		version := invoiceVersion(inv)
+		if ub.IsStaleEvent(ev.Created, version) {
+			return nil
+		}
 
 		// Stripe上のSubscriptionを取得する(自動更新後の状態)
-		stripeSub, _ := client.Subscriptions.Get(ub.StripeSubscriptionID, nil)
+		params := &stripe.SubscriptionParams{}
+		params.AddExpand("latest_invoice.payment_intent")
+		stripeSub, err := billing.GetSubscription(ub.StripeSubscriptionID, params)
+		if err != nil {
+			return handleStripeError(err)
+		}
 
 		// 次回更新時にプラン変更するパターン
 		if ub.NextPlanID != "" {
 			ub.PlanID = planID
 			ub.NextPlanID = ""
 		}
-		ub.RenewalAll(planID, stripeSub)
-		return UpdateUserSubscriptionTx(tx, ub)
+		periodStart := ub.CurrentPeriodStart
+		ub.RenewalAll(planID, stripeSub, time.Unix(ev.Created, 0))
+		if ev.Type == "invoice.payment_action_required" && ub.LatestPaymentIntentStatus == stripe.PaymentIntentStatusRequiresAction {
+			// 更新時の支払いで3Dセキュア認証が必要になった。顧客がオフセッションのため、/payment-action で取得したclient_secretで認証を促す
+			ub.PaymentActionRequiredAt = time.Unix(ev.Created, 0)
+		}
+		if !ub.CurrentPeriodStart.Equal(periodStart) {
+			// 請求期間が更新された場合、請求期間毎の特典の利用回数をリセットする
+			ub.ResetBillingPeriodUsage()
+		}
+		ub.MarkEventApplied(ev.Created, version)
+		return tx.UpdateUserSubscription(ub)
 	})
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// syncUserSubscription Stripe上のSubscriptionの状態(期間終了時のキャンセル、ダッシュボードからの変更、ステータスの遷移)をUserSubscriptionに反映する
+func syncUserSubscription(ctx context.Context, ev stripe.Event, stripeSub stripe.Subscription) error {
+	subscriptionID := stripeSub.Metadata["subscription_id"]
+	if subscriptionID == "" {
+		// 本サービス以外で作成されたSubscription
+		return nil
+	}
+
+	return repo.RunInTx(ctx, func(ctx context.Context, tx SubscriptionTx) error {
+		processed, err := isEventProcessed(tx, ev)
+		if err != nil || processed {
+			return err
+		}
+
+		sub, err := getSubscription(tx, subscriptionID)
+		if err != nil {
+			return err
+		}
+		ub, err := getUserSubscription(tx, sub, stripeSub.Customer.ID)
+		if err != nil {
+			return err
+		}
+		if err := tx.CreateProcessedEvent(NewProcessedEvent(ev, time.Now(), processedEventRetention)); err != nil {
+			return err
+		}
+		// 再登録等で既に別のStripe Subscriptionに切り替わっている場合は反映しない
+		if ub.StripeSubscriptionID != stripeSub.ID {
+			return nil
+		}
+
+		stale := ub.IsStaleEvent(ev.Created, stripeSub.CurrentPeriodEnd)
+		if stale || scheduleID(&stripeSub) != ub.StripeScheduleID {
+			// 古いイベントや、Subscription Scheduleの設定・解放の前後で順序が入れ替わったイベントの内容ではなく、
+			// Stripe上の最新の状態を取得して反映する
+			latest, err := billing.GetSubscription(stripeSub.ID, nil)
+			if err != nil {
+				return handleStripeError(err)
+			}
+			stripeSub = *latest
+		}
+		if !stale {
+			ub.MarkEventApplied(ev.Created, stripeSub.CurrentPeriodEnd)
+		}
+
+		ub.SyncStatus(&stripeSub, time.Unix(ev.Created, 0))
+		if ev.Type == "customer.subscription.trial_will_end" {
+			// トライアル終了の3日前に通知される。終了後の最初の請求に備え、支払い方法の登録を促す通知に利用する
+			ub.TrialWillEndNotifiedAt = time.Unix(ev.Created, 0)
+		}
+		if len(stripeSub.Items.Data) > 0 && stripeSub.Items.Data[0].Price != nil {
+			plan := sub.PlanByStripePriceID(stripeSub.Items.Data[0].Price.ID)
+			// 次回更新時のプラン変更を予約している場合、更新までは現在のプランを維持する
+			if plan != nil && plan.ID != ub.PlanID && plan.ID != ub.NextPlanID {
+				ub.Renewal(plan.ID)
+			}
+			// ダッシュボード等でScheduleが解放・キャンセルされた場合、予約していたプラン変更は行われない
+			if plan != nil && plan.ID == ub.PlanID && ub.NextPlanID != "" && ub.StripeScheduleID == "" {
+				ub.NextPlanID = ""
+			}
+		}
+		return tx.UpdateUserSubscription(ub)
+	})
+}
+
+// invoiceVersion Invoiceが対象とする請求期間の終了日時。同時刻のイベントの前後関係の判定に利用する
+func invoiceVersion(inv stripe.Invoice) int64 {
+	var version int64
+	for _, line := range inv.Lines.Data {
+		if line.Period != nil && line.Period.End > version {
+			version = line.Period.End
+		}
+	}
+	return version
+}
+
+// isEventProcessed イベントが既に処理済みかどうかを返す
+// Firestoreのトランザクションでは書き込みの前に読み込みを行う必要があるため、トランザクションの最初に呼び出す
+func isEventProcessed(tx SubscriptionTx, ev stripe.Event) (bool, error) {
+	_, err := tx.GetProcessedEvent(ev.ID)
+	if err == nil {
+		return true, nil
+	}
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return false, err
+}
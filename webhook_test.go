@@ -0,0 +1,291 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/ogiogi93/stripe-subscription-samples/stripefake"
+)
+
+// lastEvent フェイクで最後に発生したeventTypeのイベント
+func (e *testEnv) lastEvent(eventType string) *stripe.Event {
+	e.t.Helper()
+	evs := e.fake.Events()
+	for i := len(evs) - 1; i >= 0; i-- {
+		if evs[i].Type == eventType {
+			return evs[i]
+		}
+	}
+	e.t.Fatalf("no %s event", eventType)
+	return nil
+}
+
+// countRequests フェイクが受け付けた、パスがprefixで始まるリクエストの数
+func (e *testEnv) countRequests(method, prefix string) int {
+	n := 0
+	for _, r := range e.fake.Requests() {
+		if r.Method == method && strings.HasPrefix(r.Path, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestWebhook_InvalidSignature(t *testing.T) {
+	e := newTestEnv(t)
+	ev, err := stripefake.NewEvent("customer.subscription.updated", &stripe.Subscription{ID: "sub_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, err := stripefake.SignedPayload(ev, "whsec_other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body := e.post("/webhook", string(payload), "Stripe-Signature", sig)
+	if code != http.StatusBadRequest || errorCode(t, body) != "invalid_request" {
+		t.Errorf("webhook = %d %s, want 400 invalid_request", code, body)
+	}
+}
+
+func TestWebhook_DuplicateEvent(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-a")
+	if _, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	ev := e.lastEvent("invoice.payment_succeeded")
+
+	if code, body := e.deliver(ev); code != http.StatusOK {
+		t.Fatalf("webhook = %d %s", code, body)
+	}
+	gets := e.countRequests(http.MethodGet, "/v1/subscriptions/")
+	renewed := e.userSubscription()
+	if !renewed.CurrentPeriodStart.After(ub.CurrentPeriodStart) {
+		t.Fatalf("CurrentPeriodStart = %v, want after %v", renewed.CurrentPeriodStart, ub.CurrentPeriodStart)
+	}
+
+	// Stripeは同じイベントを複数回送信することがある。処理済みのイベントは何もせずに200を返す
+	if code, body := e.deliver(ev); code != http.StatusOK {
+		t.Fatalf("redelivered webhook = %d %s", code, body)
+	}
+	if n := e.countRequests(http.MethodGet, "/v1/subscriptions/"); n != gets {
+		t.Errorf("redelivered event called Stripe %d times", n-gets)
+	}
+
+	mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+		pe, err := tx.GetProcessedEvent(ev.ID)
+		if err != nil {
+			return err
+		}
+		if pe.Type != ev.Type {
+			t.Errorf("ProcessedEvent.Type = %s, want %s", pe.Type, ev.Type)
+		}
+		if got := pe.ExpireAt.Sub(pe.ProcessedAt); got != processedEventRetention {
+			t.Errorf("retention = %v, want %v", got, processedEventRetention)
+		}
+		return nil
+	})
+}
+
+func TestWebhook_FailedEventIsNotRecorded(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-a")
+	if _, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	ev := e.lastEvent("invoice.payment_succeeded")
+
+	// Stripeの障害で処理に失敗したイベントは、再送時に処理できるよう処理済みとして記録しない
+	prev := billing
+	billing = unavailableGateway{prev}
+	code, _ := e.deliver(ev)
+	billing = prev
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("webhook = %d, want 503", code)
+	}
+	mustRunInTx(t, repo, func(tx SubscriptionTx) error {
+		if _, err := tx.GetProcessedEvent(ev.ID); err != ErrNotFound {
+			t.Errorf("GetProcessedEvent() = %v, want ErrNotFound", err)
+		}
+		return nil
+	})
+
+	if code, body := e.deliver(ev); code != http.StatusOK {
+		t.Fatalf("redelivered webhook = %d %s", code, body)
+	}
+	if got := e.userSubscription(); !got.CurrentPeriodStart.After(ub.CurrentPeriodStart) {
+		t.Errorf("CurrentPeriodStart = %v, want after %v", got.CurrentPeriodStart, ub.CurrentPeriodStart)
+	}
+}
+
+// unavailableGateway Subscriptionの取得でStripeの一時的な障害を返す BillingGateway
+type unavailableGateway struct {
+	BillingGateway
+}
+
+func (unavailableGateway) GetSubscription(string, *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return nil, &stripe.Error{HTTPStatusCode: http.StatusServiceUnavailable, Type: stripe.ErrorTypeAPI, Msg: "unavailable"}
+}
+
+func TestWebhook_OutOfOrderSubscriptionUpdated(t *testing.T) {
+	e := newTestEnv(t)
+	start := time.Now()
+	e.fake.SetNow(func() time.Time { return start })
+	e.subscribe("plan-a")
+
+	e.fake.SetNow(func() time.Time { return start.Add(time.Minute) })
+	e.mustPost("/cancel-subscription", `{"subscription_id":"sub-ramen","decline_retention_offer":true}`, nil)
+	canceled := e.lastEvent("customer.subscription.updated")
+	e.fake.SetNow(func() time.Time { return start.Add(2 * time.Minute) })
+	e.mustPost("/resume-subscription", `{"subscription_id":"sub-ramen"}`, nil)
+	resumed := e.lastEvent("customer.subscription.updated")
+
+	// 解約の予約を取り消した後のイベントが先に届いた場合、古いイベントの内容で上書きしない
+	for _, ev := range []*stripe.Event{resumed, canceled} {
+		if code, body := e.deliver(ev); code != http.StatusOK {
+			t.Fatalf("webhook %s = %d %s", ev.ID, code, body)
+		}
+	}
+	ub := e.userSubscription()
+	if ub.CancelAtPeriodEnd {
+		t.Error("CancelAtPeriodEnd = true, want false")
+	}
+	if got := ub.LastEventCreatedAt.Unix(); got != resumed.Created {
+		t.Errorf("LastEventCreatedAt = %d, want %d", got, resumed.Created)
+	}
+}
+
+func TestWebhook_OutOfOrderRenewal(t *testing.T) {
+	e := newTestEnv(t)
+	start := time.Now()
+	e.fake.SetNow(func() time.Time { return start })
+	ub := e.subscribe("plan-a")
+
+	e.fake.SetNow(func() time.Time { return start.AddDate(0, 0, 30) })
+	if _, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	second := e.lastEvent("invoice.payment_succeeded")
+	e.fake.SetNow(func() time.Time { return start.AddDate(0, 0, 60) })
+	third, err := e.fake.AdvancePeriod(ub.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thirdEvent := e.lastEvent("invoice.payment_succeeded")
+
+	if code, body := e.deliver(thirdEvent); code != http.StatusOK {
+		t.Fatalf("webhook = %d %s", code, body)
+	}
+	gets := e.countRequests(http.MethodGet, "/v1/subscriptions/")
+	if code, body := e.deliver(second); code != http.StatusOK {
+		t.Fatalf("webhook = %d %s", code, body)
+	}
+	if n := e.countRequests(http.MethodGet, "/v1/subscriptions/"); n != gets {
+		t.Errorf("stale renewal called Stripe %d times", n-gets)
+	}
+	if got := e.userSubscription().CurrentPeriodStart.Unix(); got != third.PeriodStart {
+		t.Errorf("CurrentPeriodStart = %d, want %d", got, third.PeriodStart)
+	}
+}
+
+func TestWebhook_ForeignInvoice(t *testing.T) {
+	e := newTestEnv(t)
+	// 本サービス以外で作成されたSubscriptionの請求はmetadataを持たないため、エラーにせず無視する
+	ev, err := stripefake.NewEvent("invoice.payment_succeeded", &stripe.Invoice{
+		ID:    "in_foreign",
+		Lines: &stripe.InvoiceLineList{Data: []*stripe.InvoiceLine{{ID: "il_foreign"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := e.deliver(ev); code != http.StatusOK {
+		t.Errorf("webhook = %d %s, want 200", code, body)
+	}
+}
+
+func TestWebhook_SubscriptionDeleted(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-a")
+
+	// ダッシュボードから即時キャンセルされた場合
+	if _, err := e.fake.Client().Subscriptions.Cancel(ub.StripeSubscriptionID, nil); err != nil {
+		t.Fatal(err)
+	}
+	e.deliverEvents()
+	if got := e.userSubscription().Status; got != stripe.SubscriptionStatusCanceled {
+		t.Errorf("Status = %s, want canceled", got)
+	}
+}
+
+func TestWebhook_PlanChangedOnDashboard(t *testing.T) {
+	e := newTestEnv(t)
+	ub := e.subscribe("plan-a")
+
+	_, err := e.fake.Client().SubscriptionItems.Update(ub.StripeSubscriptionItemID, &stripe.SubscriptionItemParams{
+		Price: stripe.String(e.sub.Plan("plan-b").StripePriceID),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.deliverEvents()
+	got := e.userSubscription()
+	if got.PlanID != "plan-b" || got.NextPlanID != "" {
+		t.Errorf("PlanID = %s, NextPlanID = %q, want plan-b without a scheduled change", got.PlanID, got.NextPlanID)
+	}
+}
+
+func TestWebhook_ReplacedSubscription(t *testing.T) {
+	e := newTestEnv(t)
+	old := e.subscribe("plan-a")
+	e.mustPost("/cancel-subscription-immediately", `{"subscription_id":"sub-ramen","refund":"none"}`, nil)
+	e.deliverEvents()
+	e.mustPost("/recreate-subscription", `{"subscription_id":"sub-ramen","plan_id":"plan-b"}`, nil)
+	e.deliverEvents()
+
+	// 再登録前のStripe Subscriptionのイベントが遅れて届いた場合、再登録後の契約を上書きしない
+	oldSub, _ := e.fake.Subscription(old.StripeSubscriptionID)
+	ev, err := stripefake.NewEvent("customer.subscription.deleted", oldSub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := e.deliver(ev); code != http.StatusOK {
+		t.Fatalf("webhook = %d %s", code, body)
+	}
+	got := e.userSubscription()
+	if got.StripeSubscriptionID == old.StripeSubscriptionID || got.Status != stripe.SubscriptionStatusActive || got.PlanID != "plan-b" {
+		t.Errorf("UserSubscription = %s %s %s, want the recreated active plan-b subscription", got.StripeSubscriptionID, got.Status, got.PlanID)
+	}
+}
+
+func TestUserSubscription_IsStaleEvent(t *testing.T) {
+	last := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		created int64
+		version int64
+		want    bool
+	}{
+		{name: "newer event", created: last.Unix() + 1, version: 100, want: false},
+		{name: "older event", created: last.Unix() - 1, version: 300, want: true},
+		// 同じ秒に作成されたイベントはオブジェクトのバージョンで前後を判定する
+		{name: "same second newer version", created: last.Unix(), version: 300, want: false},
+		{name: "same second same version", created: last.Unix(), version: 200, want: false},
+		{name: "same second older version", created: last.Unix(), version: 100, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ub := &UserSubscription{}
+			if ub.IsStaleEvent(tt.created, tt.version) {
+				t.Error("first event is stale")
+			}
+			ub.MarkEventApplied(last.Unix(), 200)
+			if got := ub.IsStaleEvent(tt.created, tt.version); got != tt.want {
+				t.Errorf("IsStaleEvent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}